@@ -0,0 +1,239 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"net/http"
+)
+
+const (
+	// defaultMaxPixelRatio is the default limit of the decoded pixels per encoded byte.
+	defaultMaxPixelRatio = 1024
+	// minRatioPixels is the image size below which the pixel ratio isn't checked,
+	// the small images being cheap to decode whatever their compression.
+	minRatioPixels = 1 << 20
+	// defaultMaxFrames is the default limit of the frames of the animated images.
+	defaultMaxFrames = 500
+)
+
+// inputRejection is the rejection of a suspicious input, identified by a stable code.
+type inputRejection struct {
+	code string
+	kind ErrorKind
+	msg  string
+}
+
+func (e *inputRejection) Error() string {
+	return e.msg
+}
+
+// inspectInput rejects the inputs which would be expensive to decode before decoding them:
+// the content not matching the codec of its magic bytes, the images declaring too many pixels
+// for their encoded size (decompression bombs) and the animations with too many frames.
+// The limits are configured through the max_pixel_ratio and max_frames environment variables.
+func inspectInput(data []byte) error {
+	format := inputFormat(data)
+	if format == "" {
+		return &inputRejection{
+			code: "unsupported_format",
+			kind: ErrUnsupportedFormat,
+			msg:  fmt.Sprintf("unsupported image format: %s", http.DetectContentType(data)),
+		}
+	}
+	cfg, err := inputConfig(data, format)
+	if err != nil {
+		return &inputRejection{
+			code: "format_mismatch",
+			kind: ErrUnsupportedFormat,
+			msg:  fmt.Sprintf("the content does not match the %s signature: %v", format, err),
+		}
+	}
+	if err := checkConfig(cfg); err != nil {
+		return err
+	}
+
+	pixels := cfg.Width * cfg.Height
+	if limit := envInt("max_pixel_ratio", defaultMaxPixelRatio); pixels > minRatioPixels && pixels/len(data) > limit {
+		return &inputRejection{
+			code: "pixel_ratio_exceeded",
+			kind: ErrTooLarge,
+			msg:  fmt.Sprintf("the image declares %dx%d pixels for %d bytes, exceeding the ratio of %d pixels per byte", cfg.Width, cfg.Height, len(data), limit),
+		}
+	}
+
+	if isAnimatedWebP(data) {
+		frames, err := countWebPFrames(data)
+		if err != nil {
+			return &inputRejection{code: "format_mismatch", kind: ErrUnsupportedFormat, msg: err.Error()}
+		}
+		if limit := envInt("max_frames", defaultMaxFrames); frames > limit {
+			return &inputRejection{
+				code: "too_many_frames",
+				kind: ErrTooLarge,
+				msg:  fmt.Sprintf("the animation has %d frames, exceeding the limit of %d", frames, limit),
+			}
+		}
+	}
+	return nil
+}
+
+// inputConfig reads the dimensions of the image from its header, so every accepted format has its
+// size validated before decoding. The formats decoded by the image package must be decodable by the
+// codec matching their magic bytes, while the WebP, BMP and TIFF headers are parsed directly. The
+// other registered formats are read by their ConfigDecoder, or by the image package otherwise.
+func inputConfig(data []byte, format string) (image.Config, error) {
+	switch format {
+	case "jpeg", "png", "gif", "netpbm":
+		cfg, name, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return cfg, err
+		}
+		if name != format && !(format == "netpbm" && (name == "pbm" || name == "pgm" || name == "ppm")) {
+			return cfg, fmt.Errorf("decoded as %s", name)
+		}
+		return cfg, nil
+	case "webp":
+		return webpConfig(data)
+	case "bmp":
+		return bmpConfig(data)
+	case "tiff":
+		return tiffConfig(data)
+	}
+	if cd, ok := lookupDecoder(format).(ConfigDecoder); ok {
+		return cd.DecodeConfig(data)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	return cfg, err
+}
+
+// webpConfig reads the canvas size of the WebP image, from the lossy, the lossless
+// or the extended format header.
+func webpConfig(data []byte) (image.Config, error) {
+	if len(data) < 30 {
+		return image.Config{}, fmt.Errorf("truncated header")
+	}
+	switch string(data[12:16]) {
+	case "VP8 ":
+		if !bytes.Equal(data[23:26], []byte{0x9d, 0x01, 0x2a}) {
+			return image.Config{}, fmt.Errorf("invalid VP8 start code")
+		}
+		w := int(binary.LittleEndian.Uint16(data[26:28]) & 0x3fff)
+		h := int(binary.LittleEndian.Uint16(data[28:30]) & 0x3fff)
+		return image.Config{Width: w, Height: h}, nil
+	case "VP8L":
+		if data[20] != 0x2f {
+			return image.Config{}, fmt.Errorf("invalid VP8L signature")
+		}
+		bits := binary.LittleEndian.Uint32(data[21:25])
+		return image.Config{Width: int(bits&0x3fff) + 1, Height: int(bits>>14&0x3fff) + 1}, nil
+	case "VP8X":
+		return image.Config{Width: uint24(data[24:]) + 1, Height: uint24(data[27:]) + 1}, nil
+	}
+	return image.Config{}, fmt.Errorf("unknown WebP chunk %q", data[12:16])
+}
+
+// bmpConfig reads the size of the BMP image from its DIB header.
+func bmpConfig(data []byte) (image.Config, error) {
+	if len(data) < 26 {
+		return image.Config{}, fmt.Errorf("truncated header")
+	}
+	switch header := binary.LittleEndian.Uint32(data[14:18]); header {
+	case 12:
+		return image.Config{
+			Width:  int(binary.LittleEndian.Uint16(data[18:20])),
+			Height: int(binary.LittleEndian.Uint16(data[20:22])),
+		}, nil
+	case 40, 52, 56, 108, 124:
+		w := int(int32(binary.LittleEndian.Uint32(data[18:22])))
+		h := int(int32(binary.LittleEndian.Uint32(data[22:26])))
+		// The negative height denotes the top-down images.
+		if h < 0 {
+			h = -h
+		}
+		return image.Config{Width: w, Height: h}, nil
+	default:
+		return image.Config{}, fmt.Errorf("unknown DIB header size %d", header)
+	}
+}
+
+// tiffConfig reads the size of the TIFF image from its first image file directory.
+func tiffConfig(data []byte) (image.Config, error) {
+	if len(data) < 8 {
+		return image.Config{}, fmt.Errorf("truncated header")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+	ifd := int64(order.Uint32(data[4:]))
+	if ifd+2 > int64(len(data)) {
+		return image.Config{}, fmt.Errorf("truncated image file directory")
+	}
+	entries := int64(order.Uint16(data[ifd:]))
+	if ifd+2+entries*12 > int64(len(data)) {
+		return image.Config{}, fmt.Errorf("truncated image file directory")
+	}
+
+	var cfg image.Config
+	for i := int64(0); i < entries; i++ {
+		e := data[ifd+2+i*12:]
+		var val int
+		switch typ := order.Uint16(e[2:]); typ {
+		case 3: // SHORT
+			val = int(order.Uint16(e[8:]))
+		case 4: // LONG
+			val = int(order.Uint32(e[8:]))
+		default:
+			continue
+		}
+		switch order.Uint16(e) {
+		case 256: // ImageWidth
+			cfg.Width = val
+		case 257: // ImageLength
+			cfg.Height = val
+		}
+	}
+	if cfg.Width == 0 || cfg.Height == 0 {
+		return image.Config{}, fmt.Errorf("missing image dimensions")
+	}
+	return cfg, nil
+}
+
+// countWebPFrames counts the frames of the animated WebP image without decoding them.
+func countWebPFrames(data []byte) (int, error) {
+	chunks, err := readChunks(data[12:])
+	if err != nil {
+		return 0, err
+	}
+	frames := 0
+	for _, c := range chunks {
+		if c.id == "ANMF" {
+			frames++
+		}
+	}
+	return frames, nil
+}
@@ -0,0 +1,132 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// inFlight is the number of the requests being processed.
+var inFlight int64
+
+// maxInFlight returns the maximum number of the concurrent requests, set through the max_inflight
+// environment variable. Zero means unlimited.
+func maxInFlight() int64 {
+	n, err := strconv.ParseInt(os.Getenv("max_inflight"), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// currentLoad returns the ratio of the requests in flight to the admitted maximum,
+// or zero when the concurrency is unlimited.
+func currentLoad() float64 {
+	max := maxInFlight()
+	if max == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&inFlight)) / float64(max)
+}
+
+// admitRequests is the admission controller, rejecting the requests above the max_inflight
+// concurrent ones and tracking the load reported to the handler. Since the classic watchdog
+// forks a process per request, it's only effective in HTTP mode.
+func admitRequests(next handlerFunc) handlerFunc {
+	return func(ctx *RequestContext) *response {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+
+		if max := maxInFlight(); max > 0 && n > max {
+			res := errorResponse(http.StatusServiceUnavailable, "too many concurrent requests")
+			res.header.Set("Retry-After", "1")
+			return res
+		}
+		return next(ctx)
+	}
+}
+
+// admitExtra takes an extra in-flight slot for the additional work started by a request, like
+// the draft render of the race, reporting whether it's within the limit. The slot is released
+// by releaseExtra once the work is done.
+func admitExtra() bool {
+	n := atomic.AddInt64(&inFlight, 1)
+	if max := maxInFlight(); max > 0 && n > max {
+		atomic.AddInt64(&inFlight, -1)
+		return false
+	}
+	return true
+}
+
+// releaseExtra releases the extra in-flight slot taken by admitExtra.
+func releaseExtra() {
+	atomic.AddInt64(&inFlight, -1)
+}
+
+// envFloat returns the float value of the environment variable, or the default value.
+func envFloat(name string, def float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil {
+		return v
+	}
+	return def
+}
+
+// envInt returns the positive integer value of the environment variable, or the default value.
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// adaptIterations reduces the edge tangent flow and the fDoG iterations when the load exceeds
+// the adaptive_load ratio, keeping the latency under traffic spikes. The iterations decrease
+// linearly with the load, down to the adaptive_min_ei and adaptive_min_di bounds at full load.
+// It returns the description of the reduction, or an empty string if the iterations are kept.
+func adaptIterations(opts *options, load float64) string {
+	threshold := envFloat("adaptive_load", 0)
+	if threshold <= 0 || threshold >= 1 || load < threshold {
+		return ""
+	}
+	ratio := 1 - math.Min(1, (load-threshold)/(1-threshold))
+	reduce := func(n int, min float64) int {
+		if float64(n) <= min {
+			return n
+		}
+		return int(math.Max(min, math.Floor(min+(float64(n)-min)*ratio)))
+	}
+
+	ei := reduce(opts.etfIteration, envFloat("adaptive_min_ei", 1))
+	di := reduce(opts.fDogIteration, envFloat("adaptive_min_di", 0))
+	if ei == opts.etfIteration && di == opts.fDogIteration {
+		return ""
+	}
+	reduced := fmt.Sprintf("ei=%d->%d; di=%d->%d", opts.etfIteration, ei, opts.fDogIteration, di)
+	opts.etfIteration, opts.fDogIteration = ei, di
+	return reduced
+}
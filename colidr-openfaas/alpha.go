@@ -0,0 +1,124 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+
+	"gocv.io/x/gocv"
+)
+
+// sourceAlpha returns the alpha channel of the source image when the alpha mask is requested.
+// The decoders and the color management drop the transparency, so it's read up front from
+// the formats decoded in memory. It's nil if the image is opaque or carries no alpha channel.
+func (rp *requestParams) sourceAlpha(data []byte) *image.Alpha {
+	if !rp.opts.alphaMask {
+		return nil
+	}
+	switch inputFormat(data) {
+	case "png", "gif":
+	default:
+		return nil
+	}
+	img, _, err := decodeImage(data)
+	if err != nil {
+		return nil
+	}
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return nil
+	}
+	b := img.Bounds()
+	mask := image.NewAlpha(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			_, _, _, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			mask.Pix[y*mask.Stride+x] = uint8(a >> 8)
+		}
+	}
+	return mask
+}
+
+// attachAlpha attaches the alpha mask of the source image, applying the same transforms
+// and symmetry as on the source, so the mask covers the generated lines.
+func (c *Cld) attachAlpha(mask *image.Alpha) error {
+	b := mask.Bounds()
+	alpha, err := newMatFromBytes(b.Dy(), b.Dx(), gocv.MatTypeCV8UC1, mask.Pix)
+	if err != nil {
+		return err
+	}
+	if len(c.transforms) > 0 {
+		transformed, err := applyTransforms(alpha, c.transforms)
+		closeMat(&alpha)
+		if err != nil {
+			return err
+		}
+		alpha = transformed
+	}
+	if c.sym != nil && *c.sym != noSymmetry {
+		mirrored, err := c.sym.mirrorMat(alpha, false)
+		closeMat(&alpha)
+		if err != nil {
+			return err
+		}
+		alpha = mirrored
+	}
+	if alpha.Rows() != c.image.Rows() || alpha.Cols() != c.image.Cols() {
+		rows, cols := alpha.Rows(), alpha.Cols()
+		closeMat(&alpha)
+		return fmt.Errorf("alpha mask size %dx%d doesn't match the image size %dx%d",
+			cols, rows, c.image.Cols(), c.image.Rows())
+	}
+	closeMat(&c.alpha)
+	c.alpha = alpha
+	return nil
+}
+
+// maskAlpha fades out the lines of the transparent regions, proportionally to the transparency.
+func (c *Cld) maskAlpha() {
+	if c.alpha.Empty() || c.alpha.Rows() != c.result.Rows() || c.alpha.Cols() != c.result.Cols() {
+		return
+	}
+	data, alpha := c.result.ToBytes(), c.alpha.ToBytes()
+	for i, v := range data {
+		data[i] = 255 - uint8(int(255-v)*int(alpha[i])/255)
+	}
+	if res, err := newMatFromBytes(c.result.Rows(), c.result.Cols(), gocv.MatTypeCV8UC1, data); err == nil {
+		closeMat(&c.result)
+		c.result = res
+	}
+}
+
+// withAlpha returns the rendered image with the alpha mask of the source, so the transparent
+// regions stay transparent in the output.
+func (c *Cld) withAlpha(img image.Image) image.Image {
+	b := img.Bounds()
+	if c.alpha.Empty() || c.alpha.Rows() != b.Dy() || c.alpha.Cols() != b.Dx() {
+		return img
+	}
+	mask := &image.Alpha{Pix: c.alpha.ToBytes(), Stride: b.Dx(), Rect: image.Rect(0, 0, b.Dx(), b.Dy())}
+	dst := image.NewNRGBA(b)
+	draw.DrawMask(dst, b, img, b.Min, mask, image.ZP, draw.Src)
+	return dst
+}
@@ -0,0 +1,151 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"math"
+)
+
+// toneStats holds the luminance statistics of an image.
+type toneStats struct {
+	Histogram [256]int `json:"histogram"`
+	Mean      float64  `json:"mean"`
+	StdDev    float64  `json:"std_dev"`
+	Min       int      `json:"min"`
+	Max       int      `json:"max"`
+	P1        int      `json:"p1"`
+	P99       int      `json:"p99"`
+	// RMSContrast is the standard deviation of the normalized luminance.
+	RMSContrast float64 `json:"rms_contrast"`
+	// Michelson is the contrast computed between the 1st and 99th percentiles.
+	Michelson float64 `json:"michelson_contrast"`
+	// Entropy is the Shannon entropy of the histogram, in bits.
+	Entropy float64 `json:"entropy"`
+}
+
+// analyzeResponse is returned by the analyze mode.
+type analyzeResponse struct {
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Format    string    `json:"format"`
+	Stats     toneStats `json:"stats"`
+	Suggested struct {
+		Tau float32 `json:"tau"`
+		Rho float64 `json:"rho"`
+	} `json:"suggested"`
+}
+
+// analyze decodes the source image and returns its luminance histogram,
+// the contrast metrics and the suggested threshold parameters.
+func analyze(data []byte) ([]byte, error) {
+	img, format, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	res := analyzeResponse{
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+		Format: format,
+		Stats:  computeToneStats(img),
+	}
+	res.Suggested.Tau, res.Suggested.Rho = res.Stats.suggest()
+
+	return json.Marshal(res)
+}
+
+// computeToneStats computes the luminance statistics of the image.
+func computeToneStats(img image.Image) toneStats {
+	var s toneStats
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			s.Histogram[color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y]++
+		}
+	}
+
+	total := b.Dx() * b.Dy()
+	if total == 0 {
+		return s
+	}
+
+	var sum, sqSum float64
+	for v, n := range s.Histogram {
+		sum += float64(v * n)
+		sqSum += float64(v*v) * float64(n)
+		if n > 0 {
+			p := float64(n) / float64(total)
+			s.Entropy -= p * math.Log2(p)
+		}
+	}
+	s.Mean = sum / float64(total)
+	s.StdDev = math.Sqrt(math.Max(0, sqSum/float64(total)-s.Mean*s.Mean))
+	s.RMSContrast = s.StdDev / 255
+
+	s.Min, s.Max = s.percentile(0, total), s.percentile(1, total)
+	s.P1, s.P99 = s.percentile(0.01, total), s.percentile(0.99, total)
+	if s.P1+s.P99 > 0 {
+		s.Michelson = float64(s.P99-s.P1) / float64(s.P99+s.P1)
+	}
+	return s
+}
+
+// percentile returns the luminance value below which the provided fraction of the pixels falls.
+func (s *toneStats) percentile(q float64, total int) int {
+	if q <= 0 {
+		for v, n := range s.Histogram {
+			if n > 0 {
+				return v
+			}
+		}
+		return 0
+	}
+	target := int(math.Ceil(q * float64(total)))
+	var acc int
+	for v, n := range s.Histogram {
+		acc += n
+		if acc >= target {
+			return v
+		}
+	}
+	return 255
+}
+
+// suggest returns the tau and rho values suited for the tonal range of the image.
+// The low contrast images produce weaker DoG responses, which are compensated by a higher tau,
+// while for the low entropy (flat) images the noise sensitivity is reduced through rho.
+func (s *toneStats) suggest() (float32, float64) {
+	// The RMS contrast of the typical photographs is around 0.2.
+	contrast := math.Min(1, s.RMSContrast/0.2)
+	tau := 0.999 - 0.019*contrast
+
+	rho := 0.98
+	if s.Entropy < 5 {
+		rho = 0.99
+	}
+	return float32(math.Round(tau*1000) / 1000), rho
+}
@@ -0,0 +1,392 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io/ioutil"
+	"os"
+
+	"gocv.io/x/gocv"
+)
+
+// animFrame is a fully composited frame of an animation.
+type animFrame struct {
+	img      image.Image
+	duration int // in milliseconds
+}
+
+// animation holds the frames of an animated image together with its loop count (0 means infinite).
+type animation struct {
+	frames    []animFrame
+	loopCount int
+}
+
+// chunk is a tagged block of the RIFF (used by WebP) and PNG containers.
+type chunk struct {
+	id      string
+	payload []byte
+}
+
+// isAnimatedWebP reports whether the data is an animated WebP image.
+func isAnimatedWebP(data []byte) bool {
+	if len(data) < 21 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return false
+	}
+	// The animation flag is stored in the extended format (VP8X) header.
+	return string(data[12:16]) == "VP8X" && data[20]&0x02 != 0
+}
+
+// readChunks parses the consecutive RIFF chunks.
+func readChunks(data []byte) ([]chunk, error) {
+	var chunks []chunk
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("invalid RIFF chunk header")
+		}
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		if size < 0 || 8+size > len(data) {
+			return nil, errors.New("invalid RIFF chunk size")
+		}
+		chunks = append(chunks, chunk{id: string(data[0:4]), payload: data[8 : 8+size]})
+
+		// The chunks are padded to even sizes.
+		next := 8 + size + size&1
+		if next > len(data) {
+			next = len(data)
+		}
+		data = data[next:]
+	}
+	return chunks, nil
+}
+
+// writeChunk appends the RIFF chunk, padded to even size, to the buffer.
+func writeChunk(buf *bytes.Buffer, id string, payload []byte) {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(payload)))
+	buf.WriteString(id)
+	buf.Write(size[:])
+	buf.Write(payload)
+	if len(payload)&1 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+// riffFile wraps the chunks into a WebP RIFF container.
+func riffFile(chunks []byte) []byte {
+	buf := new(bytes.Buffer)
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(4+len(chunks)))
+	buf.WriteString("RIFF")
+	buf.Write(size[:])
+	buf.WriteString("WEBP")
+	buf.Write(chunks)
+	return buf.Bytes()
+}
+
+// uint24 decodes a 24 bit little endian number.
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+// putUint24 encodes a 24 bit little endian number.
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// decodeAnimatedWebP decodes the frames of the animated WebP image. Every frame bitstream is
+// wrapped into a still WebP image and decoded by OpenCV, then composited onto the canvas
+// following the blending and disposal methods of the frames.
+func decodeAnimatedWebP(data []byte) (*animation, error) {
+	if len(data) < 12 {
+		return nil, errors.New("invalid WebP header")
+	}
+	chunks, err := readChunks(data[12:])
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 || chunks[0].id != "VP8X" || len(chunks[0].payload) < 10 {
+		return nil, errors.New("missing WebP extended header")
+	}
+	width, height := uint24(chunks[0].payload[4:])+1, uint24(chunks[0].payload[7:])+1
+
+	anim := &animation{}
+	canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+	var dispose *image.Rectangle
+
+	for _, c := range chunks[1:] {
+		switch c.id {
+		case "ANIM":
+			if len(c.payload) >= 6 {
+				anim.loopCount = int(binary.LittleEndian.Uint16(c.payload[4:6]))
+			}
+		case "ANMF":
+			if len(c.payload) < 16 {
+				return nil, errors.New("invalid WebP animation frame")
+			}
+			p := c.payload
+			x, y := 2*uint24(p[0:]), 2*uint24(p[3:])
+			w, h := uint24(p[6:])+1, uint24(p[9:])+1
+			duration := uint24(p[12:])
+			flags := p[15]
+
+			frame, err := decodeWebPFrame(p[16:], w, h)
+			if err != nil {
+				return nil, err
+			}
+
+			if dispose != nil {
+				draw.Draw(canvas, *dispose, image.Transparent, image.ZP, draw.Src)
+				dispose = nil
+			}
+			rect := image.Rect(x, y, x+w, y+h)
+			// The blending bit set means the frame overwrites the canvas area.
+			op := draw.Over
+			if flags&0x02 != 0 {
+				op = draw.Src
+			}
+			draw.Draw(canvas, rect, frame, image.ZP, op)
+			if flags&0x01 != 0 {
+				dispose = &rect
+			}
+
+			snapshot := image.NewNRGBA(canvas.Bounds())
+			copy(snapshot.Pix, canvas.Pix)
+			anim.frames = append(anim.frames, animFrame{img: snapshot, duration: duration})
+		}
+	}
+	if len(anim.frames) == 0 {
+		return nil, errors.New("the WebP animation has no frames")
+	}
+	return anim, nil
+}
+
+// decodeWebPFrame decodes the bitstream of an animation frame.
+func decodeWebPFrame(data []byte, width, height int) (image.Image, error) {
+	subchunks, err := readChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	body := new(bytes.Buffer)
+	for _, c := range subchunks {
+		if c.id == "ALPH" {
+			// The alpha channel is only supported by the extended format.
+			vp8x := make([]byte, 10)
+			vp8x[0] = 0x10
+			putUint24(vp8x[4:], width-1)
+			putUint24(vp8x[7:], height-1)
+			writeChunk(body, "VP8X", vp8x)
+			break
+		}
+	}
+	for _, c := range subchunks {
+		if c.id == "ALPH" || c.id == "VP8 " || c.id == "VP8L" {
+			writeChunk(body, c.id, c.payload)
+		}
+	}
+
+	tmpfile, err := ioutil.TempFile("/tmp", "frame")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(tmpfile.Name())
+	if _, err := tmpfile.Write(riffFile(body.Bytes())); err != nil {
+		tmpfile.Close()
+		return nil, fmt.Errorf("unable to write the temporary file: %v", err)
+	}
+	tmpfile.Close()
+
+	mat := imRead(tmpfile.Name(), gocv.IMReadUnchanged)
+	defer closeMat(&mat)
+	if mat.Empty() {
+		return nil, errors.New("unable to decode the WebP animation frame")
+	}
+
+	return matToNRGBA(mat), nil
+}
+
+// matToNRGBA converts the BGR or BGRA matrix into a non-premultiplied RGBA image.
+func matToNRGBA(mat gocv.Mat) *image.NRGBA {
+	width, height, channels := mat.Cols(), mat.Rows(), mat.Channels()
+	data := mat.ToBytes()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for i, j := 0, 0; i+channels <= len(data) && j < len(img.Pix); i, j = i+channels, j+4 {
+		switch channels {
+		case 1:
+			img.Pix[j], img.Pix[j+1], img.Pix[j+2], img.Pix[j+3] = data[i], data[i], data[i], 255
+		case 3:
+			img.Pix[j], img.Pix[j+1], img.Pix[j+2], img.Pix[j+3] = data[i+2], data[i+1], data[i], 255
+		default:
+			img.Pix[j], img.Pix[j+1], img.Pix[j+2], img.Pix[j+3] = data[i+2], data[i+1], data[i], data[i+3]
+		}
+	}
+	return img
+}
+
+// renderAnimation generates the line drawing of the animated WebP image and encodes it
+// as animated WebP or APNG, when requested through the format parameter, otherwise as GIF.
+func renderAnimation(data []byte, rp *requestParams) ([]byte, error) {
+	anim, err := decodeAnimatedWebP(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode the animated WebP image: %v", err)
+	}
+	res, err := processAnimation(anim, rp.opts)
+	if err != nil {
+		return nil, err
+	}
+	switch rp.format {
+	case "webp":
+		return encodeAnimatedWebP(res)
+	case "apng":
+		return encodeAPNG(res)
+	}
+	return encodeGIF(res)
+}
+
+// processAnimation generates the line drawing of every frame of the animation.
+func processAnimation(anim *animation, opts options) (*animation, error) {
+	res := &animation{loopCount: anim.loopCount}
+	for _, f := range anim.frames {
+		img, err := renderFrame(f.img, opts)
+		if err != nil {
+			return nil, err
+		}
+		res.frames = append(res.frames, animFrame{img: img, duration: f.duration})
+	}
+	return res, nil
+}
+
+// renderFrame generates the line drawing of a single frame, flattened on a white background.
+func renderFrame(frame image.Image, opts options) (*image.Gray, error) {
+	flat := image.NewRGBA(frame.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(flat, flat.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+	src, err := matFromImage(flat)
+	if err != nil {
+		return nil, err
+	}
+	defer closeMat(&src)
+
+	cld, err := NewCLDFromMat(src, opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize CLD: %v", err)
+	}
+	defer cld.Close()
+
+	data, err := cld.generateLines()
+	if err != nil {
+		return nil, err
+	}
+	rows, cols := cld.image.Rows(), cld.image.Cols()
+	if len(data) != rows*cols {
+		return nil, errors.New("unexpected size of the generated frame")
+	}
+	return &image.Gray{Pix: data, Stride: cols, Rect: image.Rect(0, 0, cols, rows)}, nil
+}
+
+// encodeGIF encodes the animation as GIF, using a grayscale palette.
+// The GIF frame delays have a resolution of 10 milliseconds.
+func encodeGIF(anim *animation) ([]byte, error) {
+	palette := make(color.Palette, 256)
+	for i := range palette {
+		palette[i] = color.Gray{Y: uint8(i)}
+	}
+
+	g := &gif.GIF{LoopCount: anim.loopCount}
+	for _, f := range anim.frames {
+		frame := image.NewPaletted(f.img.Bounds(), palette)
+		draw.Draw(frame, frame.Bounds(), f.img, f.img.Bounds().Min, draw.Src)
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, (f.duration+5)/10)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeAnimatedWebP encodes the animation as animated WebP. The frames are encoded
+// as still WebP images by OpenCV, then their bitstreams are assembled into animation frames.
+func encodeAnimatedWebP(anim *animation) ([]byte, error) {
+	bounds := anim.frames[0].img.Bounds()
+	body := new(bytes.Buffer)
+
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02
+	putUint24(vp8x[4:], bounds.Dx()-1)
+	putUint24(vp8x[7:], bounds.Dy()-1)
+	writeChunk(body, "VP8X", vp8x)
+
+	animHeader := []byte{0xff, 0xff, 0xff, 0xff, 0, 0}
+	binary.LittleEndian.PutUint16(animHeader[4:], uint16(anim.loopCount))
+	writeChunk(body, "ANIM", animHeader)
+
+	for _, f := range anim.frames {
+		gray := image.NewGray(f.img.Bounds())
+		draw.Draw(gray, gray.Bounds(), f.img, f.img.Bounds().Min, draw.Src)
+		mat, err := newMatFromBytes(gray.Rect.Dy(), gray.Rect.Dx(), gocv.MatTypeCV8UC1, gray.Pix)
+		if err != nil {
+			return nil, err
+		}
+		still, err := gocv.IMEncode(".webp", mat)
+		closeMat(&mat)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode the WebP frame: %v", err)
+		}
+		if len(still) < 12 {
+			return nil, errors.New("invalid WebP frame")
+		}
+		chunks, err := readChunks(still[12:])
+		if err != nil {
+			return nil, err
+		}
+
+		frame := new(bytes.Buffer)
+		header := make([]byte, 16)
+		putUint24(header[6:], gray.Rect.Dx()-1)
+		putUint24(header[9:], gray.Rect.Dy()-1)
+		putUint24(header[12:], f.duration)
+		// Every frame covers the whole canvas, so it's drawn without blending.
+		header[15] = 0x02
+		frame.Write(header)
+		for _, c := range chunks {
+			if c.id == "ALPH" || c.id == "VP8 " || c.id == "VP8L" {
+				writeChunk(frame, c.id, c.payload)
+			}
+		}
+		writeChunk(body, "ANMF", frame.Bytes())
+	}
+	return riffFile(body.Bytes()), nil
+}
@@ -0,0 +1,144 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+)
+
+const (
+	// pngSignature is the magic number of the PNG files.
+	pngSignature = "\x89PNG\r\n\x1a\n"
+	// beforeAfterDuration is the duration of the frames of the before/after animation, in milliseconds.
+	beforeAfterDuration = 1500
+)
+
+// encodeAPNG encodes the animation as APNG, which unlike GIF is not limited to 256 colors.
+// The frames are encoded as grayscale PNG images, whose image data is then
+// reassembled into the animation frames.
+func encodeAPNG(anim *animation) ([]byte, error) {
+	if len(anim.frames) == 0 {
+		return nil, errors.New("the animation has no frames")
+	}
+	bounds := anim.frames[0].img.Bounds()
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(pngSignature)
+
+	var seq uint32
+	for i, f := range anim.frames {
+		gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(gray, gray.Bounds(), f.img, f.img.Bounds().Min, draw.Src)
+
+		frame := new(bytes.Buffer)
+		if err := png.Encode(frame, gray); err != nil {
+			return nil, err
+		}
+		chunks, err := readPNGChunks(frame.Bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			for _, c := range chunks {
+				if c.id == "IHDR" {
+					writePNGChunk(buf, "IHDR", c.payload)
+				}
+			}
+			actl := make([]byte, 8)
+			binary.BigEndian.PutUint32(actl[0:], uint32(len(anim.frames)))
+			binary.BigEndian.PutUint32(actl[4:], uint32(anim.loopCount))
+			writePNGChunk(buf, "acTL", actl)
+		}
+
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(bounds.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(bounds.Dy()))
+		// The delay is expressed as a fraction of seconds: duration/1000.
+		binary.BigEndian.PutUint16(fctl[20:], uint16(f.duration))
+		binary.BigEndian.PutUint16(fctl[22:], 1000)
+		writePNGChunk(buf, "fcTL", fctl)
+		seq++
+
+		// The image data of the first frame is the default image, the others are stored as frame data.
+		for _, c := range chunks {
+			if c.id != "IDAT" {
+				continue
+			}
+			if i == 0 {
+				writePNGChunk(buf, "IDAT", c.payload)
+				continue
+			}
+			fdat := make([]byte, 4+len(c.payload))
+			binary.BigEndian.PutUint32(fdat, seq)
+			copy(fdat[4:], c.payload)
+			writePNGChunk(buf, "fdAT", fdat)
+			seq++
+		}
+	}
+	writePNGChunk(buf, "IEND", nil)
+
+	return buf.Bytes(), nil
+}
+
+// readPNGChunks parses the chunks of the PNG file.
+func readPNGChunks(data []byte) ([]chunk, error) {
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return nil, errors.New("invalid PNG signature")
+	}
+	data = data[len(pngSignature):]
+
+	var chunks []chunk
+	for len(data) >= 12 {
+		size := int(binary.BigEndian.Uint32(data[0:4]))
+		if size < 0 || 12+size > len(data) {
+			return nil, errors.New("invalid PNG chunk size")
+		}
+		chunks = append(chunks, chunk{id: string(data[4:8]), payload: data[8 : 8+size]})
+		data = data[12+size:]
+	}
+	return chunks, nil
+}
+
+// writePNGChunk appends the PNG chunk together with its checksum to the buffer.
+func writePNGChunk(buf *bytes.Buffer, id string, payload []byte) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(len(payload)))
+	buf.Write(b[:])
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(id))
+	crc.Write(payload)
+	buf.WriteString(id)
+	buf.Write(payload)
+
+	binary.BigEndian.PutUint32(b[:], crc.Sum32())
+	buf.Write(b[:])
+}
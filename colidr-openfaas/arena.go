@@ -0,0 +1,117 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// The float slices released by the arenas are pooled by their capacity, rounded up to a power of two.
+var (
+	float32Pools [64]sync.Pool
+	float64Pools [64]sync.Pool
+)
+
+// sizeClass returns the index of the power of two capacity holding n elements.
+func sizeClass(n int) uint {
+	if n <= 1 {
+		return 0
+	}
+	return uint(bits.Len(uint(n - 1)))
+}
+
+// arena hands out the float slices used by the Go side of the pipeline during a request, which are
+// released wholesale at the end of the request and reused by the later ones, reducing the GC
+// pressure under sustained load. A nil arena falls back to the regular allocations.
+type arena struct {
+	mu  sync.Mutex
+	f32 []*[]float32
+	f64 []*[]float64
+}
+
+func newArena() *arena {
+	return &arena{}
+}
+
+// float32s returns a zeroed slice of n elements, owned by the arena.
+func (a *arena) float32s(n int) []float32 {
+	if a == nil {
+		return make([]float32, n)
+	}
+	class := sizeClass(n)
+	var buf *[]float32
+	if v := float32Pools[class].Get(); v != nil {
+		buf = v.(*[]float32)
+		*buf = (*buf)[:n]
+		for i := range *buf {
+			(*buf)[i] = 0
+		}
+	} else {
+		s := make([]float32, n, 1<<class)
+		buf = &s
+	}
+	a.mu.Lock()
+	a.f32 = append(a.f32, buf)
+	a.mu.Unlock()
+	return *buf
+}
+
+// float64s returns a zeroed slice of n elements, owned by the arena.
+func (a *arena) float64s(n int) []float64 {
+	if a == nil {
+		return make([]float64, n)
+	}
+	class := sizeClass(n)
+	var buf *[]float64
+	if v := float64Pools[class].Get(); v != nil {
+		buf = v.(*[]float64)
+		*buf = (*buf)[:n]
+		for i := range *buf {
+			(*buf)[i] = 0
+		}
+	} else {
+		s := make([]float64, n, 1<<class)
+		buf = &s
+	}
+	a.mu.Lock()
+	a.f64 = append(a.f64, buf)
+	a.mu.Unlock()
+	return *buf
+}
+
+// release returns every slice handed out by the arena to the pools. The slices must not be used afterwards.
+func (a *arena) release() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, buf := range a.f32 {
+		float32Pools[sizeClass(cap(*buf))].Put(buf)
+	}
+	for _, buf := range a.f64 {
+		float64Pools[sizeClass(cap(*buf))].Put(buf)
+	}
+	a.f32, a.f64 = nil, nil
+}
@@ -0,0 +1,105 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+const (
+	// defaultASCIIWidth is the default number of the character columns.
+	defaultASCIIWidth = 80
+	// maxASCIIWidth is the maximum number of the character columns.
+	maxASCIIWidth = 1000
+)
+
+// asciiRamps are the characters of the text output, ordered from the lightest to the darkest.
+var asciiRamps = map[string][]string{
+	"ascii":  {" ", ".", ":", "-", "=", "+", "*", "#", "%", "@"},
+	"blocks": {" ", "░", "▒", "▓", "█"},
+}
+
+// encodeASCII maps the image onto character cells. The terminal characters being about twice as
+// tall as wide, each cell covers twice as many rows as columns. The lines are thin, so the mean
+// darkness of the cells is boosted by a square root before being mapped onto the ramp. With ansi
+// set, the characters are colored with 24 bit ANSI escape sequences, using the mean color of the
+// dark pixels of the cells.
+func encodeASCII(w io.Writer, img image.Image, width int, charset string, ansi bool) error {
+	ramp, ok := asciiRamps[charset]
+	if charset == "" {
+		ramp, ok = asciiRamps["ascii"], true
+	}
+	if !ok {
+		return fmt.Errorf("unsupported charset %q: must be ascii or blocks", charset)
+	}
+	b := img.Bounds()
+	if width <= 0 {
+		width = defaultASCIIWidth
+	}
+	if width > b.Dx() {
+		width = b.Dx()
+	}
+	cellW := float64(b.Dx()) / float64(width)
+	cellH := 2 * cellW
+	height := int(math.Max(1, math.Round(float64(b.Dy())/cellH)))
+
+	bw := bufio.NewWriter(w)
+	for row := 0; row < height; row++ {
+		y0, y1 := b.Min.Y+int(float64(row)*cellH), b.Min.Y+int(math.Min(float64(b.Dy()), float64(row+1)*cellH))
+		for col := 0; col < width; col++ {
+			x0, x1 := b.Min.X+int(float64(col)*cellW), b.Min.X+int(float64(col+1)*cellW)
+
+			var darkness, r, g, bl, dark float64
+			var n int
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+					lum := float64(color.GrayModel.Convert(c).(color.Gray).Y)
+					darkness += 1 - lum/255
+					if lum < 128 {
+						r, g, bl = r+float64(c.R), g+float64(c.G), bl+float64(c.B)
+						dark++
+					}
+					n++
+				}
+			}
+			if n == 0 {
+				bw.WriteString(ramp[0])
+				continue
+			}
+			idx := int(math.Round(math.Sqrt(darkness/float64(n)) * float64(len(ramp)-1)))
+			if ansi && dark > 0 && idx > 0 {
+				fmt.Fprintf(bw, "\x1b[38;2;%d;%d;%dm%s\x1b[0m", int(r/dark), int(g/dark), int(bl/dark), ramp[idx])
+			} else {
+				bw.WriteString(ramp[idx])
+			}
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
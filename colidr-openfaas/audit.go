@@ -0,0 +1,162 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AuditRecord is a processed request captured in the audit log, with the parameters resolved,
+// including the random seed, so it can be replayed deterministically against another build.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// Params is the query string of the effective recipe of the request.
+	Params string `json:"params"`
+	Output string `json:"output,omitempty"`
+	// Draft is set when the draft render won the race against the deadline.
+	Draft bool `json:"draft,omitempty"`
+	// Downgrade is the downgrade applied to the oversized output, which isn't replayed.
+	Downgrade  string  `json:"downgrade,omitempty"`
+	InputHash  string  `json:"input_sha256"`
+	InputSize  int     `json:"input_size"`
+	Status     int     `json:"status"`
+	OutputHash string  `json:"output_sha256,omitempty"`
+	ErrorCode  string  `json:"error_code,omitempty"`
+	Duration   float64 `json:"duration_seconds"`
+}
+
+// auditLog serializes the appends to the audit log in HTTP mode.
+var auditLog sync.Mutex
+
+// auditRequests captures the processed requests into the directory set through the audit_dir
+// environment variable: the records are appended to its audit.jsonl file, while the input images
+// are stored in the blobs directory, named by their SHA-256 hash. The images fetched in url
+// input mode are not captured.
+func auditRequests(next handlerFunc) handlerFunc {
+	return func(ctx *RequestContext) *response {
+		dir := os.Getenv("audit_dir")
+		if dir == "" {
+			return next(ctx)
+		}
+		start := time.Now()
+		res := next(ctx)
+		if ctx.params == nil || ctx.InputMode == "url" {
+			return res
+		}
+		if err := writeAudit(dir, ctx, res, time.Since(start)); err != nil {
+			log.Printf("unable to write the audit log: %v", err)
+		}
+		return res
+	}
+}
+
+// writeAudit stores the input image of the request and appends its record to the audit log.
+func writeAudit(dir string, ctx *RequestContext, res *response, elapsed time.Duration) error {
+	// The image is stored decoded from the base64 or the multipart body, as it was processed,
+	// while the requests without an image have nothing to replay.
+	data, err := requestImage(ctx)
+	if err != nil {
+		return nil
+	}
+	rec := AuditRecord{
+		Time:      time.Now().UTC(),
+		Params:    exportRecipe(ctx.params).values().Encode(),
+		Output:    ctx.OutputMode,
+		Draft:     res.header.Get("X-Render-Quality") == "draft",
+		Downgrade: res.header.Get("X-Downgrade"),
+		InputHash: fmt.Sprintf("%x", sha256.Sum256(data)),
+		InputSize: len(data),
+		Status:    res.status,
+		Duration:  elapsed.Seconds(),
+	}
+	if res.status == http.StatusOK {
+		rec.OutputHash = fmt.Sprintf("%x", sha256.Sum256(res.body))
+	} else {
+		rec.ErrorCode = res.header.Get("X-Error-Code")
+	}
+
+	blobs := filepath.Join(dir, "blobs")
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return err
+	}
+	blob := filepath.Join(blobs, rec.InputHash)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(blob, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	var line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(rec); err != nil {
+		return err
+	}
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	f, err := os.OpenFile(filepath.Join(dir, "audit.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Replay processes the input image of the audit record again with its recorded parameters,
+// returning the status and the output, or the error message, of the current build.
+func (rec AuditRecord) Replay(input []byte) (int, []byte) {
+	values, err := url.ParseQuery(rec.Params)
+	if err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+	rp, err := parseParams(values)
+	if err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+	if rec.Draft {
+		rp = draftParams(rp)
+	}
+	out, err := pipeline.Process(input, rp, renderOutput(rec.Output))
+	if err == nil && rec.Output == "hash" {
+		out, err = hashResult(out, rp)
+	}
+	if err != nil {
+		res := errorFor(err)
+		return res.status, res.body
+	}
+	return http.StatusOK, out
+}
@@ -0,0 +1,392 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"strconv"
+
+	"gocv.io/x/gocv"
+)
+
+// minBandRows is the minimum band height of the low memory mode.
+const minBandRows = 32
+
+// defaultBandRows returns the band height of the low memory mode, set through the band_rows
+// environment variable. Zero disables the banded processing.
+func defaultBandRows() int {
+	if v, err := strconv.Atoi(os.Getenv("band_rows")); err == nil && v > 0 {
+		return v
+	}
+	return 0
+}
+
+// bandMargin returns the number of the rows recomputed around each band, so the lines at the band
+// borders match the whole image processing. It covers the reach of the edge tangent flow refinement,
+// the gradient and flow DoG kernels and the smoothing between the fDoG iterations, the latter three
+// being repeated at each iteration.
+func bandMargin(opts options) int {
+	margin := opts.etfKernel * opts.etfIteration
+	if opts.etfIteration == 0 {
+		margin = opts.etfKernel
+	}
+	flow := len(makeGaussianVector(opts.sigmaM))
+	if opts.maxSteps > flow {
+		flow = opts.maxSteps
+	}
+	perIteration := len(makeGaussianVector(opts.sigmaR*opts.sigmaC)) + flow + opts.combineBlur/2
+	return margin + perIteration*(opts.fDogIteration+1)
+}
+
+// newBandedCLD creates the CLD of the low memory mode, which keeps only the 8 bit source images
+// of the whole size. The edge tangent flow and the DoG responses are computed band by band
+// when the lines are generated.
+func newBandedCLD(bgr, gray gocv.Mat, cldOpts options) *Cld {
+	rows, cols := gray.Rows(), gray.Cols()
+	return &Cld{
+		image:   gray,
+		tone:    cloneMat(gray),
+		bands:   cloneMat(bgr),
+		result:  newMatWithSize(rows, cols, gocv.MatTypeCV8UC1),
+		arena:   newArena(),
+		options: cldOpts,
+	}
+}
+
+// bandStage is the stage of the low memory mode whose statistics are collected over the bands.
+type bandStage int
+
+const (
+	collectNone bandStage = iota
+	collectGradient
+	collectResponse
+)
+
+// bandHistBins is the number of the histogram bins approximating the distribution of the flow DoG
+// response of the whole image, from which the percentile and the Otsu thresholds are resolved.
+const bandHistBins = 1 << 16
+
+// valueRange is the range of the values of a matrix.
+type valueRange struct {
+	lo, hi float64
+}
+
+// emptyRange returns the range to be extended by the collected values.
+func emptyRange() valueRange {
+	return valueRange{lo: math.Inf(1), hi: math.Inf(-1)}
+}
+
+func (r *valueRange) add(v float64) {
+	r.lo = math.Min(r.lo, v)
+	r.hi = math.Max(r.hi, v)
+}
+
+// scale returns the factor and the offset mapping the range onto [0, 1], like gocv.NormMinMax
+// does with the range of the matrix values.
+func (r valueRange) scale() (float64, float64) {
+	if !(r.hi > r.lo) {
+		return 0, 0
+	}
+	s := 1 / (r.hi - r.lo)
+	return s, -r.lo * s
+}
+
+// normalizeRange maps the values of the matrix from the range onto [0, 1].
+func normalizeRange(m *gocv.Mat, r valueRange) {
+	s, o := r.scale()
+	gocv.AddWeighted(*m, s, *m, 0, o, *m)
+}
+
+// bandNorm holds the normalization ranges and the thresholds of the whole image in the low memory
+// mode, so the bands are scaled like in the whole image processing instead of by their own extremes,
+// which would make the band seams visible. The ranges are resolved by the statistics passes over
+// the bands, each pass collecting the range of the next stage. The bands are processed one at a time.
+type bandNorm struct {
+	source   valueRange
+	gradient valueRange
+	// response and taus are the flow DoG ranges and the thresholds of the fDoG iterations.
+	response []valueRange
+	taus     []float32
+
+	stage     bandStage
+	collected valueRange
+	hist      []float64
+	// top and bottom delimit the rows of the current band kept in the result,
+	// the margins being left out of the statistics.
+	top, bottom int
+	// generation is the fDoG iteration of the current band.
+	generation int
+}
+
+// collectVecs extends the collected range with the values of the multi channel matrix.
+func (n *bandNorm) collectVecs(m gocv.Mat) {
+	for y := n.top; y < n.bottom; y++ {
+		for x := 0; x < m.Cols(); x++ {
+			for _, v := range m.GetVecfAt(y, x) {
+				n.collected.add(float64(v))
+			}
+		}
+	}
+}
+
+// normalizeResponse normalizes the flow DoG response of the band with the range of the whole image,
+// or collects its statistics when the range of the fDoG iteration is not resolved yet.
+func (n *bandNorm) normalizeResponse(m matrix) {
+	rows, cols := m.Rows(), m.Cols()
+	if n.generation < len(n.response) {
+		s, o := n.response[n.generation].scale()
+		for y := 0; y < rows; y++ {
+			for x := 0; x < cols; x++ {
+				m.SetFloatAt(y, x, float32(float64(m.GetFloatAt(y, x))*s+o))
+			}
+		}
+		return
+	}
+	for y := n.top; y < n.bottom; y++ {
+		for x := 0; x < cols; x++ {
+			v := float64(m.GetFloatAt(y, x))
+			if math.IsNaN(v) {
+				continue
+			}
+			n.collected.add(v)
+			if n.hist != nil {
+				n.hist[int(math.Max(0, math.Min(1, v))*(bandHistBins-1)+0.5)]++
+			}
+		}
+	}
+}
+
+// threshold returns the tau of the current fDoG iteration, once resolved.
+func (n *bandNorm) threshold() (float32, bool) {
+	if n.generation < len(n.taus) {
+		return n.taus[n.generation], true
+	}
+	return 0, false
+}
+
+// resolveResponse resolves the range and the threshold of the collected fDoG iteration.
+// The percentile and the Otsu thresholds are taken from the histogram of the raw response,
+// mapped onto the normalized range.
+func (n *bandNorm) resolveResponse(opts options) {
+	r, tau := n.collected, opts.tau
+	s, o := r.scale()
+	switch {
+	case opts.tauPercentile > 0:
+		tau = float32(n.histPercentile(100-opts.tauPercentile)*s + o)
+	case opts.autoTau:
+		var hist [otsuBins]float64
+		for i, count := range n.hist {
+			v := math.Max(0, math.Min(1, float64(i)/(bandHistBins-1)*s+o))
+			hist[int(v*(otsuBins-1)+0.5)] += count
+		}
+		tau = otsuLevel(&hist)
+	}
+	n.response = append(n.response, r)
+	n.taus = append(n.taus, tau)
+}
+
+// histPercentile returns the value below which the requested percentage of the collected values fall,
+// like responsePercentile does with the values of a matrix.
+func (n *bandNorm) histPercentile(pct float64) float64 {
+	var total float64
+	for _, count := range n.hist {
+		total += count
+	}
+	idx := math.Ceil(pct / 100 * total)
+	if idx >= total {
+		idx = total - 1
+	}
+	var acc float64
+	for i, count := range n.hist {
+		acc += count
+		if acc > idx {
+			return float64(i) / (bandHistBins - 1)
+		}
+	}
+	return 0
+}
+
+// bandOptions returns the options of the band CLDs, which are normalized with the ranges of the whole image.
+func (c *Cld) bandOptions(n *bandNorm) options {
+	opts := c.options
+	opts.bandRows = 0
+	opts.transforms = nil
+	opts.symmetry = ""
+	opts.blankThreshold = 0
+	opts.norm = n
+	return opts
+}
+
+// eachBand calls fn with every band of the source image extended by the margin rows, which are
+// processed again but discarded. The band rows [start, end) of the image start at y0 of the region.
+func (c *Cld) eachBand(n *bandNorm, fn func(region gocv.Mat, start, end, y0 int) error) error {
+	rows, cols := c.bands.Rows(), c.bands.Cols()
+	margin := bandMargin(c.options)
+
+	for start := 0; start < rows; start += c.bandRows {
+		end := start + c.bandRows
+		if end > rows {
+			end = rows
+		}
+		y0, y1 := start-margin, end+margin
+		if y0 < 0 {
+			y0 = 0
+		}
+		if y1 > rows {
+			y1 = rows
+		}
+		n.top, n.bottom, n.generation = start-y0, end-y0, 0
+
+		region := trackMat(c.bands.Region(image.Rect(0, y0, cols, y1)))
+		err := fn(region, start, end, y0)
+		closeMat(&region)
+		if err != nil {
+			return fmt.Errorf("unable to process the rows %d-%d: %v", start, end, err)
+		}
+	}
+	return nil
+}
+
+// sourceRange returns the range of the source values, which are normalized before computing the gradients.
+func (c *Cld) sourceRange() valueRange {
+	rows, cols := c.bands.Rows(), c.bands.Cols()
+	lo, hi := 255, 0
+	for start := 0; start < rows; start += c.bandRows {
+		end := start + c.bandRows
+		if end > rows {
+			end = rows
+		}
+		region := trackMat(c.bands.Region(image.Rect(0, start, cols, end)))
+		band := cloneMat(region)
+		closeMat(&region)
+		for _, v := range band.ToBytes() {
+			if int(v) < lo {
+				lo = int(v)
+			}
+			if int(v) > hi {
+				hi = int(v)
+			}
+		}
+		closeMat(&band)
+	}
+	if lo > hi {
+		return emptyRange()
+	}
+
+	value := func(v int) float64 {
+		if c.linearRGB {
+			return float64(float32(srgbDecode(float64(v) / 255)))
+		}
+		return float64(v) * 255
+	}
+	return valueRange{lo: value(lo), hi: value(hi)}
+}
+
+// resolveBandNorm runs the statistics passes resolving the normalization ranges and the thresholds
+// of the whole image: one pass computing only the gradients, then one pass per fDoG iteration.
+func (c *Cld) resolveBandNorm() (*bandNorm, error) {
+	n := &bandNorm{source: c.sourceRange()}
+
+	n.stage, n.collected = collectGradient, emptyRange()
+	err := c.eachBand(n, func(region gocv.Mat, _, _, _ int) error {
+		opts := c.bandOptions(n)
+		opts.etfIteration = 0
+		etf, err := newRefinedEtf(region, opts)
+		if err != nil {
+			return err
+		}
+		etf.Close()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.gradient = n.collected
+
+	n.stage = collectResponse
+	for i := 0; i <= c.fDogIteration; i++ {
+		n.collected, n.hist = emptyRange(), nil
+		if c.tauPercentile > 0 || c.autoTau {
+			n.hist = make([]float64, bandHistBins)
+		}
+		err := c.eachBand(n, func(region gocv.Mat, _, _, _ int) error {
+			band, err := NewCLDFromMat(region, c.bandOptions(n))
+			if err != nil {
+				return err
+			}
+			defer band.Close()
+
+			band.generate()
+			for j := 0; j < i; j++ {
+				band.combineImage()
+				band.generate()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		n.resolveResponse(c.options)
+	}
+	n.stage, n.hist = collectNone, nil
+	return n, nil
+}
+
+// generateBands generates the lines of the source image band by band. Only a single band of the
+// floating point matrices is allocated at a time, trading speed for memory. The bands are normalized
+// and thresholded with the ranges of the whole image, resolved by the statistics passes beforehand.
+func (c *Cld) generateBands() error {
+	n, err := c.resolveBandNorm()
+	if err != nil {
+		return err
+	}
+
+	rows, cols := c.bands.Rows(), c.bands.Cols()
+	result := make([]byte, rows*cols)
+	err = c.eachBand(n, func(region gocv.Mat, start, end, y0 int) error {
+		band, err := NewCLDFromMat(region, c.bandOptions(n))
+		if err != nil {
+			return err
+		}
+		defer band.Close()
+
+		band.generateRaw()
+		data := band.result.ToBytes()
+		copy(result[start*cols:end*cols], data[(start-y0)*cols:(end-y0)*cols])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := newMatFromBytes(rows, cols, gocv.MatTypeCV8UC1, result)
+	if err != nil {
+		return err
+	}
+	closeMat(&c.result)
+	c.result = res
+	return nil
+}
@@ -0,0 +1,283 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// batchManifest is the job manifest of the batch runner, listing the images to process.
+// The default parameters are merged with the parameters of each image.
+type batchManifest struct {
+	Name   string      `json:"name"`
+	Params string      `json:"params,omitempty"`
+	Images []batchItem `json:"images"`
+}
+
+// batchItem is an image of the manifest, read from the storage key or downloaded from the URL.
+// The result is stored under the output key, derived from the image name by default.
+type batchItem struct {
+	Key    string `json:"key,omitempty"`
+	URL    string `json:"url,omitempty"`
+	Params string `json:"params,omitempty"`
+	Output string `json:"output,omitempty"`
+}
+
+// batchReport is the completion report of a batch run.
+type batchReport struct {
+	Manifest  string            `json:"manifest"`
+	Name      string            `json:"name"`
+	Started   time.Time         `json:"started"`
+	Finished  time.Time         `json:"finished"`
+	Processed int               `json:"processed"`
+	Failed    int               `json:"failed"`
+	Gallery   string            `json:"gallery,omitempty"`
+	Items     []batchItemResult `json:"items"`
+}
+
+// batchItemResult is the outcome of an image of the batch.
+type batchItemResult struct {
+	Source    string  `json:"source"`
+	Output    string  `json:"output,omitempty"`
+	URL       string  `json:"url,omitempty"`
+	Thumbnail string  `json:"thumbnail,omitempty"`
+	Params    string  `json:"params,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Size      int     `json:"size,omitempty"`
+	Duration  float64 `json:"duration_seconds"`
+}
+
+// batchRunning is set while a batch is running, preventing the overlapping runs.
+var batchRunning int32
+
+// runBatch processes the images of the manifest stored under the key, uploading the results and
+// the completion report to the storage. The report is stored next to the manifest, unless the
+// batch_report_key environment variable provides a key template, where {name} and {time} are
+// replaced by the manifest name and the start time.
+func runBatch(manifestKey string) (*batchReport, error) {
+	if !atomic.CompareAndSwapInt32(&batchRunning, 0, 1) {
+		return nil, errors.New("a batch is already running")
+	}
+	defer atomic.StoreInt32(&batchRunning, 0)
+
+	data, err := downloadObject(manifestKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the batch manifest: %v", err)
+	}
+	manifest, err := parseManifest(manifestKey, data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the batch manifest: %v", err)
+	}
+
+	report := &batchReport{Manifest: manifestKey, Name: manifest.Name, Started: time.Now().UTC()}
+	for _, item := range manifest.Images {
+		res := processBatchItem(item, manifest.Params)
+		if res.Error != "" {
+			report.Failed++
+		} else {
+			report.Processed++
+		}
+		report.Items = append(report.Items, res)
+	}
+	report.Finished = time.Now().UTC()
+
+	// The gallery is optional, so its failure is only logged.
+	if key := galleryKey(manifest.Name, report.Started); key != "" {
+		page, err := renderGallery(report)
+		if err == nil {
+			report.Gallery, err = uploadResult(key, page, "text/html; charset=utf-8")
+		}
+		if err != nil {
+			log.Printf("unable to store the gallery of the batch %s: %v", manifestKey, err)
+		}
+	}
+
+	reportKey := strings.TrimSuffix(manifestKey, path.Ext(manifestKey)) + ".report.json"
+	if tmpl := os.Getenv("batch_report_key"); tmpl != "" {
+		reportKey = strings.NewReplacer("{name}", manifest.Name, "{time}", report.Started.Format("20060102T150405Z")).Replace(tmpl)
+	}
+	body, _ := json.MarshalIndent(report, "", "  ")
+	reportURL, err := uploadResult(reportKey, body, "application/json")
+
+	event := completionEvent{
+		JobID:     manifestKey + "@" + report.Started.Format("20060102T150405Z"),
+		Kind:      "batch",
+		Status:    "succeeded",
+		ResultURL: reportURL,
+		Metrics: map[string]float64{
+			"processed":        float64(report.Processed),
+			"failed":           float64(report.Failed),
+			"duration_seconds": report.Finished.Sub(report.Started).Seconds(),
+		},
+	}
+	if err != nil {
+		event.Status, event.Error = "failed", err.Error()
+	}
+	notifyCompletion(event)
+
+	if err != nil {
+		return report, fmt.Errorf("unable to store the batch report: %v", err)
+	}
+	return report, nil
+}
+
+// processBatchItem processes a single image of the batch.
+func processBatchItem(item batchItem, defaults string) batchItemResult {
+	start := time.Now()
+	res := batchItemResult{Source: item.Key}
+	if item.URL != "" {
+		res.Source = item.URL
+	}
+	fail := func(err error) batchItemResult {
+		res.Error = err.Error()
+		res.Duration = time.Since(start).Seconds()
+		return res
+	}
+
+	params, err := url.ParseQuery(defaults)
+	if err != nil {
+		return fail(err)
+	}
+	own, err := url.ParseQuery(item.Params)
+	if err != nil {
+		return fail(err)
+	}
+	for k, v := range own {
+		params[k] = v
+	}
+	res.Params = params.Encode()
+	rp, err := parseParams(params)
+	if err != nil {
+		return fail(err)
+	}
+
+	var data []byte
+	switch {
+	case item.Key != "":
+		data, err = downloadObject(item.Key)
+	case item.URL != "":
+		data, err = fetchImage(item.URL, fetchHeaders(newRequestContext(http.MethodGet, nil, make(http.Header), nil, "")))
+	default:
+		err = errors.New("either the key or the url of the image is required")
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	out, err := pipeline.Process(data, rp, "image")
+	if err != nil {
+		return fail(err)
+	}
+
+	res.Output = item.Output
+	if res.Output == "" {
+		format := rp.encoderFormat()
+		if format == "" {
+			format = "jpeg"
+		}
+		name := path.Base(res.Source)
+		res.Output = "results/" + strings.TrimSuffix(name, path.Ext(name)) + "." + format
+	}
+	if res.URL, err = uploadResult(res.Output, out, detectContentType(out, rp.format)); err != nil {
+		return fail(err)
+	}
+	if os.Getenv("batch_gallery") != "" {
+		if thumb, ok := makeThumbnail(out); ok {
+			if res.Thumbnail, err = uploadResult(thumbnailKey(res.Output), thumb, "image/jpeg"); err != nil {
+				log.Printf("unable to store the thumbnail of %s: %v", res.Output, err)
+			}
+		} else if rp.encoderFormat() == "svg" {
+			res.Thumbnail = res.URL
+		}
+	}
+	res.Size = len(out)
+	res.Duration = time.Since(start).Seconds()
+	return res
+}
+
+// scheduleBatch runs the batch of the batch_manifest storage key on the cron schedule set through
+// the batch_schedule environment variable, e.g. "0 3 * * *" for the nightly re-stylization.
+func scheduleBatch() {
+	expr, key := os.Getenv("batch_schedule"), os.Getenv("batch_manifest")
+	if expr == "" || key == "" {
+		return
+	}
+	schedule, err := parseCron(expr)
+	if err != nil {
+		log.Printf("batch schedule disabled: %v", err)
+		return
+	}
+	for {
+		next := schedule.next(time.Now())
+		if next.IsZero() {
+			log.Printf("batch schedule disabled: %q never fires", expr)
+			return
+		}
+		time.Sleep(time.Until(next))
+
+		report, err := runBatch(key)
+		if err != nil {
+			log.Printf("batch %s failed: %v", key, err)
+			continue
+		}
+		log.Printf("batch %s completed: %d processed, %d failed", key, report.Processed, report.Failed)
+	}
+}
+
+// serveBatch runs the batch of the manifest key provided in the query string, or of the
+// batch_manifest one, returning the completion report. It can be triggered by an external
+// scheduler, like the OpenFaaS cron connector, providing the admin token.
+func serveBatch(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.URL.Query().Get("manifest")
+	if key == "" {
+		key = os.Getenv("batch_manifest")
+	}
+	if key == "" {
+		http.Error(w, "the batch manifest is required", http.StatusBadRequest)
+		return
+	}
+	report, err := runBatch(key)
+	if err != nil && report == nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
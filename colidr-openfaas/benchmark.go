@@ -0,0 +1,310 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gocv.io/x/gocv"
+	"handler/function/synth"
+)
+
+const (
+	// maxBenchmarkSize is the largest long edge of the benchmarked reference images.
+	maxBenchmarkSize = 4096
+	// maxBenchmarkRuns is the maximum number of renders of every size.
+	maxBenchmarkRuns = 10
+)
+
+// defaultBenchmarkSizes are the long edges of the reference images rendered by default.
+var defaultBenchmarkSizes = []int{256, 512, 1024}
+
+// benchmarkStages holds the timings of the processing stages, in seconds.
+type benchmarkStages struct {
+	Decode float64 `json:"decode"`
+	Flow   float64 `json:"flow"`
+	Lines  float64 `json:"lines"`
+	Encode float64 `json:"encode"`
+}
+
+// total returns the duration of all the stages.
+func (s benchmarkStages) total() float64 {
+	return s.Decode + s.Flow + s.Lines + s.Encode
+}
+
+// benchmarkResult is the performance of the reference image rendered at one size. The
+// stage timings are the medians of the runs.
+type benchmarkResult struct {
+	Width      int             `json:"width"`
+	Height     int             `json:"height"`
+	Stages     benchmarkStages `json:"stages_seconds"`
+	Total      float64         `json:"total_seconds"`
+	Throughput float64         `json:"megapixels_per_second"`
+	AllocBytes uint64          `json:"go_alloc_bytes"`
+	RSSBytes   uint64          `json:"rss_bytes,omitempty"`
+	OutputSize int             `json:"output_size"`
+}
+
+// benchmarkReport is the performance report of the node, for comparing the node types
+// and setting the autoscaling targets.
+type benchmarkReport struct {
+	Started      time.Time         `json:"started"`
+	Duration     float64           `json:"duration_seconds"`
+	CPUs         int               `json:"cpus"`
+	Params       string            `json:"params,omitempty"`
+	Runs         int               `json:"runs"`
+	Results      []benchmarkResult `json:"results"`
+	PeakRSSBytes uint64            `json:"peak_rss_bytes,omitempty"`
+}
+
+// benchmarkRunning is set while a benchmark is running, since the overlapping runs would skew each other.
+var benchmarkRunning int32
+
+// serveBenchmark renders the bundled reference image at several sizes and returns the performance
+// report. It's triggered by the operators with the admin token, set through the admin_token environment
+// variable or the admin-token secret, and disabled without it. The sizes and the number of runs are
+// set by the sizes and runs query parameters, the rest of them being the processing parameters.
+func serveBenchmark(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	sizes, runs, err := benchmarkPlan(query.Get("sizes"), query.Get("runs"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.Del("sizes")
+	query.Del("runs")
+	rp, err := parseParams(query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid parameters: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&benchmarkRunning, 0, 1) {
+		http.Error(w, "a benchmark is already running", http.StatusConflict)
+		return
+	}
+	defer atomic.StoreInt32(&benchmarkRunning, 0)
+
+	report, err := runBenchmark(sizes, runs, rp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	report.Params = query.Encode()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
+
+// benchmarkPlan parses the comma separated sizes and the number of runs of the benchmark.
+func benchmarkPlan(sizeList, runList string) ([]int, int, error) {
+	sizes := defaultBenchmarkSizes
+	if sizeList != "" {
+		sizes = nil
+		for _, s := range strings.Split(sizeList, ",") {
+			size, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || size < 16 || size > maxBenchmarkSize {
+				return nil, 0, fmt.Errorf("invalid size %q: must be between 16 and %d", s, maxBenchmarkSize)
+			}
+			sizes = append(sizes, size)
+		}
+	}
+	runs := 3
+	if runList != "" {
+		var err error
+		if runs, err = strconv.Atoi(runList); err != nil || runs < 1 || runs > maxBenchmarkRuns {
+			return nil, 0, fmt.Errorf("invalid runs %q: must be between 1 and %d", runList, maxBenchmarkRuns)
+		}
+	}
+	return sizes, runs, nil
+}
+
+// runBenchmark renders the reference image at every size, the requested number of times.
+func runBenchmark(sizes []int, runs int, rp *requestParams) (*benchmarkReport, error) {
+	report := &benchmarkReport{Started: time.Now().UTC(), CPUs: runtime.GOMAXPROCS(0), Runs: runs}
+	for _, size := range sizes {
+		img := referenceImage(size)
+		buf := new(bytes.Buffer)
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, err
+		}
+
+		b := img.Bounds()
+		res := benchmarkResult{Width: b.Dx(), Height: b.Dy()}
+		timings := make([]benchmarkStages, runs)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for i := range timings {
+			var err error
+			if timings[i], res.OutputSize, err = benchmarkRender(buf.Bytes(), rp); err != nil {
+				return nil, fmt.Errorf("unable to render the %dx%d reference image: %v", res.Width, res.Height, err)
+			}
+		}
+		runtime.ReadMemStats(&after)
+
+		res.Stages = medianStages(timings)
+		res.Total = res.Stages.total()
+		if res.Total > 0 {
+			res.Throughput = float64(res.Width*res.Height) / 1e6 / res.Total
+		}
+		res.AllocBytes = (after.TotalAlloc - before.TotalAlloc) / uint64(runs)
+		res.RSSBytes = procStatus("VmRSS")
+		report.Results = append(report.Results, res)
+	}
+	report.PeakRSSBytes = procStatus("VmHWM")
+	report.Duration = time.Since(report.Started).Seconds()
+	return report, nil
+}
+
+// benchmarkRender renders the encoded reference image, measuring the duration of the stages.
+// It returns the timings and the size of the encoded result.
+func benchmarkRender(data []byte, rp *requestParams) (benchmarkStages, int, error) {
+	var stages benchmarkStages
+
+	start := time.Now()
+	src, err := decodeMat(data)
+	if err != nil {
+		return stages, 0, err
+	}
+	defer closeMat(&src)
+	stages.Decode = time.Since(start).Seconds()
+
+	start = time.Now()
+	cld, err := NewCLDFromMat(src, rp.opts)
+	if err != nil {
+		return stages, 0, err
+	}
+	defer cld.Close()
+	stages.Flow = time.Since(start).Seconds()
+
+	start = time.Now()
+	if _, err := cld.generateLines(); err != nil {
+		return stages, 0, err
+	}
+	stages.Lines = time.Since(start).Seconds()
+
+	start = time.Now()
+	mat, err := cld.ResultMat(gocv.MatTypeCV8UC1)
+	if err != nil {
+		return stages, 0, err
+	}
+	defer closeMat(&mat)
+	img, err := mat.ToImage()
+	if err != nil {
+		return stages, 0, err
+	}
+	out, err := encodeOutput(EncodeSource{Image: img, cld: cld}, rp, "image")
+	if err != nil {
+		return stages, 0, err
+	}
+	stages.Encode = time.Since(start).Seconds()
+
+	return stages, len(out), nil
+}
+
+// medianStages returns the median timings of every stage.
+func medianStages(timings []benchmarkStages) benchmarkStages {
+	median := func(get func(benchmarkStages) float64) float64 {
+		vals := make([]float64, len(timings))
+		for i, t := range timings {
+			vals[i] = get(t)
+		}
+		sort.Float64s(vals)
+		return vals[len(vals)/2]
+	}
+	return benchmarkStages{
+		Decode: median(func(s benchmarkStages) float64 { return s.Decode }),
+		Flow:   median(func(s benchmarkStages) float64 { return s.Flow }),
+		Lines:  median(func(s benchmarkStages) float64 { return s.Lines }),
+		Encode: median(func(s benchmarkStages) float64 { return s.Encode }),
+	}
+}
+
+// referenceImage returns the reference image of the benchmark with the provided long edge. It's
+// composed of synthetic patterns, a disk over a grating next to a checkerboard, with some noise,
+// so it's the same on every node without shipping an image file.
+func referenceImage(size int) *image.Gray {
+	w, h := size, size*3/4
+	grating := synth.Grating{Period: float64(size) / 24, Angle: 0.5, Fg: 96, Bg: 192}.Render(w, h)
+	board := synth.Checkerboard{Size: float64(size) / 16, Fg: 32, Bg: 224}.Render(w, h)
+	disk := synth.Circle{CX: float64(w) * 0.35, CY: float64(h) * 0.5, Radius: float64(h) * 0.3, Fg: 40, Bg: 255}.Render(w, h)
+
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*img.Stride + x
+			if x >= w*2/3 {
+				img.Pix[i] = board.Pix[y*board.Stride+x]
+				continue
+			}
+			// The disk darkens the grating, its antialiased outline blending into it.
+			img.Pix[i] = grating.Pix[y*grating.Stride+x]
+			if d := disk.Pix[y*disk.Stride+x]; d < img.Pix[i] {
+				img.Pix[i] = d
+			}
+		}
+	}
+	return synth.AddNoise(img, 20, 1)
+}
+
+// procStatus returns the memory size of the field of the process status, like VmRSS for
+// the resident set size or VmHWM for its peak, in bytes. It's zero if it's not available.
+func procStatus(field string) uint64 {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == field+":" {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+// defaultBlankThreshold is the luminance standard deviation below which the image is considered blank.
+const defaultBlankThreshold = 2.0
+
+// blankImageError is returned for the effectively blank or uniform images,
+// which would produce an empty result.
+type blankImageError struct {
+	stdDev    float64
+	threshold float64
+}
+
+func (e *blankImageError) Error() string {
+	return fmt.Sprintf("the image is blank or uniform: its luminance standard deviation %.2f is below the %.2f threshold",
+		e.stdDev, e.threshold)
+}
+
+// checkBlank returns a blankImageError if the luminance variance of the grayscale image
+// is too low for generating any line. A zero threshold disables the check.
+func checkBlank(img gocv.Mat, threshold float64) error {
+	if threshold <= 0 {
+		return nil
+	}
+	data := img.ToBytes()
+	if len(data) == 0 {
+		return nil
+	}
+
+	var sum, sqSum float64
+	for _, v := range data {
+		sum += float64(v)
+		sqSum += float64(v) * float64(v)
+	}
+	mean := sum / float64(len(data))
+	stdDev := math.Sqrt(math.Max(0, sqSum/float64(len(data))-mean*mean))
+
+	if stdDev < threshold {
+		return &blankImageError{stdDev: stdDev, threshold: threshold}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// brandingLogo is the secret holding the logo of the branding overlay, in any of the
+// formats decoded by the image package (PNG with transparency preferably).
+const brandingLogo = "branding-logo"
+
+// branding is the branding overlay applied to every output of the deployment.
+type branding struct {
+	logo        image.Image
+	position    string
+	opacity     float64
+	scale       float64
+	border      int
+	borderColor color.RGBA
+}
+
+var (
+	brandingOnce   sync.Once
+	brandingLoaded image.Image
+)
+
+// loadBrandingLogo decodes the logo secret once. A logo which can't be decoded is logged
+// and ignored.
+func loadBrandingLogo() image.Image {
+	brandingOnce.Do(func() {
+		data, err := ioutil.ReadFile(filepath.Join(secretsDir, brandingLogo))
+		if err != nil {
+			return
+		}
+		if brandingLoaded, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+			log.Printf("branding logo disabled: %v", err)
+		}
+	})
+	return brandingLoaded
+}
+
+// deploymentBranding returns the branding of the deployment, or nil if neither a logo nor
+// a border is configured. The logo is placed at the branding_position corner (top-left,
+// top-right, bottom-left, bottom-right or center), scaled to the branding_scale fraction
+// of the image width and blended with the branding_opacity. The border of branding_border
+// pixels is drawn around the image with the branding_border_color hex color.
+func deploymentBranding() (*branding, error) {
+	b := &branding{
+		logo:        loadBrandingLogo(),
+		position:    os.Getenv("branding_position"),
+		opacity:     envFloat("branding_opacity", 0.8),
+		scale:       envFloat("branding_scale", 0.15),
+		border:      int(envFloat("branding_border", 0)),
+		borderColor: color.RGBA{A: 255},
+	}
+	if b.logo == nil && b.border <= 0 {
+		return nil, nil
+	}
+	switch b.position {
+	case "":
+		b.position = "bottom-right"
+	case "top-left", "top-right", "bottom-left", "bottom-right", "center":
+	default:
+		return nil, fmt.Errorf("invalid branding_position %q", b.position)
+	}
+	if b.opacity < 0 || b.opacity > 1 || b.scale <= 0 || b.scale > 1 {
+		return nil, fmt.Errorf("invalid branding configuration: the opacity must be between 0 and 1 and the scale between 0 (exclusive) and 1")
+	}
+	if v := os.Getenv("branding_border_color"); v != "" {
+		colors, err := parseColorList(v)
+		if err != nil || len(colors) != 1 {
+			return nil, fmt.Errorf("invalid branding_border_color %q", v)
+		}
+		b.borderColor = colors[0]
+	}
+	return b, nil
+}
+
+// apply returns the image framed by the border and overlaid with the logo.
+func (b *branding) apply(src image.Image) image.Image {
+	sb := src.Bounds()
+	border := b.border
+	if border < 0 {
+		border = 0
+	}
+	rect := image.Rect(0, 0, sb.Dx()+2*border, sb.Dy()+2*border)
+	dst := image.NewRGBA(rect)
+	draw.Draw(dst, rect, &image.Uniform{b.borderColor}, image.ZP, draw.Src)
+	draw.Draw(dst, image.Rect(border, border, border+sb.Dx(), border+sb.Dy()), src, sb.Min, draw.Src)
+
+	if b.logo == nil {
+		return dst
+	}
+	logo := downscale(b.logo, int(float64(sb.Dx())*b.scale))
+	lb := logo.Bounds()
+	inner := image.Rect(border, border, border+sb.Dx(), border+sb.Dy())
+	margin := sb.Dx() / 50
+
+	var at image.Point
+	switch b.position {
+	case "top-left":
+		at = image.Pt(inner.Min.X+margin, inner.Min.Y+margin)
+	case "top-right":
+		at = image.Pt(inner.Max.X-margin-lb.Dx(), inner.Min.Y+margin)
+	case "bottom-left":
+		at = image.Pt(inner.Min.X+margin, inner.Max.Y-margin-lb.Dy())
+	case "center":
+		at = image.Pt(inner.Min.X+(inner.Dx()-lb.Dx())/2, inner.Min.Y+(inner.Dy()-lb.Dy())/2)
+	default:
+		at = image.Pt(inner.Max.X-margin-lb.Dx(), inner.Max.Y-margin-lb.Dy())
+	}
+	mask := &image.Uniform{color.Alpha{uint8(round(b.opacity * 255))}}
+	draw.DrawMask(dst, lb.Sub(lb.Min).Add(at), logo, lb.Min, mask, image.ZP, draw.Over)
+	return dst
+}
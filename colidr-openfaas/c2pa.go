@@ -0,0 +1,148 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// c2paClaimGenerator identifies the tool in the provenance manifests.
+const c2paClaimGenerator = "colidr-openfaas/1.0"
+
+// c2paManifest is the manifest definition consumed by the c2patool utility.
+type c2paManifest struct {
+	ClaimGenerator string          `json:"claim_generator"`
+	Title          string          `json:"title"`
+	Alg            string          `json:"alg,omitempty"`
+	PrivateKey     string          `json:"private_key,omitempty"`
+	SignCert       string          `json:"sign_cert,omitempty"`
+	Assertions     []c2paAssertion `json:"assertions"`
+}
+
+// c2paAssertion is a labeled assertion of the manifest.
+type c2paAssertion struct {
+	Label string      `json:"label"`
+	Data  interface{} `json:"data"`
+}
+
+// embedC2PA embeds a signed C2PA (Content Credentials) manifest into the image, identifying
+// the tool, the parameters used for the generation and the hash of the source image.
+// The manifest is built and signed by the c2patool utility, whose location can be configured
+// through the c2patool_path environment variable. The signing certificate chain and the private
+// key are read from the c2pa-sign-cert and c2pa-private-key secrets.
+func embedC2PA(data []byte, rp *requestParams) ([]byte, error) {
+	tool := os.Getenv("c2patool_path")
+	if tool == "" {
+		tool = "c2patool"
+	}
+	if _, err := exec.LookPath(tool); err != nil {
+		return nil, fmt.Errorf("c2patool is not available: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("/tmp", "c2pa")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := c2paManifest{
+		ClaimGenerator: c2paClaimGenerator,
+		Title:          "Coherent line drawing",
+		Assertions: []c2paAssertion{{
+			Label: "c2pa.actions",
+			Data: map[string]interface{}{
+				"actions": []map[string]interface{}{{
+					"action":        "c2pa.created",
+					"softwareAgent": c2paClaimGenerator,
+				}},
+			},
+		}, {
+			Label: "org.colidr.params",
+			Data:  rp.describe(),
+		}, {
+			Label: "org.colidr.source",
+			Data: map[string]string{
+				"alg":  "sha256",
+				"hash": rp.sourceHash,
+			},
+		}},
+	}
+
+	// Without a configured certificate c2patool signs with its built-in test credentials.
+	cert, key := readSecret("c2pa-sign-cert"), readSecret("c2pa-private-key")
+	if cert != "" && key != "" {
+		manifest.Alg = "es256"
+		manifest.SignCert = filepath.Join(dir, "cert.pem")
+		manifest.PrivateKey = filepath.Join(dir, "key.pem")
+		if err := ioutil.WriteFile(manifest.SignCert, []byte(cert), 0600); err != nil {
+			return nil, fmt.Errorf("unable to write the signing certificate: %v", err)
+		}
+		if err := ioutil.WriteFile(manifest.PrivateKey, []byte(key), 0600); err != nil {
+			return nil, fmt.Errorf("unable to write the private key: %v", err)
+		}
+	}
+
+	def, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	manifestFile := filepath.Join(dir, "manifest.json")
+	if err := ioutil.WriteFile(manifestFile, def, 0600); err != nil {
+		return nil, fmt.Errorf("unable to write the manifest: %v", err)
+	}
+
+	// c2patool detects the asset type from the file extension.
+	ext := imageExt(data, rp.format)
+	src, dst := filepath.Join(dir, "source"+ext), filepath.Join(dir, "signed"+ext)
+	if err := ioutil.WriteFile(src, data, 0600); err != nil {
+		return nil, fmt.Errorf("unable to write the image: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(tool, src, "-m", manifestFile, "-o", dst, "-f")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("unable to embed the C2PA manifest: %v: %s", err, stderr.String())
+	}
+	return ioutil.ReadFile(dst)
+}
+
+// imageExt returns the file extension matching the encoded image.
+func imageExt(data []byte, format string) string {
+	switch {
+	case format == "svg":
+		return ".svg"
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return ".tif"
+	case bytes.HasPrefix(data, []byte("\x89PNG")):
+		return ".png"
+	default:
+		return ".jpg"
+	}
+}
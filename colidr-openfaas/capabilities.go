@@ -0,0 +1,121 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gocv.io/x/gocv"
+)
+
+// optionalFeatures maps the optional features to the prefix of the OpenCV module they need,
+// which the slim runtime images may lack.
+var optionalFeatures = map[string]string{
+	"thinning": "ximgproc",
+	"cuda":     "cuda",
+	"dnn":      "dnn",
+}
+
+// libraryDirs are the directories searched for the OpenCV libraries, besides LD_LIBRARY_PATH.
+var libraryDirs = []string{"/usr/local/lib", "/usr/local/lib64", "/usr/lib", "/usr/lib64", "/lib"}
+
+// capabilities describes the OpenCV runtime of the function.
+type capabilities struct {
+	OpenCV   string          `json:"opencv"`
+	GoCV     string          `json:"gocv"`
+	Modules  []string        `json:"modules"`
+	Features map[string]bool `json:"features"`
+}
+
+var (
+	detectOnce sync.Once
+	runtimeCap capabilities
+)
+
+// runtimeCapabilities detects the OpenCV modules present in the runtime image once, from the
+// shared libraries installed, and reports the optional features they make available.
+func runtimeCapabilities() capabilities {
+	detectOnce.Do(func() {
+		dirs := append(filepath.SplitList(os.Getenv("LD_LIBRARY_PATH")), libraryDirs...)
+		found := make(map[string]bool)
+		for _, dir := range dirs {
+			libs, _ := filepath.Glob(filepath.Join(dir, "libopencv_*.so*"))
+			for _, lib := range libs {
+				name := strings.TrimPrefix(filepath.Base(lib), "libopencv_")
+				found[name[:strings.Index(name, ".so")]] = true
+			}
+		}
+
+		runtimeCap = capabilities{
+			OpenCV:   gocv.OpenCVVersion(),
+			GoCV:     gocv.Version(),
+			Modules:  make([]string, 0, len(found)),
+			Features: make(map[string]bool),
+		}
+		for module := range found {
+			runtimeCap.Modules = append(runtimeCap.Modules, module)
+		}
+		sort.Strings(runtimeCap.Modules)
+		for feature, prefix := range optionalFeatures {
+			available := false
+			for module := range found {
+				if strings.HasPrefix(module, prefix) {
+					available = true
+					break
+				}
+			}
+			runtimeCap.Features[feature] = available
+		}
+	})
+	return runtimeCap
+}
+
+// logCapabilities logs the OpenCV version and the optional features missing from the runtime.
+func logCapabilities() {
+	caps := runtimeCapabilities()
+	var missing []string
+	for feature, ok := range caps.Features {
+		if !ok {
+			missing = append(missing, feature+" ("+optionalFeatures[feature]+")")
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		log.Printf("OpenCV %s, the optional features are disabled: %s", caps.OpenCV, strings.Join(missing, ", "))
+		return
+	}
+	log.Printf("OpenCV %s, all optional features are available", caps.OpenCV)
+}
+
+// serveCapabilities reports the OpenCV runtime capabilities.
+func serveCapabilities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runtimeCapabilities())
+}
@@ -0,0 +1,366 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chatClient is the HTTP client used for talking with the chat platform APIs.
+var chatClient = &http.Client{Timeout: 60 * time.Second}
+
+// slackAPI is the Slack Web API endpoint.
+var slackAPI = "https://slack.com/api"
+
+// maxWebhookAge is the maximum age of the signed webhook requests, protecting against replay attacks.
+const maxWebhookAge = 5 * time.Minute
+
+// slackPayload is the subset of the Slack Events API payload used by the bot.
+type slackPayload struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Event     struct {
+		Type    string `json:"type"`
+		Channel string `json:"channel"`
+		TS      string `json:"ts"`
+		BotID   string `json:"bot_id"`
+		Files   []struct {
+			Name       string `json:"name"`
+			Mimetype   string `json:"mimetype"`
+			URLPrivate string `json:"url_private"`
+		} `json:"files"`
+	} `json:"event"`
+}
+
+// discordMessage is the subset of the Discord message object used by the bot,
+// as relayed by a bot gateway or webhook forwarder.
+type discordMessage struct {
+	ID        string `json:"id"`
+	ChannelID string `json:"channel_id"`
+	Author    struct {
+		Bot bool `json:"bot"`
+	} `json:"author"`
+	Attachments []struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"content_type"`
+		URL         string `json:"url"`
+	} `json:"attachments"`
+}
+
+// verifySlackRequest authenticates the request with the Slack signing secret. The requests are
+// refused when the secret is not configured, since anyone could post as Slack otherwise.
+func verifySlackRequest(ctx *RequestContext) error {
+	secret := readSecret("slack-signing-secret")
+	if secret == "" {
+		return errors.New("the slack signing secret is not configured")
+	}
+	if !verifySlackSignature(ctx.Body, secret, ctx.Header.Get("X-Slack-Request-Timestamp"), ctx.Header.Get("X-Slack-Signature")) {
+		return errors.New("invalid slack signature")
+	}
+	return nil
+}
+
+// handleSlack processes the images attached to the messages received through the Slack Events API
+// with the default parameters, and uploads the results back into the same thread.
+func handleSlack(ctx *RequestContext) string {
+	var payload slackPayload
+	if err := json.Unmarshal(ctx.Body, &payload); err != nil {
+		return fmt.Sprintf("unable to decode the slack payload: %v", err)
+	}
+	if payload.Type == "url_verification" {
+		return payload.Challenge
+	}
+	// Slack retries the events which are not acknowledged in 3 seconds, but the first delivery is still being processed.
+	if ctx.Header.Get("X-Slack-Retry-Num") != "" || payload.Event.BotID != "" {
+		return "ok"
+	}
+
+	token := readSecret("slack-bot-token")
+	auth := map[string]string{"Authorization": "Bearer " + token}
+
+	for _, f := range payload.Event.Files {
+		if !isSupportedImage(f.Mimetype) {
+			continue
+		}
+		// The bot token is only sent to the Slack file server.
+		if !isSlackFileURL(f.URLPrivate) {
+			return fmt.Sprintf("refusing to download the slack attachment from %q", f.URLPrivate)
+		}
+		data, err := downloadImage(f.URLPrivate, auth)
+		if err != nil {
+			return fmt.Sprintf("unable to download the slack attachment: %v", err)
+		}
+		res, err := process(data, url.Values{}, "image")
+		if err != nil {
+			return err.Error()
+		}
+		if err := uploadSlackFile(auth, payload.Event.Channel, payload.Event.TS, "cld-"+f.Name, res); err != nil {
+			return fmt.Sprintf("unable to upload the result to slack: %v", err)
+		}
+	}
+	return "ok"
+}
+
+// isSlackFileURL reports whether the link points to the Slack file server over https.
+func isSlackFileURL(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && u.Scheme == "https" && u.Host == "files.slack.com"
+}
+
+// uploadSlackFile shares the file in the thread of the channel. The file is uploaded to the URL
+// obtained through files.getUploadURLExternal, then shared through files.completeUploadExternal.
+func uploadSlackFile(auth map[string]string, channel, threadTS, filename string, data []byte) error {
+	var upload struct {
+		UploadURL string `json:"upload_url"`
+		FileID    string `json:"file_id"`
+	}
+	form := url.Values{"filename": {filename}, "length": {strconv.Itoa(len(data))}}
+	err := callSlack("files.getUploadURLExternal", auth, "application/x-www-form-urlencoded", []byte(form.Encode()), &upload)
+	if err != nil {
+		return err
+	}
+	// The upload URL is authorized by itself, so it doesn't get the bot token.
+	if err := postMultipart(upload.UploadURL, nil, nil, "file", filename, data); err != nil {
+		return err
+	}
+
+	complete, err := json.Marshal(map[string]interface{}{
+		"files":      []map[string]string{{"id": upload.FileID, "title": filename}},
+		"channel_id": channel,
+		"thread_ts":  threadTS,
+	})
+	if err != nil {
+		return err
+	}
+	return callSlack("files.completeUploadExternal", auth, "application/json; charset=utf-8", complete, nil)
+}
+
+// callSlack calls the Slack Web API method, decoding the result into res unless it's nil.
+// The failed calls are reported with a successful status, but with the ok field unset.
+func callSlack(method string, auth map[string]string, contentType string, body []byte, res interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, slackAPI+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range auth {
+		req.Header.Set(k, v)
+	}
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := readLimited(resp.Body, 1<<20)
+	if err != nil {
+		return err
+	}
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return fmt.Errorf("unexpected %s response: %v", method, err)
+	}
+	if !status.OK {
+		return fmt.Errorf("%s failed: %s", method, status.Error)
+	}
+	if res == nil {
+		return nil
+	}
+	return json.Unmarshal(data, res)
+}
+
+// verifySlackSignature checks the request signature computed with the Slack signing secret.
+func verifySlackSignature(body []byte, secret, timestamp, signature string) bool {
+	if !recentTimestamp(timestamp) {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// recentTimestamp reports whether the Unix timestamp of the signed request is within the maximum
+// webhook age, in both directions, so the old requests can't be replayed.
+func recentTimestamp(timestamp string) bool {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(sec, 0))
+	return age <= maxWebhookAge && age >= -maxWebhookAge
+}
+
+// verifyDiscordRequest authenticates the request with the Ed25519 signature of the timestamp and
+// the body, made with the key of the Discord application, whose public key is configured through
+// the discord-public-key secret (in hex). The requests are refused without the public key.
+func verifyDiscordRequest(ctx *RequestContext) error {
+	key, err := hex.DecodeString(readSecret("discord-public-key"))
+	if err != nil || len(key) == 0 {
+		return errors.New("the discord public key is not configured")
+	}
+	timestamp := ctx.Header.Get("X-Signature-Timestamp")
+	sig, err := hex.DecodeString(ctx.Header.Get("X-Signature-Ed25519"))
+	if err != nil || !recentTimestamp(timestamp) || !verifyEd25519(key, append([]byte(timestamp), ctx.Body...), sig) {
+		return errors.New("invalid discord signature")
+	}
+	return nil
+}
+
+// handleDiscord processes the images attached to a Discord message with the default parameters,
+// and posts the results back into the channel as a reply to the original message.
+func handleDiscord(ctx *RequestContext) string {
+	var msg discordMessage
+	if err := json.Unmarshal(ctx.Body, &msg); err != nil {
+		return fmt.Sprintf("unable to decode the discord message: %v", err)
+	}
+	if msg.Author.Bot {
+		return "ok"
+	}
+
+	// The channel ID is a numeric snowflake, anything else could alter the endpoint path.
+	if !isDigits(msg.ChannelID) {
+		return fmt.Sprintf("invalid discord channel id %q", msg.ChannelID)
+	}
+	auth := map[string]string{"Authorization": "Bot " + readSecret("discord-bot-token")}
+	endpoint := fmt.Sprintf("https://discord.com/api/v10/channels/%s/messages", msg.ChannelID)
+
+	for _, a := range msg.Attachments {
+		if !isSupportedImage(a.ContentType) {
+			continue
+		}
+		data, err := downloadImage(a.URL, nil)
+		if err != nil {
+			return fmt.Sprintf("unable to download the discord attachment: %v", err)
+		}
+		res, err := process(data, url.Values{}, "image")
+		if err != nil {
+			return err.Error()
+		}
+
+		reply, _ := json.Marshal(map[string]interface{}{
+			"message_reference": map[string]string{"message_id": msg.ID},
+		})
+		fields := map[string]string{"payload_json": string(reply)}
+		if err := postMultipart(endpoint, auth, fields, "files[0]", "cld-"+a.Filename, res); err != nil {
+			return fmt.Sprintf("unable to post the result to discord: %v", err)
+		}
+	}
+	return "ok"
+}
+
+// isDigits reports whether the string is a non empty sequence of decimal digits.
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isSupportedImage reports whether the attachment mime type is accepted by the function.
+func isSupportedImage(mimetype string) bool {
+	mimetype = strings.Split(mimetype, ";")[0]
+	return mimetype == "image/jpeg" || mimetype == "image/png"
+}
+
+// downloadImage fetches the image from the URL, enforcing the upload size limit.
+func downloadImage(link string, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", fetchUserAgent())
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return readLimited(resp.Body, maxUploadSize())
+}
+
+// postMultipart uploads a file together with the form fields as a multipart request.
+func postMultipart(endpoint string, headers, fields map[string]string, field, filename string, data []byte) error {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			return err
+		}
+	}
+	fw, err := mw.CreateFormFile(field, filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
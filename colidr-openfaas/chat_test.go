@@ -0,0 +1,200 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// slackSignature signs the body with the secret like Slack does.
+func slackSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySlackRequest(t *testing.T) {
+	body := []byte(`{"type":"event_callback"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(10*time.Minute).Unix(), 10)
+
+	request := func(timestamp, signature string) *RequestContext {
+		header := http.Header{}
+		header.Set("X-Slack-Request-Timestamp", timestamp)
+		header.Set("X-Slack-Signature", signature)
+		return &RequestContext{Body: body, Header: header}
+	}
+
+	os.Unsetenv("slack_signing_secret")
+	if err := verifySlackRequest(request(now, slackSignature("", now, body))); err == nil {
+		t.Error("the request is accepted without the signing secret")
+	}
+
+	os.Setenv("slack_signing_secret", "secret")
+	defer os.Unsetenv("slack_signing_secret")
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		valid     bool
+	}{
+		{"valid", now, slackSignature("secret", now, body), true},
+		{"wrong secret", now, slackSignature("other", now, body), false},
+		{"unsigned", now, "", false},
+		{"stale", stale, slackSignature("secret", stale, body), false},
+		{"future", future, slackSignature("secret", future, body), false},
+		{"invalid timestamp", "now", slackSignature("secret", "now", body), false},
+	}
+	for _, tt := range tests {
+		if err := verifySlackRequest(request(tt.timestamp, tt.signature)); (err == nil) != tt.valid {
+			t.Errorf("%s: %v, expected valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestIsSlackFileURL(t *testing.T) {
+	tests := map[string]bool{
+		"https://files.slack.com/files-pri/T1-F1/image.png": true,
+		"http://files.slack.com/files-pri/T1-F1/image.png":  false,
+		"https://files.slack.com.example.com/image.png":     false,
+		"https://example.com/files.slack.com/image.png":     false,
+		"https://user@example.com/image.png":                false,
+		"https://files.slack.com:8443/image.png":            false,
+		"files.slack.com/image.png":                         false,
+	}
+	for link, want := range tests {
+		if got := isSlackFileURL(link); got != want {
+			t.Errorf("%s: %v, expected %v", link, got, want)
+		}
+	}
+}
+
+func TestVerifyDiscordRequestWithoutKey(t *testing.T) {
+	os.Unsetenv("discord_public_key")
+	header := http.Header{}
+	header.Set("X-Signature-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	header.Set("X-Signature-Ed25519", hex.EncodeToString(make([]byte, 64)))
+	if err := verifyDiscordRequest(&RequestContext{Body: []byte("{}"), Header: header}); err == nil {
+		t.Error("the request is accepted without the public key")
+	}
+}
+
+func TestHandleDiscordChannelID(t *testing.T) {
+	for _, id := range []string{"", "123/../../users/@me", "12?x=1", "１２３"} {
+		body := []byte(fmt.Sprintf(`{"id":"1","channel_id":%q,"attachments":[]}`, id))
+		if res := handleDiscord(&RequestContext{Body: body}); res == "ok" {
+			t.Errorf("%q: the channel id is accepted", id)
+		}
+	}
+	if res := handleDiscord(&RequestContext{Body: []byte(`{"id":"1","channel_id":"81384788765712384"}`)}); res != "ok" {
+		t.Errorf("the numeric channel id is rejected: %s", res)
+	}
+}
+
+func TestUploadSlackFile(t *testing.T) {
+	var (
+		uploaded []byte
+		complete map[string]interface{}
+	)
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files.getUploadURLExternal":
+			if r.Header.Get("Authorization") != "Bearer token" || r.FormValue("length") != "3" {
+				fmt.Fprint(w, `{"ok":false,"error":"invalid_arguments"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"ok":true,"upload_url":%q,"file_id":"F1"}`, srv.URL+"/upload")
+		case "/upload":
+			if r.Header.Get("Authorization") != "" {
+				t.Error("the bot token is sent to the upload URL")
+			}
+			f, _, err := r.FormFile("file")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			uploaded, _ = ioutil.ReadAll(f)
+		case "/files.completeUploadExternal":
+			json.NewDecoder(r.Body).Decode(&complete)
+			fmt.Fprint(w, `{"ok":true}`)
+		default:
+			fmt.Fprint(w, `{"ok":false,"error":"unknown_method"}`)
+		}
+	}))
+	defer srv.Close()
+
+	defer func(api string) { slackAPI = api }(slackAPI)
+	slackAPI = srv.URL
+
+	auth := map[string]string{"Authorization": "Bearer token"}
+	if err := uploadSlackFile(auth, "C1", "1.2", "cld-a.png", []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+	if string(uploaded) != "png" {
+		t.Errorf("uploaded %q, expected the file content", uploaded)
+	}
+	if complete["channel_id"] != "C1" || complete["thread_ts"] != "1.2" {
+		t.Errorf("the file is shared with %v", complete)
+	}
+	// The failed calls are reported with a successful status.
+	if err := uploadSlackFile(map[string]string{"Authorization": "Bearer other"}, "C1", "1.2", "cld-a.png", []byte("png")); err == nil {
+		t.Error("the failed call is not reported")
+	}
+}
+
+func TestVerifyTelegramRequest(t *testing.T) {
+	request := func(token string) *RequestContext {
+		header := http.Header{}
+		header.Set("X-Telegram-Bot-Api-Secret-Token", token)
+		return &RequestContext{Body: []byte("{}"), Header: header}
+	}
+
+	os.Unsetenv("telegram_webhook_secret")
+	if err := verifyTelegramRequest(request("")); err == nil {
+		t.Error("the update is accepted without the webhook secret")
+	}
+
+	os.Setenv("telegram_webhook_secret", "secret")
+	defer os.Unsetenv("telegram_webhook_secret")
+	if err := verifyTelegramRequest(request("secret")); err != nil {
+		t.Errorf("the update with the secret token is refused: %v", err)
+	}
+	for _, token := range []string{"", "secre", "secret2"} {
+		if err := verifyTelegramRequest(request(token)); err == nil {
+			t.Errorf("%q: the update is accepted", token)
+		}
+	}
+}
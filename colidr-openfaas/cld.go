@@ -23,6 +23,7 @@
 package function
 
 import (
+	"encoding/binary"
 	"fmt"
 	"image"
 	"math"
@@ -34,30 +35,72 @@ import (
 
 // Cld is the main entry struct for the Coherent Line Drawing operations.
 type Cld struct {
-	image  gocv.Mat
+	image gocv.Mat
+	// tone is a copy of the source image, which is altered by the fDoG iterations.
+	tone   gocv.Mat
 	result gocv.Mat
-	dog    gocv.Mat
-	fDog   gocv.Mat
-	etf    *Etf
-	wg     sync.WaitGroup
+	// dog and fDog are the DoG responses, which might be spilled to disk.
+	dog  matrix
+	fDog matrix
+	etf  *Etf
+	// ownsEtf is set when the edge tangent flow was computed by the constructor, so it's released on Close.
+	ownsEtf bool
+	// bands is the BGR source image of the low memory mode, processed band by band.
+	bands gocv.Mat
+	// color is the BGR source image, kept for the color styles.
+	color gocv.Mat
+	// alpha is the alpha mask of the source image, fading out the lines of the transparent regions.
+	alpha gocv.Mat
+	// arena holds the Go side buffers of the request, released on Close.
+	arena *arena
+	// sym holds the resolved mirror axes, when the symmetry is enforced.
+	sym *symmetry
+	wg  sync.WaitGroup
 	options
 }
 
 // Options struct contains all the options currently supported by Cld,
 // exposed by the main CLI application.
 type options struct {
-	sigmaR        float64
-	sigmaM        float64
-	sigmaC        float64
-	rho           float64
-	tau           float32
-	blurSize      int
-	etfKernel     int
-	etfIteration  int
-	fDogIteration int
-	antiAlias     bool
-	visEtf        bool
-	visResult     bool
+	sigmaR         float64
+	sigmaM         float64
+	sigmaC         float64
+	rho            float64
+	tau            float32
+	tauPercentile  float64
+	autoTau        bool
+	minFlowMag     float32
+	blurSize       int
+	combineBlur    int
+	etfKernel      int
+	relSizes       relativeSizes
+	normalize      bool
+	referenceSize  int
+	precision      precision
+	etfIteration   int
+	fDogIteration  int
+	maxSteps       int
+	flowBalance    float64
+	jitterAmp      float64
+	jitterFreq     float64
+	jitterStrokes  bool
+	seed           int64
+	linearRGB      bool
+	antiAlias      bool
+	strict         bool
+	blankThreshold float64
+	transforms     []transform
+	postFilters    []postFilter
+	maxStrokes     int
+	targetCoverage float64
+	symmetry       string
+	symmetryAxis   float64
+	bandRows       int
+	norm           *bandNorm
+	keepColor      bool
+	alphaMask      bool
+	visEtf         bool
+	visResult      bool
 }
 
 // position is a basic struct for vector type operations
@@ -75,19 +118,111 @@ func NewCLD(imgFile string, cldOpts options) (*Cld, error) {
 		return nil, fmt.Errorf("missing file name")
 	}
 
-	srcImage := gocv.IMRead(imgFile, gocv.IMReadGrayScale)
-	rows, cols := srcImage.Rows(), srcImage.Cols()
+	src := imRead(imgFile, gocv.IMReadColor)
+	defer closeMat(&src)
+	if src.Empty() {
+		return nil, fmt.Errorf("unable to decode the image")
+	}
+
+	return NewCLDFromMat(src, cldOpts)
+}
+
+// NewCLDFromBytes creates the CLD from the encoded source image, decoding it in memory.
+func NewCLDFromBytes(data []byte, cldOpts options) (*Cld, error) {
+	src, err := decodeMat(data)
+	if err != nil {
+		return nil, err
+	}
+	defer closeMat(&src)
+
+	return NewCLDFromMat(src, cldOpts)
+}
+
+// NewCLDFromMat creates the CLD from the BGR or grayscale source image matrix.
+// The source matrix is not retained, so it remains owned by the caller.
+func NewCLDFromMat(src gocv.Mat, cldOpts options) (*Cld, error) {
+	if src.Empty() {
+		return nil, fmt.Errorf("empty source image")
+	}
+	if len(cldOpts.transforms) > 0 {
+		transformed, err := applyTransforms(src, cldOpts.transforms)
+		if err != nil {
+			return nil, err
+		}
+		defer closeMat(&transformed)
+		src = transformed
+	}
+	cldOpts = cldOpts.resolveSizes(src.Cols(), src.Rows())
+
+	bgr, gray := newMat(), newMat()
+	defer closeMat(&bgr)
+	if src.Channels() == 1 {
+		src.CopyTo(gray)
+		gocv.CvtColor(src, bgr, gocv.ColorGrayToBGR)
+	} else {
+		src.CopyTo(bgr)
+		gocv.CvtColor(src, gray, gocv.ColorBGRToGray)
+	}
+
+	// Detect the blank images early, before spending time on computing the edge tangent flow.
+	if err := checkBlank(gray, cldOpts.blankThreshold); err != nil {
+		closeMat(&gray)
+		return nil, err
+	}
+
+	// Averaging the source with its mirrored copy makes the flow field symmetric as well.
+	var sym *symmetry
+	if cldOpts.symmetry != "" {
+		s := resolveSymmetry(cldOpts.symmetry, cldOpts.symmetryAxis, gray.ToBytes(), gray.Cols(), gray.Rows())
+		sym = &s
+		if s != noSymmetry {
+			mirrored, err := s.mirrorMat(bgr, true)
+			if err != nil {
+				closeMat(&gray)
+				return nil, err
+			}
+			closeMat(&bgr)
+			bgr = mirrored
+			gocv.CvtColor(bgr, gray, gocv.ColorBGRToGray)
+		}
+	}
+
+	if cldOpts.bandRows > 0 && gray.Rows() > cldOpts.bandRows {
+		cld := newBandedCLD(bgr, gray, cldOpts)
+		cld.sym = sym
+		return cld, nil
+	}
+
+	etf, err := newRefinedEtf(bgr, cldOpts)
+	if err != nil {
+		closeMat(&gray)
+		return nil, err
+	}
+	cld, err := newCLDWithEtf(gray, etf, cldOpts)
+	if err != nil {
+		closeMat(&gray)
+		etf.Close()
+		return nil, err
+	}
+	cld.ownsEtf = true
+	cld.sym = sym
+	if cldOpts.keepColor {
+		cld.color = cloneMat(bgr)
+	}
 
-	result := gocv.NewMatWithSize(rows, cols, gocv.MatTypeCV8UC1)
-	dog := gocv.NewMatWithSize(rows, cols, gocv.MatTypeCV32F)
-	fDog := gocv.NewMatWithSize(rows, cols, gocv.MatTypeCV32F)
+	return cld, nil
+}
 
-	var wg sync.WaitGroup
+// newRefinedEtf computes the edge tangent flow of the BGR image, refined by the requested number of iterations.
+func newRefinedEtf(src gocv.Mat, cldOpts options) (*Etf, error) {
+	rows, cols := src.Rows(), src.Cols()
 
 	etf := NewETF()
 	etf.Init(cols, rows)
+	etf.linearRGB = cldOpts.linearRGB
+	etf.norm = cldOpts.norm
 
-	err = etf.InitDefaultEtf(imgFile, image.Point{X: cols, Y: rows})
+	err := etf.InitEtfFromMat(src, image.Point{X: cols, Y: rows})
 	if err != nil {
 		return nil, fmt.Errorf("unable to initialize edge tangent flow: %s", err)
 	}
@@ -97,15 +232,105 @@ func NewCLD(imgFile string, cldOpts options) (*Cld, error) {
 			etf.RefineEtf(cldOpts.etfKernel)
 		}
 	}
+	return etf, nil
+}
+
+// newCLDWithEtf creates the CLD from an already computed edge tangent flow,
+// which makes possible to reuse it between the renders of the same image.
+func newCLDWithEtf(srcImage gocv.Mat, etf *Etf, cldOpts options) (*Cld, error) {
+	var err error
+	rows, cols := srcImage.Rows(), srcImage.Cols()
+
+	cldOpts.blurSize, err = validateBlurSize(cldOpts.blurSize, rows, cols, cldOpts.strict)
+	if err != nil {
+		return nil, err
+	}
+	// A zero combine blur size disables the smoothing applied between the fDoG iterations.
+	if cldOpts.combineBlur != 0 {
+		cldOpts.combineBlur, err = validateBlurSize(cldOpts.combineBlur, rows, cols, cldOpts.strict)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := newMatWithSize(rows, cols, gocv.MatTypeCV8UC1)
+	dog := newResponseMat(rows, cols)
+	fDog := newResponseMat(rows, cols)
 
 	return &Cld{
-		srcImage, result, dog, fDog, etf, wg, cldOpts,
+		image:   srcImage,
+		tone:    cloneMat(srcImage),
+		result:  result,
+		dog:     dog,
+		fDog:    fDog,
+		etf:     etf,
+		arena:   newArena(),
+		options: cldOpts,
 	}, nil
 }
 
+// Close releases the matrices allocated by the CLD. The edge tangent flow is only released
+// if it was computed by the constructor, since otherwise it might be shared between multiple renders.
+func (c *Cld) Close() {
+	closeMat(&c.image)
+	closeMat(&c.tone)
+	closeMat(&c.bands)
+	closeMat(&c.color)
+	closeMat(&c.alpha)
+	closeMat(&c.result)
+	closeMatrix(c.dog)
+	closeMatrix(c.fDog)
+	if c.ownsEtf {
+		c.etf.Close()
+	}
+	c.arena.release()
+}
+
 // GenerateCld is the entry method for generating the coherent line drawing output.
-// It triggers the generate method in iterative manner and returns the resulting byte array.
-func (c *Cld) GenerateCld() []byte {
+// It triggers the generate method in iterative manner and returns the resulting image
+// encoded with the provided encoder options.
+func (c *Cld) GenerateCld(enc EncodeOptions) ([]byte, error) {
+	if _, err := c.generateLines(); err != nil {
+		return nil, err
+	}
+	return c.Encode(enc)
+}
+
+// generateLines runs the generation iterations and the post processing,
+// returning the resulting grayscale byte array.
+func (c *Cld) generateLines() ([]byte, error) {
+	// In the low memory mode there is no edge tangent flow of the whole image.
+	if c.etf == nil {
+		if err := c.generateBands(); err != nil {
+			return nil, err
+		}
+	} else {
+		c.generateRaw()
+		c.pruneStrokes()
+	}
+	c.symmetrize()
+
+	pp := NewPostProcessingWithSeed(c.blurSize, c.seed)
+	// The vector output jitters the traced strokes instead.
+	if c.jitterAmp > 0 && !c.jitterStrokes {
+		if res, err := pp.Jitter(c.result, c.jitterAmp, c.jitterFreq); err == nil {
+			closeMat(&c.result)
+			c.result = res
+		}
+	}
+	if c.antiAlias {
+		pp.AntiAlias(c.result, c.result)
+	}
+	for _, f := range c.postFilters {
+		f.apply(&c.result)
+	}
+	c.maskAlpha()
+
+	return c.result.ToBytes(), nil
+}
+
+// generateRaw runs the generation iterations, without any post processing.
+func (c *Cld) generateRaw() {
 	c.generate()
 
 	if c.fDogIteration > 0 {
@@ -114,27 +339,52 @@ func (c *Cld) GenerateCld() []byte {
 			c.generate()
 		}
 	}
+}
 
-	pp := NewPostProcessing(c.blurSize)
-	if c.antiAlias {
-		pp.AntiAlias(c.result, c.result)
+// ResultMat returns the generated line drawing converted to the requested matrix type, so the
+// integrators embedding the package can avoid the extra conversions. The supported types are
+// gocv.MatTypeCV8UC1 (grayscale), gocv.MatTypeCV8UC3 (BGR color) and gocv.MatTypeCV16U
+// (16 bit grayscale). It must be called after GenerateCld, and the returned matrix
+// has to be closed by the caller.
+func (c *Cld) ResultMat(mt gocv.MatType) (gocv.Mat, error) {
+	rows, cols := c.result.Rows(), c.result.Cols()
+
+	switch mt {
+	case gocv.MatTypeCV8UC1:
+		return cloneMat(c.result), nil
+	case gocv.MatTypeCV8UC3:
+		dst := newMatWithSize(rows, cols, gocv.MatTypeCV8UC3)
+		gocv.CvtColor(c.result, dst, gocv.ColorGrayToBGR)
+		return dst, nil
+	case gocv.MatTypeCV16U:
+		dst := newMatWithSize(rows, cols, gocv.MatTypeCV16U)
+		// Scale the 8 bit values to the full 16 bit range (255 * 257 = 65535).
+		c.result.ConvertTo(&dst, gocv.MatTypeCV16U, 257)
+		return dst, nil
 	}
-
-	return c.result.ToBytes()
+	return gocv.Mat{}, fmt.Errorf("unsupported output matrix type: %d", mt)
 }
 
 // generate is a helper method which enclose all the requested operation for the CLD computation.
 func (c *Cld) generate() {
-	srcImg32FC1 := gocv.NewMatWithSize(c.image.Rows(), c.image.Cols(), gocv.MatTypeCV32F)
-	c.image.ConvertTo(&srcImg32FC1, gocv.MatTypeCV32F, 1.0/255.0)
+	srcImg32FC1 := newMatWithSize(c.image.Rows(), c.image.Cols(), gocv.MatTypeCV32F)
+	if c.linearRGB {
+		closeMat(&srcImg32FC1)
+		srcImg32FC1 = linearizeMat(c.image)
+	} else {
+		c.image.ConvertTo(&srcImg32FC1, gocv.MatTypeCV32F, 1.0/255.0)
+	}
 
-	c.gradientDoG(&srcImg32FC1, &c.dog, c.rho, c.sigmaC)
-	c.flowDoG(&c.dog, &c.fDog, c.sigmaM)
-	c.binaryThreshold(&c.fDog, &c.result, c.tau)
+	c.gradientDoG(&srcImg32FC1, c.dog, c.rho, c.sigmaC)
+	c.flowDoG(c.dog, c.fDog, c.sigmaM)
+	c.binaryThreshold(c.fDog, &c.result, c.threshold(c.fDog))
+	if c.norm != nil {
+		c.norm.generation++
+	}
 }
 
 // gradientDoG computes the gradient difference-of-Gaussians (DoG)
-func (c *Cld) gradientDoG(src, dst *gocv.Mat, rho, sigmaC float64) {
+func (c *Cld) gradientDoG(src, dst matrix, rho, sigmaC float64) {
 	var sigmaS = c.sigmaR * sigmaC
 	gvc := makeGaussianVector(sigmaC)
 	gvs := makeGaussianVector(sigmaS)
@@ -147,8 +397,8 @@ func (c *Cld) gradientDoG(src, dst *gocv.Mat, rho, sigmaC float64) {
 		for x := 0; x < width; x++ {
 			go func(y, x int) {
 				var (
-					gauCAcc, gauSAcc             float64
-					gauCWeightAcc, gauSWeightAcc float64
+					gauCAcc, gauSAcc             = accumulator{mode: c.precision}, accumulator{mode: c.precision}
+					gauCWeightAcc, gauSWeightAcc = accumulator{mode: c.precision}, accumulator{mode: c.precision}
 				)
 
 				c.etf.mu.Lock()
@@ -175,14 +425,14 @@ func (c *Cld) gradientDoG(src, dst *gocv.Mat, rho, sigmaC float64) {
 					}(gauIdx)
 
 					gauSWeight := gvs[gauIdx]
-					gauCAcc += float64(val) * gauCWeight
-					gauSAcc += float64(val) * gauSWeight
-					gauCWeightAcc += gauCWeight
-					gauSWeightAcc += gauSWeight
+					gauCAcc.add(float64(val) * gauCWeight)
+					gauSAcc.add(float64(val) * gauSWeight)
+					gauCWeightAcc.add(gauCWeight)
+					gauSWeightAcc.add(gauSWeight)
 				}
 
-				vc := gauCAcc / gauCWeightAcc
-				vs := gauSAcc / gauSWeightAcc
+				vc := gauCAcc.value() / gauCWeightAcc.value()
+				vs := gauSAcc.value() / gauSWeightAcc.value()
 
 				res := vc - rho*vs
 				dst.SetFloatAt(y, x, float32(res))
@@ -195,16 +445,23 @@ func (c *Cld) gradientDoG(src, dst *gocv.Mat, rho, sigmaC float64) {
 }
 
 // flowDoG computes the flow difference-of-Gaussians (DoG)
-func (c *Cld) flowDoG(src, dst *gocv.Mat, sigmaM float64) {
-	var (
-		gauAcc       float64
-		gauWeightAcc float64
-	)
-
+func (c *Cld) flowDoG(src, dst matrix, sigmaM float64) {
 	gausVec := makeGaussianVector(sigmaM)
 	width, height := src.Cols(), src.Rows()
 	kernelHalf := len(gausVec) - 1
 
+	// The integration length is derived from sigmaM, unless explicitly requested.
+	if c.maxSteps > 0 {
+		for i := len(gausVec); i <= c.maxSteps; i++ {
+			gausVec = append(gausVec, gauss(float64(i), 0.0, sigmaM))
+		}
+		kernelHalf = c.maxSteps
+	}
+
+	// Weight the integration along and against the flow by the requested balance.
+	fwdWeight := math.Min(1.0, 1.0+c.flowBalance)
+	bwdWeight := math.Min(1.0, 1.0-c.flowBalance)
+
 	c.wg.Add(width * height)
 
 	for y := 0; y < height; y++ {
@@ -213,8 +470,9 @@ func (c *Cld) flowDoG(src, dst *gocv.Mat, sigmaM float64) {
 				c.etf.mu.Lock()
 				defer c.etf.mu.Unlock()
 
-				gauAcc = -gausVec[0] * float64(src.GetFloatAt(y, x))
-				gauWeightAcc = -gausVec[0]
+				gauAcc, gauWeightAcc := accumulator{mode: c.precision}, accumulator{mode: c.precision}
+				gauAcc.add(-gausVec[0] * float64(src.GetFloatAt(y, x)))
+				gauWeightAcc.add(-gausVec[0])
 
 				// Integral alone ETF
 				pos := &position{x: float64(x), y: float64(y)}
@@ -232,10 +490,10 @@ func (c *Cld) flowDoG(src, dst *gocv.Mat, sigmaM float64) {
 					}
 
 					value := src.GetFloatAt(int(pos.y), int(pos.x))
-					weight := gausVec[step]
+					weight := gausVec[step] * fwdWeight
 
-					gauAcc += float64(value) * weight
-					gauWeightAcc += weight
+					gauAcc.add(float64(value) * weight)
+					gauWeightAcc.add(weight)
 
 					// move along ETF direction
 					pos.x += direction.x
@@ -263,10 +521,10 @@ func (c *Cld) flowDoG(src, dst *gocv.Mat, sigmaM float64) {
 					}
 
 					value := src.GetFloatAt(int(pos.y), int(pos.x))
-					weight := gausVec[step]
+					weight := gausVec[step] * bwdWeight
 
-					gauAcc += float64(value) * weight
-					gauWeightAcc += weight
+					gauAcc.add(float64(value) * weight)
+					gauWeightAcc.add(weight)
 
 					// move along ETF direction
 					pos.x += direction.x
@@ -281,6 +539,11 @@ func (c *Cld) flowDoG(src, dst *gocv.Mat, sigmaM float64) {
 				newVal := func(gauAcc, gauWeightAcc float64) float64 {
 					var res float64
 
+					// With a one sided balance the streamline of the border and the single pixel
+					// images may leave the image at once, leaving only the center pixel.
+					if gauWeightAcc == 0 {
+						gauAcc, gauWeightAcc = float64(src.GetFloatAt(y, x)), 1
+					}
 					if gauAcc/gauWeightAcc > 0 {
 						res = 1.0
 					} else {
@@ -290,19 +553,23 @@ func (c *Cld) flowDoG(src, dst *gocv.Mat, sigmaM float64) {
 				}
 
 				// Update pixel value in the destination matrix.
-				dst.SetFloatAt(y, x, float32(newVal(gauAcc, gauWeightAcc)))
+				dst.SetFloatAt(y, x, float32(newVal(gauAcc.value(), gauWeightAcc.value())))
 
 				c.wg.Done()
 			}(y, x)
 		}
 	}
-	gocv.Normalize(*dst, dst, 0.0, 1.0, gocv.NormMinMax)
-
 	c.wg.Wait()
+
+	if c.norm != nil {
+		c.norm.normalizeResponse(dst)
+		return
+	}
+	c.imageOps().Normalize(dst, dst, 0.0, 1.0)
 }
 
 // binaryThreshold threshold an image as black and white.
-func (c *Cld) binaryThreshold(src, dst *gocv.Mat, tau float32) []byte {
+func (c *Cld) binaryThreshold(src, dst matrix, tau float32) {
 	width, height := dst.Cols(), dst.Rows()
 	c.wg.Add(width * height)
 
@@ -319,6 +586,11 @@ func (c *Cld) binaryThreshold(src, dst *gocv.Mat, tau float32) []byte {
 					}
 					return 255
 				}(h)
+
+				// Suppress the lines in the flat regions where the flow is too weak.
+				if c.minFlowMag > 0 && c.etf.magnitudeAt(y, x) < c.minFlowMag {
+					v = 255
+				}
 				dst.SetUCharAt(y, x, v)
 
 				c.wg.Done()
@@ -326,8 +598,6 @@ func (c *Cld) binaryThreshold(src, dst *gocv.Mat, tau float32) []byte {
 		}
 	}
 	c.wg.Wait()
-
-	return dst.ToBytes()
 }
 
 func (c *Cld) combineImage() {
@@ -347,9 +617,44 @@ func (c *Cld) combineImage() {
 		}
 	}
 
-	// Apply a gaussian blur to let it more smooth
-	gocv.GaussianBlur(c.image, &c.image, image.Point{c.blurSize, c.blurSize}, 0.0, 0.0, gocv.BorderConstant)
 	c.wg.Wait()
+
+	// Apply a gaussian blur to let it more smooth
+	if c.combineBlur > 0 {
+		c.imageOps().GaussianBlur(&c.image, &c.image, c.combineBlur)
+	}
+}
+
+// validateBlurSize checks the Gaussian blur kernel size, which has to be a positive odd number
+// not exceeding the image size. Invalid values are coerced to the nearest valid size,
+// or rejected in strict mode.
+func validateBlurSize(size, rows, cols int, strict bool) (int, error) {
+	maxSize := rows
+	if cols < maxSize {
+		maxSize = cols
+	}
+	if maxSize%2 == 0 {
+		maxSize--
+	}
+	if maxSize < 1 {
+		maxSize = 1
+	}
+
+	valid := size
+	if valid < 1 {
+		valid = 1
+	}
+	if valid%2 == 0 {
+		valid++
+	}
+	if valid > maxSize {
+		valid = maxSize
+	}
+
+	if valid != size && strict {
+		return 0, fmt.Errorf("invalid blur size %d: must be a positive odd number not greater than %d", size, maxSize)
+	}
+	return valid, nil
 }
 
 // gauss computes gaussian function of variance
@@ -357,13 +662,18 @@ func gauss(x, mean, sigma float64) float64 {
 	return math.Exp((-(x-mean)*(x-mean))/(2*sigma*sigma)) / math.Sqrt(math.Pi*2.0*sigma*sigma)
 }
 
-// makeGaussianVector constructs a gaussian vector field of floats
+// makeGaussianVector constructs a gaussian vector field of floats. It holds the weights of the
+// non-negative half of the symmetric kernel, decreasing from the center sample.
 func makeGaussianVector(sigma float64) []float64 {
 	var (
 		gau       []float64
 		threshold = 0.001
 		i         int
 	)
+	// A degenerate sigma would never fall below the threshold, so it's reduced to the identity kernel.
+	if !(sigma > 0) || math.IsInf(sigma, 0) {
+		return []float64{1.0}
+	}
 
 	for {
 		i++
@@ -392,6 +702,20 @@ func absInt(x int) int {
 	return x
 }
 
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 // round returns the nearest integer, rounding ties away from zero.
 func round(x float64) float64 {
 	t := math.Trunc(x)
@@ -400,3 +724,30 @@ func round(x float64) float64 {
 	}
 	return t
 }
+
+// linearizeMat converts the sRGB encoded 8 bit matrix into a floating point matrix
+// holding the linear light values in the [0, 1] range, with the same number of channels.
+func linearizeMat(src gocv.Mat) gocv.Mat {
+	var lut [256]float32
+	for i := range lut {
+		lut[i] = float32(srgbDecode(float64(i) / 255))
+	}
+
+	data := src.ToBytes()
+	// The matrix data is stored in the native byte order of the platform, which is little endian.
+	buf := make([]byte, 4*len(data))
+	for i, v := range data {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(lut[v]))
+	}
+
+	mt := gocv.MatType(gocv.MatTypeCV32F)
+	if src.Channels() == 3 {
+		mt += gocv.MatChannels3
+	}
+	dst, err := newMatFromBytes(src.Rows(), src.Cols(), mt, buf)
+	if err != nil {
+		dst = newMatWithSize(src.Rows(), src.Cols(), mt)
+		src.ConvertTo(&dst, mt, 1.0/255.0)
+	}
+	return dst
+}
@@ -0,0 +1,325 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/rand"
+	"net/url"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"gocv.io/x/gocv"
+	"handler/function/synth"
+)
+
+// sigmaValue generates the sigmas of the property tests, in the range of the practical kernels.
+func sigmaValue(values []reflect.Value, r *rand.Rand) {
+	values[0] = reflect.ValueOf(0.3 + r.Float64()*10)
+}
+
+func TestGaussianVectorDegenerateSigma(t *testing.T) {
+	for _, sigma := range []float64{0, -1, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if gau := makeGaussianVector(sigma); len(gau) != 1 || gau[0] != 1 {
+			t.Errorf("sigma %v: kernel %v, expected the identity kernel", sigma, gau)
+		}
+	}
+}
+
+func TestGaussianVectorShape(t *testing.T) {
+	shape := func(sigma float64) bool {
+		gau := makeGaussianVector(sigma)
+		// The full kernel mirrors the half one around the center sample, so its size is odd.
+		if size := 2*len(gau) - 1; size%2 != 1 || len(gau) < 2 {
+			return false
+		}
+		for j := range gau {
+			if gau[j] != gauss(float64(-j), 0, sigma) {
+				return false
+			}
+			if j > 0 && gau[j] >= gau[j-1] {
+				return false
+			}
+		}
+		// Only the last weight falls below the threshold.
+		return gau[len(gau)-1] < 0.001 && (len(gau) == 2 || gau[len(gau)-2] >= 0.001)
+	}
+	if err := quick.Check(shape, &quick.Config{Values: sigmaValue}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGaussianVectorNormalization(t *testing.T) {
+	// Up to this sigma the truncated tails of the kernel are negligible.
+	for _, sigma := range []float64{1, 2, 3, 5} {
+		gau := makeGaussianVector(sigma)
+		sum := gau[0]
+		for _, w := range gau[1:] {
+			sum += 2 * w
+		}
+		if math.Abs(sum-1) > 0.01 {
+			t.Errorf("sigma %v: the kernel weights sum to %v", sigma, sum)
+		}
+	}
+}
+
+// kernelMean returns the weighted mean of the samples f(step) along the kernel, like the gradient
+// DoG accumulates them: the kernel spans the reach of the surround Gaussian, the center Gaussian
+// being zero beyond its own reach.
+func kernelMean(gau []float64, reach int, f func(step int) float64) float64 {
+	var acc, weights float64
+	for step := -reach; step <= reach; step++ {
+		if idx := absInt(step); idx < len(gau) {
+			acc += gau[idx] * f(step)
+			weights += gau[idx]
+		}
+	}
+	return acc / weights
+}
+
+func TestDoGLinearity(t *testing.T) {
+	// The symmetric kernels reproduce the linear gradients, so the DoG response of a ramp is zero.
+	linear := func(sigmaC, offset, slope float64) bool {
+		gvc, gvs := makeGaussianVector(sigmaC), makeGaussianVector(1.6*sigmaC)
+		ramp := func(step int) float64 { return offset + slope*float64(step) }
+
+		reach := len(gvs) - 1
+		center, surround := kernelMean(gvc, reach, ramp), kernelMean(gvs, reach, ramp)
+		return math.Abs(center-offset) < 1e-9 && math.Abs(center-surround) < 1e-9
+	}
+	// The ramps span the range of the normalized intensities.
+	values := func(values []reflect.Value, r *rand.Rand) {
+		sigmaValue(values, r)
+		values[1] = reflect.ValueOf(r.Float64())
+		values[2] = reflect.ValueOf(r.Float64()*0.2 - 0.1)
+	}
+	if err := quick.Check(linear, &quick.Config{Values: values}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRound(t *testing.T) {
+	// The ties are rounded away from zero.
+	for x, want := range map[float64]float64{
+		0.5: 1, -0.5: -1, 1.5: 2, 2.5: 3, -2.5: -3, 0.49999: 0, -0.49999: 0, 3: 3, 0: 0,
+	} {
+		if got := round(x); got != want {
+			t.Errorf("round(%v) = %v, expected %v", x, got, want)
+		}
+	}
+	if err := quick.CheckEqual(round, math.Round, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateBlurSize(t *testing.T) {
+	tests := []struct {
+		size, rows, cols int
+		want             int
+	}{
+		{5, 100, 100, 5},
+		{4, 100, 100, 5},
+		{0, 100, 100, 1},
+		{-3, 100, 100, 1},
+		{9, 6, 100, 5},
+		{9, 100, 7, 7},
+		{6, 4, 4, 3},
+		{3, 1, 1, 1},
+	}
+	for _, tt := range tests {
+		got, err := validateBlurSize(tt.size, tt.rows, tt.cols, false)
+		if err != nil || got != tt.want {
+			t.Errorf("blur size %d of %dx%d: %d (%v), expected %d", tt.size, tt.cols, tt.rows, got, err, tt.want)
+		}
+		// The strict mode only accepts the sizes which are valid already.
+		_, err = validateBlurSize(tt.size, tt.rows, tt.cols, true)
+		if (err == nil) != (tt.size == tt.want) {
+			t.Errorf("blur size %d of %dx%d: strict mode error %v", tt.size, tt.cols, tt.rows, err)
+		}
+	}
+}
+
+// forTinySizes runs fn as a subtest for every image size from 1x1 through 16x16.
+func forTinySizes(t *testing.T, fn func(t *testing.T, rows, cols int)) {
+	for rows := 1; rows <= 16; rows++ {
+		for cols := 1; cols <= 16; cols++ {
+			rows, cols := rows, cols
+			t.Run(fmt.Sprintf("%dx%d", cols, rows), func(t *testing.T) { fn(t, rows, cols) })
+		}
+	}
+}
+
+// tinyPattern returns the pixels of a synthetic checkerboard of 2 pixel cells, with the channels of each pixel.
+func tinyPattern(rows, cols, channels int) []byte {
+	return grayPixels(synth.Checkerboard{Size: 2, Fg: 40, Bg: 210}.Render(cols, rows), channels)
+}
+
+// grayPixels returns the pixels of the grayscale image, repeating the value in the channels of each pixel.
+func grayPixels(img *image.Gray, channels int) []byte {
+	data := make([]byte, 0, len(img.Pix)*channels)
+	for _, v := range img.Pix {
+		for ch := 0; ch < channels; ch++ {
+			data = append(data, v)
+		}
+	}
+	return data
+}
+
+func TestGenerateTinyImages(t *testing.T) {
+	rp, err := parseParams(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forTinySizes(t, func(t *testing.T, rows, cols int) {
+		src, err := newMatFromBytes(rows, cols, gocv.MatTypeCV8UC3, tinyPattern(rows, cols, 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeMat(&src)
+
+		opts := rp.opts
+		// The blank detection would reject the single pixel images, which have no contrast.
+		opts.blankThreshold = 0
+		cld, err := NewCLDFromMat(src, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cld.Close()
+		data, err := cld.generateLines()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != rows*cols {
+			t.Errorf("%d pixels generated, expected %d", len(data), rows*cols)
+		}
+	})
+}
+
+func TestSinglePixelImageIsBlank(t *testing.T) {
+	rp, err := parseParams(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := newMatFromBytes(1, 1, gocv.MatTypeCV8UC3, tinyPattern(1, 1, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeMat(&src)
+	if _, err := NewCLDFromMat(src, rp.opts); ErrorCode(err) != "blank_image" {
+		t.Errorf("the single pixel image is not reported as blank: %v", err)
+	}
+}
+
+func TestThresholdTinyResponses(t *testing.T) {
+	forTinySizes(t, func(t *testing.T, rows, cols int) {
+		m := newDenseMat(rows, cols, gocv.MatTypeCV32F)
+		for i, v := range tinyPattern(rows, cols, 1) {
+			m.data[i] = float32(v) / 255
+		}
+		if tau := otsuThreshold(m); !(tau >= 0 && tau <= 1) {
+			t.Errorf("Otsu threshold %v out of the [0, 1] range", tau)
+		}
+		if tau := responsePercentile(newArena(), m, 15); tau != float32(40)/255 && tau != float32(210)/255 {
+			t.Errorf("percentile %v is not one of the response values", tau)
+		}
+	})
+}
+
+func TestLinearizeMat(t *testing.T) {
+	data := make([]byte, 3*256)
+	for i := range data {
+		data[i] = byte(i / 3)
+	}
+	src, err := newMatFromBytes(1, 256, gocv.MatTypeCV8UC3, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeMat(&src)
+
+	dst := linearizeMat(src)
+	defer closeMat(&dst)
+	if dst.Channels() != 3 || dst.Rows() != 1 || dst.Cols() != 256 {
+		t.Fatalf("%dx%d matrix of %d channels, expected 256x1 of 3 channels", dst.Cols(), dst.Rows(), dst.Channels())
+	}
+	for x := 0; x < 256; x++ {
+		want := float32(srgbDecode(float64(x) / 255))
+		for ch, v := range dst.GetVecfAt(0, x) {
+			if v != want {
+				t.Fatalf("value %d, channel %d: %v, expected %v", x, ch, v, want)
+			}
+		}
+	}
+}
+
+func TestLinesFollowEdges(t *testing.T) {
+	const size = 96
+	rp, err := parseParams(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns := map[string]synth.Pattern{
+		"circle":       synth.Circle{CX: size / 2, CY: size / 2, Radius: size / 3, Fg: 32, Bg: 224},
+		"grating":      synth.Grating{Period: 24, Angle: 0.5, Fg: 32, Bg: 224},
+		"checkerboard": synth.Checkerboard{Size: 24, Fg: 32, Bg: 224},
+	}
+	for name, pattern := range patterns {
+		pattern := pattern
+		t.Run(name, func(t *testing.T) {
+			src, err := newMatFromBytes(size, size, gocv.MatTypeCV8UC3, grayPixels(pattern.Render(size, size), 3))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeMat(&src)
+			cld, err := NewCLDFromMat(src, rp.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cld.Close()
+			data, err := cld.generateLines()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The lines are drawn along the analytic edges, within the reach of the DoG kernels.
+			var lines, stray int
+			for i, v := range data {
+				if v >= 128 {
+					continue
+				}
+				lines++
+				if pattern.EdgeDistance(float64(i%size)+0.5, float64(i/size)+0.5) > 4 {
+					stray++
+				}
+			}
+			if lines == 0 {
+				t.Fatal("no lines drawn")
+			}
+			if float64(stray) > 0.05*float64(lines) {
+				t.Errorf("%d of the %d line pixels are off the edges", stray, lines)
+			}
+		})
+	}
+}
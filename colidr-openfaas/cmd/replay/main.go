@@ -0,0 +1,171 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Command replay re-executes the requests captured in the audit log of the function against
+// the local build, and diffs the outputs against the recorded hashes. It's meant for validating
+// the upgrades of OpenCV and gocv, which may subtly change the filtering results:
+//
+//	go run ./cmd/replay -out /tmp/diffs /var/audit/audit.jsonl
+//
+// A single saved request blob can be replayed as well, with its parameters and output hash:
+//
+//	go run ./cmd/replay -blob photo.jpg -params "tau=0.98&seed=1" -hash 3f5a...
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"handler/function"
+)
+
+// result counts the outcomes of the replayed requests.
+type result struct {
+	matched, changed, failed, skipped int
+}
+
+func main() {
+	var (
+		blobs  = flag.String("blobs", "", "the directory of the input blobs, by default next to the audit log")
+		out    = flag.String("out", "", "the directory the changed outputs are written to")
+		blob   = flag.String("blob", "", "a saved request blob, replayed instead of the audit log")
+		params = flag.String("params", "", "the query string of the saved request blob")
+		output = flag.String("output", "image", "the output mode of the saved request blob")
+		hash   = flag.String("hash", "", "the SHA-256 hash of the expected output of the saved request blob")
+	)
+	flag.Parse()
+
+	var res result
+	if *blob != "" {
+		input, err := ioutil.ReadFile(*blob)
+		if err != nil {
+			fatal(err)
+		}
+		rec := function.AuditRecord{Params: *params, Output: *output, Status: http.StatusOK, OutputHash: *hash}
+		res.replay(rec, input, *out)
+	} else {
+		if flag.NArg() == 0 {
+			fmt.Fprintln(os.Stderr, "usage: replay [flags] audit.jsonl...")
+			flag.PrintDefaults()
+			os.Exit(2)
+		}
+		for _, path := range flag.Args() {
+			dir := *blobs
+			if dir == "" {
+				dir = filepath.Join(filepath.Dir(path), "blobs")
+			}
+			if err := res.replayLog(path, dir, *out); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	fmt.Printf("%d matched, %d changed, %d failed, %d skipped\n", res.matched, res.changed, res.failed, res.skipped)
+	if res.changed > 0 || res.failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// fatal reports the error and exits with the exit code of its kind.
+func fatal(err error) {
+	log.Print(err)
+	os.Exit(function.KindOf(err).ExitCode())
+}
+
+// replayLog replays the records of the audit log, reading the inputs from the blobs directory.
+func (res *result) replayLog(path, blobs, out string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var rec function.AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("%s:%d: invalid audit record: %v", path, line, err)
+		}
+		input, err := ioutil.ReadFile(filepath.Join(blobs, rec.InputHash))
+		if err != nil {
+			res.skipped++
+			fmt.Printf("SKIP %s:%d: %v\n", path, line, err)
+			continue
+		}
+		res.replay(rec, input, out)
+	}
+	return scanner.Err()
+}
+
+// replay replays the record and compares the status and the output hash with the recorded ones.
+// The error responses are compared by their status only, since their messages may be localized,
+// as are the downgraded oversized outputs.
+func (res *result) replay(rec function.AuditRecord, input []byte, out string) {
+	status, body := rec.Replay(input)
+	hash := fmt.Sprintf("%x", sha256.Sum256(body))
+	name := rec.InputHash
+	if name == "" {
+		name = fmt.Sprintf("%x", sha256.Sum256(input))
+	}
+	name = name[:12] + " " + rec.Params
+
+	switch {
+	case status != rec.Status:
+		res.failed++
+		fmt.Printf("FAIL %s: status %d, recorded %d: %.200s\n", name, status, rec.Status, body)
+	case status != http.StatusOK || rec.OutputHash == "" || rec.Downgrade != "" || hash == rec.OutputHash:
+		res.matched++
+		fmt.Printf("ok   %s\n", name)
+	default:
+		res.changed++
+		fmt.Printf("DIFF %s: output %s, recorded %s\n", name, hash[:12], rec.OutputHash[:minInt(12, len(rec.OutputHash))])
+		if out != "" {
+			if err := writeOutput(out, hash, body); err != nil {
+				log.Printf("unable to write the output: %v", err)
+			}
+		}
+	}
+}
+
+// writeOutput writes the changed output into the directory, named by its hash.
+func writeOutput(dir, hash string, body []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, hash), body, 0644)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,184 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// RequestContext holds everything the handlers need from a request. It's parsed once, either from
+// the environment variables set by the classic watchdog or from an HTTP request, then passed through
+// the middlewares and the handlers, so they don't have to read the environment on their own.
+type RequestContext struct {
+	Method string
+	Body   []byte
+	Header http.Header
+	Query  url.Values
+	// Remote is the address of the client.
+	Remote string
+	// InputMode is the input mode of the function (e.g. url, slack or telegram).
+	InputMode string
+	// OutputMode is the output mode (image, json_image or ascii). The output_mode environment
+	// variable overrides the output query parameter.
+	OutputMode string
+	// Params are the processing parameters, taken from the query string,
+	// or from the image URL in url input mode.
+	Params url.Values
+
+	params *requestParams
+}
+
+// newRequestContext creates the context of the request, applying the environment overrides.
+func newRequestContext(method string, body []byte, header http.Header, query url.Values, remote string) *RequestContext {
+	if query == nil {
+		query = make(url.Values)
+	}
+	ctx := &RequestContext{
+		Method:     method,
+		Body:       body,
+		Header:     header,
+		Query:      query,
+		Remote:     remote,
+		InputMode:  os.Getenv("input_mode"),
+		OutputMode: query.Get("output"),
+		Params:     query,
+	}
+	if val, exists := os.LookupEnv("output_mode"); exists {
+		ctx.OutputMode = val
+	}
+	return ctx
+}
+
+// requestFromEnv builds the request context from the environment variables set by the classic
+// watchdog, which exposes the request headers as Http_ prefixed variables.
+func requestFromEnv(body []byte) *RequestContext {
+	header := make(http.Header)
+	for _, env := range os.Environ() {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "Http_") {
+			continue
+		}
+		switch name := strings.TrimPrefix(kv[0], "Http_"); name {
+		case "Method", "Query", "Path":
+		default:
+			header.Set(strings.Replace(name, "_", "-", -1), kv[1])
+		}
+	}
+	query, _ := url.ParseQuery(os.Getenv("Http_Query"))
+
+	return newRequestContext(os.Getenv("Http_Method"), body, header, query, clientAddr(header, ""))
+}
+
+// requestFromHTTP builds the request context from the HTTP request, reading its body up to the upload limit.
+func requestFromHTTP(r *http.Request) (*RequestContext, error) {
+	body, err := readLimited(r.Body, maxUploadSize())
+	if err != nil {
+		return nil, err
+	}
+	return newRequestContext(r.Method, body, r.Header, r.URL.Query(), clientAddr(r.Header, r.RemoteAddr)), nil
+}
+
+// resolve parses the processing parameters, once for the whole request.
+func (ctx *RequestContext) resolve() (*requestParams, error) {
+	if ctx.params == nil {
+		// The recipe can also be submitted as JSON in the X-Recipe header.
+		if js := ctx.Header.Get("X-Recipe"); js != "" && ctx.Params.Get("recipe_json") == "" {
+			ctx.Params.Set("recipe_json", js)
+		}
+		rp, err := parseParams(ctx.Params)
+		if err != nil {
+			return nil, err
+		}
+		ctx.params = rp
+	}
+	return ctx.params, nil
+}
+
+// trustedProxies returns the networks of the proxies in front of the function, like the gateway,
+// configured through the trusted_proxies environment variable as a comma separated list of
+// addresses and CIDR ranges.
+func trustedProxies() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, p := range strings.Split(os.Getenv("trusted_proxies"), ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// trusted reports whether the address belongs to one of the networks.
+func trusted(addr string, nets []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client. The X-Forwarded-For header is set by the clients,
+// so it's only used when the request comes through a trusted proxy, taking its right-most address
+// not belonging to the trusted proxies. The classic watchdog doesn't expose the address of the peer,
+// which is the gateway, so there the forwarded addresses are used once the proxies are configured.
+func clientAddr(header http.Header, remoteAddr string) string {
+	addr := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		addr = host
+	}
+	proxies := trustedProxies()
+	if len(proxies) == 0 || (addr != "" && !trusted(addr, proxies)) {
+		return addr
+	}
+	hops := strings.Split(header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !trusted(hop, proxies) {
+			return hop
+		}
+		addr = hop
+	}
+	return addr
+}
@@ -0,0 +1,105 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// The cgroup files holding the CPU limits of the container, for the v2 and v1 hierarchies.
+const (
+	cgroupV2CPUMax    = "/sys/fs/cgroup/cpu.max"
+	cgroupV1CPUQuota  = "/sys/fs/cgroup/cpu/cpu.cfs_quota_us"
+	cgroupV1CPUPeriod = "/sys/fs/cgroup/cpu/cpu.cfs_period_us"
+)
+
+func init() {
+	runtime.GOMAXPROCS(maxProcs())
+}
+
+// maxProcs returns the number of threads executing the per pixel kernels simultaneously. Go sizes
+// GOMAXPROCS after the number of host CPUs, while the function pods are usually limited by
+// a CPU quota, so all the threads get throttled together once the quota is used up. The value
+// is derived from the quota, unless it is set explicitly through the max_procs (or GOMAXPROCS)
+// environment variable.
+func maxProcs() int {
+	if val, exists := os.LookupEnv("max_procs"); exists {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			return n
+		}
+	}
+	if _, exists := os.LookupEnv("GOMAXPROCS"); exists {
+		return runtime.GOMAXPROCS(0)
+	}
+	procs := runtime.NumCPU()
+	if quota, ok := cpuQuota(); ok {
+		if n := int(math.Ceil(quota)); n < procs {
+			procs = n
+		}
+	}
+	if procs < 1 {
+		procs = 1
+	}
+	return procs
+}
+
+// cpuQuota returns the number of CPUs the container is allowed to use, as configured
+// by the CPU limit of the pod. It reports false if the container is not limited.
+func cpuQuota() (float64, bool) {
+	if data, err := ioutil.ReadFile(cgroupV2CPUMax); err == nil {
+		// The file holds the quota and the period, like "150000 100000" or "max 100000".
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		return quotaRatio(fields[0], fields[1])
+	}
+
+	quota, err := ioutil.ReadFile(cgroupV1CPUQuota)
+	if err != nil {
+		return 0, false
+	}
+	period, err := ioutil.ReadFile(cgroupV1CPUPeriod)
+	if err != nil {
+		return 0, false
+	}
+	return quotaRatio(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+// quotaRatio divides the CPU quota by its period, the negative quota meaning no limit.
+func quotaRatio(quota, period string) (float64, bool) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
@@ -0,0 +1,373 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"gocv.io/x/gocv"
+)
+
+// defaultMaxPixels is the default limit of the image size, around 64 megapixels.
+const defaultMaxPixels = 1 << 26
+
+// Decoder decodes an input format into a normalized BGR matrix.
+type Decoder interface {
+	// Sniff reports whether the data looks like an image of the decoder's format.
+	Sniff(data []byte) bool
+	// Decode decodes the image into a BGR matrix, which has to be closed by the caller.
+	Decode(data []byte) (gocv.Mat, error)
+}
+
+// ConfigDecoder is implemented by the decoders reading the image dimensions from the header, which
+// are validated before decoding. The images of the registered formats not implementing it must be
+// readable by image.DecodeConfig, otherwise they are rejected.
+type ConfigDecoder interface {
+	DecodeConfig(data []byte) (image.Config, error)
+}
+
+// namedDecoder is a registered decoder.
+type namedDecoder struct {
+	format string
+	Decoder
+}
+
+// decoders is the registry of the input formats, in the order of the content sniffing.
+var decoders []namedDecoder
+
+// RegisterDecoder registers the decoder of an input format, replacing the existing one.
+// The new formats are sniffed after the already registered ones.
+func RegisterDecoder(format string, dec Decoder) {
+	for i, d := range decoders {
+		if d.format == format {
+			decoders[i].Decoder = dec
+			return
+		}
+	}
+	decoders = append(decoders, namedDecoder{format: format, Decoder: dec})
+}
+
+// lookupDecoder returns the decoder registered for the format, or nil.
+func lookupDecoder(format string) Decoder {
+	for _, d := range decoders {
+		if d.format == format {
+			return d.Decoder
+		}
+	}
+	return nil
+}
+
+// decoderFunc adapts the sniffing and the decoding functions to the Decoder interface.
+type decoderFunc struct {
+	sniff  func(data []byte) bool
+	decode func(data []byte) (gocv.Mat, error)
+}
+
+func (d decoderFunc) Sniff(data []byte) bool { return d.sniff(data) }
+
+func (d decoderFunc) Decode(data []byte) (gocv.Mat, error) { return d.decode(data) }
+
+// hasPrefix returns a sniffing function matching any of the magic numbers.
+func hasPrefix(magic ...string) func([]byte) bool {
+	return func(data []byte) bool {
+		for _, m := range magic {
+			if bytes.HasPrefix(data, []byte(m)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func init() {
+	// The formats supported by the standard library (and the registered ones) are decoded in memory.
+	RegisterDecoder("jpeg", decoderFunc{hasPrefix("\xff\xd8\xff"), decodeStd})
+	RegisterDecoder("png", decoderFunc{hasPrefix("\x89PNG\r\n\x1a\n"), decodeStd})
+	RegisterDecoder("gif", decoderFunc{hasPrefix("GIF87a", "GIF89a"), decodeStd})
+	RegisterDecoder("netpbm", decoderFunc{hasPrefix("P1", "P2", "P3", "P4", "P5", "P6"), decodeStd})
+
+	// The rest of the formats are decoded by OpenCV, which can only read from files.
+	RegisterDecoder("webp", decoderFunc{func(data []byte) bool {
+		return len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+	}, readMat})
+	RegisterDecoder("bmp", decoderFunc{hasPrefix("BM"), readMat})
+	RegisterDecoder("tiff", decoderFunc{hasPrefix("II*\x00", "MM\x00*"), readMat})
+}
+
+// inputFormat returns the name of the registered decoder matching the data,
+// or an empty string if none of them recognizes it.
+func inputFormat(data []byte) string {
+	for _, d := range decoders {
+		if d.Sniff(data) {
+			return d.format
+		}
+	}
+	return ""
+}
+
+// inputFormats returns the names of the registered decoders.
+func inputFormats() []string {
+	formats := make([]string, len(decoders))
+	for i, d := range decoders {
+		formats[i] = d.format
+	}
+	return formats
+}
+
+// decodeMat sniffs the format of the image and decodes it into a BGR matrix with the matching
+// decoder. It's the entry point of decoding the untrusted inputs into matrices, so the header is
+// inspected first, rejecting the unknown formats and the images exceeding the limits.
+func decodeMat(data []byte) (mat gocv.Mat, err error) {
+	// This only recovers the panics of the Go decoders. The aborts of the native OpenCV code can't
+	// be recovered and take down the function, which is why the headers are validated beforehand.
+	defer func() {
+		if r := recover(); r != nil {
+			mat, err = gocv.Mat{}, newError(ErrInvalidInput, "malformed image: %v", r)
+		}
+	}()
+	if err := inspectInput(data); err != nil {
+		return gocv.Mat{}, err
+	}
+	return lookupDecoder(inputFormat(data)).Decode(data)
+}
+
+// decodeImage decodes the untrusted input with the image package, inspecting its header first
+// like decodeMat does.
+func decodeImage(data []byte) (image.Image, string, error) {
+	if err := inspectInput(data); err != nil {
+		return nil, "", err
+	}
+	return image.Decode(bytes.NewReader(data))
+}
+
+// maxPixels returns the maximum number of pixels of the accepted images.
+func maxPixels() int {
+	if val, exists := os.LookupEnv("max_pixels"); exists {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultMaxPixels
+}
+
+// checkConfig validates the image dimensions against the configured limit.
+func checkConfig(cfg image.Config) error {
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return newError(ErrInvalidInput, "invalid image dimensions: %dx%d", cfg.Width, cfg.Height)
+	}
+	if limit := maxPixels(); cfg.Width > limit/cfg.Height {
+		return &imageSizeError{width: cfg.Width, height: cfg.Height, limit: limit}
+	}
+	return nil
+}
+
+// imageSizeError is returned for the images exceeding the pixel limit.
+type imageSizeError struct {
+	width, height, limit int
+}
+
+func (e *imageSizeError) Error() string {
+	return fmt.Sprintf("image too large: %dx%d exceeds the limit of %d pixels", e.width, e.height, e.limit)
+}
+
+// decodeStd decodes the image in memory through the standard image package.
+func decodeStd(data []byte) (gocv.Mat, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return gocv.Mat{}, newError(ErrInvalidInput, "unable to decode the image: %v", err)
+	}
+	// OpenCV applies the EXIF orientation on reading, so keep the same behavior.
+	if o := jpegOrientation(data); o > 1 {
+		img = orient(img, o)
+	}
+	return matFromImage(img)
+}
+
+// readMat decodes the image using OpenCV, through a temporary file.
+func readMat(data []byte) (gocv.Mat, error) {
+	tmpfile, err := ioutil.TempFile("/tmp", "image")
+	if err != nil {
+		return gocv.Mat{}, fmt.Errorf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write(data); err != nil {
+		tmpfile.Close()
+		return gocv.Mat{}, fmt.Errorf("unable to write the temporary file: %v", err)
+	}
+	tmpfile.Close()
+
+	mat := imRead(tmpfile.Name(), gocv.IMReadColor)
+	if mat.Empty() {
+		closeMat(&mat)
+		return gocv.Mat{}, newError(ErrInvalidInput, "unable to decode the image")
+	}
+	return mat, nil
+}
+
+// matFromImage converts the image into a BGR matrix. Like OpenCV, the alpha channel is dropped
+// without compositing the image onto a background.
+func matFromImage(img image.Image) (gocv.Mat, error) {
+	data, width, height := bgrBytes(img)
+	return newMatFromBytes(height, width, gocv.MatTypeCV8UC3, data)
+}
+
+// bgrBytes returns the pixels of the image in the interleaved BGR layout of the OpenCV matrices.
+func bgrBytes(img image.Image) (data []byte, width, height int) {
+	b := img.Bounds()
+	width, height = b.Dx(), b.Dy()
+	data = make([]byte, 3*width*height)
+
+	switch src := img.(type) {
+	case *image.Gray:
+		for y := 0; y < height; y++ {
+			row := src.Pix[y*src.Stride : y*src.Stride+width]
+			for x, v := range row {
+				i := 3 * (y*width + x)
+				data[i], data[i+1], data[i+2] = v, v, v
+			}
+		}
+	case *image.YCbCr:
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				yi := src.YOffset(b.Min.X+x, b.Min.Y+y)
+				ci := src.COffset(b.Min.X+x, b.Min.Y+y)
+				r, g, bl := color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+				i := 3 * (y*width + x)
+				data[i], data[i+1], data[i+2] = bl, g, r
+			}
+		}
+	default:
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+				i := 3 * (y*width + x)
+				data[i], data[i+1], data[i+2] = c.B, c.G, c.R
+			}
+		}
+	}
+	return data, width, height
+}
+
+// jpegOrientation returns the EXIF orientation of the JPEG image, or 0 if it has none.
+func jpegOrientation(data []byte) int {
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return 0
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return 0
+		}
+		marker := data[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			return 0
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 0
+		}
+		seg := data[i+4 : i+2+size]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return exifOrientation(seg[6:])
+		}
+		i += 2 + size
+	}
+	return 0
+}
+
+// exifOrientation looks up the orientation tag in the first IFD of the TIFF structured EXIF data.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		pos := ifd + 2 + 12*i
+		if pos+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[pos:]) == 0x0112 {
+			return int(order.Uint16(tiff[pos+8:]))
+		}
+	}
+	return 0
+}
+
+// orient transforms the image according to the EXIF orientation (2-8).
+func orient(img image.Image, o int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,200 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// pngHeader returns the PNG signature followed by the header chunk declaring the image size,
+// without any image data.
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12], ihdr[13] = 8, 0 // 8 bit grayscale
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)-4))
+	buf.Write(ihdr)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	return buf.Bytes()
+}
+
+// decodeSeeds returns the valid and the malformed inputs of the decoder front-end, which are
+// also the seeds of the fuzz targets.
+func decodeSeeds(t testing.TB) [][]byte {
+	img := testImage(t)
+	return [][]byte{
+		img,
+		img[:len(img)/2],
+		pngHeader(16, 16),
+		pngHeader(0, 16),
+		pngHeader(1<<20, 1<<20),
+		[]byte("\xff\xd8\xff\xe0"),
+		[]byte("GIF89a\x00\x00"),
+		[]byte("P5\n99999 99999\n255\n"),
+		[]byte("RIFF\x00\x00\x00\x00WEBPVP8 "),
+		[]byte("RIFF\x1a\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02\x00\x00\x00\xff\xff\xff\xff\xff\xff"),
+		[]byte("BM\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x28\x00\x00\x00\x00\x00\x00\x80\x00\x00\x00\x80"),
+		tiffHeader(binary.BigEndian, 64, 48),
+		[]byte("II*\x00\xff\xff\xff\x7f"),
+		[]byte("this is not an image"),
+		nil,
+	}
+}
+
+func TestInspectInput(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		// code is the code of the expected rejection, empty when the input is accepted.
+		code string
+	}{
+		{"valid image", testImage(t), ""},
+		{"unknown format", []byte("this is not an image"), "unsupported_format"},
+		{"truncated header", []byte("\x89PNG\r\n\x1a\n\x00\x00"), "format_mismatch"},
+		{"zero width", pngHeader(0, 16), "format_mismatch"},
+		{"too many pixels", pngHeader(1<<20, 1<<20), "image_too_large"},
+		{"decompression bomb", pngHeader(4096, 4096), "pixel_ratio_exceeded"},
+		{"truncated webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), "format_mismatch"},
+		{"negative bmp width", []byte("BM\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x28\x00\x00\x00\x00\x00\x00\x80\x10\x00\x00\x00"), "invalid_input"},
+		{"large webp", webpHeader(16384, 16384), "image_too_large"},
+		{"large bmp", bmpHeader(20000, 20000), "image_too_large"},
+		{"large tiff", tiffHeader(binary.LittleEndian, 20000, 20000), "image_too_large"},
+		{"large big endian tiff", tiffHeader(binary.BigEndian, 20000, 20000), "image_too_large"},
+		{"valid tiff", tiffHeader(binary.LittleEndian, 64, 48), ""},
+		{"tiff without dimensions", []byte("II*\x00\x08\x00\x00\x00\x00\x00"), "format_mismatch"},
+		{"truncated tiff", []byte("II*\x00\xff\x00\x00\x00"), "format_mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := inspectInput(tt.data)
+			switch {
+			case tt.code == "" && err != nil:
+				t.Errorf("rejected: %v", err)
+			case tt.code != "" && err == nil:
+				t.Errorf("accepted, expected %s", tt.code)
+			case tt.code != "" && ErrorCode(err) != tt.code:
+				t.Errorf("rejected as %s (%v), expected %s", ErrorCode(err), err, tt.code)
+			}
+		})
+	}
+}
+
+// webpHeader returns the header of a lossless WebP image declaring the provided size.
+func webpHeader(width, height uint32) []byte {
+	data := make([]byte, 30)
+	copy(data, "RIFF\x00\x00\x00\x00WEBPVP8L")
+	data[20] = 0x2f
+	binary.LittleEndian.PutUint32(data[21:], (width-1)|(height-1)<<14)
+	return data
+}
+
+// bmpHeader returns the file and the DIB headers of a BMP image declaring the provided size.
+func bmpHeader(width, height uint32) []byte {
+	data := make([]byte, 54)
+	copy(data, "BM")
+	binary.LittleEndian.PutUint32(data[14:], 40)
+	binary.LittleEndian.PutUint32(data[18:], width)
+	binary.LittleEndian.PutUint32(data[22:], height)
+	return data
+}
+
+// tiffHeader returns the header and the first image file directory of a TIFF image declaring
+// the provided size.
+func tiffHeader(order binary.ByteOrder, width, height uint32) []byte {
+	var buf bytes.Buffer
+	if order == binary.BigEndian {
+		buf.WriteString("MM\x00*")
+	} else {
+		buf.WriteString("II*\x00")
+	}
+	binary.Write(&buf, order, uint32(8))
+	binary.Write(&buf, order, uint16(2))
+	for _, e := range [][2]uint32{{256, width}, {257, height}} {
+		binary.Write(&buf, order, uint16(e[0]))
+		binary.Write(&buf, order, uint16(4)) // LONG
+		binary.Write(&buf, order, uint32(1))
+		binary.Write(&buf, order, e[1])
+	}
+	binary.Write(&buf, order, uint32(0))
+	return buf.Bytes()
+}
+
+func TestInspectInputMaxPixels(t *testing.T) {
+	if _, ok := inspectInput(pngHeader(1<<20, 1<<20)).(*imageSizeError); !ok {
+		t.Errorf("the image exceeding the default limit is accepted")
+	}
+
+	os.Setenv("max_pixels", "100")
+	defer os.Unsetenv("max_pixels")
+	for _, data := range [][]byte{testImage(t), webpHeader(16, 16), bmpHeader(16, 16), tiffHeader(binary.LittleEndian, 16, 16)} {
+		if _, ok := inspectInput(data).(*imageSizeError); !ok {
+			t.Errorf("the %s image exceeding the max_pixels limit is accepted", inputFormat(data))
+		}
+	}
+}
+
+func TestRequestImage(t *testing.T) {
+	img := testImage(t)
+	form, formType := multipartBody(t, img)
+
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+		want        []byte
+		fails       bool
+	}{
+		{name: "raw", body: img, want: img},
+		{name: "base64", body: []byte(base64.StdEncoding.EncodeToString(img)), want: img},
+		{name: "invalid base64", body: []byte("not base64!"), want: []byte("not base64!")},
+		{name: "multipart", body: form, contentType: formType, want: img},
+		{name: "missing boundary", body: form, contentType: "multipart/form-data", fails: true},
+		{name: "truncated multipart", body: form[:len(form)/2], contentType: formType, fails: true},
+		{name: "multipart without image", body: []byte("--b\r\nContent-Disposition: form-data; name=\"k\"\r\n\r\n2\r\n--b--\r\n"), contentType: "multipart/form-data; boundary=b", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &RequestContext{Body: tt.body, Header: http.Header{"Content-Type": {tt.contentType}}}
+			data, err := requestImage(ctx)
+			switch {
+			case tt.fails && err == nil:
+				t.Errorf("extracted %d bytes, expected an error", len(data))
+			case !tt.fails && err != nil:
+				t.Errorf("failed: %v", err)
+			case !tt.fails && !bytes.Equal(data, tt.want):
+				t.Errorf("extracted %d bytes, expected %d", len(data), len(tt.want))
+			}
+		})
+	}
+}
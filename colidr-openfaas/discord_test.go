@@ -0,0 +1,77 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build go1.13
+// +build go1.13
+
+package function
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestVerifyDiscordRequest signs the requests with the standard library implementation, available
+// since Go 1.13, which cross-checks the verification as well.
+func TestVerifyDiscordRequest(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("discord_public_key", hex.EncodeToString(pub))
+	defer os.Unsetenv("discord_public_key")
+
+	body := []byte(`{"id":"1","channel_id":"81384788765712384"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	sign := func(timestamp string, body []byte) string {
+		return hex.EncodeToString(ed25519.Sign(priv, append([]byte(timestamp), body...)))
+	}
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		valid     bool
+	}{
+		{"valid", now, sign(now, body), true},
+		{"other body", now, sign(now, []byte("{}")), false},
+		{"other timestamp", now, sign(stale, body), false},
+		{"stale", stale, sign(stale, body), false},
+		{"unsigned", now, "", false},
+		{"malformed", now, "zz", false},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		header.Set("X-Signature-Timestamp", tt.timestamp)
+		header.Set("X-Signature-Ed25519", tt.signature)
+		if err := verifyDiscordRequest(&RequestContext{Body: body, Header: header}); (err == nil) != tt.valid {
+			t.Errorf("%s: %v, expected valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// defaultDowngrade is the order of the strategies applied to the oversized responses.
+	defaultDowngrade = "recompress,url,downscale"
+	// minDowngradeSize is the smallest long edge the oversized images are downscaled to.
+	minDowngradeSize = 64
+)
+
+// downgradeQualities are the JPEG qualities the oversized images are recompressed with.
+var downgradeQualities = []int{85, 70, 55, 40}
+
+// maxResponseSize returns the largest response the gateway accepts, set through the
+// max_response_bytes environment variable. Zero disables the limit.
+func maxResponseSize() int {
+	return envInt("max_response_bytes", 0)
+}
+
+// downgradeStrategies returns the strategies of the oversized responses, set through the
+// response_downgrade environment variable as a comma separated list.
+func downgradeStrategies() []string {
+	spec := os.Getenv("response_downgrade")
+	if spec == "" {
+		spec = defaultDowngrade
+	}
+	var strategies []string
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			strategies = append(strategies, s)
+		}
+	}
+	return strategies
+}
+
+// urlResponse is the body of the oversized responses switched to URL output.
+type urlResponse struct {
+	URL  string `json:"url"`
+	Size int    `json:"size"`
+}
+
+// limitResponse downgrades the successful responses exceeding the maximum response size of the
+// gateway, instead of letting them be truncated or rejected. The strategies are tried in order:
+// recompress re-encodes the raster images as JPEG with decreasing qualities, url uploads the
+// result to the storage and returns its URL, while downscale halves the raster images until
+// they fit. The applied downgrade is indicated in the X-Downgrade response header.
+func limitResponse(next handlerFunc) handlerFunc {
+	return func(ctx *RequestContext) *response {
+		res := next(ctx)
+		limit := maxResponseSize()
+		if limit == 0 || res.status != http.StatusOK || len(res.body) <= limit {
+			return res
+		}
+		// The raw output must remain the encoded image, so it's rejected instead of being downgraded.
+		if ctx.OutputMode == "raw" {
+			return errorResponse(http.StatusRequestEntityTooLarge, "the result of %d bytes exceeds the maximum response size of %d bytes", len(res.body), limit).withCode("response_too_large")
+		}
+
+		// The vector, plotter and JSON outputs can only be switched to URL output.
+		img, _, err := image.Decode(bytes.NewReader(res.body))
+		for _, strategy := range downgradeStrategies() {
+			var (
+				body        []byte
+				contentType = "image/jpeg"
+				how         string
+			)
+			switch {
+			case strategy == "recompress" && err == nil:
+				body, how = recompress(img, limit)
+			case strategy == "downscale" && err == nil:
+				body, how = downscaleToFit(img, limit)
+			case strategy == "url":
+				body, how = uploadOversized(res, ctx.Params.Get("format"))
+				contentType = "application/json"
+			}
+			if body == nil {
+				continue
+			}
+			downgraded := newResponse(http.StatusOK, body)
+			for k, v := range res.header {
+				downgraded.header[k] = v
+			}
+			downgraded.header.Set("Content-Type", contentType)
+			downgraded.header.Set("X-Downgrade", how)
+			return downgraded
+		}
+		return errorResponse(http.StatusRequestEntityTooLarge, "the result of %d bytes exceeds the maximum response size of %d bytes", len(res.body), limit).withCode("response_too_large")
+	}
+}
+
+// recompress re-encodes the image as JPEG with the highest quality fitting in the limit.
+func recompress(img image.Image, limit int) ([]byte, string) {
+	img = opaque(img)
+	for _, q := range downgradeQualities {
+		buf := new(bytes.Buffer)
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: q}); err != nil {
+			return nil, ""
+		}
+		if buf.Len() <= limit {
+			return buf.Bytes(), fmt.Sprintf("recompress;quality=%d", q)
+		}
+	}
+	return nil, ""
+}
+
+// downscaleToFit halves the image until its JPEG encoding fits in the limit.
+func downscaleToFit(img image.Image, limit int) ([]byte, string) {
+	img = opaque(img)
+	b := img.Bounds()
+	size := maxInt(b.Dx(), b.Dy())
+	for size/2 >= minDowngradeSize {
+		size /= 2
+		scaled := downscale(img, size)
+		buf := new(bytes.Buffer)
+		if err := jpeg.Encode(buf, scaled, &jpeg.Options{Quality: downgradeQualities[1]}); err != nil {
+			return nil, ""
+		}
+		if buf.Len() <= limit {
+			sb := scaled.Bounds()
+			return buf.Bytes(), fmt.Sprintf("downscale;size=%dx%d", sb.Dx(), sb.Dy())
+		}
+	}
+	return nil, ""
+}
+
+// uploadOversized uploads the response body to the storage, returning the JSON body with its URL.
+func uploadOversized(res *response, format string) ([]byte, string) {
+	if os.Getenv("storage_url") == "" {
+		return nil, ""
+	}
+	contentType := res.header.Get("Content-Type")
+	if contentType == "" {
+		contentType = detectContentType(res.body, format)
+	}
+	key := fmt.Sprintf("oversized/%x", sha256.Sum256(res.body))
+	if format != "" {
+		key += "." + format
+	}
+	link, err := uploadResult(key, res.body, contentType)
+	if err != nil {
+		log.Printf("unable to upload the oversized response: %v", err)
+		return nil, ""
+	}
+	body, err := json.Marshal(urlResponse{URL: link, Size: len(res.body)})
+	if err != nil {
+		return nil, ""
+	}
+	return body, "url"
+}
+
+// opaque flattens the transparent image onto white, since JPEG has no alpha channel.
+func opaque(img image.Image) image.Image {
+	if _, ok := img.(*image.Gray); ok {
+		return img
+	}
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
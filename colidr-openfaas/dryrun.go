@@ -0,0 +1,114 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+)
+
+// Rough cost coefficients used for estimating the processing time on a single core.
+const (
+	// secondsPerUnit is the cost of a single kernel sample.
+	secondsPerUnit = 5e-9
+	// secondsPerTask is the overhead of spawning and scheduling a per-pixel goroutine.
+	secondsPerTask = 5e-7
+	// bytesPerPixel is the memory used by the intermediate matrices for each pixel.
+	bytesPerPixel = 98
+	// bytesPerTask is the stack size of a per-pixel goroutine, which are all alive at the same time.
+	bytesPerTask = 2048
+	// bytesPerBandedPixel is the memory used by the 8 bit images of the whole size in the low memory mode.
+	bytesPerBandedPixel = 7
+)
+
+// dryRunResponse describes what the request would do, without processing it.
+type dryRunResponse struct {
+	Width            int                    `json:"width"`
+	Height           int                    `json:"height"`
+	Format           string                 `json:"format"`
+	Params           map[string]interface{} `json:"params"`
+	EstimatedMemory  int64                  `json:"estimated_memory_bytes"`
+	EstimatedRuntime float64                `json:"estimated_runtime_seconds"`
+	ModelSamples     int                    `json:"runtime_model_samples"`
+}
+
+// dryRun validates the source image headers and returns the resolved parameters
+// together with the estimated resource usage.
+func dryRun(data []byte, rp *requestParams) ([]byte, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	pixels := cfg.Width * cfg.Height
+	model := loadRuntimeModel(runtimeModelFile())
+	opts := rp.opts.resolveSizes(cfg.Width, cfg.Height)
+
+	res := dryRunResponse{
+		Width:            cfg.Width,
+		Height:           cfg.Height,
+		Format:           format,
+		Params:           rp.describe(),
+		EstimatedMemory:  opts.estimateMemory(cfg.Width, cfg.Height),
+		EstimatedRuntime: model.predict(opts.estimateRuntime(pixels)),
+		ModelSamples:     int(model.N),
+	}
+	return json.Marshal(res)
+}
+
+// estimateMemory returns the approximate peak memory used for processing the image. In the low
+// memory mode only a single band, extended by the margins, is processed at a time.
+func (o options) estimateMemory(width, height int) int64 {
+	if o.bandRows <= 0 || height <= o.bandRows {
+		return int64(width*height) * (bytesPerPixel + bytesPerTask)
+	}
+	bandHeight := o.bandRows + 2*bandMargin(o)
+	if bandHeight > height {
+		bandHeight = height
+	}
+	return int64(width*height)*bytesPerBandedPixel + int64(width*bandHeight)*(bytesPerPixel+bytesPerTask)
+}
+
+// workUnits returns the approximate number of kernel samples needed for processing the image.
+func (o options) workUnits(pixels int) float64 {
+	etfKernel := float64(2*o.etfKernel + 1)
+	gradKernel := float64(2*len(makeGaussianVector(o.sigmaR*o.sigmaC)) - 1)
+
+	flowKernel := float64(2 * len(makeGaussianVector(o.sigmaM)))
+	if o.maxSteps > 0 {
+		flowKernel = float64(2 * o.maxSteps)
+	}
+
+	etf := float64(o.etfIteration) * etfKernel * etfKernel
+	dog := float64(o.fDogIteration+1) * (gradKernel + flowKernel)
+
+	return float64(pixels) * (etf + dog)
+}
+
+// tasks returns the number of per-pixel goroutines spawned while processing the image.
+func (o options) tasks(pixels int) float64 {
+	// The ETF initialization, rotation and every refinement pass, then
+	// the gradient DoG, flow DoG and thresholding on every fDoG iteration.
+	passes := 2 + o.etfIteration + 3*(o.fDogIteration+1) + o.fDogIteration
+	return float64(pixels * passes)
+}
@@ -0,0 +1,197 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// defaultStitchLength is the default length of the run stitches, in millimeters.
+	defaultStitchLength = 2.5
+	// maxDSTStep is the maximum displacement of a DST record, in 0.1 mm units.
+	maxDSTStep = 121
+)
+
+// dstRecord is the type of a Tajima DST stitch record.
+type dstRecord int
+
+const (
+	dstStitch dstRecord = iota
+	dstJump
+	dstColorChange
+	dstEnd
+)
+
+// dstDigits are the bit flags of the balanced ternary digits of the DST record displacements.
+var dstDigits = []struct {
+	weight, byte           int
+	xPos, xNeg, yPos, yNeg byte
+}{
+	{81, 2, 0x04, 0x08, 0x20, 0x10},
+	{27, 1, 0x04, 0x08, 0x20, 0x10},
+	{9, 0, 0x04, 0x08, 0x20, 0x10},
+	{3, 1, 0x01, 0x02, 0x80, 0x40},
+	{1, 0, 0x01, 0x02, 0x80, 0x40},
+}
+
+// dstWriter converts the absolute needle positions, in 0.1 mm units with the Y axis pointing
+// upward, into the relative DST records, tracking the design extents for the header.
+type dstWriter struct {
+	buf                    bytes.Buffer
+	x, y                   int
+	minX, maxX, minY, maxY int
+	stitches, colors       int
+}
+
+// record writes a single record with a displacement within the ±121 range.
+func (d *dstWriter) record(dx, dy int, typ dstRecord) {
+	var b [3]byte
+	switch typ {
+	case dstStitch:
+		b[2] = 0x03
+	case dstJump:
+		b[2] = 0x83
+	case dstColorChange:
+		b[2] = 0xc3
+	case dstEnd:
+		b[2] = 0xf3
+	}
+	// Each axis is encoded in balanced ternary, the 81, 27, 9, 3 and 1 digits being spread over the three bytes.
+	for _, t := range dstDigits {
+		limit := t.weight / 2
+		switch {
+		case dx > limit:
+			b[t.byte] |= t.xPos
+			dx -= t.weight
+		case dx < -limit:
+			b[t.byte] |= t.xNeg
+			dx += t.weight
+		}
+		switch {
+		case dy > limit:
+			b[t.byte] |= t.yPos
+			dy -= t.weight
+		case dy < -limit:
+			b[t.byte] |= t.yNeg
+			dy += t.weight
+		}
+	}
+	d.buf.Write(b[:])
+	d.stitches++
+}
+
+// moveTo moves the needle to the absolute position, split into multiple records if needed.
+func (d *dstWriter) moveTo(x, y int, typ dstRecord) {
+	x0, y0 := d.x, d.y
+	dx, dy := x-x0, y-y0
+	steps := int(math.Ceil(math.Max(math.Abs(float64(dx)), math.Abs(float64(dy))) / maxDSTStep))
+	if steps == 0 {
+		return
+	}
+	for i := 1; i <= steps; i++ {
+		nx, ny := x0+dx*i/steps, y0+dy*i/steps
+		d.record(nx-d.x, ny-d.y, typ)
+		d.x, d.y = nx, ny
+	}
+	d.minX, d.maxX = int(math.Min(float64(d.minX), float64(x))), int(math.Max(float64(d.maxX), float64(x)))
+	d.minY, d.maxY = int(math.Min(float64(d.minY), float64(y))), int(math.Max(float64(d.maxY), float64(y)))
+}
+
+// header returns the 512 bytes DST header.
+func (d *dstWriter) header(label string) []byte {
+	if len(label) > 16 {
+		label = label[:16]
+	}
+	sign := func(v int) string {
+		if v < 0 {
+			return fmt.Sprintf("-%5d", -v)
+		}
+		return fmt.Sprintf("+%5d", v)
+	}
+	h := fmt.Sprintf("LA:%-16s\rST:%7d\rCO:%3d\r+X:%5d\r-X:%5d\r+Y:%5d\r-Y:%5d\rAX:%s\rAY:%s\rMX:+    0\rMY:+    0\rPD:******\r\x1a",
+		label, d.stitches, d.colors, d.maxX, -d.minX, d.maxY, -d.minY, sign(d.x), sign(d.y))
+	return append([]byte(h), bytes.Repeat([]byte{' '}, 512-len(h))...)
+}
+
+// encodeDST converts the traced strokes into a Tajima DST embroidery file, sewing the stroke
+// outlines with run stitches of the requested length (in millimeters) at the print resolution.
+// The pen layers are separated by color changes. It should be called after GenerateCld.
+func (c *Cld) encodeDST(w io.Writer, opts EncodeOptions) error {
+	layers, err := c.plotLayers(opts)
+	if err != nil {
+		return err
+	}
+	dpi := opts.print.dpi
+	if dpi <= 0 {
+		dpi = 300
+	}
+	stitchLen := opts.StitchLength
+	if stitchLen <= 0 {
+		stitchLen = defaultStitchLength
+	}
+	// The needle starts in the center of the design, the DST Y axis pointing upward.
+	scale := 254 / float64(dpi)
+	cx, cy := float64(c.result.Cols())/2, float64(c.result.Rows())/2
+	pos := func(x, y float64) (int, int) {
+		return int(math.Round((x - cx) * scale)), int(math.Round((cy - y) * scale))
+	}
+	step := stitchLen * 10 / scale
+
+	d := &dstWriter{}
+	sewn := false
+	for _, l := range layers {
+		if len(l.strokes) == 0 {
+			continue
+		}
+		if sewn {
+			d.record(0, 0, dstColorChange)
+			d.colors++
+		}
+		for _, s := range l.strokes {
+			x, y := pos(float64(s.points[0].X), float64(s.points[0].Y))
+			d.moveTo(x, y, dstJump)
+			for j := 1; j <= len(s.points); j++ {
+				p, q := s.points[j-1], s.points[j%len(s.points)]
+				dist := math.Hypot(float64(q.X-p.X), float64(q.Y-p.Y))
+				n := int(math.Ceil(dist / step))
+				for k := 1; k <= n; k++ {
+					t := float64(k) / float64(n)
+					x, y := pos(float64(p.X)+float64(q.X-p.X)*t, float64(p.Y)+float64(q.Y-p.Y)*t)
+					d.moveTo(x, y, dstStitch)
+				}
+			}
+			sewn = true
+		}
+	}
+	d.record(0, 0, dstEnd)
+
+	if _, err := w.Write(d.header("colidr")); err != nil {
+		return err
+	}
+	_, err = d.buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,171 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"crypto/sha512"
+	"math/big"
+)
+
+// The Ed25519 signatures are verified with the big number arithmetic, since the crypto/ed25519
+// package is not available in the Go versions the function is built with. It's slow compared to
+// the optimized implementations, but it's only used for authenticating the webhook requests.
+var (
+	// edP is the prime of the field, 2^255 - 19.
+	edP = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	// edL is the order of the base point, 2^252 + 27742317777372353535851937790883648493.
+	edL, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+	// edD is the curve constant, -121665/121666.
+	edD = edMul(big.NewInt(-121665), edInv(big.NewInt(121666)))
+	// edSqrtM1 is a square root of -1, 2^((p-1)/4).
+	edSqrtM1 = new(big.Int).Exp(big.NewInt(2), new(big.Int).Rsh(new(big.Int).Sub(edP, big.NewInt(1)), 2), edP)
+	// edBase is the base point, whose y coordinate is 4/5 and the x coordinate is even.
+	edBase, _ = edDecode(edEncode(edPoint{big.NewInt(0), edMul(big.NewInt(4), edInv(big.NewInt(5)))}, false))
+)
+
+// edPoint is a point of the twisted Edwards curve in affine coordinates.
+type edPoint struct {
+	x, y *big.Int
+}
+
+func edMul(a, b *big.Int) *big.Int {
+	r := new(big.Int).Mul(a, b)
+	return r.Mod(r, edP)
+}
+
+func edInv(a *big.Int) *big.Int {
+	return new(big.Int).ModInverse(new(big.Int).Mod(a, edP), edP)
+}
+
+// add returns the sum of the points. The addition law is complete, so it holds for doubling as well.
+func (p edPoint) add(q edPoint) edPoint {
+	xx, yy := edMul(p.x, q.x), edMul(p.y, q.y)
+	dxy := edMul(edD, edMul(xx, yy))
+
+	x := new(big.Int).Add(edMul(p.x, q.y), edMul(p.y, q.x))
+	y := new(big.Int).Add(yy, xx)
+	one := big.NewInt(1)
+	return edPoint{
+		edMul(x, edInv(new(big.Int).Add(one, dxy))),
+		edMul(y, edInv(new(big.Int).Sub(one, dxy))),
+	}
+}
+
+// scalarMult returns the point multiplied by the scalar, with the double and add method.
+func (p edPoint) scalarMult(k *big.Int) edPoint {
+	r := edPoint{big.NewInt(0), big.NewInt(1)}
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		r = r.add(r)
+		if k.Bit(i) == 1 {
+			r = r.add(p)
+		}
+	}
+	return r
+}
+
+// edEncode returns the 32 byte encoding of the point: the little endian y coordinate, with the top bit
+// holding the parity of x. The negative flag encodes the negated point, with the same y coordinate.
+func edEncode(p edPoint, negative bool) []byte {
+	x := p.x
+	if negative {
+		x = new(big.Int).Mod(new(big.Int).Neg(x), edP)
+	}
+	buf := make([]byte, 32)
+	b := p.y.Bytes()
+	for i := range b {
+		buf[i] = b[len(b)-1-i]
+	}
+	buf[31] |= byte(x.Bit(0)) << 7
+	return buf
+}
+
+// edDecode decodes the 32 byte encoding of a point, reporting whether it's a valid point of the curve.
+func edDecode(buf []byte) (edPoint, bool) {
+	if len(buf) != 32 {
+		return edPoint{}, false
+	}
+	sign := uint(buf[31] >> 7)
+	le := append([]byte(nil), buf...)
+	le[31] &= 0x7f
+	y := leInt(le)
+	if y.Cmp(edP) >= 0 {
+		return edPoint{}, false
+	}
+
+	// x^2 = (y^2 - 1) / (d y^2 + 1)
+	yy := edMul(y, y)
+	u := new(big.Int).Sub(yy, big.NewInt(1))
+	v := new(big.Int).Add(edMul(edD, yy), big.NewInt(1))
+	xx := edMul(u, edInv(v))
+
+	exp := new(big.Int).Rsh(new(big.Int).Add(edP, big.NewInt(3)), 3)
+	x := new(big.Int).Exp(xx, exp, edP)
+	if edMul(x, x).Cmp(xx) != 0 {
+		x = edMul(x, edSqrtM1)
+	}
+	if edMul(x, x).Cmp(xx) != 0 {
+		return edPoint{}, false
+	}
+	if x.Sign() == 0 && sign == 1 {
+		return edPoint{}, false
+	}
+	if x.Bit(0) != sign {
+		x.Sub(edP, x)
+	}
+	return edPoint{x, y}, true
+}
+
+// leInt converts the little endian bytes into a number.
+func leInt(le []byte) *big.Int {
+	be := make([]byte, len(le))
+	for i := range le {
+		be[len(le)-1-i] = le[i]
+	}
+	return new(big.Int).SetBytes(be)
+}
+
+// verifyEd25519 reports whether the signature of the message is valid for the public key (RFC 8032).
+func verifyEd25519(publicKey, message, sig []byte) bool {
+	if len(publicKey) != 32 || len(sig) != 64 {
+		return false
+	}
+	a, ok := edDecode(publicKey)
+	if !ok {
+		return false
+	}
+	s := leInt(sig[32:])
+	if s.Cmp(edL) >= 0 {
+		return false
+	}
+
+	h := sha512.New()
+	h.Write(sig[:32])
+	h.Write(publicKey)
+	h.Write(message)
+	k := new(big.Int).Mod(leInt(h.Sum(nil)), edL)
+
+	// The signature is valid if [s]B - [k]A encodes to R.
+	ka := a.scalarMult(k)
+	r := edBase.scalarMult(s).add(edPoint{new(big.Int).Mod(new(big.Int).Neg(ka.x), edP), ka.y})
+	return string(edEncode(r, false)) == string(sig[:32])
+}
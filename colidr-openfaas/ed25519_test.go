@@ -0,0 +1,63 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestVerifyEd25519(t *testing.T) {
+	// The test vectors of RFC 8032, section 7.1.
+	vectors := []struct {
+		key, msg, sig string
+	}{
+		{"d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a", "",
+			"e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b"},
+		{"3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c", "72",
+			"92a009a9f0d4cab8720e820b5f642540a2b27b5416503f8fb3762223ebdb69da085ac1e43e15996e458f3613d0f11d8c387b2eaeb4302aeeb00d291612bb0c00"},
+		{"fc51cd8e6218a1a38da47ed00230f0580816ed13ba3303ac5deb911548908025", "af82",
+			"6291d657deec24024827e69c3abe01a30ce548a284743a445e3680d7db5ac3ac18ff9b538d16f290ae67f760984dc6594a7c15e9716ed28dc027beceea1ec40a"},
+	}
+	for i, v := range vectors {
+		key, _ := hex.DecodeString(v.key)
+		msg, _ := hex.DecodeString(v.msg)
+		sig, _ := hex.DecodeString(v.sig)
+		if !verifyEd25519(key, msg, sig) {
+			t.Errorf("vector %d: the valid signature is rejected", i+1)
+		}
+		if verifyEd25519(key, append(msg, 0), sig) {
+			t.Errorf("vector %d: the signature of another message is accepted", i+1)
+		}
+		for _, pos := range []int{0, 31, 32, 63} {
+			bad := append([]byte(nil), sig...)
+			bad[pos] ^= 1
+			if verifyEd25519(key, msg, bad) {
+				t.Errorf("vector %d: the signature altered at byte %d is accepted", i+1, pos)
+			}
+		}
+		if verifyEd25519(key[:31], msg, sig) || verifyEd25519(key, msg, sig[:63]) {
+			t.Errorf("vector %d: the truncated key or signature is accepted", i+1)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+// Encoder encodes the generated image into an output format.
+type Encoder interface {
+	// MIMEType returns the media type of the encoded output.
+	MIMEType() string
+	// Encode writes the encoded image into w.
+	Encode(w io.Writer, src EncodeSource, opts EncodeOptions) error
+}
+
+// EncodeSource holds the generated image to be encoded.
+type EncodeSource struct {
+	// Image is the rendered raster image.
+	Image image.Image
+	// Before is the source image, used by the before/after animations.
+	Before image.Image
+	// cld is the generator of the image, used by the vector encoders. It's nil
+	// if the image is not a line drawing (e.g. an intermediate map).
+	cld *Cld
+}
+
+// EncodeOptions selects the encoding of the generated image.
+type EncodeOptions struct {
+	// Format is the name of the registered encoder, e.g. jpeg, png or raw (the grayscale pixels without any header).
+	Format string
+	// Quality is the JPEG quality, ranging from 1 to 100.
+	Quality int
+	// Layers and Colors are the tau values and the colors of the line layers of the vector output.
+	Layers []float32
+	Colors []color.RGBA
+	// GroupBy groups the strokes of the vector output by length or orientation.
+	GroupBy string
+	// Pens splits the strokes of the vector output into layers by the tone bands of the source image.
+	Pens int
+	// StitchLength is the length of the embroidery run stitches, in millimeters.
+	StitchLength float64
+	// ASCIIWidth, Charset and ANSI select the number of the columns, the character ramp (ascii or blocks)
+	// and the terminal colors of the text output.
+	ASCIIWidth int
+	Charset    string
+	ANSI       bool
+	// Order sorts the strokes of the vector output by the underlying tone, dark or light first.
+	Order string
+
+	print printOptions
+}
+
+// encoders is the registry of the output formats, keyed by the format name.
+var encoders = map[string]Encoder{}
+
+// RegisterEncoder registers the encoder of an output format, replacing the existing one.
+func RegisterEncoder(format string, enc Encoder) {
+	encoders[format] = enc
+}
+
+// encoderFunc adapts an encoding function with its media type to the Encoder interface.
+type encoderFunc struct {
+	mime   string
+	encode func(w io.Writer, src EncodeSource, opts EncodeOptions) error
+}
+
+func (e encoderFunc) MIMEType() string { return e.mime }
+
+func (e encoderFunc) Encode(w io.Writer, src EncodeSource, opts EncodeOptions) error {
+	return e.encode(w, src, opts)
+}
+
+func init() {
+	RegisterEncoder("jpeg", encoderFunc{"image/jpeg", encodeJPEG})
+	RegisterEncoder("png", encoderFunc{"image/png", func(w io.Writer, src EncodeSource, _ EncodeOptions) error {
+		return png.Encode(w, src.Image)
+	}})
+	RegisterEncoder("gif", encoderFunc{"image/gif", func(w io.Writer, src EncodeSource, _ EncodeOptions) error {
+		return gif.Encode(w, src.Image, nil)
+	}})
+	RegisterEncoder("webp", encoderFunc{"image/webp", encodeWebP})
+	RegisterEncoder("tiff", encoderFunc{"image/tiff", func(w io.Writer, src EncodeSource, opts EncodeOptions) error {
+		// Only the print output is converted into CMYK, and only on request.
+		if opts.print.enabled && opts.print.cmyk {
+			return encodeTiff(w, toCMYK(src.Image), opts.print.dpi)
+		}
+		return encodeTiff(w, src.Image, opts.print.dpi)
+	}})
+	RegisterEncoder("svg", encoderFunc{"image/svg+xml", func(w io.Writer, src EncodeSource, opts EncodeOptions) error {
+		if src.cld == nil {
+			return newError(ErrUnsupportedFormat, "the svg output is only supported for the line drawings")
+		}
+		return src.cld.encodeSVG(w, opts)
+	}})
+	RegisterEncoder("gcode", encoderFunc{"text/x-gcode", func(w io.Writer, src EncodeSource, opts EncodeOptions) error {
+		if src.cld == nil {
+			return newError(ErrUnsupportedFormat, "the gcode output is only supported for the line drawings")
+		}
+		return src.cld.encodeGCode(w, opts)
+	}})
+	RegisterEncoder("dst", encoderFunc{"application/x-dst", func(w io.Writer, src EncodeSource, opts EncodeOptions) error {
+		if src.cld == nil {
+			return newError(ErrUnsupportedFormat, "the dst output is only supported for the line drawings")
+		}
+		return src.cld.encodeDST(w, opts)
+	}})
+	RegisterEncoder("ascii", encoderFunc{"text/plain; charset=utf-8", func(w io.Writer, src EncodeSource, opts EncodeOptions) error {
+		return encodeASCII(w, src.Image, opts.ASCIIWidth, opts.Charset, opts.ANSI)
+	}})
+	RegisterEncoder("apng", encoderFunc{"image/apng", func(w io.Writer, src EncodeSource, _ EncodeOptions) error {
+		frames := []animFrame{{img: src.Image, duration: beforeAfterDuration}}
+		if src.Before != nil {
+			frames = append([]animFrame{{img: src.Before, duration: beforeAfterDuration}}, frames...)
+		}
+		res, err := encodeAPNG(&animation{frames: frames})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(res)
+		return err
+	}})
+	for format, mime := range map[string]string{
+		"pbm": "image/x-portable-bitmap",
+		"pgm": "image/x-portable-graymap",
+		"ppm": "image/x-portable-pixmap",
+	} {
+		format := format
+		RegisterEncoder(format, encoderFunc{mime, func(w io.Writer, src EncodeSource, _ EncodeOptions) error {
+			return encodeNetpbm(w, src.Image, format)
+		}})
+	}
+	RegisterEncoder("raw", encoderFunc{"application/octet-stream", func(w io.Writer, src EncodeSource, _ EncodeOptions) error {
+		gray := image.NewGray(src.Image.Bounds())
+		draw.Draw(gray, gray.Bounds(), src.Image, src.Image.Bounds().Min, draw.Src)
+		_, err := w.Write(gray.Pix)
+		return err
+	}})
+}
+
+// lookupEncoder returns the encoder registered for the format, the empty format meaning jpeg.
+func lookupEncoder(format string) (Encoder, error) {
+	switch format {
+	case "":
+		format = "jpeg"
+	case "jpg":
+		format = "jpeg"
+	}
+	enc, ok := encoders[format]
+	if !ok {
+		return nil, newError(ErrUnsupportedFormat, "unsupported output format: %s", format)
+	}
+	return enc, nil
+}
+
+// encodeJPEG encodes the image as JPEG, embedding the print resolution when requested.
+func encodeJPEG(w io.Writer, src EncodeSource, opts EncodeOptions) error {
+	quality := opts.Quality
+	if quality <= 0 || quality > 100 {
+		quality = 100
+	}
+	if !opts.print.enabled {
+		return jpeg.Encode(w, src.Image, &jpeg.Options{Quality: quality})
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, src.Image, &jpeg.Options{Quality: quality}); err != nil {
+		return err
+	}
+	return writeJFIFDensity(w, buf.Bytes(), opts.print.dpi)
+}
+
+// encodeWebP encodes the image as a still WebP image through OpenCV.
+func encodeWebP(w io.Writer, src EncodeSource, _ EncodeOptions) error {
+	mat, err := matFromImage(src.Image)
+	if err != nil {
+		return err
+	}
+	defer closeMat(&mat)
+
+	res, err := gocv.IMEncode(".webp", mat)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(res)
+	return err
+}
+
+// negotiateFormat returns the registered format matching the most preferred media type
+// of the Accept header, or an empty string if none of them matches. The wildcards are
+// not matched, so they leave the choice to the default format.
+func negotiateFormat(accept string) string {
+	type mediaRange struct {
+		mime string
+		q    float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		r := mediaRange{mime: strings.TrimSpace(fields[0]), q: 1}
+		for _, f := range fields[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(f), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					r.q = q
+				}
+			}
+		}
+		// The browsers accept a long list of image formats, but they are expecting the default one.
+		if r.mime == "text/html" {
+			return ""
+		}
+		if r.mime != "" && r.q > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	for _, r := range ranges {
+		// The most common formats are preferred for the ambiguous media types.
+		for _, format := range []string{"jpeg", "png", "svg", "webp", "gif", "tiff", "apng", "pgm", "pbm", "ppm"} {
+			if enc, ok := encoders[format]; ok && enc.MIMEType() == r.mime {
+				return format
+			}
+		}
+		for format, enc := range encoders {
+			if enc.MIMEType() == r.mime {
+				return format
+			}
+		}
+	}
+	return ""
+}
+
+// Encode encodes the generated line drawing in memory. It should be called after GenerateCld.
+func (c *Cld) Encode(opts EncodeOptions) ([]byte, error) {
+	enc, err := lookupEncoder(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	img, err := c.result.ToImage()
+	if err != nil {
+		return nil, fmt.Errorf("error converting matrix to image: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := enc.Encode(buf, EncodeSource{Image: img, cld: c}, opts); err != nil {
+		return nil, fmt.Errorf("cannot encode the output image: %v", err)
+	}
+	return buf.Bytes(), nil
+}
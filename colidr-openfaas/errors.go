@@ -0,0 +1,183 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ErrorKind classifies the errors returned by the library, so the front ends (the HTTP handler,
+// gRPC servers and command line tools) report them consistently.
+type ErrorKind int
+
+const (
+	// ErrInternal is a failure of the processing itself, not caused by the request.
+	ErrInternal ErrorKind = iota
+	// ErrInvalidInput is a malformed image or invalid parameters.
+	ErrInvalidInput
+	// ErrUnsupportedFormat is an input or output format which isn't supported.
+	ErrUnsupportedFormat
+	// ErrTooLarge is an input exceeding the size limits.
+	ErrTooLarge
+	// ErrTimeout is a processing which didn't complete in time.
+	ErrTimeout
+)
+
+// String returns the name of the error kind.
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrInvalidInput:
+		return "invalid_input"
+	case ErrUnsupportedFormat:
+		return "unsupported_format"
+	case ErrTooLarge:
+		return "too_large"
+	case ErrTimeout:
+		return "timeout"
+	}
+	return "internal"
+}
+
+// HTTPStatus returns the HTTP response status of the error kind.
+func (k ErrorKind) HTTPStatus() int {
+	switch k {
+	case ErrInvalidInput:
+		return http.StatusBadRequest
+	case ErrUnsupportedFormat:
+		return http.StatusUnsupportedMediaType
+	case ErrTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// GRPCCode returns the gRPC status code of the error kind, matching the values
+// of the google.golang.org/grpc/codes package.
+func (k ErrorKind) GRPCCode() uint32 {
+	switch k {
+	case ErrInvalidInput, ErrUnsupportedFormat:
+		return 3 // InvalidArgument
+	case ErrTooLarge:
+		return 8 // ResourceExhausted
+	case ErrTimeout:
+		return 4 // DeadlineExceeded
+	}
+	return 13 // Internal
+}
+
+// ExitCode returns the exit code of the command line tools for the error kind.
+func (k ErrorKind) ExitCode() int {
+	switch k {
+	case ErrInvalidInput:
+		return 2
+	case ErrUnsupportedFormat:
+		return 3
+	case ErrTooLarge:
+		return 4
+	case ErrTimeout:
+		return 5
+	}
+	return 1
+}
+
+// Error is an error classified by its kind, optionally identified by a more specific code.
+type Error struct {
+	Kind ErrorKind
+	Code string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// newError returns the error of the kind with the formatted message.
+func newError(kind ErrorKind, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// wrapError prefixes the message of the error, preserving its kind.
+func wrapError(err error, prefix string) error {
+	return &Error{Kind: KindOf(err), Code: ErrorCode(err), Err: fmt.Errorf("%s: %v", prefix, err)}
+}
+
+// ErrorCode returns the stable machine code of the error, more specific than its kind.
+func ErrorCode(err error) string {
+	switch e := err.(type) {
+	case *Error:
+		if e.Code != "" {
+			return e.Code
+		}
+	case *inputRejection:
+		return e.code
+	case *imageSizeError:
+		return "image_too_large"
+	case *blankImageError:
+		return "blank_image"
+	case *truncatedInputError:
+		return "truncated_image"
+	case *stageError:
+		if !e.timeout {
+			return "upstream_failed"
+		}
+	}
+	if err == errUploadTooLarge {
+		return "upload_too_large"
+	}
+	return KindOf(err).String()
+}
+
+// errorFor returns the response of the error, with the status of its kind and its code.
+// The failures of the sibling functions are reported as gateway errors.
+func errorFor(err error) *response {
+	status := KindOf(err).HTTPStatus()
+	if se, ok := err.(*stageError); ok {
+		status = se.httpStatus()
+	}
+	return errorResponse(status, "%s", err).withCode(ErrorCode(err))
+}
+
+// KindOf returns the kind of the error. The errors which aren't classified are internal.
+func KindOf(err error) ErrorKind {
+	switch e := err.(type) {
+	case *Error:
+		return e.Kind
+	case *imageSizeError:
+		return ErrTooLarge
+	case *inputRejection:
+		return e.kind
+	case *stageError:
+		if e.timeout {
+			return ErrTimeout
+		}
+	case *blankImageError, *truncatedInputError:
+		return ErrInvalidInput
+	}
+	if err == errUploadTooLarge {
+		return ErrTooLarge
+	}
+	return ErrInternal
+}
@@ -23,6 +23,7 @@
 package function
 
 import (
+	"fmt"
 	"image"
 	"math"
 	"sync"
@@ -39,6 +40,9 @@ type Etf struct {
 	gradientMag   gocv.Mat
 	wg            sync.WaitGroup
 	mu            sync.RWMutex
+	linearRGB     bool
+	// norm holds the normalization ranges of the whole image in the low memory mode.
+	norm *bandNorm
 }
 
 // point is a basic struct for vector type operations
@@ -54,31 +58,65 @@ func NewETF() *Etf {
 
 // Init initializes the ETF matrices.
 func (etf *Etf) Init(rows, cols int) {
-	etf.flowField = gocv.NewMatWithSize(rows, cols, gocv.MatTypeCV32F+gocv.MatChannels3)
-	etf.gradientField = gocv.NewMatWithSize(rows, cols, gocv.MatTypeCV32F+gocv.MatChannels3)
-	etf.refinedEtf = gocv.NewMatWithSize(rows, cols, gocv.MatTypeCV32F+gocv.MatChannels3)
-	etf.gradientMag = gocv.NewMatWithSize(rows, cols, gocv.MatTypeCV32F+gocv.MatChannels3)
+	etf.flowField = newMatWithSize(rows, cols, gocv.MatTypeCV32F+gocv.MatChannels3)
+	etf.gradientField = newMatWithSize(rows, cols, gocv.MatTypeCV32F+gocv.MatChannels3)
+	etf.refinedEtf = newMatWithSize(rows, cols, gocv.MatTypeCV32F+gocv.MatChannels3)
+	etf.gradientMag = newMatWithSize(rows, cols, gocv.MatTypeCV32F+gocv.MatChannels3)
 }
 
 // InitDefaultEtf computes the gradientField matrix by setting up
 // the pixel values from original image on which a sobel threshold has been applied.
 func (etf *Etf) InitDefaultEtf(file string, size image.Point) error {
+	src := imRead(file, gocv.IMReadColor)
+	defer closeMat(&src)
+	if src.Empty() {
+		return fmt.Errorf("unable to read the image file: %s", file)
+	}
+
+	return etf.InitEtfFromMat(src, size)
+}
+
+// InitEtfFromMat computes the gradientField matrix from the BGR source image already
+// decoded in memory. The source matrix is left unchanged.
+func (etf *Etf) InitEtfFromMat(img gocv.Mat, size image.Point) error {
 	etf.resizeMat(size)
 
-	src := gocv.IMRead(file, gocv.IMReadColor)
-	src.ConvertTo(&src, gocv.MatTypeCV32F, 255)
-	gocv.Normalize(src, &src, 0.0, 1.0, gocv.NormMinMax)
+	var src gocv.Mat
+	// Computing the gradients on gamma encoded values biases the edge strength in the shadows.
+	if etf.linearRGB {
+		src = linearizeMat(img)
+	} else {
+		src = newMat()
+		img.ConvertTo(&src, gocv.MatTypeCV32F, 255)
+	}
+	defer closeMat(&src)
+	if etf.norm != nil {
+		normalizeRange(&src, etf.norm.source)
+	} else {
+		gocv.Normalize(src, &src, 0.0, 1.0, gocv.NormMinMax)
+	}
 
 	// Generate gradX and gradY
-	gradX := gocv.NewMatWithSize(src.Rows(), src.Cols(), gocv.MatTypeCV32F)
-	gradY := gocv.NewMatWithSize(src.Rows(), src.Cols(), gocv.MatTypeCV32F)
+	gradX := newMatWithSize(src.Rows(), src.Cols(), gocv.MatTypeCV32F)
+	gradY := newMatWithSize(src.Rows(), src.Cols(), gocv.MatTypeCV32F)
+	defer closeMat(&gradX)
+	defer closeMat(&gradY)
 
 	gocv.Sobel(src, &gradX, gocv.MatTypeCV32F, 1, 0, 5, 1, 0, gocv.BorderDefault)
 	gocv.Sobel(src, &gradY, gocv.MatTypeCV32F, 0, 1, 5, 1, 0, gocv.BorderDefault)
 
 	// Compute gradient
 	gocv.Magnitude(gradX, gradY, &etf.gradientMag)
-	gocv.Normalize(etf.gradientMag, &etf.gradientMag, 0.0, 1.0, gocv.NormMinMax)
+	switch {
+	case etf.norm == nil:
+		gocv.Normalize(etf.gradientMag, &etf.gradientMag, 0.0, 1.0, gocv.NormMinMax)
+	case etf.norm.stage == collectGradient:
+		// The statistics pass only needs the gradient magnitude.
+		etf.norm.collectVecs(etf.gradientMag)
+		return nil
+	default:
+		normalizeRange(&etf.gradientMag, etf.norm.gradient)
+	}
 
 	width, height := src.Cols(), src.Rows()
 	etf.wg.Add(width * height)
@@ -123,7 +161,36 @@ func (etf *Etf) RefineEtf(kernel int) {
 		}
 	}
 	etf.wg.Wait()
-	etf.flowField = etf.refinedEtf.Clone()
+	closeMat(&etf.flowField)
+	etf.flowField = cloneMat(etf.refinedEtf)
+}
+
+// MagnitudeMap returns the gradient magnitude map normalized as a single channel grayscale matrix.
+func (etf *Etf) MagnitudeMap() gocv.Mat {
+	gray := newMat()
+	defer closeMat(&gray)
+
+	gocv.CvtColor(etf.gradientMag, gray, gocv.ColorBGRToGray)
+	gocv.Normalize(gray, &gray, 0.0, 255.0, gocv.NormMinMax)
+
+	dst := newMat()
+	gray.ConvertTo(&dst, gocv.MatTypeCV8UC1, 1.0)
+
+	return dst
+}
+
+// magnitudeAt returns the normalized gradient magnitude at the provided position.
+func (etf *Etf) magnitudeAt(y, x int) float32 {
+	v := etf.gradientMag.GetVecfAt(y, x)
+	return (v[0] + v[1] + v[2]) / 3
+}
+
+// Close releases the ETF matrices.
+func (etf *Etf) Close() {
+	closeMat(&etf.flowField)
+	closeMat(&etf.gradientField)
+	closeMat(&etf.refinedEtf)
+	closeMat(&etf.gradientMag)
 }
 
 // resizeMat resize all the matrices
@@ -135,7 +202,7 @@ func (etf *Etf) resizeMat(size image.Point) {
 }
 
 // rotateFlow applies a rotation on the original gradient field and calculates the new angles.
-func (etf *Etf) rotateFlow(src, dst *gocv.Mat, theta float64) {
+func (etf *Etf) rotateFlow(src, dst matrix, theta float64) {
 	theta = theta / 180.0 * math.Pi
 
 	width, height := src.Cols(), src.Rows()
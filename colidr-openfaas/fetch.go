@@ -0,0 +1,183 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// fetchClient downloads the source images in url input mode.
+var fetchClient = &http.Client{Timeout: 2 * time.Minute}
+
+// defaultUserAgent identifies the function, since some image hosts block the default Go user agent.
+const defaultUserAgent = "colidr-openfaas/1.0 (+https://github.com/esimov/openfaas-coherent-line-drawing)"
+
+// fetchHeaders returns the headers of the image downloads. The deployment defaults are configured
+// through the fetch_user_agent and fetch_headers environment variables, the latter holding
+// semicolon separated "Name: value" pairs. They can be complemented per request through the
+// X-Fetch-User-Agent and X-Fetch-Headers request headers, using the same format, which can't
+// replace the headers set by the deployment nor carry credentials.
+func fetchHeaders(ctx *RequestContext) http.Header {
+	header := make(http.Header)
+	header.Set("User-Agent", fetchUserAgent())
+	parseHeaderList(header, os.Getenv("fetch_headers"))
+
+	if ua := ctx.Header.Get("X-Fetch-User-Agent"); ua != "" && os.Getenv("fetch_user_agent") == "" {
+		header.Set("User-Agent", ua)
+	}
+	requested := make(http.Header)
+	parseHeaderList(requested, ctx.Header.Get("X-Fetch-Headers"))
+	for name, values := range requested {
+		if credentialHeaders[name] || header.Get(name) != "" {
+			continue
+		}
+		header[name] = values
+	}
+	return header
+}
+
+// credentialHeaders are the headers the callers can't send along the image downloads.
+var credentialHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// fetchUserAgent returns the User-Agent of the outbound requests, configurable through fetch_user_agent.
+func fetchUserAgent() string {
+	if ua := os.Getenv("fetch_user_agent"); ua != "" {
+		return ua
+	}
+	return defaultUserAgent
+}
+
+// parseHeaderList adds the semicolon separated "Name: value" pairs to the headers, skipping the malformed ones.
+func parseHeaderList(header http.Header, list string) {
+	for _, pair := range strings.Split(list, ";") {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			continue
+		}
+		header.Set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+}
+
+const (
+	// fetchChunkSize is the size of the chunks the download is read in.
+	fetchChunkSize = 32 << 10
+	// maxHeaderProbe is the amount of data searched for the image header. Beyond it the
+	// dimensions are left to be validated by the decoder.
+	maxHeaderProbe = 1 << 20
+)
+
+// fetchImage downloads the image, enforcing the upload size limit on the stream. The download
+// is aborted as soon as the Content-Length or the image header reveals that the image exceeds
+// the configured limits, instead of buffering the whole body before rejecting it.
+// When the fetch cache is enabled, the cached images are revalidated with a conditional request.
+func fetchImage(link string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	cache := newFetchCache()
+	var (
+		entry  *fetchCacheEntry
+		cached []byte
+	)
+	if cache != nil {
+		if entry, cached = cache.lookup(link); entry != nil {
+			entry.revalidate(req)
+		}
+	}
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		return cached, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	limit := maxUploadSize()
+	if resp.ContentLength > limit {
+		return nil, errUploadTooLarge
+	}
+	data, err := readImageStream(resp.Body, limit)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		if err := cache.store(link, resp.Header, data); err != nil {
+			log.Printf("unable to cache the image of %s: %v", link, err)
+		}
+	}
+	return data, nil
+}
+
+// readImageStream reads the image from the stream in chunks, validating the dimensions
+// as soon as the header is received.
+func readImageStream(r io.Reader, limit int64) ([]byte, error) {
+	var (
+		buf     bytes.Buffer
+		checked bool
+	)
+	lr := io.LimitReader(r, limit+1)
+	for {
+		n, err := io.CopyN(&buf, lr, fetchChunkSize)
+		if int64(buf.Len()) > limit {
+			return nil, errUploadTooLarge
+		}
+		if !checked && n > 0 {
+			// The header is incomplete as long as the config can't be decoded, so keep reading.
+			if cfg, _, cerr := image.DecodeConfig(bytes.NewReader(buf.Bytes())); cerr == nil {
+				if err := checkConfig(cfg); err != nil {
+					return nil, err
+				}
+				checked = true
+			} else if buf.Len() >= maxHeaderProbe {
+				checked = true
+			}
+		}
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
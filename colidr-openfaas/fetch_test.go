@@ -0,0 +1,60 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestFetchHeaders(t *testing.T) {
+	os.Setenv("fetch_headers", "Authorization: Bearer deploy; Referer: https://example.com")
+	defer os.Unsetenv("fetch_headers")
+
+	req := make(http.Header)
+	req.Set("X-Fetch-User-Agent", "caller/1.0")
+	req.Set("X-Fetch-Headers", "Authorization: Bearer caller; Referer: https://caller.example.com; Cookie: session=1; Proxy-Authorization: Basic eA==; Accept: image/*")
+	header := fetchHeaders(newRequestContext(http.MethodPost, nil, req, nil, ""))
+
+	want := map[string]string{
+		"Authorization":       "Bearer deploy",
+		"Referer":             "https://example.com",
+		"Cookie":              "",
+		"Proxy-Authorization": "",
+		"Accept":              "image/*",
+		"User-Agent":          "caller/1.0",
+	}
+	for name, value := range want {
+		if got := header.Get(name); got != value {
+			t.Errorf("%s: %q, expected %q", name, got, value)
+		}
+	}
+
+	// The user agent configured by the deployment is kept as well.
+	os.Setenv("fetch_user_agent", "deploy/1.0")
+	defer os.Unsetenv("fetch_user_agent")
+	if ua := fetchHeaders(newRequestContext(http.MethodPost, nil, req, nil, "")).Get("User-Agent"); ua != "deploy/1.0" {
+		t.Errorf("User-Agent: %q, expected the deployment one", ua)
+	}
+}
@@ -0,0 +1,114 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// fetchCacheEntry holds the validators of a downloaded source image.
+type fetchCacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// fetchCache keeps the downloaded source images on disk together with their ETag and
+// Last-Modified validators, so the repeated requests of the same URL are revalidated
+// with a conditional request instead of downloading the whole image again.
+type fetchCache struct {
+	dir string
+}
+
+// newFetchCache returns the cache configured through the fetch_cache_dir environment variable,
+// or nil if caching is disabled.
+func newFetchCache() *fetchCache {
+	dir := os.Getenv("fetch_cache_dir")
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil
+	}
+	return &fetchCache{dir: dir}
+}
+
+// path returns the location of the cached files of the URL, keyed by its hash.
+func (fc *fetchCache) path(link, ext string) string {
+	sum := sha256.Sum256([]byte(link))
+	return filepath.Join(fc.dir, hex.EncodeToString(sum[:])+ext)
+}
+
+// lookup returns the cached entry of the URL together with the image data.
+func (fc *fetchCache) lookup(link string) (*fetchCacheEntry, []byte) {
+	meta, err := ioutil.ReadFile(fc.path(link, ".json"))
+	if err != nil {
+		return nil, nil
+	}
+	entry := &fetchCacheEntry{}
+	if err := json.Unmarshal(meta, entry); err != nil || entry.URL != link {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(fc.path(link, ".data"))
+	if err != nil {
+		return nil, nil
+	}
+	return entry, data
+}
+
+// store caches the image, if the response provided any validator to revalidate it with.
+func (fc *fetchCache) store(link string, header http.Header, data []byte) error {
+	entry := fetchCacheEntry{
+		URL:          link,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	}
+	if entry.ETag == "" && entry.LastModified == "" {
+		return nil
+	}
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// The data is written first, so an entry never refers to a missing image.
+	if err := writeFileAtomic(fc.path(link, ".data"), data); err != nil {
+		return err
+	}
+	return writeFileAtomic(fc.path(link, ".json"), meta)
+}
+
+// revalidate adds the conditional headers of the cached entry to the request.
+func (entry *fetchCacheEntry) revalidate(req *http.Request) {
+	if entry.ETag != "" {
+		req.Header.Set("If-None-Match", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.LastModified)
+	}
+}
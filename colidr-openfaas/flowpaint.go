@@ -0,0 +1,133 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// defaultFlowLength is the default streamline length of the flow painting, in pixels.
+	defaultFlowLength = 24
+	// maxFlowLength is the maximum streamline length of the flow painting.
+	maxFlowLength = 200
+)
+
+// flowPainting renders the long exposure flow painting of the source image. Instead of
+// thresholding the edges, a noise weighted by the source luminance (each pixel lit with the
+// probability of its luminance) is smeared along the long streamlines of the edge tangent
+// flow, which keeps the tones while following the flow with silky strokes.
+func (c *Cld) flowPainting(length int) (gocv.Mat, error) {
+	rows, cols := c.tone.Rows(), c.tone.Cols()
+	rnd := rand.New(rand.NewSource(c.seed))
+
+	noise := make([]float32, rows*cols)
+	for i, v := range c.tone.ToBytes() {
+		if rnd.Float32()*255 < float32(v) {
+			noise[i] = 1
+		}
+	}
+	res := lineIntegral(flowGrid(c.etf.flowField), noise, rows, cols, length, float64(length)/2)
+
+	// The averaging flattens the contrast, which is stretched back to the full range.
+	min, max := float32(1), float32(0)
+	for _, v := range res {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	out := make([]byte, len(res))
+	if max > min {
+		for i, v := range res {
+			out[i] = uint8(round(float64((v - min) / (max - min) * 255)))
+		}
+	}
+	return newMatFromBytes(rows, cols, gocv.MatTypeCV8UC1, out)
+}
+
+// flowGrid copies the flow field into a slice, so the streamlines are traced without
+// accessing the matrix for each step.
+func flowGrid(flowField gocv.Mat) []gocv.Vecf {
+	rows, cols := flowField.Rows(), flowField.Cols()
+	grid := make([]gocv.Vecf, rows*cols)
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			grid[i*cols+j] = flowField.GetVecfAt(i, j)
+		}
+	}
+	return grid
+}
+
+// lineIntegral convolves the values along the streamlines of the flow field (line integral
+// convolution), tracing the length steps along and against the flow from each pixel. Every
+// step moves by one pixel along the dominant axis of the flow, and the samples are weighted
+// by a Gaussian of sigma steps. The streamlines stop at the image borders.
+func lineIntegral(flow []gocv.Vecf, values []float32, rows, cols, length int, sigma float64) []float32 {
+	weights := make([]float64, length)
+	for k := range weights {
+		weights[k] = math.Exp(-float64(k*k) / (2 * sigma * sigma))
+	}
+
+	res := make([]float32, rows*cols)
+	var wg sync.WaitGroup
+	wg.Add(rows)
+	for i := 0; i < rows; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < cols; j++ {
+				var sum, wSum float64
+				for _, dir := range []float32{1, -1} {
+					x, y := float32(i), float32(j)
+					for k := 0; k < length; k++ {
+						xi, yi := int(x), int(y)
+						if x < 0 || y < 0 || xi >= rows || yi >= cols {
+							break
+						}
+						sum += weights[k] * float64(values[xi*cols+yi])
+						wSum += weights[k]
+
+						v := flow[xi*cols+yi]
+						norm := abs(v[0]) + abs(v[1])
+						if norm == 0 {
+							break
+						}
+						x += dir * v[0] / norm
+						y += dir * v[1] / norm
+					}
+				}
+				if wSum > 0 {
+					res[i*cols+j] = float32(sum / wSum)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	return res
+}
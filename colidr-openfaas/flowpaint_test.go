@@ -0,0 +1,57 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"math"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+// tinyFlow returns a flow field turning from pixel to pixel, so the streamlines leave the tiny
+// images in every direction.
+func tinyFlow(rows, cols int) []gocv.Vecf {
+	flow := make([]gocv.Vecf, rows*cols)
+	for i := range flow {
+		a := 0.7 * float64(i)
+		flow[i] = gocv.Vecf{float32(math.Cos(a)), float32(math.Sin(a)), 0}
+	}
+	return flow
+}
+
+func TestLineIntegralTinyImages(t *testing.T) {
+	forTinySizes(t, func(t *testing.T, rows, cols int) {
+		values := make([]float32, rows*cols)
+		for i := range values {
+			values[i] = 0.5
+		}
+		// The streamlines stop at the image borders, so the constant values are preserved.
+		res := lineIntegral(tinyFlow(rows, cols), values, rows, cols, 8, 3)
+		for i, v := range res {
+			if math.Abs(float64(v)-0.5) > 1e-6 {
+				t.Fatalf("pixel %d: %v, expected 0.5", i, v)
+			}
+		}
+	})
+}
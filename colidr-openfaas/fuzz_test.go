@@ -0,0 +1,62 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build go1.18
+// +build go1.18
+
+package function
+
+import (
+	"net/http"
+	"testing"
+)
+
+// FuzzInspectInput checks that the header inspection of the decoder front-end never panics, and
+// that the accepted images declare a valid size.
+func FuzzInspectInput(f *testing.F) {
+	for _, seed := range decodeSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := inspectInput(data); err != nil {
+			return
+		}
+		if cfg, err := inputConfig(data, inputFormat(data)); err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+			t.Errorf("accepted the image of %dx%d pixels (%v)", cfg.Width, cfg.Height, err)
+		}
+	})
+}
+
+// FuzzRequestImage checks that the extraction of the image from the raw, the base64 encoded
+// and the multipart request bodies never panics.
+func FuzzRequestImage(f *testing.F) {
+	img := testImage(f)
+	form, formType := multipartBody(f, img)
+	f.Add(img, "")
+	f.Add(form, formType)
+	f.Add(form[:len(form)/2], formType)
+	f.Add([]byte("aGVsbG8="), "text/plain")
+	f.Add([]byte("--b\r\n\r\n--b--"), "multipart/form-data; boundary=b")
+	f.Fuzz(func(t *testing.T, body []byte, contentType string) {
+		requestImage(&RequestContext{Body: body, Header: http.Header{"Content-Type": {contentType}}})
+	})
+}
@@ -0,0 +1,108 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// thumbnailSize is the size of the gallery thumbnails.
+const thumbnailSize = 320
+
+// galleryKey returns the storage key of the gallery of the batch, set through the batch_gallery
+// environment variable, where {name} and {time} are replaced as in the report key. An empty key
+// disables the gallery.
+func galleryKey(name string, started time.Time) string {
+	tmpl := os.Getenv("batch_gallery")
+	if tmpl == "" {
+		return ""
+	}
+	return strings.NewReplacer("{name}", name, "{time}", started.Format("20060102T150405Z")).Replace(tmpl)
+}
+
+// thumbnailKey returns the storage key of the thumbnail of the output, in the thumbs folder next to it.
+func thumbnailKey(output string) string {
+	name := path.Base(output)
+	return path.Join(path.Dir(output), "thumbs", strings.TrimSuffix(name, path.Ext(name))+".jpg")
+}
+
+// makeThumbnail returns the downscaled JPEG copy of the raster output. The outputs which can't
+// be decoded, like the vector and the plotter formats, have no thumbnail.
+func makeThumbnail(out []byte) ([]byte, bool) {
+	img, _, err := image.Decode(bytes.NewReader(out))
+	if err != nil {
+		return nil, false
+	}
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, downscale(img, thumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// renderGallery renders the static gallery of the batch report, linking the thumbnails
+// to the full results, with the parameters of each result shown on hover.
+func renderGallery(report *batchReport) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := galleryTemplate.Execute(buf, report); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var galleryTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{if .Name}}{{.Name}}{{else}}{{.Manifest}}{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+.grid { display: flex; flex-wrap: wrap; gap: 1em; }
+figure { margin: 0; width: 320px; }
+figure img { max-width: 320px; max-height: 320px; border: 1px solid #ddd; }
+figcaption { font-size: 0.8em; word-break: break-all; }
+.missing { display: flex; align-items: center; justify-content: center; width: 320px; height: 120px; border: 1px dashed #aaa; color: #888; }
+.failed { color: #b00; }
+</style>
+</head>
+<body>
+<h1>{{if .Name}}{{.Name}}{{else}}{{.Manifest}}{{end}}</h1>
+<p>{{.Processed}} processed, {{.Failed}} failed, finished {{.Finished.Format "2006-01-02 15:04:05 MST"}}</p>
+<div class="grid">
+{{range .Items}}<figure title="{{.Params}}">
+{{if .Error}}<div class="missing failed">failed</div>
+<figcaption class="failed">{{.Source}}: {{.Error}}</figcaption>
+{{else}}<a href="{{.URL}}">{{if .Thumbnail}}<img src="{{.Thumbnail}}" alt="{{.Output}}" loading="lazy">{{else}}<div class="missing">{{.Output}}</div>{{end}}</a>
+<figcaption>{{.Output}}</figcaption>
+{{end}}</figure>
+{{end}}</div>
+</body>
+</html>
+`))
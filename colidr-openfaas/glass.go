@@ -0,0 +1,224 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// defaultCellSize is the default superpixel size of the stained glass, in pixels.
+	defaultCellSize = 24
+	// defaultCellStretch is the default elongation of the superpixels along the flow.
+	defaultCellStretch = 2.0
+	// glassCompactness weights the spatial distance against the color distance of the clustering.
+	glassCompactness = 10.0
+	// glassIterations is the number of the clustering iterations.
+	glassIterations = 5
+)
+
+// glassCell is a superpixel cluster: its mean Lab color, its center and the unit tangent
+// of the flow at the center.
+type glassCell struct {
+	l, a, b float64
+	y, x    float64
+	ty, tx  float64
+}
+
+// stainedGlass renders the stained glass mosaic of the source image. The image is segmented into
+// flow-aligned superpixels by a SLIC clustering, whose spatial distance is measured in the frame
+// of the edge tangent flow at the seed, with the distance along the flow shrunk by the stretch,
+// so the cells elongate along the flow. The cells are filled with their average color, then
+// the cell borders and the coherent lines are drawn over them like the lead came.
+func (c *Cld) stainedGlass(size int, stretch float64) (gocv.Mat, error) {
+	rows, cols := c.tone.Rows(), c.tone.Cols()
+
+	bgr := c.color
+	if bgr.Empty() {
+		bgr = newMat()
+		defer closeMat(&bgr)
+		gocv.CvtColor(c.tone, bgr, gocv.ColorGrayToBGR)
+	}
+	lab := newMat()
+	defer closeMat(&lab)
+	gocv.CvtColor(bgr, lab, gocv.ColorBGRToLab)
+	colors, labData := bgr.ToBytes(), lab.ToBytes()
+
+	labels, count := flowSuperpixels(labData, flowGrid(c.etf.flowField), rows, cols, size, stretch)
+
+	fills := make([][4]float64, count)
+	for i, k := range labels {
+		f := &fills[k]
+		f[0] += float64(colors[3*i])
+		f[1] += float64(colors[3*i+1])
+		f[2] += float64(colors[3*i+2])
+		f[3]++
+	}
+
+	lines, err := c.generateLines()
+	if err != nil {
+		return gocv.Mat{}, err
+	}
+	out := make([]byte, 3*rows*cols)
+	for i, k := range labels {
+		y, x := i/cols, i%cols
+		border := (x+1 < cols && labels[i+1] != k) || (y+1 < rows && labels[i+cols] != k)
+		if border {
+			continue
+		}
+		// The lines darken the fill, keeping their anti-aliased edges.
+		f, shade := fills[k], float64(lines[i])/255
+		for ch := 0; ch < 3; ch++ {
+			out[3*i+ch] = uint8(round(f[ch] / f[3] * shade))
+		}
+	}
+	return newMatFromBytes(rows, cols, gocv.MatTypeCV8UC3, out)
+}
+
+// flowSuperpixels clusters the pixels of the Lab image into the flow-aligned superpixels of the
+// size, returning the cell label of each pixel and the number of the cells.
+func flowSuperpixels(labData []byte, flow []gocv.Vecf, rows, cols, size int, stretch float64) ([]int32, int) {
+	tangent := func(y, x float64) (float64, float64) {
+		yi := int(math.Max(0, math.Min(float64(rows-1), y)))
+		xi := int(math.Max(0, math.Min(float64(cols-1), x)))
+		v := flow[yi*cols+xi]
+		norm := math.Hypot(float64(v[0]), float64(v[1]))
+		if norm == 0 {
+			return 0, 1
+		}
+		return float64(v[0]) / norm, float64(v[1]) / norm
+	}
+
+	// The seeds are placed greedily on a fine grid, keeping the cell size apart in the flow frame,
+	// so they space out along the flow by the stretch.
+	reach := int(math.Ceil(float64(size) * stretch))
+	bucketCols := cols/reach + 1
+	buckets := make(map[int][]int)
+	var cells []glassCell
+	// The grid is centered on the images smaller than the step, so they get a seed as well.
+	step := maxInt(1, size/2)
+	for y := minInt(step, rows) / 2; y < rows; y += step {
+		for x := minInt(step, cols) / 2; x < cols; x += step {
+			ty, tx := tangent(float64(y), float64(x))
+			by, bx := y/reach, x/reach
+			free := true
+			for ny := by - 1; ny <= by+1 && free; ny++ {
+				for nx := bx - 1; nx <= bx+1 && free; nx++ {
+					if nx < 0 || nx >= bucketCols {
+						continue
+					}
+					for _, k := range buckets[ny*bucketCols+nx] {
+						dy, dx := cells[k].y-float64(y), cells[k].x-float64(x)
+						along := (dy*ty + dx*tx) / stretch
+						across := dx*ty - dy*tx
+						if along*along+across*across < float64(size*size) {
+							free = false
+							break
+						}
+					}
+				}
+			}
+			if !free {
+				continue
+			}
+			i := 3 * (y*cols + x)
+			buckets[by*bucketCols+bx] = append(buckets[by*bucketCols+bx], len(cells))
+			cells = append(cells, glassCell{
+				l: float64(labData[i]), a: float64(labData[i+1]), b: float64(labData[i+2]),
+				y: float64(y), x: float64(x), ty: ty, tx: tx,
+			})
+		}
+	}
+
+	labels := make([]int32, rows*cols)
+	dist := make([]float64, rows*cols)
+	spatial := (glassCompactness / float64(size)) * (glassCompactness / float64(size))
+
+	for iter := 0; iter < glassIterations; iter++ {
+		for i := range dist {
+			dist[i], labels[i] = math.Inf(1), -1
+		}
+		for k, cell := range cells {
+			cy, cx := int(cell.y), int(cell.x)
+			for y := maxInt(0, cy-reach); y < minInt(rows, cy+reach+1); y++ {
+				for x := maxInt(0, cx-reach); x < minInt(cols, cx+reach+1); x++ {
+					dy, dx := float64(y)-cell.y, float64(x)-cell.x
+					along := (dy*cell.ty + dx*cell.tx) / stretch
+					across := dx*cell.ty - dy*cell.tx
+
+					i := y*cols + x
+					dl := float64(labData[3*i]) - cell.l
+					da := float64(labData[3*i+1]) - cell.a
+					db := float64(labData[3*i+2]) - cell.b
+					d := dl*dl + da*da + db*db + spatial*(along*along+across*across)
+					if d < dist[i] {
+						dist[i], labels[i] = d, int32(k)
+					}
+				}
+			}
+		}
+
+		// Move the cells to the centroids of their pixels, and realign them with the flow there.
+		sums := make([][6]float64, len(cells))
+		for i, k := range labels {
+			if k < 0 {
+				continue
+			}
+			s := &sums[k]
+			s[0] += float64(labData[3*i])
+			s[1] += float64(labData[3*i+1])
+			s[2] += float64(labData[3*i+2])
+			s[3] += float64(i / cols)
+			s[4] += float64(i % cols)
+			s[5]++
+		}
+		for k, s := range sums {
+			if s[5] == 0 {
+				continue
+			}
+			cell := &cells[k]
+			cell.l, cell.a, cell.b = s[0]/s[5], s[1]/s[5], s[2]/s[5]
+			cell.y, cell.x = s[3]/s[5], s[4]/s[5]
+			cell.ty, cell.tx = tangent(cell.y, cell.x)
+		}
+	}
+
+	// The pixels out of the reach of every cell join their left or upper neighbor.
+	for i, k := range labels {
+		if k >= 0 {
+			continue
+		}
+		switch {
+		case i%cols > 0:
+			labels[i] = labels[i-1]
+		case i >= cols:
+			labels[i] = labels[i-cols]
+		default:
+			labels[i] = 0
+		}
+	}
+
+	return labels, len(cells)
+}
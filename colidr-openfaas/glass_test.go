@@ -0,0 +1,39 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import "testing"
+
+func TestFlowSuperpixelsTinyImages(t *testing.T) {
+	forTinySizes(t, func(t *testing.T, rows, cols int) {
+		labels, count := flowSuperpixels(tinyPattern(rows, cols, 3), tinyFlow(rows, cols), rows, cols, 24, 2)
+		if count < 1 {
+			t.Fatalf("no cells")
+		}
+		for i, k := range labels {
+			if k < 0 || int(k) >= count {
+				t.Fatalf("pixel %d: label %d out of the %d cells", i, k, count)
+			}
+		}
+	})
+}
@@ -24,15 +24,12 @@ package function
 
 import (
 	"bytes"
-	"encoding/base64"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
-	"image/jpeg"
-	"io"
-	"io/ioutil"
+	"image"
 	"net/http"
 	"net/url"
-	"os"
-	"strconv"
 	"strings"
 	"time"
 
@@ -41,151 +38,385 @@ import (
 
 // Handle a serverless request
 func Handle(req []byte) string {
-	var (
-		data   []byte
-		image  []byte
-		params url.Values
-	)
+	return string(HandleBytes(req))
+}
+
+// HandleBytes handles a serverless request like Handle, returning the response body as is. The
+// classic entrypoints should write it to the standard output without any formatting, since
+// appending a newline, like the default template does, alters the binary images.
+func HandleBytes(req []byte) []byte {
+	return chain(handleRequest, defaultMiddlewares()...)(requestFromEnv(req)).body
+}
+
+// renderOutput returns the output mode the image is processed in. The raw output mode is
+// the encoded image, like the image mode, guaranteed to be passed through unaltered, while
+// the hash output mode describes the encoded image.
+func renderOutput(mode string) string {
+	if mode == "raw" || mode == "hash" {
+		return "image"
+	}
+	return mode
+}
+
+// handleRequest is the core of the classic watchdog handler, dispatching the request
+// based on the input mode and processing the received image.
+func handleRequest(ctx *RequestContext) *response {
+	var data []byte
 
-	if val, exists := os.LookupEnv("input_mode"); exists && val == "url" {
-		inputURL := strings.TrimSpace(string(req))
+	switch ctx.InputMode {
+	case "slack":
+		if err := verifySlackRequest(ctx); err != nil {
+			return errorResponse(http.StatusUnauthorized, "%v", err).withCode("unauthorized")
+		}
+		return newResponse(http.StatusOK, []byte(handleSlack(ctx)))
+	case "discord":
+		if err := verifyDiscordRequest(ctx); err != nil {
+			return errorResponse(http.StatusUnauthorized, "%v", err).withCode("unauthorized")
+		}
+		return newResponse(http.StatusOK, []byte(handleDiscord(ctx)))
+	case "telegram":
+		if err := verifyTelegramRequest(ctx); err != nil {
+			return errorResponse(http.StatusUnauthorized, "%v", err).withCode("unauthorized")
+		}
+		return newResponse(http.StatusOK, []byte(handleTelegram(ctx)))
+	case "shopify":
+		if err := verifyShopifyRequest(ctx); err != nil {
+			return errorResponse(http.StatusUnauthorized, "%v", err).withCode("unauthorized")
+		}
+		return newResponse(http.StatusOK, []byte(handleShopify(ctx)))
+	}
+
+	if ctx.InputMode == "url" {
+		inputURL := strings.TrimSpace(string(ctx.Body))
 		u, err := url.Parse(inputURL)
 		if err != nil {
-			return fmt.Sprintf("Unable to parse url: %s", err)
+			return errorResponse(http.StatusBadRequest, "Unable to parse url: %s", err)
 		}
 		link := strings.Split(inputURL, "?")[0]
-		params = u.Query()
+		// In url input mode the parameters are provided through the image URL.
+		ctx.Params = u.Query()
 
-		resp, err := http.Get(link)
-		if err != nil {
-			return fmt.Sprintf("unable to download image file from URI: %s, status %v", inputURL, resp.Status)
+		data, err = fetchImage(link, fetchHeaders(ctx))
+		if err == errUploadTooLarge {
+			return errorResponse(http.StatusRequestEntityTooLarge, "the image exceeds the maximum allowed size of %d bytes", maxUploadSize()).withCode("upload_too_large")
+		}
+		if _, ok := err.(*imageSizeError); ok {
+			return errorFor(err)
 		}
-		defer resp.Body.Close()
-
-		data, err = ioutil.ReadAll(resp.Body)
-
 		if err != nil {
-			return fmt.Sprintf("unable to read response body: %s", err)
+			return errorResponse(http.StatusBadGateway, "unable to download image file from URI: %s, %v", inputURL, err).withCode("download_failed")
 		}
 	} else {
-		var decodeError error
-		data, decodeError = base64.StdEncoding.DecodeString(string(req))
-		if decodeError != nil {
-			data = req
+		var err error
+		if data, err = requestImage(ctx); err != nil {
+			return errorResponse(http.StatusBadRequest, "%s", err)
 		}
 
-		contentType := http.DetectContentType(req)
-		if contentType != "image/jpeg" && contentType != "image/png" {
-			return fmt.Sprintf("Only jpeg or png images, either raw uncompressed bytes or base64 encoded are acceptable inputs, you uploaded: %s", contentType)
+		if inputFormat(data) == "" {
+			return errorResponse(http.StatusUnsupportedMediaType, "Only images in one of the supported formats (%s), either raw bytes, base64 encoded or multipart uploads are acceptable inputs, you uploaded: %s",
+				strings.Join(inputFormats(), ", "), http.DetectContentType(data))
 		}
 	}
+
+	// The suspicious inputs are rejected before spending resources on decoding them.
+	if err := inspectInput(data); err != nil {
+		return errorFor(err)
+	}
+
+	negotiateOutput(ctx)
+	rp, err := ctx.resolve()
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "invalid parameters: %v", err).withCode("invalid_parameters")
+	}
+	// Under high load the iterations are transparently reduced, which is flagged in the response.
+	reduced := adaptIterations(&rp.opts, currentLoad())
+
+	// With a deadline, a draft render races against the full one.
 	var (
-		sr, sm, sc, rho, tau float64 = 2.6, 3.0, 1.0, 0.98, 0.98
-		k, ei, di, bl        int64   = 2, 2, 1, 3
-		ai                           = true
+		res     []byte
+		quality string
+		output  = renderOutput(ctx.OutputMode)
 	)
-	if params.Get("sr") != "" {
-		sr, _ = strconv.ParseFloat(params.Get("sr"), 64)
+	if deadline, ok := renderDeadline(ctx); ok && !rp.dryRun && !rp.exportRecipe {
+		res, quality, err = raceRender(data, rp, output, deadline)
+	} else {
+		res, err = pipeline.Process(data, rp, output)
 	}
-	if params.Get("sm") != "" {
-		sm, _ = strconv.ParseFloat(params.Get("sm"), 64)
+	if err == nil && ctx.OutputMode == "hash" {
+		res, err = hashResult(res, rp)
 	}
-	if params.Get("sc") != "" {
-		sc, _ = strconv.ParseFloat(params.Get("sc"), 64)
+	if err != nil {
+		return errorFor(err)
 	}
-	if params.Get("rho") != "" {
-		rho, _ = strconv.ParseFloat(params.Get("rho"), 64)
+	resp := newResponse(http.StatusOK, res)
+	if ctx.OutputMode == "hash" {
+		resp.header.Set("Content-Type", "application/json")
 	}
-	if params.Get("tau") != "" {
-		tau, _ = strconv.ParseFloat(params.Get("tau"), 32)
+	if ctx.OutputMode == "raw" {
+		resp.header.Set("Content-Type", detectContentType(res, rp.encoderFormat()))
 	}
-	if params.Get("k") != "" {
-		k, _ = strconv.ParseInt(params.Get("k"), 10, 32)
+	if reduced != "" {
+		resp.header.Set("X-Reduced-Iterations", reduced)
 	}
-	if params.Get("ei") != "" {
-		ei, _ = strconv.ParseInt(params.Get("ei"), 10, 32)
+	if quality != "" {
+		resp.header.Set("X-Render-Quality", quality)
 	}
-	if params.Get("di") != "" {
-		di, _ = strconv.ParseInt(params.Get("di"), 10, 32)
+	return resp
+}
+
+// process generates the coherent line drawing of the source image and returns it encoded
+// in the format requested by the parameters. The output mode selects between the raw
+// image and the json response.
+func process(data []byte, params url.Values, output string) ([]byte, error) {
+	rp, err := parseParams(params)
+	if err != nil {
+		return nil, &Error{Kind: ErrInvalidInput, Code: "invalid_parameters", Err: fmt.Errorf("invalid parameters: %v", err)}
 	}
-	if params.Get("bl") != "" {
-		bl, _ = strconv.ParseInt(params.Get("bl"), 10, 32)
+	return processParams(data, rp, output)
+}
+
+// processParams processes the image with the already resolved parameters.
+func processParams(data []byte, rp *requestParams, output string) ([]byte, error) {
+	var (
+		image []byte
+		err   error
+	)
+
+	if rp.exportRecipe {
+		return json.MarshalIndent(exportRecipe(rp), "", "  ")
 	}
-	if params.Get("ai") != "" {
-		ai, _ = strconv.ParseBool(params.Get("ai"))
+
+	if rp.dryRun {
+		res, err := dryRun(data, rp)
+		if err != nil {
+			return nil, wrapError(err, "unable to decode the image header")
+		}
+		return res, nil
 	}
 
-	opts := options{
-		sigmaR:        sr,
-		sigmaM:        sm,
-		sigmaC:        sc,
-		rho:           rho,
-		tau:           float32(tau),
-		etfKernel:     int(k),
-		etfIteration:  int(ei),
-		fDogIteration: int(di),
-		blurSize:      int(bl),
-		antiAlias:     ai,
+	if rp.analyze {
+		res, err := analyze(data)
+		if err != nil {
+			return nil, wrapError(err, "unable to decode the image")
+		}
+		return res, nil
 	}
 
-	tmpfile, err := ioutil.TempFile("/tmp", "image")
-	if err != nil {
-		return fmt.Sprintf("unable to create temporary file: %v", err)
+	rp.sourceHash = fmt.Sprintf("%x", sha256.Sum256(data))
+	original := data
+
+	if isAnimatedWebP(data) {
+		res, err := renderAnimation(data, rp)
+		if err != nil {
+			return nil, err
+		}
+		if output == "json_image" {
+			return signResponse(res, integrityKey(), nil)
+		}
+		return res, nil
 	}
-	defer os.Remove(tmpfile.Name())
 
-	_, err = io.Copy(tmpfile, bytes.NewBuffer(data))
-	if err != nil {
-		return fmt.Sprintf("unable to copy the source URI to the destination file")
+	if isTruncatedJPEG(data) {
+		if !rp.salvage {
+			return nil, &truncatedInputError{size: len(data)}
+		}
+		if data, err = salvageJPEG(data); err != nil {
+			return nil, err
+		}
 	}
 
-	var output string
-	query, err := url.ParseQuery(os.Getenv("Http_Query"))
-	if err == nil {
-		output = query.Get("output")
+	alpha := rp.sourceAlpha(data)
+	if rp.useICC {
+		if data, err = applyICC(data, rp.linear); err != nil {
+			return nil, wrapError(err, "unable to apply the embedded ICC profile")
+		}
 	}
 
-	if val, exists := os.LookupEnv("output_mode"); exists {
-		output = val
+	// The ascii output mode renders the line drawing as text.
+	if output == "ascii" {
+		rp.format = "ascii"
+	}
+	// The coordinator mode renders the large images in tiles across the function replicas.
+	if rp.tiled(output) {
+		res, err := renderTiles(data, rp, output)
+		if _, ok := err.(*blankImageError); ok && rp.blankMode == "passthrough" {
+			return original, nil
+		}
+		return res, err
 	}
 
-	if output == "image" || output == "json_image" {
-		cld, err := NewCLD(tmpfile.Name(), opts)
+	if output == "image" || output == "json_image" || output == "ascii" {
+		start := time.Now()
+		cld, pinned, err := warmed.lookup(rp)
+		if !pinned {
+			cld, err = NewCLDFromBytes(data, rp.opts)
+		}
+		if _, ok := err.(*blankImageError); ok {
+			if rp.blankMode == "passthrough" {
+				return original, nil
+			}
+			return nil, err
+		}
 		if err != nil {
-			return fmt.Sprintf("cannot initialize CLD: %v", err)
+			return nil, wrapError(err, "cannot initialize CLD")
+		}
+		defer cld.Close()
+		if alpha != nil {
+			if err := cld.attachAlpha(alpha); err != nil {
+				return nil, wrapError(err, "cannot apply the alpha mask")
+			}
 		}
 
-		cldData := cld.GenerateCld()
+		return render(cld, rp, output, start)
+	}
+
+	return image, nil
+}
 
-		rows, cols := cld.image.Rows(), cld.image.Cols()
-		mat, err := gocv.NewMatFromBytes(rows, cols, gocv.MatTypeCV8UC1, cldData)
-		if err != nil {
-			return fmt.Sprintf("error retrieving the byte array: %v", err)
+// render generates the line drawing, or the requested intermediate map, and encodes it
+// in the requested format. The start time is used for measuring the processing time.
+func render(cld *Cld, rp *requestParams, output string, start time.Time) ([]byte, error) {
+	var err error
+
+	// The before/after animation starts with the source image, which is altered by the generation.
+	var before image.Image
+	if rp.format == "apng" {
+		if before, err = cld.image.ToImage(); err != nil {
+			return nil, fmt.Errorf("error converting matrix to image: %v", err)
 		}
+	}
 
-		filename := fmt.Sprintf("/tmp/%d.jpg", time.Now().UnixNano())
-		dst, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0755)
+	var mat gocv.Mat
+	switch {
+	case rp.outMap == "magnitude":
+		mat = cld.etf.MagnitudeMap()
+	case rp.style == "flow":
+		if mat, err = cld.flowPainting(rp.flowLength); err != nil {
+			return nil, fmt.Errorf("error rendering the flow painting: %v", err)
+		}
+	case rp.style == "glass":
+		if mat, err = cld.stainedGlass(rp.cellSize, rp.cellStretch); err != nil {
+			return nil, fmt.Errorf("error rendering the stained glass: %v", err)
+		}
+	default:
+		// The generation alters the source image, so keep a copy of it for the retry.
+		var orig gocv.Mat
+		if rp.retry {
+			orig = cloneMat(cld.image)
+		}
+		cldData, err := cld.generateLines()
 		if err != nil {
-			return fmt.Sprintf("unable to open the destination file: %v", err)
+			closeMat(&orig)
+			return nil, fmt.Errorf("error generating the lines: %v", err)
 		}
-		defer os.Remove(filename)
 
-		img, err := mat.ToImage()
-		if err != nil {
-			return fmt.Sprintf("error converting matrix to image: %v", err)
+		if rp.retry {
+			if coverage := lineCoverage(cldData); coverage < rp.minCoverage {
+				relaxed := relaxParams(cld.options)
+				retried, err := newCLDWithEtf(orig, cld.etf, relaxed)
+				if err != nil {
+					closeMat(&orig)
+					return nil, err
+				}
+				defer retried.Close()
+				// The retried CLD takes over the alpha mask, released on its Close.
+				retried.alpha, cld.alpha = cld.alpha, gocv.Mat{}
+
+				cld = retried
+				if cldData, err = cld.generateLines(); err != nil {
+					return nil, fmt.Errorf("error generating the lines: %v", err)
+				}
+				rp.relaxed = &relaxedParams{
+					Tau:      relaxed.tau,
+					Rho:      relaxed.rho,
+					Coverage: lineCoverage(cldData),
+				}
+			} else {
+				closeMat(&orig)
+			}
 		}
 
-		err = jpeg.Encode(dst, img, &jpeg.Options{Quality: 100})
+		mat, err = cld.ResultMat(gocv.MatTypeCV8UC1)
 		if err != nil {
-			return fmt.Sprintf("cannot encode the jpeg image: %v", err)
+			return nil, fmt.Errorf("error retrieving the result: %v", err)
 		}
+	}
+	defer closeMat(&mat)
+
+	// Feed the runtime model used for the estimates with the measured processing time.
+	if rp.drawsLines() {
+		recordRuntime(rp.opts, mat.Rows()*mat.Cols(), time.Since(start).Seconds())
+	}
+
+	img, err := mat.ToImage()
+	if err != nil {
+		return nil, fmt.Errorf("error converting matrix to image: %v", err)
+	}
+	src := EncodeSource{Image: img, Before: before}
+	if rp.drawsLines() {
+		src.cld = cld
+		if len(rp.layerTaus) > 0 {
+			src.Image = cld.renderLayers(rp.layerTaus, rp.layerColors)
+		}
+		if rp.encoderFormat() == "png" {
+			src.Image = cld.withAlpha(src.Image)
+		}
+	}
+	return encodeOutput(src, rp, output)
+}
+
+// encodeOutput encodes the rendered image in the requested format, applying the print bleed,
+// the embedded ICC profile and the content credentials, then wraps it for the json_image output.
+func encodeOutput(src EncodeSource, rp *requestParams, output string) ([]byte, error) {
+	enc, err := lookupEncoder(rp.encoderFormat())
+	if err != nil {
+		return nil, err
+	}
+	// The branding of the deployment is mandatory, so the formats which can't carry it are refused.
+	brand, err := deploymentBranding()
+	if err != nil {
+		return nil, err
+	}
+	if brand != nil {
+		switch rp.encoderFormat() {
+		case "svg", "gcode", "dst", "ascii":
+			return nil, newError(ErrUnsupportedFormat, "the %s format is not available on this deployment", rp.encoderFormat())
+		}
+		src.Image = brand.apply(src.Image)
+		if src.Before != nil {
+			src.Before = brand.apply(src.Before)
+		}
+	}
+	if rp.print.enabled {
+		src.Image = addBleed(src.Image, rp.print)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := enc.Encode(buf, src, rp.encodeOptions()); err != nil {
+		return nil, wrapError(err, "cannot encode the output image")
+	}
+	if rp.embedICC {
+		embedded := embedICC(buf.Bytes(), rp.encoderFormat(), outputProfile(src.Image))
+		buf = bytes.NewBuffer(embedded)
+	}
+
+	result := buf.Bytes()
+	if rp.iptc {
+		result = embedMetadata(result, rp.keywords(), rp.description)
+	}
+	if rp.c2pa {
+		if result, err = embedC2PA(result, rp); err != nil {
+			return nil, err
+		}
+	}
 
-		// Retrieve the resized image.
-		image, err = ioutil.ReadFile(filename)
+	if output == "json_image" {
+		res, err := signResponse(result, integrityKey(), rp.relaxed)
 		if err != nil {
-			return fmt.Sprintf("unable to read the generated image: %v", err)
+			return nil, fmt.Errorf("unable to encode the json response: %v", err)
 		}
+		return res, nil
 	}
 
-	return string(image)
+	return result, nil
 }
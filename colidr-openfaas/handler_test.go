@@ -0,0 +1,215 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"handler/function/synth"
+)
+
+// stubPipeline replaces the processor of the handlers, returning the function restoring it.
+func stubPipeline(p processorFunc) func() {
+	orig := pipeline
+	pipeline = p
+	return func() { pipeline = orig }
+}
+
+// testImage returns a small PNG encoded image of a synthetic circle.
+func testImage(t testing.TB) []byte {
+	img := synth.Circle{CX: 8, CY: 8, Radius: 5, Fg: 32, Bg: 224}.Render(16, 16)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// serveRequest runs the request through the handler and the default middlewares.
+func serveRequest(body []byte, header http.Header, query string) *response {
+	values, _ := url.ParseQuery(query)
+	if header == nil {
+		header = make(http.Header)
+	}
+	ctx := newRequestContext(http.MethodPost, body, header, values, "192.0.2.1:1234")
+	return chain(handleRequest, defaultMiddlewares()...)(ctx)
+}
+
+// multipartBody returns the multipart form carrying the data in the image field.
+func multipartBody(t testing.TB, data []byte) ([]byte, string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile(multipartField, "image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.Close()
+	return buf.Bytes(), mw.FormDataContentType()
+}
+
+func TestHandleRequest(t *testing.T) {
+	img := testImage(t)
+	form, formType := multipartBody(t, img)
+
+	tests := []struct {
+		name        string
+		input       []byte
+		contentType string
+		query       string
+		// result and err are returned by the stub processor.
+		result []byte
+		err    error
+
+		status  int
+		code    string
+		want    string
+		headers map[string]string
+		// processed is set when the stub processor has to receive the image.
+		processed bool
+	}{
+		{name: "raw upload", input: img, result: []byte("drawing"), status: http.StatusOK, want: "drawing", processed: true},
+		{name: "base64 upload", input: []byte(base64.StdEncoding.EncodeToString(img)), result: []byte("drawing"), status: http.StatusOK, want: "drawing", processed: true},
+		{name: "multipart upload", input: form, contentType: formType, result: []byte("drawing"), status: http.StatusOK, want: "drawing", processed: true},
+		{name: "not an image", input: []byte("this is not an image"), status: http.StatusUnsupportedMediaType, code: "unsupported_format"},
+		{name: "invalid parameters", input: img, query: "ei=100", status: http.StatusBadRequest, code: "invalid_parameters"},
+		{name: "invalid input", input: img, err: newError(ErrInvalidInput, "malformed image"), status: http.StatusBadRequest, code: "invalid_input", processed: true},
+		{name: "coded error", input: img, err: &Error{Kind: ErrTooLarge, Code: "image_too_large", Err: errors.New("too large")}, status: http.StatusRequestEntityTooLarge, code: "image_too_large", processed: true},
+		{name: "internal error", input: img, err: errors.New("failure"), status: http.StatusInternalServerError, code: "internal", processed: true},
+		{name: "raw output", input: img, query: "output=raw&format=png", result: img, status: http.StatusOK, headers: map[string]string{"Content-Type": "image/png"}, processed: true},
+		{name: "hash output", input: img, query: "output=hash", result: img, status: http.StatusOK, headers: map[string]string{"Content-Type": "application/json"}, processed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var processed []byte
+			defer stubPipeline(func(data []byte, rp *requestParams, output string) ([]byte, error) {
+				// The raw and the hash output modes are processed as images.
+				if output != "image" {
+					t.Errorf("processed in the %q output mode, expected image", output)
+				}
+				processed = data
+				return tt.result, tt.err
+			})()
+
+			header := make(http.Header)
+			if tt.contentType != "" {
+				header.Set("Content-Type", tt.contentType)
+			}
+			query := tt.query
+			if query == "" {
+				query = "output=image"
+			}
+			res := serveRequest(tt.input, header, query)
+			if res.status != tt.status {
+				t.Fatalf("status %d, expected %d: %s", res.status, tt.status, res.body)
+			}
+			if code := res.header.Get("X-Error-Code"); code != tt.code {
+				t.Errorf("error code %q, expected %q", code, tt.code)
+			}
+			if tt.want != "" && string(res.body) != tt.want {
+				t.Errorf("body %q, expected %q", res.body, tt.want)
+			}
+			for name, value := range tt.headers {
+				if got := res.header.Get(name); got != value {
+					t.Errorf("%s header %q, expected %q", name, got, value)
+				}
+			}
+			switch {
+			case tt.processed && !bytes.Equal(processed, img):
+				t.Errorf("the processor received %d bytes, expected the %d bytes of the image", len(processed), len(img))
+			case !tt.processed && processed != nil:
+				t.Errorf("the processor was called")
+			}
+		})
+	}
+}
+
+func TestHandleRequestHash(t *testing.T) {
+	img := testImage(t)
+	defer stubPipeline(func(data []byte, rp *requestParams, output string) ([]byte, error) {
+		return img, nil
+	})()
+
+	res := serveRequest(img, nil, "output=hash")
+	if res.status != http.StatusOK {
+		t.Fatalf("status %d: %s", res.status, res.body)
+	}
+	var hr hashResponse
+	if err := json.Unmarshal(res.body, &hr); err != nil {
+		t.Fatalf("invalid hash response: %v", err)
+	}
+	sum := sha256.Sum256(img)
+	if hr.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("sha256 %s, expected %x", hr.SHA256, sum)
+	}
+	if hr.Size != len(img) || hr.Width != 16 || hr.Height != 16 {
+		t.Errorf("described %d bytes of %dx%d, expected %d bytes of 16x16", hr.Size, hr.Width, hr.Height, len(img))
+	}
+}
+
+func TestHandleUploadContentType(t *testing.T) {
+	img := testImage(t)
+	var format string
+	defer stubPipeline(func(data []byte, rp *requestParams, output string) ([]byte, error) {
+		format = rp.encoderFormat()
+		return img, nil
+	})()
+
+	tests := []struct {
+		query  string
+		header http.Header
+		want   string
+	}{
+		{"format=png", nil, "image/png"},
+		{"", http.Header{"Accept": {"image/webp"}}, "image/webp"},
+		{`recipe_json={"format":"svg"}`, http.Header{"Accept": {"image/webp"}}, "image/svg+xml"},
+		{"", http.Header{"X-Recipe": {`{"format":"tiff"}`}, "Accept": {"image/webp"}}, "image/tiff"},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		if tt.header == nil {
+			tt.header = make(http.Header)
+		}
+		ctx := newRequestContext(http.MethodPost, img, tt.header, values, "192.0.2.1:1234")
+		res := handleUpload(ctx)
+		if res.status != http.StatusOK {
+			t.Fatalf("%q: status %d: %s", tt.query, res.status, res.body)
+		}
+		if ct := res.header.Get("Content-Type"); ct != tt.want {
+			t.Errorf("%q %v: content type %s, expected %s", tt.query, tt.header, ct, tt.want)
+		}
+		if encoders[format].MIMEType() != tt.want {
+			t.Errorf("%q %v: rendered as %s, expected %s", tt.query, tt.header, format, tt.want)
+		}
+	}
+}
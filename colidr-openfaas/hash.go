@@ -0,0 +1,90 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/color"
+)
+
+// hashResponse is the body of the hash output mode, describing the would-be result,
+// so the deduplication and QA pipelines can decide whether to request the full artifact.
+type hashResponse struct {
+	SHA256       string  `json:"sha256"`
+	Size         int     `json:"size"`
+	ContentType  string  `json:"content_type"`
+	Width        int     `json:"width,omitempty"`
+	Height       int     `json:"height,omitempty"`
+	Coverage     float64 `json:"coverage,omitempty"`
+	SourceSHA256 string  `json:"source_sha256,omitempty"`
+	// Relaxed is set when the image was regenerated with relaxed parameters.
+	Relaxed *relaxedParams `json:"relaxed,omitempty"`
+}
+
+// hashResult returns the content hash and the metrics of the result, in place of the result itself.
+// The response only depends on the result, so the same image and parameters give the same response.
+func hashResult(res []byte, rp *requestParams) ([]byte, error) {
+	sum := sha256.Sum256(res)
+	hr := hashResponse{
+		SHA256:       hex.EncodeToString(sum[:]),
+		Size:         len(res),
+		ContentType:  detectContentType(res, rp.encoderFormat()),
+		SourceSHA256: rp.sourceHash,
+		Relaxed:      rp.relaxed,
+	}
+	if img, _, err := image.Decode(bytes.NewReader(res)); err == nil {
+		b := img.Bounds()
+		hr.Width, hr.Height = b.Dx(), b.Dy()
+		if rp.drawsLines() {
+			hr.Coverage = imageCoverage(img)
+		}
+	}
+	return json.Marshal(hr)
+}
+
+// imageCoverage returns the ratio of the line (dark) pixels of the encoded result,
+// the transparent pixels not being counted.
+func imageCoverage(img image.Image) float64 {
+	b := img.Bounds()
+	var lines, total int
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.At(x, y)
+			if _, _, _, a := c.RGBA(); a < 0x8000 {
+				continue
+			}
+			total++
+			if color.GrayModel.Convert(c).(color.Gray).Y < 128 {
+				lines++
+			}
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(lines) / float64(total)
+}
@@ -0,0 +1,292 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errorMessages are the localized messages of the error codes, keyed by the language.
+// The English messages are the fallback of the missing translations.
+var errorMessages = map[string]map[string]string{
+	"en": {
+		"invalid_input":        "The request is invalid.",
+		"invalid_parameters":   "Some of the parameters are invalid.",
+		"unsupported_format":   "The image format is not supported.",
+		"format_mismatch":      "The file is not a valid image.",
+		"too_large":            "The image is too large.",
+		"image_too_large":      "The image has too many pixels.",
+		"upload_too_large":     "The file is too large.",
+		"response_too_large":   "The result is too large to be returned.",
+		"pixel_ratio_exceeded": "The image is too large for its file size.",
+		"too_many_frames":      "The animation has too many frames.",
+		"blank_image":          "The image is blank, there is nothing to draw.",
+		"truncated_image":      "The image is incomplete.",
+		"download_failed":      "The image could not be downloaded.",
+		"timeout":              "The processing took too long.",
+		"upstream_failed":      "A processing stage failed.",
+		"unauthorized":         "Authentication is required.",
+		"rate_limited":         "Too many requests, please try again later.",
+		"overloaded":           "The service is busy, please try again later.",
+		"method_not_allowed":   "The request method is not allowed.",
+		"not_found":            "The resource was not found.",
+		"internal":             "Something went wrong while processing the image.",
+	},
+	"de": {
+		"invalid_input":        "Die Anfrage ist ungültig.",
+		"invalid_parameters":   "Einige Parameter sind ungültig.",
+		"unsupported_format":   "Das Bildformat wird nicht unterstützt.",
+		"format_mismatch":      "Die Datei ist kein gültiges Bild.",
+		"too_large":            "Das Bild ist zu groß.",
+		"image_too_large":      "Das Bild hat zu viele Pixel.",
+		"upload_too_large":     "Die Datei ist zu groß.",
+		"response_too_large":   "Das Ergebnis ist zu groß, um zurückgegeben zu werden.",
+		"pixel_ratio_exceeded": "Das Bild ist für seine Dateigröße zu groß.",
+		"too_many_frames":      "Die Animation hat zu viele Einzelbilder.",
+		"blank_image":          "Das Bild ist leer, es gibt nichts zu zeichnen.",
+		"truncated_image":      "Das Bild ist unvollständig.",
+		"download_failed":      "Das Bild konnte nicht heruntergeladen werden.",
+		"timeout":              "Die Verarbeitung hat zu lange gedauert.",
+		"upstream_failed":      "Ein Verarbeitungsschritt ist fehlgeschlagen.",
+		"unauthorized":         "Eine Authentifizierung ist erforderlich.",
+		"rate_limited":         "Zu viele Anfragen, bitte später erneut versuchen.",
+		"overloaded":           "Der Dienst ist ausgelastet, bitte später erneut versuchen.",
+		"method_not_allowed":   "Die Anfragemethode ist nicht erlaubt.",
+		"not_found":            "Die Ressource wurde nicht gefunden.",
+		"internal":             "Bei der Verarbeitung des Bildes ist ein Fehler aufgetreten.",
+	},
+	"fr": {
+		"invalid_input":        "La requête est invalide.",
+		"invalid_parameters":   "Certains paramètres sont invalides.",
+		"unsupported_format":   "Le format de l'image n'est pas pris en charge.",
+		"format_mismatch":      "Le fichier n'est pas une image valide.",
+		"too_large":            "L'image est trop grande.",
+		"image_too_large":      "L'image a trop de pixels.",
+		"upload_too_large":     "Le fichier est trop volumineux.",
+		"response_too_large":   "Le résultat est trop volumineux pour être renvoyé.",
+		"pixel_ratio_exceeded": "L'image est trop grande pour la taille de son fichier.",
+		"too_many_frames":      "L'animation a trop d'images.",
+		"blank_image":          "L'image est vide, il n'y a rien à dessiner.",
+		"truncated_image":      "L'image est incomplète.",
+		"download_failed":      "L'image n'a pas pu être téléchargée.",
+		"timeout":              "Le traitement a pris trop de temps.",
+		"upstream_failed":      "Une étape du traitement a échoué.",
+		"unauthorized":         "Une authentification est requise.",
+		"rate_limited":         "Trop de requêtes, veuillez réessayer plus tard.",
+		"overloaded":           "Le service est occupé, veuillez réessayer plus tard.",
+		"method_not_allowed":   "La méthode de la requête n'est pas autorisée.",
+		"not_found":            "La ressource est introuvable.",
+		"internal":             "Une erreur est survenue lors du traitement de l'image.",
+	},
+	"es": {
+		"invalid_input":        "La solicitud no es válida.",
+		"invalid_parameters":   "Algunos parámetros no son válidos.",
+		"unsupported_format":   "El formato de la imagen no es compatible.",
+		"format_mismatch":      "El archivo no es una imagen válida.",
+		"too_large":            "La imagen es demasiado grande.",
+		"image_too_large":      "La imagen tiene demasiados píxeles.",
+		"upload_too_large":     "El archivo es demasiado grande.",
+		"response_too_large":   "El resultado es demasiado grande para ser devuelto.",
+		"pixel_ratio_exceeded": "La imagen es demasiado grande para el tamaño de su archivo.",
+		"too_many_frames":      "La animación tiene demasiados fotogramas.",
+		"blank_image":          "La imagen está vacía, no hay nada que dibujar.",
+		"truncated_image":      "La imagen está incompleta.",
+		"download_failed":      "No se pudo descargar la imagen.",
+		"timeout":              "El procesamiento tardó demasiado.",
+		"upstream_failed":      "Una etapa del procesamiento falló.",
+		"unauthorized":         "Se requiere autenticación.",
+		"rate_limited":         "Demasiadas solicitudes, inténtelo de nuevo más tarde.",
+		"overloaded":           "El servicio está ocupado, inténtelo de nuevo más tarde.",
+		"method_not_allowed":   "El método de la solicitud no está permitido.",
+		"not_found":            "No se encontró el recurso.",
+		"internal":             "Se produjo un error al procesar la imagen.",
+	},
+	"hu": {
+		"invalid_input":        "A kérés érvénytelen.",
+		"invalid_parameters":   "Néhány paraméter érvénytelen.",
+		"unsupported_format":   "A képformátum nem támogatott.",
+		"format_mismatch":      "A fájl nem érvényes kép.",
+		"too_large":            "A kép túl nagy.",
+		"image_too_large":      "A kép túl sok képpontból áll.",
+		"upload_too_large":     "A fájl túl nagy.",
+		"response_too_large":   "Az eredmény túl nagy a visszaküldéshez.",
+		"pixel_ratio_exceeded": "A kép túl nagy a fájlmérethez képest.",
+		"too_many_frames":      "Az animáció túl sok képkockából áll.",
+		"blank_image":          "A kép üres, nincs mit rajzolni.",
+		"truncated_image":      "A kép hiányos.",
+		"download_failed":      "A képet nem sikerült letölteni.",
+		"timeout":              "A feldolgozás túl sokáig tartott.",
+		"upstream_failed":      "Az egyik feldolgozási lépés sikertelen volt.",
+		"unauthorized":         "Hitelesítés szükséges.",
+		"rate_limited":         "Túl sok kérés, kérjük, próbálja újra később.",
+		"overloaded":           "A szolgáltatás túlterhelt, kérjük, próbálja újra később.",
+		"method_not_allowed":   "A kérés metódusa nem engedélyezett.",
+		"not_found":            "Az erőforrás nem található.",
+		"internal":             "Hiba történt a kép feldolgozása közben.",
+	},
+}
+
+var customMessagesOnce sync.Once
+
+// loadCustomMessages merges the messages of the JSON file set through the error_messages
+// environment variable, keyed by the language then by the code, over the built-in ones.
+func loadCustomMessages() {
+	customMessagesOnce.Do(func() {
+		name := os.Getenv("error_messages")
+		if name == "" {
+			return
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			log.Printf("unable to read the error messages: %v", err)
+			return
+		}
+		var custom map[string]map[string]string
+		if err := json.Unmarshal(data, &custom); err != nil {
+			log.Printf("unable to parse the error messages: %v", err)
+			return
+		}
+		for lang, messages := range custom {
+			lang = strings.ToLower(lang)
+			if errorMessages[lang] == nil {
+				errorMessages[lang] = make(map[string]string)
+			}
+			for code, msg := range messages {
+				errorMessages[lang][code] = msg
+			}
+		}
+	})
+}
+
+// statusErrorCodes are the codes of the error responses without a specific one.
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_input",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_format",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusBadGateway:            "upstream_failed",
+	http.StatusServiceUnavailable:    "overloaded",
+	http.StatusGatewayTimeout:        "timeout",
+}
+
+// negotiateLanguage returns the language of the messages preferred by the Accept-Language header,
+// matching the primary language of the tags (e.g. de for de-AT), or an empty string.
+func negotiateLanguage(accept string) string {
+	type languageRange struct {
+		lang string
+		q    float64
+	}
+	var ranges []languageRange
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		r := languageRange{lang: strings.ToLower(strings.TrimSpace(fields[0])), q: 1}
+		for _, f := range fields[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(f), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					r.q = q
+				}
+			}
+		}
+		if i := strings.Index(r.lang, "-"); i > 0 {
+			r.lang = r.lang[:i]
+		}
+		if r.lang != "" && r.q > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	for _, r := range ranges {
+		if _, ok := errorMessages[r.lang]; ok {
+			return r.lang
+		}
+	}
+	return ""
+}
+
+// errorMessage returns the message of the code in the language, falling back to English.
+func errorMessage(lang, code string) string {
+	if msg, ok := errorMessages[lang][code]; ok {
+		return msg
+	}
+	return errorMessages["en"][code]
+}
+
+// errorBody is the JSON body of the error responses.
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// localizeErrors keys the error responses by a stable machine code, set in the X-Error-Code
+// header. The clients accepting JSON receive the code, the human message in the language
+// negotiated through the Accept-Language header and the technical detail, while the others
+// keep receiving the detail as plain text.
+func localizeErrors(next handlerFunc) handlerFunc {
+	return func(ctx *RequestContext) *response {
+		res := next(ctx)
+		if res.status < 400 {
+			return res
+		}
+		code := res.header.Get("X-Error-Code")
+		if code == "" {
+			if code = statusErrorCodes[res.status]; code == "" {
+				code = "internal"
+			}
+			res.header.Set("X-Error-Code", code)
+		}
+		if !strings.Contains(ctx.Header.Get("Accept"), "application/json") {
+			return res
+		}
+
+		loadCustomMessages()
+		lang := negotiateLanguage(ctx.Header.Get("Accept-Language"))
+		if lang == "" {
+			lang = "en"
+		}
+		body, err := json.Marshal(errorBody{
+			Code:    code,
+			Message: errorMessage(lang, code),
+			Detail:  strings.TrimSpace(string(res.body)),
+		})
+		if err != nil {
+			return res
+		}
+		res.body = body
+		res.header.Set("Content-Type", "application/json")
+		res.header.Set("Content-Language", lang)
+		return res
+	}
+}
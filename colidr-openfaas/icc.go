@@ -0,0 +1,529 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// iccProfile contains the information extracted from an embedded ICC profile
+// needed for computing the luminance of the source image.
+type iccProfile struct {
+	colorSpace string
+	// Luminance (Y) contribution of the red, green and blue primaries.
+	lum [3]float64
+	// Tone reproduction curves of the red, green, blue (or gray) channels.
+	trc [3]*toneCurve
+}
+
+// toneCurve describes an ICC tone reproduction curve,
+// either as a sampled table or as a parametric function.
+type toneCurve struct {
+	table  []float64
+	params []float64
+	kind   int
+}
+
+// extractICC returns the raw ICC profile embedded into a JPEG or PNG image, or nil if there is none.
+func extractICC(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return extractJPEGICC(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return extractPNGICC(data)
+	}
+	return nil
+}
+
+// extractJPEGICC concatenates the ICC profile chunks stored in the APP2 segments.
+func extractJPEGICC(data []byte) []byte {
+	var (
+		chunks = make(map[int][]byte)
+		sig    = []byte("ICC_PROFILE\x00")
+	)
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			break
+		}
+		marker := data[i+1]
+		// Stop at the start of scan, the metadata segments are all before it.
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			break
+		}
+		seg := data[i+4 : i+2+size]
+		if marker == 0xe2 && bytes.HasPrefix(seg, sig) && len(seg) > len(sig)+2 {
+			chunks[int(seg[len(sig)])] = seg[len(sig)+2:]
+		}
+		i += 2 + size
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	keys := make([]int, 0, len(chunks))
+	for k := range chunks {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	var profile []byte
+	for _, k := range keys {
+		profile = append(profile, chunks[k]...)
+	}
+	return profile
+}
+
+// extractPNGICC decompresses the profile stored in the iCCP chunk.
+func extractPNGICC(data []byte) []byte {
+	for i := 8; i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		if length < 0 || i+12+length > len(data) {
+			break
+		}
+		chunk := data[i+8 : i+8+length]
+
+		switch typ {
+		case "iCCP":
+			// The chunk holds the profile name, a null separator, the compression method and the profile.
+			idx := bytes.IndexByte(chunk, 0)
+			if idx < 0 || idx+2 > len(chunk) {
+				return nil
+			}
+			r, err := zlib.NewReader(bytes.NewReader(chunk[idx+2:]))
+			if err != nil {
+				return nil
+			}
+			defer r.Close()
+
+			profile, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil
+			}
+			return profile
+		case "IDAT", "IEND":
+			return nil
+		}
+		i += 12 + length
+	}
+	return nil
+}
+
+// applyICC converts the source image to grayscale using its embedded ICC profile
+// and returns it PNG encoded. If the image has no embedded profile, or the profile
+// is not supported, the source is returned unchanged.
+func applyICC(data []byte, linear bool) ([]byte, error) {
+	profile := extractICC(data)
+	if profile == nil {
+		return data, nil
+	}
+	p, err := parseICC(profile)
+	if err != nil {
+		return data, nil
+	}
+
+	src, _, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, p.toGray(src, linear)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parseICC parses the matrix/TRC based RGB and gray ICC profiles.
+func parseICC(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("invalid ICC profile")
+	}
+	p := &iccProfile{colorSpace: string(data[16:20])}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count; i++ {
+		off := 132 + i*12
+		if off+12 > len(data) {
+			return nil, errors.New("truncated ICC tag table")
+		}
+		sig := string(data[off : off+4])
+		start := int(binary.BigEndian.Uint32(data[off+4:]))
+		size := int(binary.BigEndian.Uint32(data[off+8:]))
+		if start < 0 || size < 0 || start+size > len(data) {
+			return nil, errors.New("invalid ICC tag offset")
+		}
+		tags[sig] = data[start : start+size]
+	}
+
+	var err error
+	switch p.colorSpace {
+	case "RGB ":
+		for i, c := range []string{"r", "g", "b"} {
+			xyz, ok := tags[c+"XYZ"]
+			if !ok || len(xyz) < 20 {
+				return nil, errors.New("missing ICC colorant tags")
+			}
+			p.lum[i] = s15Fixed16(xyz[12:])
+			if p.trc[i], err = parseToneCurve(tags[c+"TRC"]); err != nil {
+				return nil, err
+			}
+		}
+	case "GRAY":
+		p.lum = [3]float64{1, 0, 0}
+		if p.trc[0], err = parseToneCurve(tags["kTRC"]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported ICC color space: " + p.colorSpace)
+	}
+	return p, nil
+}
+
+// parseToneCurve parses the curv and para ICC tag types.
+func parseToneCurve(data []byte) (*toneCurve, error) {
+	if len(data) < 12 {
+		return nil, errors.New("missing ICC tone curve")
+	}
+	switch string(data[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(data[8:]))
+		switch {
+		case n == 0:
+			return &toneCurve{params: []float64{1}}, nil
+		case n == 1 && len(data) >= 14:
+			return &toneCurve{params: []float64{float64(binary.BigEndian.Uint16(data[12:])) / 256}}, nil
+		case len(data) >= 12+2*n:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(data[12+2*i:])) / 65535
+			}
+			return &toneCurve{table: table}, nil
+		}
+	case "para":
+		kind := int(binary.BigEndian.Uint16(data[8:]))
+		n := []int{1, 3, 4, 5, 7}
+		if kind >= len(n) || len(data) < 12+4*n[kind] {
+			break
+		}
+		params := make([]float64, n[kind])
+		for i := range params {
+			params[i] = s15Fixed16(data[12+4*i:])
+		}
+		return &toneCurve{params: params, kind: kind}, nil
+	}
+	return nil, errors.New("invalid ICC tone curve")
+}
+
+// linearize maps an encoded value in the [0, 1] range to linear light.
+func (t *toneCurve) linearize(v float64) float64 {
+	if t.table != nil {
+		pos := v * float64(len(t.table)-1)
+		i := int(pos)
+		if i >= len(t.table)-1 {
+			return t.table[len(t.table)-1]
+		}
+		frac := pos - float64(i)
+		return t.table[i]*(1-frac) + t.table[i+1]*frac
+	}
+
+	p := t.params
+	g := p[0]
+	switch t.kind {
+	case 1:
+		if v >= -p[2]/p[1] {
+			return math.Pow(p[1]*v+p[2], g)
+		}
+		return 0
+	case 2:
+		if v >= -p[2]/p[1] {
+			return math.Pow(p[1]*v+p[2], g) + p[3]
+		}
+		return p[3]
+	case 3:
+		if v >= p[4] {
+			return math.Pow(p[1]*v+p[2], g)
+		}
+		return p[3] * v
+	case 4:
+		if v >= p[4] {
+			return math.Pow(p[1]*v+p[2], g) + p[5]
+		}
+		return p[3]*v + p[6]
+	}
+	return math.Pow(v, g)
+}
+
+// toGray converts the source image to grayscale by computing its luminance in linear light
+// based on the profile, then encoding it either as linear or as sRGB gamma corrected values.
+func (p *iccProfile) toGray(src image.Image, linear bool) *image.Gray {
+	b := src.Bounds()
+	dst := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+
+	// Since the tone curves are applied to 8 bit values we can precompute them.
+	var lut [3][256]float64
+	for c := 0; c < 3; c++ {
+		if p.trc[c] == nil {
+			continue
+		}
+		for i := 0; i < 256; i++ {
+			lut[c][i] = p.trc[c].linearize(float64(i) / 255)
+		}
+	}
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := src.At(x, y).RGBA()
+
+			var lum float64
+			if p.colorSpace == "GRAY" {
+				lum = lut[0][r>>8]
+			} else {
+				lum = p.lum[0]*lut[0][r>>8] + p.lum[1]*lut[1][g>>8] + p.lum[2]*lut[2][bl>>8]
+			}
+			lum = math.Max(0, math.Min(1, lum))
+			if !linear {
+				lum = srgbEncode(lum)
+			}
+			dst.Pix[(y-b.Min.Y)*dst.Stride+(x-b.Min.X)] = uint8(round(lum * 255))
+		}
+	}
+	return dst
+}
+
+// srgbEncode applies the sRGB transfer function on a linear light value.
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// srgbDecode converts an sRGB encoded value into linear light.
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// s15Fixed16 decodes a signed 15.16 fixed point number.
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// sGrayProfile builds an ICC v2 gray profile using the sRGB tone reproduction curve.
+func sGrayProfile() []byte {
+	curv := srgbCurve()
+	return buildProfile("GRAY", "sGray", []iccTag{{"kTRC", curv}})
+}
+
+// sRGBProfile builds an ICC v2 RGB profile with the sRGB primaries, adapted to the D50 illuminant
+// of the profile connection space, and the sRGB tone reproduction curve.
+func sRGBProfile() []byte {
+	curv := srgbCurve()
+	xyz := func(x, y, z float64) []byte {
+		b := make([]byte, 20)
+		copy(b, "XYZ ")
+		putS15Fixed16(b[8:], x)
+		putS15Fixed16(b[12:], y)
+		putS15Fixed16(b[16:], z)
+		return b
+	}
+	return buildProfile("RGB ", "sRGB", []iccTag{
+		{"rXYZ", xyz(0.4360747, 0.2225045, 0.0139322)},
+		{"gXYZ", xyz(0.3850649, 0.7168786, 0.0971045)},
+		{"bXYZ", xyz(0.1430804, 0.0606169, 0.7141733)},
+		{"rTRC", curv}, {"gTRC", curv}, {"bTRC", curv},
+	})
+}
+
+// outputProfile returns the profile matching the color model of the output image: sGray for
+// the grayscale images, and sRGB for the rest, like the colored styles or the branded images.
+func outputProfile(img image.Image) []byte {
+	switch img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		return sGrayProfile()
+	}
+	return sRGBProfile()
+}
+
+// iccTag is a tagged element of an ICC profile.
+type iccTag struct {
+	sig  string
+	data []byte
+}
+
+// srgbCurve returns the sRGB tone reproduction curve, sampled in 1024 points.
+func srgbCurve() []byte {
+	curv := make([]byte, 12+2*1024)
+	copy(curv, "curv")
+	binary.BigEndian.PutUint32(curv[8:], 1024)
+	for i := 0; i < 1024; i++ {
+		binary.BigEndian.PutUint16(curv[12+2*i:], uint16(round(srgbDecode(float64(i)/1023)*65535)))
+	}
+	return curv
+}
+
+// buildProfile builds an ICC v2 display profile of the color space, with the description, the
+// D50 white point and the copyright tags followed by the provided ones.
+func buildProfile(colorSpace, name string, extra []iccTag) []byte {
+	be := binary.BigEndian
+
+	desc := make([]byte, 12+len(name)+1+4+4+2+1+67)
+	copy(desc, "desc")
+	be.PutUint32(desc[8:], uint32(len(name)+1))
+	copy(desc[12:], name)
+
+	wtpt := make([]byte, 20)
+	copy(wtpt, "XYZ ")
+	putS15Fixed16(wtpt[8:], 0.9642)
+	putS15Fixed16(wtpt[12:], 1.0)
+	putS15Fixed16(wtpt[16:], 0.8249)
+
+	cprt := append([]byte("text\x00\x00\x00\x00"), []byte("No copyright, use freely\x00")...)
+
+	tags := append([]iccTag{{"desc", desc}, {"wtpt", wtpt}}, extra...)
+	tags = append(tags, iccTag{"cprt", cprt})
+
+	offset := 128 + 4 + 12*len(tags)
+	header := make([]byte, offset)
+	var body []byte
+	// The tags sharing the same data, like the tone curves, point to the same element.
+	written := make(map[*byte]int)
+	be.PutUint32(header[128:], uint32(len(tags)))
+	for i, t := range tags {
+		pos := 132 + i*12
+		copy(header[pos:], t.sig)
+		at, ok := written[&t.data[0]]
+		if !ok {
+			at = offset + len(body)
+			written[&t.data[0]] = at
+			body = append(body, t.data...)
+			// Tag data must be aligned on 4 byte boundaries.
+			for len(body)%4 != 0 {
+				body = append(body, 0)
+			}
+		}
+		be.PutUint32(header[pos+4:], uint32(at))
+		be.PutUint32(header[pos+8:], uint32(len(t.data)))
+	}
+
+	profile := append(header, body...)
+	be.PutUint32(profile[0:], uint32(len(profile)))
+	be.PutUint32(profile[8:], 0x02100000)
+	copy(profile[12:], "mntr")
+	copy(profile[16:], colorSpace)
+	copy(profile[20:], "XYZ ")
+	copy(profile[36:], "acsp")
+	putS15Fixed16(profile[68:], 0.9642)
+	putS15Fixed16(profile[72:], 1.0)
+	putS15Fixed16(profile[76:], 0.8249)
+
+	return profile
+}
+
+// putS15Fixed16 encodes a signed 15.16 fixed point number.
+func putS15Fixed16(b []byte, v float64) {
+	binary.BigEndian.PutUint32(b, uint32(int32(round(v*65536))))
+}
+
+// embedICC embeds the ICC profile into the image encoded in the format. The JPEG images get it
+// as APP2 segments and the PNG images as an iCCP chunk, while the other formats are left as is.
+func embedICC(data []byte, format string, profile []byte) []byte {
+	switch format {
+	case "", "jpg", "jpeg":
+		return embedJPEGICC(data, profile)
+	case "png":
+		return embedPNGICC(data, profile)
+	}
+	return data
+}
+
+// embedPNGICC inserts the zlib compressed ICC profile as an iCCP chunk into the encoded PNG image,
+// right after the header chunk, since it has to precede the image data.
+func embedPNGICC(data, profile []byte) []byte {
+	chunks, err := readPNGChunks(data)
+	if err != nil || len(chunks) == 0 || chunks[0].id != "IHDR" {
+		return data
+	}
+	// The chunk holds the profile name, the compression method (zlib) and the compressed profile.
+	payload := bytes.NewBufferString("ICC profile\x00\x00")
+	zw := zlib.NewWriter(payload)
+	zw.Write(profile)
+	if err := zw.Close(); err != nil {
+		return data
+	}
+
+	buf := bytes.NewBufferString(pngSignature)
+	for i, c := range chunks {
+		writePNGChunk(buf, c.id, c.payload)
+		if i == 0 {
+			writePNGChunk(buf, "iCCP", payload.Bytes())
+		}
+	}
+	return buf.Bytes()
+}
+
+// embedJPEGICC inserts the ICC profile as APP2 segments into the encoded JPEG image.
+func embedJPEGICC(data, profile []byte) []byte {
+	const maxChunk = 65533 - 2 - 14
+
+	if len(data) < 2 || len(profile) == 0 || data[0] != 0xff || data[1] != 0xd8 {
+		return data
+	}
+	// Insert the profile after the JFIF header if there is one, otherwise right after SOI.
+	pos := 2
+	if len(data) > 6 && data[2] == 0xff && data[3] == 0xe0 {
+		pos = 4 + int(binary.BigEndian.Uint16(data[4:]))
+	}
+
+	count := (len(profile) + maxChunk - 1) / maxChunk
+	out := make([]byte, 0, len(data)+len(profile)+count*18)
+	out = append(out, data[:pos]...)
+	for i := 0; i < count; i++ {
+		chunk := profile[i*maxChunk:]
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		size := 2 + 14 + len(chunk)
+		out = append(out, 0xff, 0xe2, byte(size>>8), byte(size))
+		out = append(out, "ICC_PROFILE\x00"...)
+		out = append(out, byte(i+1), byte(count))
+		out = append(out, chunk...)
+	}
+	return append(out, data[pos:]...)
+}
@@ -0,0 +1,139 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// unitValue generates the values of the property tests in the [0, 1] range.
+func unitValue(values []reflect.Value, r *rand.Rand) {
+	values[0] = reflect.ValueOf(r.Float64())
+}
+
+func TestSRGBTransfer(t *testing.T) {
+	for _, v := range []float64{0, 1} {
+		if got := srgbDecode(v); math.Abs(got-v) > 1e-12 {
+			t.Errorf("srgbDecode(%v) = %v", v, got)
+		}
+		if got := srgbEncode(v); math.Abs(got-v) > 1e-12 {
+			t.Errorf("srgbEncode(%v) = %v", v, got)
+		}
+	}
+	// The two pieces of the curve meet at the breakpoint.
+	if d := srgbDecode(0.04045+1e-9) - srgbDecode(0.04045); math.Abs(d) > 1e-6 {
+		t.Errorf("srgbDecode is discontinuous at the breakpoint by %v", d)
+	}
+
+	config := &quick.Config{Values: unitValue}
+	roundTrip := func(v float64) bool {
+		return math.Abs(srgbEncode(srgbDecode(v))-v) < 1e-9
+	}
+	if err := quick.Check(roundTrip, config); err != nil {
+		t.Error(err)
+	}
+	// The linear light values are below the encoded ones, compressing the shadows
+	// where the encoded values overstate the edge strength.
+	darker := func(v float64) bool {
+		return v == 0 || srgbDecode(v) < v
+	}
+	if err := quick.Check(darker, config); err != nil {
+		t.Error(err)
+	}
+	monotonic := func(v float64) bool {
+		return srgbDecode(v) <= srgbDecode(math.Min(1, v+1e-3))
+	}
+	if err := quick.Check(monotonic, config); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEmbedICC(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 8, 8))
+	rgba := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	rgba.Set(2, 2, color.RGBA{200, 40, 40, 255})
+	encode := func(format string, img image.Image) []byte {
+		var buf bytes.Buffer
+		if format == "png" {
+			png.Encode(&buf, img)
+		} else {
+			jpeg.Encode(&buf, img, nil)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		format     string
+		img        image.Image
+		colorSpace string
+	}{
+		{"jpeg", gray, "GRAY"},
+		{"jpeg", rgba, "RGB "},
+		{"", rgba, "RGB "},
+		{"png", gray, "GRAY"},
+		{"png", rgba, "RGB "},
+	}
+	for _, tt := range tests {
+		data := encode(tt.format, tt.img)
+		out := embedICC(data, tt.format, outputProfile(tt.img))
+		p, err := parseICC(extractICC(out))
+		if err != nil {
+			t.Errorf("%q %T: %v", tt.format, tt.img, err)
+			continue
+		}
+		if p.colorSpace != tt.colorSpace {
+			t.Errorf("%q %T: %q profile, expected %q", tt.format, tt.img, p.colorSpace, tt.colorSpace)
+		}
+		if _, _, err := image.Decode(bytes.NewReader(out)); err != nil {
+			t.Errorf("%q %T: the image with the profile can't be decoded: %v", tt.format, tt.img, err)
+		}
+	}
+
+	// The sRGB profile weights the primaries like the sRGB luminance.
+	p, err := parseICC(sRGBProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []float64{0.2225, 0.7169, 0.0606} {
+		if math.Abs(p.lum[i]-want) > 1e-3 {
+			t.Errorf("the luminance of primary %d is %v, expected %v", i, p.lum[i], want)
+		}
+	}
+
+	// The profile is only spliced into the formats supporting it.
+	jpg := encode("jpeg", gray)
+	for _, format := range []string{"svg", "webp", "tiff", "gif"} {
+		if out := embedICC(jpg, format, sGrayProfile()); !bytes.Equal(out, jpg) {
+			t.Errorf("%s: the output is altered", format)
+		}
+	}
+}
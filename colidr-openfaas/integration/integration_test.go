@@ -0,0 +1,300 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build integration
+// +build integration
+
+// Package integration holds the integration tests of the packaged function. They start the
+// built function image in a docker container, run the requests of a corpus against it, then
+// validate the responses and, when the metrics endpoint is served, the request metrics.
+// They are excluded from the regular test runs by the integration build tag:
+//
+//	go test -tags integration ./integration -args -image esimov/colidr-openfaas:0.1
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"handler/function/synth"
+)
+
+// inputSize is the edge of the generated input images.
+const inputSize = 256
+
+// testCase is a request of the corpus together with the expected response.
+type testCase struct {
+	Name string `json:"name"`
+	// Input is the generated image posted to the function: circle, grating, checkerboard,
+	// noisy (a noisy circle) or text, which is not an image.
+	Input  string `json:"input"`
+	Params string `json:"params"`
+	Expect expect `json:"expect"`
+}
+
+// expect describes the valid response. The zero values are not checked.
+type expect struct {
+	Status int `json:"status"`
+	// Format is the format of the returned image, like jpeg or png. The image
+	// is expected to have the size of the input, unless Width and Height are set.
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// JSON requires the response to be a JSON document.
+	JSON bool `json:"json"`
+	// Contains is a text the response body must contain, like an error code.
+	Contains string `json:"contains"`
+}
+
+// envList collects the repeated -env flags.
+type envList []string
+
+func (e *envList) String() string     { return strings.Join(*e, ",") }
+func (e *envList) Set(v string) error { *e = append(*e, v); return nil }
+
+var (
+	imageName = flag.String("image", "esimov/colidr-openfaas:0.1", "the built function image")
+	corpus    = flag.String("corpus", "corpus.json", "the request corpus")
+	port      = flag.Int("port", 18080, "the host port the function is published on")
+	health    = flag.String("health", "/_/health", "the readiness path of the watchdog")
+	metrics   = flag.String("metrics", "", "the metrics path, if served, e.g. /metrics in HTTP mode")
+	startup   = flag.Duration("startup", time.Minute, "the time to wait for the function to be ready")
+	timeout   = flag.Duration("timeout", 2*time.Minute, "the timeout of a request")
+	keep      = flag.Bool("keep", false, "keep the container running after the run")
+	env       envList
+)
+
+func init() {
+	flag.Var(&env, "env", "an environment variable of the function, as name=value (repeatable)")
+}
+
+// TestFunction runs the requests of the corpus against the function container, each as a subtest.
+func TestFunction(t *testing.T) {
+	cases, err := loadCorpus(*corpus)
+	if err != nil {
+		t.Fatalf("unable to load the corpus: %v", err)
+	}
+
+	id, err := startContainer(*imageName, *port, env)
+	if err != nil {
+		t.Fatalf("unable to start the function: %v", err)
+	}
+	if !*keep {
+		defer exec.Command("docker", "rm", "-f", id).Run()
+	}
+
+	base := "http://127.0.0.1:" + strconv.Itoa(*port)
+	client := &http.Client{Timeout: *timeout}
+	if err := waitReady(client, base+*health, *startup); err != nil {
+		logs, _ := exec.Command("docker", "logs", id).CombinedOutput()
+		t.Logf("container logs:\n%s", logs)
+		t.Fatalf("the function is not ready: %v", err)
+	}
+
+	var before float64
+	if *metrics != "" {
+		if before, err = scrapeRequests(client, base+*metrics); err != nil {
+			t.Fatalf("unable to scrape the metrics: %v", err)
+		}
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			if err := tc.run(client, base); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	if *metrics != "" {
+		t.Run("metrics", func(t *testing.T) {
+			after, err := scrapeRequests(client, base+*metrics)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after-before != float64(len(cases)) {
+				t.Errorf("%v requests counted, expected %d", after-before, len(cases))
+			}
+		})
+	}
+}
+
+// loadCorpus reads the test cases of the corpus file.
+func loadCorpus(path string) ([]testCase, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cases []testCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, err
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("the corpus is empty")
+	}
+	return cases, nil
+}
+
+// startContainer starts the function image, returning the container identifier.
+func startContainer(imageName string, port int, env []string) (string, error) {
+	args := []string{"run", "-d", "-p", fmt.Sprintf("127.0.0.1:%d:8080", port)}
+	for _, e := range env {
+		args = append(args, "-e", e)
+	}
+	out, err := exec.Command("docker", append(args, imageName)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// waitReady polls the readiness endpoint until it succeeds or the time runs out.
+func waitReady(client *http.Client, url string, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		res, err := client.Get(url)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("status %d", res.StatusCode)
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// scrapeRequests returns the total number of the requests counted by the function metrics.
+func scrapeRequests(client *http.Client, url string) (float64, error) {
+	res, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	var total float64
+	for _, line := range strings.Split(string(body), "\n") {
+		if !strings.HasPrefix(line, "colidr_requests_total{") {
+			continue
+		}
+		fields := strings.Fields(line)
+		v, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid metric %q", line)
+		}
+		total += v
+	}
+	return total, nil
+}
+
+// input generates the input image of the test case.
+func (tc testCase) input() ([]byte, error) {
+	var img image.Image
+	switch tc.Input {
+	case "", "circle":
+		img = synth.Circle{CX: inputSize / 2, CY: inputSize / 2, Radius: inputSize / 3, Fg: 32, Bg: 224}.Render(inputSize, inputSize)
+	case "grating":
+		img = synth.Grating{Period: 24, Angle: 0.5, Fg: 32, Bg: 224}.Render(inputSize, inputSize)
+	case "checkerboard":
+		img = synth.Checkerboard{Size: 32, Fg: 32, Bg: 224}.Render(inputSize, inputSize)
+	case "noisy":
+		img = synth.AddNoise(synth.Circle{CX: inputSize / 2, CY: inputSize / 2, Radius: inputSize / 3, Fg: 32, Bg: 224}.Render(inputSize, inputSize), 10, 1)
+	case "text":
+		return []byte("this is not an image"), nil
+	default:
+		return nil, fmt.Errorf("unknown input %q", tc.Input)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// run posts the request of the test case and validates the response.
+func (tc testCase) run(client *http.Client, base string) error {
+	data, err := tc.input()
+	if err != nil {
+		return err
+	}
+	url := base + "/"
+	if tc.Params != "" {
+		url += "?" + tc.Params
+	}
+	res, err := client.Post(url, "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	e := tc.Expect
+	if e.Status != 0 && res.StatusCode != e.Status {
+		return fmt.Errorf("status %d, expected %d: %.200s", res.StatusCode, e.Status, body)
+	}
+	if e.Contains != "" && !bytes.Contains(body, []byte(e.Contains)) {
+		return fmt.Errorf("the response doesn't contain %q: %.200s", e.Contains, body)
+	}
+	if e.JSON && !json.Valid(body) {
+		return fmt.Errorf("invalid JSON response: %.200s", body)
+	}
+	if e.Format != "" {
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("invalid image response: %v: %.200s", err, body)
+		}
+		if format != e.Format {
+			return fmt.Errorf("%s image, expected %s", format, e.Format)
+		}
+		width, height := e.Width, e.Height
+		if width == 0 && height == 0 {
+			width, height = inputSize, inputSize
+		}
+		if cfg.Width != width || cfg.Height != height {
+			return fmt.Errorf("%dx%d image, expected %dx%d", cfg.Width, cfg.Height, width, height)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// signedResponse is the JSON response which carries the integrity fields of the generated image,
+// so the downstream stages of a function chain can verify they received the complete result.
+type signedResponse struct {
+	Image  string `json:"image"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+	HMAC   string `json:"hmac,omitempty"`
+	// Relaxed is set when the image was regenerated with relaxed parameters.
+	Relaxed *relaxedParams `json:"relaxed,omitempty"`
+}
+
+// integrityKey returns the signing key, read either from the integrity_key environment variable
+// or from the integrity-key OpenFaaS secret. If none of them is provided only the checksum is computed.
+func integrityKey() []byte {
+	if key := readSecret("integrity-key"); key != "" {
+		return []byte(key)
+	}
+	return nil
+}
+
+// signResponse encodes the image into a JSON response together with its SHA-256 checksum,
+// and with its HMAC-SHA256 signature in case a signing key is configured.
+func signResponse(data, key []byte, relaxed *relaxedParams) ([]byte, error) {
+	sum := sha256.Sum256(data)
+	res := signedResponse{
+		Image:   base64.StdEncoding.EncodeToString(data),
+		Size:    len(data),
+		SHA256:  hex.EncodeToString(sum[:]),
+		Relaxed: relaxed,
+	}
+	if len(key) > 0 {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		res.HMAC = hex.EncodeToString(mac.Sum(nil))
+	}
+	return json.Marshal(res)
+}
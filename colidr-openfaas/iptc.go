@@ -0,0 +1,186 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+const (
+	// metadataKeyword is the keyword tagging every generated artwork.
+	metadataKeyword = "coherent line drawing"
+	// defaultDescription is the description of the outputs without a custom one.
+	defaultDescription = "Coherent line drawing generated by colidr-openfaas"
+	// maxIPTCKeyword and maxIPTCCaption are the IIM limits of the keyword and caption datasets.
+	maxIPTCKeyword = 64
+	maxIPTCCaption = 2000
+)
+
+// keywords returns the metadata keywords of the output: the generic keyword, the preset
+// and the recipe names, followed by the custom tags.
+func (rp *requestParams) keywords() []string {
+	keywords := []string{metadataKeyword}
+	for _, name := range []string{rp.preset, rp.recipe} {
+		if name != "" {
+			keywords = append(keywords, name)
+		}
+	}
+	return append(keywords, rp.tags...)
+}
+
+// parseTags parses the comma separated list of the custom keywords.
+func parseTags(list string) ([]string, error) {
+	var tags []string
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if len(tag) > maxIPTCKeyword {
+			return nil, fmt.Errorf("invalid tag %q: longer than %d bytes", tag, maxIPTCKeyword)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// embedMetadata writes the keywords and the description into the encoded output, as an IPTC
+// record in JPEG images and as an XMP packet in PNG images. The other formats are returned as is.
+func embedMetadata(data []byte, keywords []string, description string) []byte {
+	if description == "" {
+		description = defaultDescription
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return embedJPEGIPTC(data, keywords, description)
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		return embedPNGXMP(data, keywords, description)
+	}
+	return data
+}
+
+// iptcRecord returns the IPTC-IIM record of the keywords and the caption, encoded in UTF-8.
+func iptcRecord(keywords []string, caption string) []byte {
+	buf := new(bytes.Buffer)
+	dataset := func(record, tag byte, value []byte) {
+		buf.Write([]byte{0x1c, record, tag, byte(len(value) >> 8), byte(len(value))})
+		buf.Write(value)
+	}
+	// The coded character set escape sequence declares the UTF-8 encoding.
+	dataset(1, 90, []byte{0x1b, '%', 'G'})
+	dataset(2, 0, []byte{0, 4})
+	for _, k := range keywords {
+		dataset(2, 25, []byte(truncateUTF8(k, maxIPTCKeyword)))
+	}
+	dataset(2, 120, []byte(truncateUTF8(caption, maxIPTCCaption)))
+	return buf.Bytes()
+}
+
+// embedJPEGIPTC inserts the IPTC record as a Photoshop APP13 segment into the encoded JPEG image.
+func embedJPEGIPTC(data []byte, keywords []string, caption string) []byte {
+	record := iptcRecord(keywords, caption)
+
+	// The record is wrapped into an image resource block with an empty name.
+	res := new(bytes.Buffer)
+	res.WriteString("8BIM")
+	res.Write([]byte{0x04, 0x04, 0, 0})
+	binary.Write(res, binary.BigEndian, uint32(len(record)))
+	res.Write(record)
+	if len(record)%2 == 1 {
+		res.WriteByte(0)
+	}
+
+	payload := append([]byte("Photoshop 3.0\x00"), res.Bytes()...)
+	if len(payload)+2 > 0xffff {
+		return data
+	}
+	// Insert the segment after the JFIF header if there is one, otherwise right after SOI.
+	pos := 2
+	if len(data) > 6 && data[2] == 0xff && data[3] == 0xe0 {
+		pos = 4 + int(binary.BigEndian.Uint16(data[4:]))
+	}
+	size := len(payload) + 2
+
+	out := make([]byte, 0, len(data)+size+2)
+	out = append(out, data[:pos]...)
+	out = append(out, 0xff, 0xed, byte(size>>8), byte(size))
+	out = append(out, payload...)
+	return append(out, data[pos:]...)
+}
+
+// xmpPacket returns the XMP packet holding the keywords as the Dublin Core subject
+// and the description.
+func xmpPacket(keywords []string, description string) []byte {
+	escape := func(s string) string {
+		buf := new(bytes.Buffer)
+		xml.EscapeText(buf, []byte(s))
+		return buf.String()
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(`<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>`)
+	buf.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`)
+	buf.WriteString(`<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">`)
+	buf.WriteString(`<dc:subject><rdf:Bag>`)
+	for _, k := range keywords {
+		buf.WriteString("<rdf:li>" + escape(k) + "</rdf:li>")
+	}
+	buf.WriteString(`</rdf:Bag></dc:subject>`)
+	buf.WriteString(`<dc:description><rdf:Alt><rdf:li xml:lang="x-default">` + escape(description) + `</rdf:li></rdf:Alt></dc:description>`)
+	buf.WriteString(`</rdf:Description></rdf:RDF></x:xmpmeta><?xpacket end="w"?>`)
+	return buf.Bytes()
+}
+
+// embedPNGXMP inserts the XMP packet as an iTXt chunk right after the header of the encoded PNG image.
+func embedPNGXMP(data []byte, keywords []string, description string) []byte {
+	chunks, err := readPNGChunks(data)
+	if err != nil || len(chunks) == 0 || chunks[0].id != "IHDR" {
+		return data
+	}
+	// The iTXt chunk holds the keyword, the compression flag and method, and the empty language tags.
+	payload := append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), xmpPacket(keywords, description)...)
+
+	buf := bytes.NewBufferString(pngSignature)
+	for i, c := range chunks {
+		writePNGChunk(buf, c.id, c.payload)
+		if i == 0 {
+			writePNGChunk(buf, "iTXt", payload)
+		}
+	}
+	return buf.Bytes()
+}
+
+// truncateUTF8 truncates the string to the byte size, without splitting the multibyte characters.
+func truncateUTF8(s string, size int) string {
+	if len(s) <= size {
+		return s
+	}
+	for size > 0 && s[size]&0xc0 == 0x80 {
+		size--
+	}
+	return s[:size]
+}
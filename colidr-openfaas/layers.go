@@ -0,0 +1,128 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+// layer is a set of lines obtained by thresholding the flow DoG response at a specific tau value.
+type layer struct {
+	tau   float32
+	color color.RGBA
+	mask  gocv.Mat
+}
+
+// generateLayers thresholds the flow DoG response at each of the provided tau values,
+// producing separate line sets with depth-graded strength. It should be called after GenerateCld.
+func (c *Cld) generateLayers(taus []float32, colors []color.RGBA) []layer {
+	layers := make([]layer, len(taus))
+	for i, tau := range taus {
+		mask := newMatWithSize(c.fDog.Rows(), c.fDog.Cols(), gocv.MatTypeCV8UC1)
+		c.binaryThreshold(c.fDog, &mask, tau)
+
+		col := color.RGBA{A: 255}
+		if i < len(colors) {
+			col = colors[i]
+		}
+		layers[i] = layer{tau: tau, color: col, mask: mask}
+	}
+	return layers
+}
+
+// renderLayers generates the line layers and composes them into a single color image.
+func (c *Cld) renderLayers(taus []float32, colors []color.RGBA) image.Image {
+	layers := c.generateLayers(taus, colors)
+	defer func() {
+		for _, l := range layers {
+			closeMat(&l.mask)
+		}
+	}()
+	return composeLayers(layers)
+}
+
+// composeLayers paints the layers over a white background. The layers with higher tau values
+// contain more lines, so they are painted first to let the stronger lines remain on top.
+func composeLayers(layers []layer) *image.RGBA {
+	if len(layers) == 0 {
+		return nil
+	}
+	rows, cols := layers[0].mask.Rows(), layers[0].mask.Cols()
+	dst := image.NewRGBA(image.Rect(0, 0, cols, rows))
+	for i := range dst.Pix {
+		dst.Pix[i] = 255
+	}
+
+	ordered := make([]layer, len(layers))
+	copy(ordered, layers)
+	for i := 1; i < len(ordered); i++ {
+		for j := i; j > 0 && ordered[j].tau > ordered[j-1].tau; j-- {
+			ordered[j], ordered[j-1] = ordered[j-1], ordered[j]
+		}
+	}
+
+	for _, l := range ordered {
+		data := l.mask.ToBytes()
+		for y := 0; y < rows; y++ {
+			for x := 0; x < cols; x++ {
+				if data[y*cols+x] == 0 {
+					dst.SetRGBA(x, y, l.color)
+				}
+			}
+		}
+	}
+	return dst
+}
+
+// parseTauList parses a comma separated list of tau values.
+func parseTauList(s string) ([]float32, error) {
+	var taus []float32
+	for _, v := range strings.Split(s, ",") {
+		tau, err := strconv.ParseFloat(strings.TrimSpace(v), 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tau value %q", v)
+		}
+		taus = append(taus, float32(tau))
+	}
+	return taus, nil
+}
+
+// parseColorList parses a comma separated list of hex colors, like 000000,ff0000.
+func parseColorList(s string) ([]color.RGBA, error) {
+	var colors []color.RGBA
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "#")
+		c, err := strconv.ParseUint(v, 16, 32)
+		if err != nil || len(v) != 6 {
+			return nil, fmt.Errorf("invalid color %q", v)
+		}
+		colors = append(colors, color.RGBA{R: uint8(c >> 16), G: uint8(c >> 8), B: uint8(c), A: 255})
+	}
+	return colors, nil
+}
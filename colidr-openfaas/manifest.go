@@ -0,0 +1,155 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// parseManifest parses the batch manifest, selecting its format by the extension of the key.
+// Besides the JSON manifest, the CSV and the JSONL ones list the images with their parameter
+// overrides one per row, letting the heterogeneous collections be tuned per image. They're named
+// after the key, while their default parameters are set through the batch_params environment variable.
+func parseManifest(key string, data []byte) (batchManifest, error) {
+	ext := strings.ToLower(path.Ext(key))
+	if ext != ".csv" && ext != ".jsonl" {
+		var manifest batchManifest
+		err := json.Unmarshal(data, &manifest)
+		return manifest, err
+	}
+
+	manifest := batchManifest{
+		Name:   strings.TrimSuffix(path.Base(key), path.Ext(key)),
+		Params: os.Getenv("batch_params"),
+	}
+	var err error
+	if ext == ".csv" {
+		manifest.Images, err = parseCSVManifest(data)
+	} else {
+		manifest.Images, err = parseJSONLManifest(data)
+	}
+	return manifest, err
+}
+
+// parseCSVManifest parses the images of the CSV manifest. The header names the columns: the key,
+// url, output and params columns have the meaning of the manifest image fields, while the rest of
+// them are parameters overriding the defaults, like tau or sm. The empty cells are not overridden.
+//
+//	key,tau,sm,output
+//	scans/page1.jpg,0.995,3,
+//	photos/beach.jpg,0.97,,styled/beach.png
+func parseCSVManifest(data []byte) ([]batchItem, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the CSV header: %v", err)
+	}
+	for i, name := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(name))
+	}
+
+	var items []batchItem
+	for row := 1; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var (
+			item      batchItem
+			overrides = make(url.Values)
+		)
+		for i, val := range record {
+			val = strings.TrimSpace(val)
+			if val == "" {
+				continue
+			}
+			switch header[i] {
+			case "key":
+				item.Key = val
+			case "url":
+				item.URL = val
+			case "output":
+				item.Output = val
+			case "params":
+				item.Params = val
+			default:
+				overrides.Set(header[i], val)
+			}
+		}
+		if item.Params, err = mergeParams(item.Params, overrides); err != nil {
+			return nil, fmt.Errorf("invalid params on row %d: %v", row, err)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// parseJSONLManifest parses the images of the JSONL manifest, which has an image per line
+// in the format of the JSON manifest images.
+func parseJSONLManifest(data []byte) ([]batchItem, error) {
+	var items []batchItem
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var item batchItem
+		if err := json.Unmarshal([]byte(text), &item); err != nil {
+			return nil, fmt.Errorf("invalid image on line %d: %v", line, err)
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
+
+// mergeParams returns the query string of the parameters, overridden by the provided values.
+func mergeParams(params string, overrides url.Values) (string, error) {
+	if len(overrides) == 0 {
+		return params, nil
+	}
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range overrides {
+		values[k] = v
+	}
+	return values.Encode(), nil
+}
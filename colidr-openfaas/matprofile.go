@@ -0,0 +1,182 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime/debug"
+	"sort"
+	"sync"
+
+	"gocv.io/x/gocv"
+)
+
+// matTracker accounts the native matrices allocated by the function. The matrices are
+// allocated by OpenCV outside of the Go heap, so the leaks caused by the missing Close calls
+// are invisible to the Go profiler.
+type matTracker struct {
+	mu        sync.Mutex
+	live      map[interface{}]matAlloc
+	seq       int64
+	allocated int64
+	released  int64
+	debug     bool
+}
+
+// matAlloc records an outstanding matrix, with the allocation stack in debug mode.
+type matAlloc struct {
+	seq   int64
+	stack []byte
+}
+
+// mats tracks the matrices of the process. With mat_debug=true the allocation stacks
+// are recorded, and the matrices left open by a request are logged after it.
+var mats = &matTracker{
+	live:  make(map[interface{}]matAlloc),
+	debug: os.Getenv("mat_debug") == "true",
+}
+
+// trackMat registers the newly allocated matrix.
+func trackMat(m gocv.Mat) gocv.Mat {
+	key := m.Ptr()
+	if key == nil {
+		return m
+	}
+	mats.mu.Lock()
+	defer mats.mu.Unlock()
+
+	mats.seq++
+	mats.allocated++
+	alloc := matAlloc{seq: mats.seq}
+	if mats.debug {
+		alloc.stack = debug.Stack()
+	}
+	mats.live[key] = alloc
+	return m
+}
+
+// closeMat releases the matrix, removing it from the outstanding ones.
+func closeMat(m *gocv.Mat) {
+	if key := m.Ptr(); key != nil {
+		mats.mu.Lock()
+		if _, ok := mats.live[key]; ok {
+			delete(mats.live, key)
+			mats.released++
+		}
+		mats.mu.Unlock()
+	}
+	m.Close()
+}
+
+func newMat() gocv.Mat {
+	return trackMat(gocv.NewMat())
+}
+
+func newMatWithSize(rows, cols int, mt gocv.MatType) gocv.Mat {
+	return trackMat(gocv.NewMatWithSize(rows, cols, mt))
+}
+
+func newMatFromBytes(rows, cols int, mt gocv.MatType, data []byte) (gocv.Mat, error) {
+	m, err := gocv.NewMatFromBytes(rows, cols, mt, data)
+	if err != nil {
+		return m, err
+	}
+	return trackMat(m), nil
+}
+
+func cloneMat(m gocv.Mat) gocv.Mat {
+	return trackMat(m.Clone())
+}
+
+func imRead(file string, flags gocv.IMReadFlag) gocv.Mat {
+	return trackMat(gocv.IMRead(file, flags))
+}
+
+// outstanding returns the number of matrices not released yet.
+func (t *matTracker) outstanding() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.live)
+}
+
+// since returns the outstanding matrices allocated after the provided sequence number, oldest first.
+func (t *matTracker) since(seq int64) []matAlloc {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var allocs []matAlloc
+	for _, a := range t.live {
+		if a.seq > seq {
+			allocs = append(allocs, a)
+		}
+	}
+	sort.Slice(allocs, func(i, j int) bool { return allocs[i].seq < allocs[j].seq })
+	return allocs
+}
+
+// current returns the sequence number of the last allocation.
+func (t *matTracker) current() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.seq
+}
+
+// write writes the matrix counters in the Prometheus text format.
+func (t *matTracker) write(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP colidr_mats_allocated_total The number of native matrices allocated.")
+	fmt.Fprintln(w, "# TYPE colidr_mats_allocated_total counter")
+	fmt.Fprintf(w, "colidr_mats_allocated_total %d\n", t.allocated)
+	fmt.Fprintln(w, "# HELP colidr_mats_released_total The number of native matrices released.")
+	fmt.Fprintln(w, "# TYPE colidr_mats_released_total counter")
+	fmt.Fprintf(w, "colidr_mats_released_total %d\n", t.released)
+	fmt.Fprintln(w, "# HELP colidr_mats_outstanding The number of native matrices not released yet.")
+	fmt.Fprintln(w, "# TYPE colidr_mats_outstanding gauge")
+	fmt.Fprintf(w, "colidr_mats_outstanding %d\n", len(t.live))
+}
+
+// detectMatLeaks logs the allocation stacks of the matrices left open by the request, in debug mode.
+// The matrices retained on purpose, like the ones held by the sessions, are reported as well.
+func detectMatLeaks(next handlerFunc) handlerFunc {
+	return func(ctx *RequestContext) *response {
+		if !mats.debug {
+			return next(ctx)
+		}
+		start := mats.current()
+		res := next(ctx)
+
+		leaked := mats.since(start)
+		for _, a := range leaked {
+			log.Printf("mat #%d not released, allocated at:\n%s", a.seq, a.stack)
+		}
+		if len(leaked) > 0 {
+			log.Printf("%d native matrices not released by the request, %d outstanding in total", len(leaked), mats.outstanding())
+		}
+		return res
+	}
+}
@@ -0,0 +1,277 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"image"
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+// matrix is the subset of the gocv.Mat accessors used by the line drawing kernels.
+// *gocv.Mat satisfies it, while denseMat is a pure Go implementation, so the algorithm
+// logic can be exercised on small hand made matrices, without OpenCV.
+type matrix interface {
+	Rows() int
+	Cols() int
+	Channels() int
+	Type() gocv.MatType
+	GetUCharAt(row, col int) uint8
+	SetUCharAt(row, col int, val uint8)
+	GetFloatAt(row, col int) float32
+	SetFloatAt(row, col int, val float32)
+	GetVecfAt(row, col int) gocv.Vecf
+	SetVecfAt(row, col int, val gocv.Vecf)
+}
+
+// imageOps are the image processing operations the algorithm relies on.
+type imageOps interface {
+	// Decode decodes the image into a BGR matrix.
+	Decode(data []byte) (matrix, error)
+	// GaussianBlur blurs the single channel matrix with a square kernel, using a constant zero border.
+	GaussianBlur(src, dst matrix, ksize int)
+	// Normalize scales the values of the matrix into the [alpha, beta] range.
+	Normalize(src, dst matrix, alpha, beta float64)
+}
+
+// ops are the image operations used by the kernels. The OpenCV backed implementation
+// falls back to the pure Go one for matrices not allocated by OpenCV.
+var ops imageOps = gocvOps{}
+
+// imageOps returns the image operations of the CLD, the pure Go operations
+// taking their temporary buffers from the arena of the request.
+func (c *Cld) imageOps() imageOps {
+	switch o := ops.(type) {
+	case gocvOps:
+		o.fallback.arena = c.arena
+		return o
+	case goOps:
+		o.arena = c.arena
+		return o
+	}
+	return ops
+}
+
+// gocvOps implements the image operations with OpenCV.
+type gocvOps struct {
+	// fallback processes the matrices not allocated by OpenCV.
+	fallback goOps
+}
+
+func (gocvOps) Decode(data []byte) (matrix, error) {
+	mat, err := decodeMat(data)
+	if err != nil {
+		return nil, err
+	}
+	return &mat, nil
+}
+
+func (g gocvOps) GaussianBlur(src, dst matrix, ksize int) {
+	s, ok1 := src.(*gocv.Mat)
+	d, ok2 := dst.(*gocv.Mat)
+	if !ok1 || !ok2 {
+		g.fallback.GaussianBlur(src, dst, ksize)
+		return
+	}
+	gocv.GaussianBlur(*s, d, image.Point{ksize, ksize}, 0.0, 0.0, gocv.BorderConstant)
+}
+
+func (g gocvOps) Normalize(src, dst matrix, alpha, beta float64) {
+	s, ok1 := src.(*gocv.Mat)
+	d, ok2 := dst.(*gocv.Mat)
+	if !ok1 || !ok2 {
+		g.fallback.Normalize(src, dst, alpha, beta)
+		return
+	}
+	gocv.Normalize(*s, d, alpha, beta, gocv.NormMinMax)
+}
+
+// goOps implements the image operations in pure Go, on any matrix.
+type goOps struct {
+	// arena provides the temporary buffers, if set.
+	arena *arena
+}
+
+func (goOps) Decode(data []byte) (matrix, error) {
+	img, _, err := decodeImage(data)
+	if err != nil {
+		return nil, wrapError(err, "unable to decode the image")
+	}
+	if o := jpegOrientation(data); o > 1 {
+		img = orient(img, o)
+	}
+	pix, width, height := bgrBytes(img)
+	m := newDenseMat(height, width, gocv.MatTypeCV8UC3)
+	for i, v := range pix {
+		m.data[i] = float32(v)
+	}
+	return m, nil
+}
+
+func (o goOps) GaussianBlur(src, dst matrix, ksize int) {
+	// The sigma is derived from the kernel size with the same formula OpenCV uses for the larger kernels.
+	sigma := 0.3*(float64(ksize-1)*0.5-1) + 0.8
+	half := ksize / 2
+	kernel := make([]float64, ksize)
+	var sum float64
+	for i := range kernel {
+		kernel[i] = gauss(float64(i-half), 0.0, sigma)
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	rows, cols := src.Rows(), src.Cols()
+	tmp := o.arena.float64s(rows * cols)
+	// The kernel is separable, so the rows and the columns are convolved in two passes.
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			var acc float64
+			for k, w := range kernel {
+				if c := x + k - half; c >= 0 && c < cols {
+					acc += w * matValue(src, y, c)
+				}
+			}
+			tmp[y*cols+x] = acc
+		}
+	}
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			var acc float64
+			for k, w := range kernel {
+				if r := y + k - half; r >= 0 && r < rows {
+					acc += w * tmp[r*cols+x]
+				}
+			}
+			setMatValue(dst, y, x, acc)
+		}
+	}
+}
+
+func (goOps) Normalize(src, dst matrix, alpha, beta float64) {
+	rows, cols, ch := src.Rows(), src.Cols(), src.Channels()
+	// The values of every channel are normalized together, like with OpenCV.
+	at := func(y, x int) []float64 {
+		if ch == 1 {
+			return []float64{matValue(src, y, x)}
+		}
+		v := src.GetVecfAt(y, x)
+		vals := make([]float64, ch)
+		for i := range vals {
+			vals[i] = float64(v[i])
+		}
+		return vals
+	}
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			for _, v := range at(y, x) {
+				lo = math.Min(lo, v)
+				hi = math.Max(hi, v)
+			}
+		}
+	}
+	scale := 0.0
+	if hi > lo {
+		scale = (beta - alpha) / (hi - lo)
+	}
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			vals := at(y, x)
+			if ch == 1 {
+				setMatValue(dst, y, x, alpha+(vals[0]-lo)*scale)
+				continue
+			}
+			out := make(gocv.Vecf, ch)
+			for i, v := range vals {
+				out[i] = float32(alpha + (v-lo)*scale)
+			}
+			dst.SetVecfAt(y, x, out)
+		}
+	}
+}
+
+// matValue returns the value of the single channel matrix as float, regardless of its depth.
+func matValue(m matrix, row, col int) float64 {
+	if m.Type()&7 == gocv.MatTypeCV8U {
+		return float64(m.GetUCharAt(row, col))
+	}
+	return float64(m.GetFloatAt(row, col))
+}
+
+// setMatValue sets the value of the single channel matrix, rounding and saturating the 8 bit values.
+func setMatValue(m matrix, row, col int, v float64) {
+	if m.Type()&7 == gocv.MatTypeCV8U {
+		m.SetUCharAt(row, col, uint8(math.Max(0, math.Min(255, round(v)))))
+		return
+	}
+	m.SetFloatAt(row, col, float32(v))
+}
+
+// denseMat is a pure Go matrix, holding the values of every depth as float32.
+type denseMat struct {
+	rows, cols, channels int
+	typ                  gocv.MatType
+	data                 []float32
+}
+
+// newDenseMat allocates a zeroed matrix of the provided type.
+func newDenseMat(rows, cols int, mt gocv.MatType) *denseMat {
+	ch := int(mt>>3) + 1
+	return &denseMat{
+		rows:     rows,
+		cols:     cols,
+		channels: ch,
+		typ:      mt,
+		data:     make([]float32, rows*cols*ch),
+	}
+}
+
+func (m *denseMat) Rows() int          { return m.rows }
+func (m *denseMat) Cols() int          { return m.cols }
+func (m *denseMat) Channels() int      { return m.channels }
+func (m *denseMat) Type() gocv.MatType { return m.typ }
+
+func (m *denseMat) offset(row, col int) int { return (row*m.cols + col) * m.channels }
+
+func (m *denseMat) GetUCharAt(row, col int) uint8 { return uint8(m.data[m.offset(row, col)]) }
+
+func (m *denseMat) SetUCharAt(row, col int, val uint8) { m.data[m.offset(row, col)] = float32(val) }
+
+func (m *denseMat) GetFloatAt(row, col int) float32 { return m.data[m.offset(row, col)] }
+
+func (m *denseMat) SetFloatAt(row, col int, val float32) { m.data[m.offset(row, col)] = val }
+
+func (m *denseMat) GetVecfAt(row, col int) gocv.Vecf {
+	i := m.offset(row, col)
+	v := make(gocv.Vecf, m.channels)
+	copy(v, m.data[i:i+m.channels])
+	return v
+}
+
+func (m *denseMat) SetVecfAt(row, col int, val gocv.Vecf) {
+	copy(m.data[m.offset(row, col):m.offset(row, col)+m.channels], val)
+}
@@ -0,0 +1,94 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// requestMetrics holds the request counters of the process.
+type requestMetrics struct {
+	mu       sync.Mutex
+	requests map[int]int64
+	duration float64
+	bytesIn  int64
+	bytesOut int64
+}
+
+var metrics = &requestMetrics{requests: make(map[int]int64)}
+
+// collectMetrics counts the requests by status, together with their duration and size.
+func collectMetrics(next handlerFunc) handlerFunc {
+	return func(ctx *RequestContext) *response {
+		start := time.Now()
+		res := next(ctx)
+
+		metrics.mu.Lock()
+		metrics.requests[res.status]++
+		metrics.duration += time.Since(start).Seconds()
+		metrics.bytesIn += int64(len(ctx.Body))
+		metrics.bytesOut += int64(len(res.body))
+		metrics.mu.Unlock()
+
+		return res
+	}
+}
+
+// ServeHTTP exposes the metrics in the Prometheus text format.
+func (m *requestMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *requestMetrics) write(w io.Writer) {
+	statuses := make([]int, 0, len(m.requests))
+	for status := range m.requests {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+
+	fmt.Fprintln(w, "# HELP colidr_requests_total The number of processed requests by status code.")
+	fmt.Fprintln(w, "# TYPE colidr_requests_total counter")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "colidr_requests_total{code=\"%d\"} %d\n", status, m.requests[status])
+	}
+	fmt.Fprintln(w, "# HELP colidr_request_duration_seconds_total The total time spent processing the requests.")
+	fmt.Fprintln(w, "# TYPE colidr_request_duration_seconds_total counter")
+	fmt.Fprintf(w, "colidr_request_duration_seconds_total %g\n", m.duration)
+	fmt.Fprintln(w, "# HELP colidr_request_bytes_total The total size of the requests.")
+	fmt.Fprintln(w, "# TYPE colidr_request_bytes_total counter")
+	fmt.Fprintf(w, "colidr_request_bytes_total %d\n", m.bytesIn)
+	fmt.Fprintln(w, "# HELP colidr_response_bytes_total The total size of the responses.")
+	fmt.Fprintln(w, "# TYPE colidr_response_bytes_total counter")
+	fmt.Fprintf(w, "colidr_response_bytes_total %d\n", m.bytesOut)
+	mats.write(w)
+}
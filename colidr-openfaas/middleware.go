@@ -0,0 +1,314 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// response is the result of the handler.
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// handlerFunc is the core of the function, wrapped by the middlewares.
+type handlerFunc func(ctx *RequestContext) *response
+
+// middleware wraps a handler with a cross-cutting concern.
+type middleware func(next handlerFunc) handlerFunc
+
+// chain wraps the handler with the middlewares, the first one being the outermost.
+func chain(h handlerFunc, mws ...middleware) handlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// defaultMiddlewares are the middlewares applied around the function handlers.
+func defaultMiddlewares() []middleware {
+	return []middleware{logRequests, auditRequests, collectMetrics, detectMatLeaks, localizeErrors, limitResponse, recoverPanics, allowCORS, authenticate, limitRate, admitRequests, limitSize}
+}
+
+// newResponse creates a response with the provided status and body.
+func newResponse(status int, body []byte) *response {
+	return &response{status: status, header: make(http.Header), body: body}
+}
+
+// errorResponse creates a response carrying the error message.
+func errorResponse(status int, format string, args ...interface{}) *response {
+	res := newResponse(status, []byte(fmt.Sprintf(format, args...)))
+	res.header.Set("Content-Type", "text/plain; charset=utf-8")
+	return res
+}
+
+// withCode sets the machine code of the error response.
+func (r *response) withCode(code string) *response {
+	r.header.Set("X-Error-Code", code)
+	return r
+}
+
+// writeResponse writes the response of the handler to the HTTP response writer.
+func writeResponse(w http.ResponseWriter, res *response) {
+	for k, v := range res.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(res.status)
+	w.Write(res.body)
+}
+
+// statusRecorder records the status of the response written by an HTTP handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes the flushes through, so the streamed responses are not buffered.
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// chainHTTP mounts the HTTP handler behind the default middlewares, so its requests are
+// authenticated, rate limited, admitted and size limited like the uploads. The handler writes
+// its response itself from within the chain, which keeps the streamed responses admitted for
+// their whole duration, while the responses of the middlewares rejecting the request are written
+// instead of it.
+func chainHTTP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := requestFromHTTP(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		var served bool
+		res := chain(func(ctx *RequestContext) *response {
+			served = true
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			r.Body = ioutil.NopCloser(bytes.NewReader(ctx.Body))
+			h.ServeHTTP(rec, r)
+			return newResponse(rec.status, nil)
+		}, defaultMiddlewares()...)(req)
+		if !served {
+			writeResponse(w, res)
+		}
+	})
+}
+
+// logRequests logs the processed requests when the request_logging environment variable is set.
+// With the classic watchdog make sure combine_output is disabled, so the logs don't end up in the response.
+func logRequests(next handlerFunc) handlerFunc {
+	return func(ctx *RequestContext) *response {
+		if os.Getenv("request_logging") != "true" {
+			return next(ctx)
+		}
+		start := time.Now()
+		res := next(ctx)
+		log.Printf("%s %s status=%d in=%d out=%d duration=%s",
+			ctx.Method, ctx.Remote, res.status, len(ctx.Body), len(res.body), time.Since(start))
+		return res
+	}
+}
+
+// recoverPanics converts the panics of the handler into internal error responses.
+func recoverPanics(next handlerFunc) handlerFunc {
+	return func(ctx *RequestContext) (res *response) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("panic while processing the request: %v\n%s", r, debug.Stack())
+				// The panic value might reveal the internals, so it's only logged.
+				res = errorResponse(http.StatusInternalServerError, "internal error")
+			}
+		}()
+		return next(ctx)
+	}
+}
+
+// allowCORS adds the CORS headers for the origins allowed through the cors_origins environment
+// variable (a comma separated list, or * for any origin) and answers the preflight requests.
+func allowCORS(next handlerFunc) handlerFunc {
+	return func(ctx *RequestContext) *response {
+		origin := ctx.Header.Get("Origin")
+		allowed := os.Getenv("cors_origins")
+		if origin == "" || allowed == "" {
+			return next(ctx)
+		}
+
+		var match bool
+		for _, o := range strings.Split(allowed, ",") {
+			if o = strings.TrimSpace(o); o == "*" || o == origin {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return next(ctx)
+		}
+
+		var res *response
+		if ctx.Method == http.MethodOptions {
+			res = newResponse(http.StatusNoContent, nil)
+			res.header.Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			res.header.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Api-Key")
+			res.header.Set("Access-Control-Max-Age", "600")
+		} else {
+			res = next(ctx)
+		}
+		res.header.Set("Access-Control-Allow-Origin", origin)
+		res.header.Set("Access-Control-Expose-Headers", "X-Error-Code")
+		res.header.Add("Vary", "Origin")
+		return res
+	}
+}
+
+// authenticate rejects the requests without the API key, when one is configured through
+// the api_key environment variable or the api-key secret. The key is accepted either
+// as a bearer token or in the X-Api-Key header.
+func authenticate(next handlerFunc) handlerFunc {
+	return func(ctx *RequestContext) *response {
+		key := readSecret("api-key")
+		if key == "" {
+			return next(ctx)
+		}
+		provided := ctx.Header.Get("X-Api-Key")
+		if auth := ctx.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			provided = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(key)) != 1 {
+			return errorResponse(http.StatusUnauthorized, "missing or invalid API key")
+		}
+		return next(ctx)
+	}
+}
+
+// tokenBucket is a rate limiter allowing bursts up to its capacity.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiterSweepInterval is the interval of dropping the buckets of the idle clients.
+const limiterSweepInterval = time.Minute
+
+// rateLimiter limits the request rate of every client.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// rate and burst are the last limits applied, used by the sweep.
+	rate, burst float64
+	sweeping    sync.Once
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// sweep drops the buckets of the idle clients, which are full anyway.
+func (l *rateLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range l.buckets {
+		if now.Sub(v.last).Seconds()*l.rate > l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// allow reports whether the client can make a request, refilling its bucket with rate tokens per second.
+func (l *rateLimiter) allow(client string, rate, burst float64) bool {
+	l.sweeping.Do(func() {
+		go func() {
+			for range time.Tick(limiterSweepInterval) {
+				l.sweep()
+			}
+		}()
+	})
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate, l.burst = rate, burst
+	now := time.Now()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// limitRate limits the requests per client to the rate_limit requests per second, configured
+// through the environment, allowing bursts of rate_burst requests. Since the classic watchdog
+// forks a process per request, the limit is only effective in HTTP mode.
+func limitRate(next handlerFunc) handlerFunc {
+	return func(ctx *RequestContext) *response {
+		rate, err := strconv.ParseFloat(os.Getenv("rate_limit"), 64)
+		if err != nil || rate <= 0 {
+			return next(ctx)
+		}
+		burst, err := strconv.ParseFloat(os.Getenv("rate_burst"), 64)
+		if err != nil || burst < 1 {
+			burst = 1
+		}
+		if !limiter.allow(ctx.Remote, rate, burst) {
+			return errorResponse(http.StatusTooManyRequests, "rate limit exceeded")
+		}
+		return next(ctx)
+	}
+}
+
+// limitSize rejects the requests exceeding the maximum upload size.
+func limitSize(next handlerFunc) handlerFunc {
+	return func(ctx *RequestContext) *response {
+		if limit := maxUploadSize(); int64(len(ctx.Body)) > limit {
+			return errorResponse(http.StatusRequestEntityTooLarge, "the request exceeds the maximum allowed size of %d bytes", limit)
+		}
+		return next(ctx)
+	}
+}
@@ -0,0 +1,336 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+)
+
+// The Netpbm formats are registered, so they can be decoded through the standard image package.
+func init() {
+	for _, magic := range []string{"P1", "P2", "P3", "P4", "P5", "P6"} {
+		image.RegisterFormat(netpbmFormat(magic), magic, decodeNetpbm, decodeNetpbmConfig)
+	}
+}
+
+// netpbmHeader is the header of the Netpbm (PBM, PGM and PPM) images.
+type netpbmHeader struct {
+	magic         string
+	width, height int
+	maxVal        int
+}
+
+// netpbmFormat returns the format name of the Netpbm magic number.
+func netpbmFormat(magic string) string {
+	switch magic {
+	case "P1", "P4":
+		return "pbm"
+	case "P2", "P5":
+		return "pgm"
+	}
+	return "ppm"
+}
+
+// readNetpbmToken reads the next whitespace separated token of the header, skipping the comments.
+func readNetpbmToken(r *bufio.Reader) (string, error) {
+	var token []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(token) > 0 {
+				return string(token), nil
+			}
+			return "", err
+		}
+		switch {
+		case b == '#':
+			if _, err := r.ReadString('\n'); err != nil {
+				return "", err
+			}
+			if len(token) > 0 {
+				return string(token), nil
+			}
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f':
+			if len(token) > 0 {
+				return string(token), nil
+			}
+		default:
+			token = append(token, b)
+		}
+	}
+}
+
+// readNetpbmInt reads the next header token as a positive integer.
+func readNetpbmInt(r *bufio.Reader) (int, error) {
+	token, err := readNetpbmToken(r)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(token)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("netpbm: invalid header value %q", token)
+	}
+	return v, nil
+}
+
+// readNetpbmHeader parses the header. The single whitespace following
+// the header is consumed, so the reader is positioned on the raster.
+func readNetpbmHeader(r *bufio.Reader) (*netpbmHeader, error) {
+	magic, err := readNetpbmToken(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(magic) != 2 || magic[0] != 'P' || magic[1] < '1' || magic[1] > '6' {
+		return nil, errors.New("netpbm: invalid magic number")
+	}
+
+	h := &netpbmHeader{magic: magic, maxVal: 1}
+	if h.width, err = readNetpbmInt(r); err != nil {
+		return nil, err
+	}
+	if h.height, err = readNetpbmInt(r); err != nil {
+		return nil, err
+	}
+	if magic != "P1" && magic != "P4" {
+		if h.maxVal, err = readNetpbmInt(r); err != nil {
+			return nil, err
+		}
+		if h.maxVal > 65535 {
+			return nil, errors.New("netpbm: the maximum value must be less than 65536")
+		}
+	}
+	return h, nil
+}
+
+// decodeNetpbmConfig returns the color model and the dimensions of the Netpbm image.
+func decodeNetpbmConfig(r io.Reader) (image.Config, error) {
+	h, err := readNetpbmHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	model := color.GrayModel
+	switch {
+	case (h.magic == "P3" || h.magic == "P6") && h.maxVal > 255:
+		model = color.RGBA64Model
+	case h.magic == "P3" || h.magic == "P6":
+		model = color.RGBAModel
+	case h.maxVal > 255:
+		model = color.Gray16Model
+	}
+	return image.Config{ColorModel: model, Width: h.width, Height: h.height}, nil
+}
+
+// decodeNetpbm decodes the plain (ASCII) and raw (binary) variants of the PBM, PGM and PPM images.
+// The samples with more than 8 bits are decoded into 16 bit images.
+func decodeNetpbm(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readNetpbmHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := 1
+	if h.magic == "P3" || h.magic == "P6" {
+		channels = 3
+	}
+	samples := make([]int, h.width*h.height*channels)
+
+	switch h.magic {
+	case "P1", "P2", "P3":
+		for i := range samples {
+			if h.magic == "P1" {
+				// The plain PBM samples are not required to be separated by whitespaces.
+				b, err := readNonSpace(br)
+				if err != nil {
+					return nil, err
+				}
+				samples[i] = int(b - '0')
+				continue
+			}
+			if samples[i], err = readNetpbmSample(br); err != nil {
+				return nil, err
+			}
+		}
+	case "P4":
+		row := make([]byte, (h.width+7)/8)
+		for y := 0; y < h.height; y++ {
+			if _, err := io.ReadFull(br, row); err != nil {
+				return nil, err
+			}
+			for x := 0; x < h.width; x++ {
+				samples[y*h.width+x] = int(row[x/8]>>(7-uint(x%8))) & 1
+			}
+		}
+	default:
+		size := 1
+		if h.maxVal > 255 {
+			size = 2
+		}
+		raster := make([]byte, len(samples)*size)
+		if _, err := io.ReadFull(br, raster); err != nil {
+			return nil, err
+		}
+		for i := range samples {
+			if size == 2 {
+				samples[i] = int(raster[2*i])<<8 | int(raster[2*i+1])
+			} else {
+				samples[i] = int(raster[i])
+			}
+		}
+	}
+
+	// In the PBM images 1 stands for black.
+	if h.magic == "P1" || h.magic == "P4" {
+		for i, v := range samples {
+			samples[i] = 1 - v
+		}
+	}
+	return netpbmImage(h, samples), nil
+}
+
+// readNonSpace returns the next non whitespace byte.
+func readNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\t' && b != '\n' && b != '\r' && b != '\v' && b != '\f' {
+			return b, nil
+		}
+	}
+}
+
+// readNetpbmSample reads a sample of the plain formats.
+func readNetpbmSample(r *bufio.Reader) (int, error) {
+	token, err := readNetpbmToken(r)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(token)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("netpbm: invalid sample %q", token)
+	}
+	return v, nil
+}
+
+// netpbmImage builds the image from the samples, scaling them to the full range of the image type.
+func netpbmImage(h *netpbmHeader, samples []int) image.Image {
+	rect := image.Rect(0, 0, h.width, h.height)
+	wide := h.maxVal > 255
+
+	scale := func(v int) int {
+		if v > h.maxVal {
+			v = h.maxVal
+		}
+		if wide {
+			return v * 65535 / h.maxVal
+		}
+		return v * 255 / h.maxVal
+	}
+
+	if h.magic == "P3" || h.magic == "P6" {
+		if wide {
+			img := image.NewRGBA64(rect)
+			for i := 0; i < len(samples)/3; i++ {
+				img.SetRGBA64(i%h.width, i/h.width, color.RGBA64{
+					R: uint16(scale(samples[3*i])),
+					G: uint16(scale(samples[3*i+1])),
+					B: uint16(scale(samples[3*i+2])),
+					A: 0xffff,
+				})
+			}
+			return img
+		}
+		img := image.NewRGBA(rect)
+		for i := 0; i < len(samples)/3; i++ {
+			img.Pix[4*i] = uint8(scale(samples[3*i]))
+			img.Pix[4*i+1] = uint8(scale(samples[3*i+1]))
+			img.Pix[4*i+2] = uint8(scale(samples[3*i+2]))
+			img.Pix[4*i+3] = 0xff
+		}
+		return img
+	}
+
+	if wide {
+		img := image.NewGray16(rect)
+		for i, v := range samples {
+			img.SetGray16(i%h.width, i/h.width, color.Gray16{Y: uint16(scale(v))})
+		}
+		return img
+	}
+	img := image.NewGray(rect)
+	for i, v := range samples {
+		img.Pix[i] = uint8(scale(v))
+	}
+	return img
+}
+
+// encodeNetpbm encodes the image in the raw variant of the requested Netpbm format:
+// pbm (thresholded at the middle gray), pgm or ppm.
+func encodeNetpbm(w io.Writer, img image.Image, format string) error {
+	b := img.Bounds()
+	bw := bufio.NewWriter(w)
+
+	switch format {
+	case "pbm":
+		fmt.Fprintf(bw, "P4\n%d %d\n", b.Dx(), b.Dy())
+		row := make([]byte, (b.Dx()+7)/8)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for i := range row {
+				row[i] = 0
+			}
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y < 128 {
+					i := x - b.Min.X
+					row[i/8] |= 1 << (7 - uint(i%8))
+				}
+			}
+			bw.Write(row)
+		}
+	case "pgm":
+		fmt.Fprintf(bw, "P5\n%d %d\n255\n", b.Dx(), b.Dy())
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				bw.WriteByte(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			}
+		}
+	case "ppm":
+		fmt.Fprintf(bw, "P6\n%d %d\n255\n", b.Dx(), b.Dy())
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+				bw.Write([]byte{c.R, c.G, c.B})
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported Netpbm format %q", format)
+	}
+	return bw.Flush()
+}
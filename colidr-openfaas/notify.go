@@ -0,0 +1,112 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// completionEvent is the small event published on the completion of the async jobs, i.e. the queue
+// messages and the batches, so the downstream systems can react without polling.
+type completionEvent struct {
+	JobID     string             `json:"job_id"`
+	Kind      string             `json:"kind"`
+	Status    string             `json:"status"`
+	ResultURL string             `json:"result_url,omitempty"`
+	Error     string             `json:"error,omitempty"`
+	Metrics   map[string]float64 `json:"metrics,omitempty"`
+	Time      time.Time          `json:"time"`
+}
+
+// notifyClient is shared by the Pub/Sub notifications, caching the access token.
+var notifyClient = newPubSubClient()
+
+// notifyCompletion publishes the event to the SNS topic set through the notify_sns_topic_arn
+// environment variable and to the Pub/Sub topic set through the notify_pubsub_topic one
+// (projects/{project}/topics/{name}). The failures are only logged.
+func notifyCompletion(event completionEvent) {
+	event.Time = time.Now().UTC()
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if arn := os.Getenv("notify_sns_topic_arn"); arn != "" {
+		if err := publishSNS(arn, body); err != nil {
+			log.Printf("unable to publish the completion of %s to SNS: %v", event.JobID, err)
+		}
+	}
+	if topic := os.Getenv("notify_pubsub_topic"); topic != "" {
+		err := notifyClient.call(topic, "publish", map[string]interface{}{
+			"messages": []map[string]interface{}{{
+				"data":       base64.StdEncoding.EncodeToString(body),
+				"attributes": map[string]string{"kind": event.Kind, "status": event.Status},
+			}},
+		}, nil)
+		if err != nil {
+			log.Printf("unable to publish the completion of %s to Pub/Sub: %v", event.JobID, err)
+		}
+	}
+}
+
+// publishSNS publishes the message to the SNS topic through the query API, the region being
+// derived from the topic ARN, like arn:aws:sns:us-east-1:123456789012:name.
+func publishSNS(arn string, message []byte) error {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 6 {
+		return fmt.Errorf("invalid topic ARN %q", arn)
+	}
+	form := url.Values{
+		"Action":   {"Publish"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {arn},
+		"Message":  {string(message)},
+	}
+	body := []byte(form.Encode())
+	req, err := http.NewRequest(http.MethodPost, "https://sns."+parts[3]+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, body, parts[3], "sns", time.Now().UTC())
+
+	resp, err := storageClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %v: %s", resp.Status, data)
+	}
+	return nil
+}
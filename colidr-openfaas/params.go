@@ -0,0 +1,594 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxFlowSteps is the maximum number of the streamline integration steps, bounding the
+	// Gaussian kernel extended up to it.
+	maxFlowSteps = 512
+	// maxEtfKernel is the maximum radius of the edge tangent flow kernel, the work per pixel
+	// growing with its square.
+	maxEtfKernel = 32
+	// maxIterations is the maximum number of the ETF and FDoG iterations.
+	maxIterations = 10
+	// maxJitterFreq is the maximum jitter frequency, the noise lattice growing with it.
+	maxJitterFreq = 1.0
+)
+
+// requestParams holds all the parameters resolved from the request query string.
+type requestParams struct {
+	opts     options
+	print    printOptions
+	useICC   bool
+	linear   bool
+	embedICC bool
+	outMap   string
+	// style is the artistic mode rendered instead of the line drawing.
+	style       string
+	flowLength  int
+	cellSize    int
+	cellStretch float64
+	format      string
+	groupBy     string
+	strokeOrder string
+	pens        int
+	// stitchLength is the length of the embroidery stitches in millimeters.
+	stitchLength float64
+	asciiWidth   int
+	charset      string
+	ansi         bool
+	layerTaus    []float32
+	layerColors  []color.RGBA
+	dryRun       bool
+	analyze      bool
+	// exportRecipe returns the effective recipe instead of processing the image.
+	exportRecipe bool
+	retry        bool
+	minCoverage  float64
+	blankMode    string
+	// tileSize is the tile edge of the distributed rendering, zero rendering the whole image locally.
+	tileSize int
+	salvage  bool
+	quality  int
+	relaxed  *relaxedParams
+	c2pa     bool
+	// iptc writes the keywords and the description into the output metadata.
+	iptc        bool
+	tags        []string
+	description string
+	preset      string
+	recipe      string
+	sourceHash  string
+}
+
+// paramParser parses the query parameters, retaining the first parsing error.
+// The numeric values are parsed independently of the locale, so the only accepted
+// decimal separator is the dot, while the scientific notation (e.g. 1e-2) is supported.
+type paramParser struct {
+	values url.Values
+	err    error
+}
+
+// parseParams resolves the request parameters, falling back to the defaults for the missing ones.
+func parseParams(values url.Values) (*requestParams, error) {
+	recipe, preset := values.Get("recipe"), values.Get("preset")
+	values, err := applyRecipe(values)
+	if err != nil {
+		return nil, err
+	}
+	if values, err = applyPreset(values); err != nil {
+		return nil, err
+	}
+
+	rp := &requestParams{
+		opts: options{
+			sigmaR:         2.6,
+			sigmaM:         3.0,
+			sigmaC:         1.0,
+			rho:            0.98,
+			tau:            0.98,
+			etfKernel:      2,
+			etfIteration:   2,
+			fDogIteration:  1,
+			blurSize:       3,
+			jitterFreq:     0.02,
+			seed:           time.Now().UnixNano(),
+			antiAlias:      true,
+			blankThreshold: defaultBlankThreshold,
+		},
+		print:       printOptions{dpi: 300},
+		minCoverage: defaultMinCoverage,
+		quality:     100,
+		flowLength:  defaultFlowLength,
+		cellSize:    defaultCellSize,
+		cellStretch: defaultCellStretch,
+	}
+
+	p := &paramParser{values: values}
+	p.float("sr", &rp.opts.sigmaR)
+	if !p.relative("sm", &rp.opts.relSizes.sigmaM) {
+		p.float("sm", &rp.opts.sigmaM)
+	}
+	if !p.relative("sc", &rp.opts.relSizes.sigmaC) {
+		p.float("sc", &rp.opts.sigmaC)
+	}
+	p.float("rho", &rp.opts.rho)
+	if strings.EqualFold(values.Get("tau"), "auto") {
+		rp.opts.autoTau = true
+	} else {
+		p.float32("tau", &rp.opts.tau)
+	}
+	p.float("tau_pct", &rp.opts.tauPercentile)
+	p.int("max_strokes", &rp.opts.maxStrokes)
+	p.float("target_coverage", &rp.opts.targetCoverage)
+	rp.opts.symmetry = strings.ToLower(values.Get("symmetry"))
+	p.float("symmetry_axis", &rp.opts.symmetryAxis)
+	p.float32("min_flow_magnitude", &rp.opts.minFlowMag)
+	p.int("ms", &rp.opts.maxSteps)
+	p.float("fb", &rp.opts.flowBalance)
+	p.float("ja", &rp.opts.jitterAmp)
+	p.float("jf", &rp.opts.jitterFreq)
+	p.int64("seed", &rp.opts.seed)
+	if !p.relative("k", &rp.opts.relSizes.etfKernel) {
+		p.int("k", &rp.opts.etfKernel)
+	}
+	p.int("ei", &rp.opts.etfIteration)
+	p.int("di", &rp.opts.fDogIteration)
+	p.int("bl", &rp.opts.blurSize)
+	rp.opts.combineBlur = rp.opts.blurSize
+	p.int("cb", &rp.opts.combineBlur)
+	p.bool("ai", &rp.opts.antiAlias)
+	p.bool("strict", &rp.opts.strict)
+	p.bool("srgb_linear", &rp.opts.linearRGB)
+	p.bool("alpha_mask", &rp.opts.alphaMask)
+	p.bool("normalize_params", &rp.opts.normalize)
+	rp.opts.referenceSize = referenceSize()
+	p.int("reference_size", &rp.opts.referenceSize)
+	p.float("blank_threshold", &rp.opts.blankThreshold)
+	rp.opts.bandRows = defaultBandRows()
+	p.int("band_rows", &rp.opts.bandRows)
+	rp.tileSize = defaultTileSize()
+	p.int("tile_size", &rp.tileSize)
+
+	p.bool("icc", &rp.useICC)
+	p.bool("linear", &rp.linear)
+	p.bool("embed_icc", &rp.embedICC)
+
+	p.bool("print", &rp.print.enabled)
+	p.int("dpi", &rp.print.dpi)
+	p.bool("cmyk", &rp.print.cmyk)
+	p.float("bleed", &rp.print.bleed)
+
+	p.int("pens", &rp.pens)
+	p.float("stitch_len", &rp.stitchLength)
+	p.int("ascii_width", &rp.asciiWidth)
+	p.int("flow_len", &rp.flowLength)
+	p.int("cell", &rp.cellSize)
+	p.float("cell_stretch", &rp.cellStretch)
+	p.bool("ansi", &rp.ansi)
+
+	p.bool("dryrun", &rp.dryRun)
+	p.bool("analyze", &rp.analyze)
+	p.bool("export_recipe", &rp.exportRecipe)
+	p.bool("retry", &rp.retry)
+	p.float("min_coverage", &rp.minCoverage)
+	p.bool("salvage", &rp.salvage)
+	p.int("quality", &rp.quality)
+	p.bool("c2pa", &rp.c2pa)
+	p.bool("iptc", &rp.iptc)
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	for i, sigma := range []float64{rp.opts.sigmaR, rp.opts.sigmaM, rp.opts.sigmaC} {
+		if !(sigma > 0) || math.IsInf(sigma, 0) {
+			return nil, fmt.Errorf("invalid %s %v: must be a positive number", []string{"sr", "sm", "sc"}[i], sigma)
+		}
+	}
+	if rp.opts.referenceSize <= 0 {
+		return nil, fmt.Errorf("invalid reference_size %d: must be a positive number", rp.opts.referenceSize)
+	}
+	if values.Get("tau_pct") != "" && !(rp.opts.tauPercentile > 0 && rp.opts.tauPercentile < 100) {
+		return nil, fmt.Errorf("invalid tau_pct %v: must be between 0 and 100", rp.opts.tauPercentile)
+	}
+	if rp.opts.etfKernel < 1 || rp.opts.etfKernel > maxEtfKernel {
+		return nil, fmt.Errorf("invalid k %d: must be between 1 and %d", rp.opts.etfKernel, maxEtfKernel)
+	}
+	if rp.opts.etfIteration < 0 || rp.opts.etfIteration > maxIterations {
+		return nil, fmt.Errorf("invalid ei %d: must be between 0 and %d", rp.opts.etfIteration, maxIterations)
+	}
+	if rp.opts.fDogIteration < 0 || rp.opts.fDogIteration > maxIterations {
+		return nil, fmt.Errorf("invalid di %d: must be between 0 and %d", rp.opts.fDogIteration, maxIterations)
+	}
+	if !(rp.opts.jitterFreq > 0 && rp.opts.jitterFreq <= maxJitterFreq) {
+		return nil, fmt.Errorf("invalid jf %v: must be greater than 0 and at most %g", rp.opts.jitterFreq, maxJitterFreq)
+	}
+	if rp.opts.maxSteps < 0 || rp.opts.maxSteps > maxFlowSteps {
+		return nil, fmt.Errorf("invalid ms %d: must be between 0 and %d", rp.opts.maxSteps, maxFlowSteps)
+	}
+	if rp.opts.maxStrokes < 0 {
+		return nil, fmt.Errorf("invalid max_strokes %d: must not be negative", rp.opts.maxStrokes)
+	}
+	if rp.opts.targetCoverage < 0 || rp.opts.targetCoverage > 1 {
+		return nil, fmt.Errorf("invalid target_coverage %v: must be between 0 and 1", rp.opts.targetCoverage)
+	}
+	if err := validateSymmetry(rp.opts.symmetry, rp.opts.symmetryAxis); err != nil {
+		return nil, err
+	}
+	rp.opts.flowBalance = math.Max(-1.0, math.Min(1.0, rp.opts.flowBalance))
+	if rp.print.dpi <= 0 {
+		return nil, fmt.Errorf("invalid dpi %d: must be a positive number", rp.print.dpi)
+	}
+	if rp.quality < 1 || rp.quality > 100 {
+		return nil, fmt.Errorf("invalid quality %d: must be between 1 and 100", rp.quality)
+	}
+
+	if rp.opts.precision, err = parsePrecision(values.Get("precision")); err != nil {
+		return nil, err
+	}
+	rp.outMap = values.Get("map")
+	rp.style = values.Get("style")
+	if rp.style != "" && rp.style != "flow" && rp.style != "glass" {
+		return nil, fmt.Errorf("invalid style %q: must be flow or glass", rp.style)
+	}
+	if rp.cellSize < 4 {
+		return nil, fmt.Errorf("invalid cell %d: must be at least 4", rp.cellSize)
+	}
+	if !(rp.cellStretch >= 1 && rp.cellStretch <= 8) {
+		return nil, fmt.Errorf("invalid cell_stretch %v: must be between 1 and 8", rp.cellStretch)
+	}
+	// The stained glass is filled with the colors of the source.
+	rp.opts.keepColor = rp.style == "glass"
+	if rp.flowLength < 2 || rp.flowLength > maxFlowLength {
+		return nil, fmt.Errorf("invalid flow_len %d: must be between 2 and %d", rp.flowLength, maxFlowLength)
+	}
+	rp.format = values.Get("format")
+	rp.groupBy = values.Get("group")
+	rp.strokeOrder = values.Get("order")
+	if rp.strokeOrder != "" && rp.strokeOrder != "dark" && rp.strokeOrder != "light" {
+		return nil, fmt.Errorf("invalid stroke order %q: must be dark or light", rp.strokeOrder)
+	}
+	rp.blankMode = values.Get("blank")
+	if rp.blankMode != "" && rp.blankMode != "error" && rp.blankMode != "passthrough" {
+		return nil, fmt.Errorf("invalid blank mode %q: must be error or passthrough", rp.blankMode)
+	}
+
+	rp.preset, rp.recipe = preset, recipe
+	rp.description = values.Get("description")
+	if rp.tags, err = parseTags(values.Get("tags")); err != nil {
+		return nil, err
+	}
+
+	if values.Get("t") != "" {
+		if rp.opts.transforms, err = parseTransforms(values.Get("t")); err != nil {
+			return nil, err
+		}
+	}
+	if values.Get("post") != "" {
+		if rp.opts.postFilters, err = parsePostFilters(values.Get("post")); err != nil {
+			return nil, err
+		}
+	}
+	if values.Get("layers") != "" {
+		if rp.layerTaus, err = parseTauList(values.Get("layers")); err != nil {
+			return nil, fmt.Errorf("unable to parse the layers: %v", err)
+		}
+	}
+	if values.Get("colors") != "" {
+		if rp.layerColors, err = parseColorList(values.Get("colors")); err != nil {
+			return nil, fmt.Errorf("unable to parse the layer colors: %v", err)
+		}
+	}
+	if rp.stitchLength < 0 || rp.stitchLength > maxDSTStep/10.0 {
+		return nil, fmt.Errorf("invalid stitch_len %v: must be between 0 and %v mm", rp.stitchLength, maxDSTStep/10.0)
+	}
+	if rp.asciiWidth < 0 || rp.asciiWidth > maxASCIIWidth {
+		return nil, fmt.Errorf("invalid ascii_width %d: must be between 0 and %d", rp.asciiWidth, maxASCIIWidth)
+	}
+	rp.charset = values.Get("charset")
+	if _, ok := asciiRamps[rp.charset]; rp.charset != "" && !ok {
+		return nil, fmt.Errorf("invalid charset %q: must be ascii or blocks", rp.charset)
+	}
+	if err := validatePens(rp.pens, rp.layerTaus); err != nil {
+		return nil, err
+	}
+	if rp.opts.bandRows != 0 && rp.opts.bandRows < minBandRows {
+		return nil, fmt.Errorf("invalid band_rows %d: must be 0 or at least %d", rp.opts.bandRows, minBandRows)
+	}
+	if rp.tileSize != 0 && rp.tileSize < minTileSize {
+		return nil, fmt.Errorf("invalid tile_size %d: must be 0 or at least %d", rp.tileSize, minTileSize)
+	}
+	if rp.wholeImage() {
+		rp.opts.bandRows = 0
+	}
+	// The vector outputs jitter the traced strokes, rather than the raster lines they are traced from.
+	switch rp.encoderFormat() {
+	case "svg", "gcode", "dst":
+		rp.opts.jitterStrokes = true
+	}
+	return rp, nil
+}
+
+// wholeImage reports whether the request uses the features working on the whole image responses,
+// which fall back from the banded and the tiled processing to the whole image processing.
+func (rp *requestParams) wholeImage() bool {
+	return len(rp.layerTaus) > 0 || rp.outMap != "" || rp.style != "" || rp.retry || rp.opts.maxStrokes > 0 || rp.opts.targetCoverage > 0 || rp.opts.alphaMask
+}
+
+// drawsLines reports whether the request renders the line drawing, rather than an intermediate
+// map or an artistic style.
+func (rp *requestParams) drawsLines() bool {
+	return rp.outMap == "" && rp.style == ""
+}
+
+// encoderFormat returns the name of the encoder of the output. The print output is either
+// a JPEG embedding the resolution or a CMYK TIFF, while the intermediate maps can't be traced as vectors.
+func (rp *requestParams) encoderFormat() string {
+	switch {
+	case rp.print.enabled && rp.print.cmyk:
+		return "tiff"
+	case rp.print.enabled, (rp.format == "svg" || rp.format == "gcode" || rp.format == "dst") && !rp.drawsLines():
+		return "jpeg"
+	}
+	return rp.format
+}
+
+// encodeOptions returns the options of the output encoder.
+func (rp *requestParams) encodeOptions() EncodeOptions {
+	return EncodeOptions{
+		Format:       rp.encoderFormat(),
+		Quality:      rp.quality,
+		Layers:       rp.layerTaus,
+		Colors:       rp.layerColors,
+		GroupBy:      rp.groupBy,
+		Order:        rp.strokeOrder,
+		Pens:         rp.pens,
+		StitchLength: rp.stitchLength,
+		ASCIIWidth:   rp.asciiWidth,
+		Charset:      rp.charset,
+		ANSI:         rp.ansi,
+		print:        rp.print,
+	}
+}
+
+// ParseOptions resolves the CLD options from the query string styled values, falling back
+// to the defaults for the missing ones. It is meant for using the package as a library,
+// together with NewCLDFromBytes or NewCLDFromMat.
+func ParseOptions(values url.Values) (options, error) {
+	rp, err := parseParams(values)
+	if err != nil {
+		return options{}, err
+	}
+	return rp.opts, nil
+}
+
+// describe returns the resolved parameters keyed by their query parameter names.
+func (rp *requestParams) describe() map[string]interface{} {
+	o := rp.opts
+	params := map[string]interface{}{
+		"sr":                 o.sigmaR,
+		"sm":                 formatRelative(o.sigmaM, o.relSizes.sigmaM),
+		"sc":                 formatRelative(o.sigmaC, o.relSizes.sigmaC),
+		"rho":                o.rho,
+		"tau":                o.tau,
+		"tau_pct":            o.tauPercentile,
+		"tau_auto":           o.autoTau,
+		"max_strokes":        o.maxStrokes,
+		"target_coverage":    o.targetCoverage,
+		"symmetry":           o.symmetry,
+		"symmetry_axis":      o.symmetryAxis,
+		"min_flow_magnitude": o.minFlowMag,
+		"ms":                 o.maxSteps,
+		"fb":                 o.flowBalance,
+		"ja":                 o.jitterAmp,
+		"jf":                 o.jitterFreq,
+		"seed":               o.seed,
+		"k":                  formatRelative(o.etfKernel, o.relSizes.etfKernel),
+		"ei":                 o.etfIteration,
+		"di":                 o.fDogIteration,
+		"bl":                 o.blurSize,
+		"cb":                 o.combineBlur,
+		"ai":                 o.antiAlias,
+		"strict":             o.strict,
+		"srgb_linear":        o.linearRGB,
+		"blank_threshold":    o.blankThreshold,
+		"band_rows":          o.bandRows,
+		"tile_size":          rp.tileSize,
+		"t":                  formatTransforms(o.transforms),
+		"post":               formatPostFilters(o.postFilters),
+		"icc":                rp.useICC,
+		"linear":             rp.linear,
+		"embed_icc":          rp.embedICC,
+		"print":              rp.print.enabled,
+		"dpi":                rp.print.dpi,
+		"cmyk":               rp.print.cmyk,
+		"bleed":              rp.print.bleed,
+		"c2pa":               rp.c2pa,
+		"retry":              rp.retry,
+		"min_coverage":       rp.minCoverage,
+		"salvage":            rp.salvage,
+		"quality":            rp.quality,
+	}
+	if o.precision != precisionDefault {
+		params["precision"] = o.precision.String()
+	}
+	if o.alphaMask {
+		params["alpha_mask"] = o.alphaMask
+	}
+	if o.normalize {
+		params["normalize_params"] = o.normalize
+		params["reference_size"] = o.referenceSize
+	}
+	if rp.outMap != "" {
+		params["map"] = rp.outMap
+	}
+	if rp.style != "" {
+		params["style"] = rp.style
+	}
+	if rp.style == "flow" {
+		params["flow_len"] = rp.flowLength
+	}
+	if rp.style == "glass" {
+		params["cell"] = rp.cellSize
+		params["cell_stretch"] = rp.cellStretch
+	}
+	if rp.format != "" {
+		params["format"] = rp.format
+	}
+	if rp.groupBy != "" {
+		params["group"] = rp.groupBy
+	}
+	if rp.strokeOrder != "" {
+		params["order"] = rp.strokeOrder
+	}
+	if rp.pens > 0 {
+		params["pens"] = rp.pens
+	}
+	if rp.stitchLength > 0 {
+		params["stitch_len"] = rp.stitchLength
+	}
+	if rp.asciiWidth > 0 {
+		params["ascii_width"] = rp.asciiWidth
+	}
+	if rp.charset != "" {
+		params["charset"] = rp.charset
+	}
+	if rp.iptc {
+		params["iptc"] = rp.iptc
+	}
+	if len(rp.tags) > 0 {
+		params["tags"] = rp.tags
+	}
+	if rp.description != "" {
+		params["description"] = rp.description
+	}
+	if rp.ansi {
+		params["ansi"] = rp.ansi
+	}
+	if rp.blankMode != "" {
+		params["blank"] = rp.blankMode
+	}
+	if len(rp.layerTaus) > 0 {
+		params["layers"] = rp.layerTaus
+	}
+	if len(rp.layerColors) > 0 {
+		colors := make([]string, len(rp.layerColors))
+		for i, c := range rp.layerColors {
+			colors[i] = fmt.Sprintf("%02x%02x%02x", c.R, c.G, c.B)
+		}
+		params["colors"] = colors
+	}
+	return params
+}
+
+// parseFloat parses a locale independent floating point number, rejecting the non finite values.
+func parseFloat(s string, bitSize int) (float64, error) {
+	if strings.Contains(s, ",") {
+		return 0, fmt.Errorf("invalid number %q: the decimal separator must be a dot", s)
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), bitSize)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return v, nil
+}
+
+// value returns the raw value of the parameter, or an empty string if it's missing
+// or a previous parameter has already failed to parse.
+func (p *paramParser) value(name string) string {
+	if p.err != nil {
+		return ""
+	}
+	return p.values.Get(name)
+}
+
+// fail records the parsing error of the parameter.
+func (p *paramParser) fail(name string, err error) {
+	p.err = fmt.Errorf("invalid value for parameter %q: %v", name, err)
+}
+
+func (p *paramParser) float(name string, dst *float64) {
+	if s := p.value(name); s != "" {
+		v, err := parseFloat(s, 64)
+		if err != nil {
+			p.fail(name, err)
+			return
+		}
+		*dst = v
+	}
+}
+
+func (p *paramParser) float32(name string, dst *float32) {
+	if s := p.value(name); s != "" {
+		v, err := parseFloat(s, 32)
+		if err != nil {
+			p.fail(name, err)
+			return
+		}
+		*dst = float32(v)
+	}
+}
+
+func (p *paramParser) int(name string, dst *int) {
+	if s := p.value(name); s != "" {
+		v, err := strconv.ParseInt(strings.TrimSpace(s), 10, 32)
+		if err != nil {
+			p.fail(name, fmt.Errorf("%q is not an integer", s))
+			return
+		}
+		*dst = int(v)
+	}
+}
+
+func (p *paramParser) int64(name string, dst *int64) {
+	if s := p.value(name); s != "" {
+		v, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			p.fail(name, fmt.Errorf("%q is not an integer", s))
+			return
+		}
+		*dst = v
+	}
+}
+
+func (p *paramParser) bool(name string, dst *bool) {
+	if s := p.value(name); s != "" {
+		v, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			p.fail(name, fmt.Errorf("%q is not a boolean", s))
+			return
+		}
+		*dst = v
+	}
+}
@@ -0,0 +1,134 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseParamsSigma(t *testing.T) {
+	tests := []struct {
+		query string
+		valid bool
+	}{
+		{"sr=2.6&sm=3&sc=1", true},
+		{"sc=0.01", true},
+		{"sr=0", false},
+		{"sm=-1", false},
+		{"sc=0", false},
+		{"sr=NaN", false},
+		{"sm=Inf", false},
+		{"sc=-Inf", false},
+		{"sr=abc", false},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		_, err := parseParams(values)
+		if tt.valid && err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: accepted", tt.query)
+		}
+	}
+}
+
+func TestParseParamsLinearRGB(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+		valid bool
+	}{
+		{"", false, true},
+		{"srgb_linear=true", true, true},
+		{"srgb_linear=false", false, true},
+		{"srgb_linear=1", true, true},
+		{"srgb_linear=maybe", false, false},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		rp, err := parseParams(values)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%s: accepted", tt.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if rp.opts.linearRGB != tt.want {
+			t.Errorf("%s: linear processing %t, expected %t", tt.query, rp.opts.linearRGB, tt.want)
+		}
+	}
+}
+
+func TestParseParamsJitterStrokes(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"ja=2", false},
+		{"ja=2&format=png", false},
+		{"ja=2&format=svg", true},
+		{"ja=2&format=gcode", true},
+		{"ja=2&format=dst", true},
+		{"ja=2&format=svg&map=magnitude", false},
+		{"ja=2&format=svg&print=true", false},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		rp, err := parseParams(values)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if rp.opts.jitterStrokes != tt.want {
+			t.Errorf("%s: jitterStrokes %v, expected %v", tt.query, rp.opts.jitterStrokes, tt.want)
+		}
+	}
+}
+
+func TestParseParamsICC(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", false},
+		{"icc=true", true},
+		{"icc=false", false},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		rp, err := parseParams(values)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if rp.useICC != tt.want {
+			t.Errorf("%s: useICC %v, expected %v", tt.query, rp.useICC, tt.want)
+		}
+	}
+}
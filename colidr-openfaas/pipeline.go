@@ -0,0 +1,88 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strings"
+)
+
+// processor turns the uploaded image into the response body. The handlers only depend on this
+// interface, so the request parsing and the error paths can be exercised with a stub processor,
+// without an OpenCV environment.
+type processor interface {
+	Process(data []byte, rp *requestParams, output string) ([]byte, error)
+}
+
+// processorFunc adapts an ordinary function to the processor interface.
+type processorFunc func(data []byte, rp *requestParams, output string) ([]byte, error)
+
+// Process calls f(data, rp, output).
+func (f processorFunc) Process(data []byte, rp *requestParams, output string) ([]byte, error) {
+	return f(data, rp, output)
+}
+
+// pipeline is the processor used by the handlers, generating the coherent line drawing by default,
+// composed with the configured sibling function stages.
+var pipeline processor = stagedProcessor{processorFunc(processParams)}
+
+// multipartField is the form field holding the image in multipart uploads.
+const multipartField = "image"
+
+// requestImage extracts the image from the request body, which is either a multipart form
+// with the image in the "image" field, base64 encoded or the raw image bytes.
+func requestImage(ctx *RequestContext) ([]byte, error) {
+	mediaType, params, err := mime.ParseMediaType(ctx.Header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		return multipartImage(ctx.Body, params["boundary"])
+	}
+	if data, err := base64.StdEncoding.DecodeString(string(ctx.Body)); err == nil {
+		return data, nil
+	}
+	return ctx.Body, nil
+}
+
+// multipartImage returns the content of the image field of a multipart body,
+// falling back to the first file part.
+func multipartImage(body []byte, boundary string) ([]byte, error) {
+	if boundary == "" {
+		return nil, errors.New("missing multipart boundary")
+	}
+	mr := multipart.NewReader(strings.NewReader(string(body)), boundary)
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil, errors.New("no image found in the multipart form")
+		}
+		if part.FormName() == multipartField || part.FileName() != "" {
+			data, err := ioutil.ReadAll(part)
+			part.Close()
+			return data, err
+		}
+		part.Close()
+	}
+}
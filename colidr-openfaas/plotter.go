@@ -0,0 +1,166 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+)
+
+// maxPens is the maximum number of the pen layers.
+const maxPens = 8
+
+// penLayer is a named set of strokes, plotted with the same pen.
+type penLayer struct {
+	label   string
+	color   color.RGBA
+	strokes []stroke
+}
+
+// plotLayers traces the strokes of the generated lines. The strokes are split into the line layers
+// thresholded at the requested tau values, or into pens by the tone bands of the source image,
+// and they are jittered and ordered by the underlying tone if requested.
+func (c *Cld) plotLayers(opts EncodeOptions) ([]penLayer, error) {
+	var gray []byte
+	if opts.Order != "" || opts.Pens > 0 {
+		gray = c.tone.ToBytes()
+	}
+	cols := c.result.Cols()
+
+	var layers []penLayer
+	if len(opts.Layers) > 0 {
+		for _, l := range c.generateLayers(opts.Layers, opts.Colors) {
+			layers = append(layers, penLayer{label: fmt.Sprintf("tau %g", l.tau), color: l.color, strokes: traceStrokes(l.mask)})
+			closeMat(&l.mask)
+		}
+	} else {
+		strokes := traceStrokes(c.result)
+		if opts.Pens > 0 {
+			layers = toneBands(strokes, opts.Pens, opts.Colors, gray, cols)
+		} else {
+			layers = []penLayer{{label: fmt.Sprintf("tau %g", c.tau), color: color.RGBA{A: 255}, strokes: strokes}}
+		}
+	}
+
+	if c.jitterAmp > 0 && c.jitterStrokes {
+		pp := NewPostProcessingWithSeed(c.blurSize, c.seed)
+		pp.jitterStrokes(layers, cols, c.result.Rows(), c.jitterAmp, c.jitterFreq)
+	}
+
+	for _, l := range layers {
+		if err := sortStrokes(l.strokes, opts.Order, gray, cols); err != nil {
+			return nil, err
+		}
+	}
+	return layers, nil
+}
+
+// toneBands splits the strokes into equally wide bands of the source tone, from the darkest
+// to the lightest, so each band can be plotted with a different pen weight.
+func toneBands(strokes []stroke, pens int, colors []color.RGBA, gray []byte, cols int) []penLayer {
+	layers := make([]penLayer, pens)
+	for i := range layers {
+		layers[i].label = toneBandName(i, pens)
+		layers[i].color = color.RGBA{A: 255}
+		if i < len(colors) {
+			layers[i].color = colors[i]
+		}
+	}
+	for _, s := range strokes {
+		band := int(s.tone(gray, cols) * float64(pens) / 256)
+		if band >= pens {
+			band = pens - 1
+		}
+		layers[band].strokes = append(layers[band].strokes, s)
+	}
+	return layers
+}
+
+// toneBandName returns the label of the tone band.
+func toneBandName(band, pens int) string {
+	switch pens {
+	case 1:
+		return "all"
+	case 2:
+		return []string{"dark", "light"}[band]
+	case 3:
+		return []string{"dark", "medium", "light"}[band]
+	}
+	return fmt.Sprintf("tone %d", band+1)
+}
+
+// encodeGCode writes the traced strokes as G-code for pen plotters, in millimeters at the print
+// resolution. The pen is lifted on the Z axis, and the program pauses before each pen layer, so
+// the pen can be changed.
+func (c *Cld) encodeGCode(w io.Writer, opts EncodeOptions) error {
+	layers, err := c.plotLayers(opts)
+	if err != nil {
+		return err
+	}
+	dpi := opts.print.dpi
+	if dpi <= 0 {
+		dpi = 300
+	}
+	scale := 25.4 / float64(dpi)
+	height := c.result.Rows()
+	// The G-code Y axis points upward, while the image Y axis points downward.
+	coord := func(x, y int) (float64, float64) {
+		return float64(x) * scale, float64(height-y) * scale
+	}
+
+	fmt.Fprintln(w, "G21 ; millimeters")
+	fmt.Fprintln(w, "G90 ; absolute positioning")
+	fmt.Fprintln(w, "G0 Z5")
+	for i, l := range layers {
+		if len(l.strokes) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "M0 ; pen %d: %s\n", i+1, l.label)
+		for _, s := range l.strokes {
+			x, y := coord(s.points[0].X, s.points[0].Y)
+			fmt.Fprintf(w, "G0 X%.2f Y%.2f\n", x, y)
+			fmt.Fprintln(w, "G1 Z0")
+			for j := 1; j <= len(s.points); j++ {
+				p := s.points[j%len(s.points)]
+				x, y := coord(p.X, p.Y)
+				fmt.Fprintf(w, "G1 X%.2f Y%.2f\n", x, y)
+			}
+			fmt.Fprintln(w, "G0 Z5")
+		}
+	}
+	_, err = fmt.Fprintln(w, "G0 X0 Y0")
+	return err
+}
+
+// validatePens checks the number of the pen layers, which can't be combined with the tau layers.
+func validatePens(pens int, layers []float32) error {
+	if pens < 0 || pens > maxPens {
+		return fmt.Errorf("invalid pens %d: must be between 0 and %d", pens, maxPens)
+	}
+	if pens > 0 && len(layers) > 0 {
+		return errors.New("the pens can't be combined with the layers")
+	}
+	return nil
+}
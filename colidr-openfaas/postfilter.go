@@ -0,0 +1,113 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+// postFilter is an operation applied on the generated line drawing.
+type postFilter struct {
+	op  string
+	arg int
+}
+
+// postFilterOps are the supported post filters, with their default argument. The lines
+// are black on white, so thickening them is an erosion and thinning them a dilation.
+var postFilterOps = map[string]int{
+	"thicken": 1,
+	"thin":    1,
+	"blur":    3,
+	"invert":  0,
+}
+
+// parsePostFilters parses the post filter list, like "thicken:2;blur:3". The supported filters are:
+//
+//	thicken:n   thickens the lines by n pixels
+//	thin:n      thins the lines by n pixels
+//	blur:n      softens the lines with a n×n Gaussian kernel
+//	invert      draws white lines on black background
+func parsePostFilters(spec string) ([]postFilter, error) {
+	var filters []postFilter
+	for _, step := range strings.Split(spec, ";") {
+		step = strings.TrimSpace(step)
+		if step == "" {
+			continue
+		}
+		parts := strings.SplitN(step, ":", 2)
+		op := strings.ToLower(parts[0])
+		arg, ok := postFilterOps[op]
+		if !ok {
+			return nil, fmt.Errorf("invalid post filter %q: unknown operation", step)
+		}
+		if len(parts) == 2 {
+			v, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+			if err != nil || v < 1 {
+				return nil, fmt.Errorf("invalid post filter %q: expects a positive integer", step)
+			}
+			arg = v
+		}
+		filters = append(filters, postFilter{op: op, arg: arg})
+	}
+	return filters, nil
+}
+
+// formatPostFilters returns the post filter list in the format accepted by parsePostFilters.
+func formatPostFilters(filters []postFilter) string {
+	steps := make([]string, len(filters))
+	for i, f := range filters {
+		steps[i] = f.op
+		if f.op != "invert" {
+			steps[i] += ":" + strconv.Itoa(f.arg)
+		}
+	}
+	return strings.Join(steps, ";")
+}
+
+// apply applies the filter on the grayscale image in place.
+func (f postFilter) apply(img *gocv.Mat) {
+	switch f.op {
+	case "thicken", "thin":
+		size := 2*f.arg + 1
+		kernel := trackMat(gocv.GetStructuringElement(gocv.MorphEllipse, image.Point{size, size}))
+		defer closeMat(&kernel)
+		if f.op == "thicken" {
+			gocv.Erode(*img, *img, kernel)
+		} else {
+			gocv.Dilate(*img, *img, kernel)
+		}
+	case "blur":
+		size := f.arg
+		if size%2 == 0 {
+			size++
+		}
+		gocv.GaussianBlur(*img, img, image.Point{size, size}, 0, 0, gocv.BorderDefault)
+	case "invert":
+		gocv.BitwiseNot(*img, *img)
+	}
+}
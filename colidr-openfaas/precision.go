@@ -0,0 +1,89 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import "fmt"
+
+// precision selects the accumulation of the Gaussian weighted samples in the DoG integrals.
+type precision uint8
+
+const (
+	// precisionDefault accumulates in float64 with the plain summation.
+	precisionDefault precision = iota
+	// precisionFast accumulates in float32, trading the accuracy for the speed.
+	precisionFast
+	// precisionAccurate accumulates in float64 with the Kahan compensated summation.
+	precisionAccurate
+)
+
+// parsePrecision parses the precision parameter value.
+func parsePrecision(s string) (precision, error) {
+	switch s {
+	case "":
+		return precisionDefault, nil
+	case "fast":
+		return precisionFast, nil
+	case "accurate":
+		return precisionAccurate, nil
+	}
+	return precisionDefault, fmt.Errorf("invalid precision %q: must be fast or accurate", s)
+}
+
+func (p precision) String() string {
+	switch p {
+	case precisionFast:
+		return "fast"
+	case precisionAccurate:
+		return "accurate"
+	}
+	return ""
+}
+
+// accumulator sums the samples with the requested precision.
+type accumulator struct {
+	mode  precision
+	sum   float64
+	comp  float64
+	sum32 float32
+}
+
+func (a *accumulator) add(v float64) {
+	switch a.mode {
+	case precisionFast:
+		a.sum32 += float32(v)
+	case precisionAccurate:
+		y := v - a.comp
+		t := a.sum + y
+		a.comp = (t - a.sum) - y
+		a.sum = t
+	default:
+		a.sum += v
+	}
+}
+
+func (a *accumulator) value() float64 {
+	if a.mode == precisionFast {
+		return float64(a.sum32)
+	}
+	return a.sum
+}
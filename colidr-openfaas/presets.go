@@ -0,0 +1,68 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// presets contains the built-in parameter sets which can be referenced by name.
+var presets = map[string]url.Values{
+	"default": {},
+	"fine": {
+		"tau": {"0.99"}, "rho": {"0.997"}, "sr": {"1.6"}, "sm": {"2"}, "sc": {"0.8"},
+		"k": {"2"}, "ei": {"1"}, "di": {"0"}, "bl": {"1"},
+	},
+	"bold": {
+		"tau": {"0.95"}, "rho": {"0.98"}, "sr": {"3.5"}, "sm": {"4.5"}, "sc": {"1.6"},
+		"k": {"3"}, "ei": {"3"}, "di": {"2"}, "bl": {"5"},
+	},
+	"sketchy": {
+		"tau": {"0.97"}, "rho": {"0.99"}, "sr": {"2.9"}, "sm": {"3.5"}, "sc": {"1"},
+		"ja": {"1.5"}, "jf": {"0.03"},
+	},
+}
+
+// applyPreset returns the parameters of the named preset, overridden by the explicitly provided ones.
+func applyPreset(values url.Values) (url.Values, error) {
+	name := values.Get("preset")
+	if name == "" {
+		return values, nil
+	}
+	preset, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q", name)
+	}
+
+	merged := url.Values{}
+	for k, v := range preset {
+		merged[k] = v
+	}
+	for k, v := range values {
+		if k != "preset" {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,318 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// previewSize is the maximum size of the draft image rendered by the preview stream.
+	previewSize = 320
+	// previewTTL is the time after which the idle previews are evicted.
+	previewTTL = 10 * time.Minute
+	// defaultMaxPreviews is the default maximum number of the active previews.
+	defaultMaxPreviews = 64
+)
+
+// errTooManyPreviews is returned when the maximum number of the active previews is reached.
+var errTooManyPreviews = errors.New("too many active previews")
+
+// preview holds a downscaled copy of the uploaded image in memory,
+// which is re-rendered each time its parameters are changed.
+type preview struct {
+	mu         sync.Mutex
+	draft      []byte
+	params     url.Values
+	changed    chan struct{}
+	lastAccess time.Time
+}
+
+// previewHub keeps track of the active previews, evicting the idle ones.
+type previewHub struct {
+	mu       sync.Mutex
+	previews map[string]*preview
+	max      int
+}
+
+// newPreviewHub creates the preview hub and starts the eviction of the idle previews. The maximum
+// number of the active previews can be configured through the max_previews environment variable.
+func newPreviewHub() *previewHub {
+	h := &previewHub{previews: make(map[string]*preview), max: envInt("max_previews", defaultMaxPreviews)}
+
+	go func() {
+		for range time.Tick(previewTTL / 2) {
+			h.evict()
+		}
+	}()
+	return h
+}
+
+// create registers a new preview for the image and returns its identifier. The image dimensions
+// are checked from the header before decoding it.
+func (h *previewHub) create(data []byte, params url.Values) (string, error) {
+	h.evict()
+	if h.full() {
+		return "", errTooManyPreviews
+	}
+	src, _, err := decodeImage(data)
+	if err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, downscale(src, previewSize)); err != nil {
+		return "", err
+	}
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The concurrent uploads might have filled the hub in the meantime.
+	if len(h.previews) >= h.max {
+		return "", errTooManyPreviews
+	}
+	h.previews[id] = &preview{
+		draft:      buf.Bytes(),
+		params:     params,
+		changed:    make(chan struct{}),
+		lastAccess: time.Now(),
+	}
+	return id, nil
+}
+
+// full reports whether the maximum number of the active previews is reached.
+func (h *previewHub) full() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.previews) >= h.max
+}
+
+// evict removes the previews which were not accessed for longer than the time to live.
+func (h *previewHub) evict() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for id, p := range h.previews {
+		if time.Since(p.touch(false)) > previewTTL {
+			delete(h.previews, id)
+		}
+	}
+}
+
+// get returns the preview with the provided identifier.
+func (h *previewHub) get(id string) (*preview, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	p, ok := h.previews[id]
+	if ok {
+		p.touch(true)
+	}
+	return p, ok
+}
+
+// touch returns the time of the last access, updating it if requested.
+func (p *preview) touch(update bool) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if update {
+		p.lastAccess = time.Now()
+	}
+	return p.lastAccess
+}
+
+// update replaces the parameters and notifies the streams about the change.
+func (p *preview) update(params url.Values) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.params = params
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// snapshot returns the current parameters together with the channel signaling their next change.
+func (p *preview) snapshot() (url.Values, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.params, p.changed
+}
+
+// ServeHTTP routes the preview requests:
+//
+//	POST /preview                 uploads the image and returns the preview identifier
+//	GET  /preview/{id}/stream     streams the rendered drafts as MJPEG
+//	POST /preview/{id}/params     replaces the parameters with the ones from the query string
+func (h *previewHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/preview"), "/"), "/")
+
+	if parts[0] == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := readLimited(r.Body, maxUploadSize())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		id, err := h.create(data, r.URL.Query())
+		if err == errTooManyPreviews {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to decode the image: %v", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, id)
+		return
+	}
+
+	p, ok := h.get(parts[0])
+	if !ok || len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch parts[1] {
+	case "params":
+		if _, err := parseParams(r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.update(r.URL.Query())
+		w.WriteHeader(http.StatusNoContent)
+	case "stream":
+		p.stream(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// stream renders the draft as MJPEG frames, a new frame being emitted on every parameter change.
+func (p *preview) stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+
+	for {
+		params, changed := p.snapshot()
+		rp, err := parseParams(params)
+		var frame []byte
+		if err == nil {
+			frame, err = processParams(p.draft, rp, "image")
+		}
+		if err == nil {
+			// The format of the frames can be selected by the parameters, like the format of the uploads.
+			fmt.Fprintf(w, "--frame\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n", detectContentType(frame, rp.encoderFormat()), len(frame))
+			w.Write(frame)
+			fmt.Fprint(w, "\r\n")
+			flusher.Flush()
+		}
+
+		select {
+		case <-changed:
+			p.touch(true)
+		case <-r.Context().Done():
+			return
+		case <-time.After(previewTTL):
+			return
+		}
+	}
+}
+
+// downscale resizes the image, preserving its aspect ratio, to fit into the provided size.
+// Each destination pixel is the average of the source pixels it covers.
+func downscale(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	scale := float64(size) / float64(w)
+	if h > w {
+		scale = float64(size) / float64(h)
+	}
+	dw, dh := int(float64(w)*scale), int(float64(h)*scale)
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+cr, g+cg, bl+cb, a+ca
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// newID generates a random identifier.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
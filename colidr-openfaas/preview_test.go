@@ -0,0 +1,58 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPreviewHubCreate(t *testing.T) {
+	h := &previewHub{previews: make(map[string]*preview), max: 2}
+
+	if _, err := h.create(pngHeader(1<<20, 1<<20), url.Values{}); ErrorCode(err) != "image_too_large" {
+		t.Errorf("the oversized image is not rejected before decoding: %v", err)
+	}
+
+	img := testImage(t)
+	first, err := h.create(img, url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.create(img, url.Values{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.create(img, url.Values{}); err != errTooManyPreviews {
+		t.Errorf("the preview exceeding the limit is created: %v", err)
+	}
+
+	// The idle previews are evicted, making room for the new ones.
+	h.previews[first].lastAccess = time.Now().Add(-2 * previewTTL)
+	if _, err := h.create(img, url.Values{}); err != nil {
+		t.Errorf("the idle preview is not evicted: %v", err)
+	}
+	if _, ok := h.get(first); ok {
+		t.Error("the idle preview is still available")
+	}
+}
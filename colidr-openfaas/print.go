@@ -0,0 +1,218 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+)
+
+// printOptions holds the options used for generating a print ready output.
+type printOptions struct {
+	enabled bool
+	dpi     int
+	cmyk    bool
+	bleed   float64
+}
+
+// addBleed extends the image with a white bleed margin, expressed in millimeters.
+func addBleed(src image.Image, opts printOptions) image.Image {
+	margin := int(round(opts.bleed / 25.4 * float64(opts.dpi)))
+	if margin <= 0 {
+		return src
+	}
+	b := src.Bounds()
+	rect := image.Rect(0, 0, b.Dx()+2*margin, b.Dy()+2*margin)
+
+	var dst draw.Image
+	if _, ok := src.(*image.Gray); ok {
+		dst = image.NewGray(rect)
+	} else {
+		dst = image.NewRGBA(rect)
+	}
+	draw.Draw(dst, dst.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(dst, image.Rect(margin, margin, margin+b.Dx(), margin+b.Dy()), src, b.Min, draw.Src)
+
+	return dst
+}
+
+// toCMYK converts the source image into the CMYK color space.
+func toCMYK(src image.Image) *image.CMYK {
+	b := src.Bounds()
+	dst := image.NewCMYK(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(x-b.Min.X, y-b.Min.Y, color.CMYKModel.Convert(src.At(x, y)))
+		}
+	}
+	return dst
+}
+
+// writeJFIFDensity inserts a JFIF APP0 segment holding the pixel density
+// right after the SOI marker of the encoded JPEG image.
+func writeJFIFDensity(w io.Writer, data []byte, dpi int) error {
+	if len(data) < 2 {
+		return io.ErrUnexpectedEOF
+	}
+	density := uint16(math.Min(float64(dpi), math.MaxUint16))
+	app0 := []byte{
+		0xff, 0xe0, 0x00, 0x10,
+		'J', 'F', 'I', 'F', 0x00,
+		0x01, 0x01, // version 1.01
+		0x01, // density expressed in dots per inch
+		byte(density >> 8), byte(density),
+		byte(density >> 8), byte(density),
+		0x00, 0x00, // no thumbnail
+	}
+	if _, err := w.Write(data[:2]); err != nil {
+		return err
+	}
+	if _, err := w.Write(app0); err != nil {
+		return err
+	}
+	_, err := w.Write(data[2:])
+	return err
+}
+
+// The photometric interpretations of the TIFF output.
+const (
+	tiffGray      = 1
+	tiffRGB       = 2
+	tiffSeparated = 5
+)
+
+// encodeTiff writes the image as an uncompressed, baseline TIFF file. The grayscale and the CMYK
+// images are written as they are, while the other images are converted into RGBA.
+func encodeTiff(w io.Writer, src image.Image, dpi int) error {
+	switch img := src.(type) {
+	case *image.Gray:
+		return writeTiff(w, img.Pix, img.Stride, img.Rect, 1, tiffGray, dpi)
+	case *image.CMYK:
+		return writeTiff(w, img.Pix, img.Stride, img.Rect, 4, tiffSeparated, dpi)
+	}
+	b := src.Bounds()
+	img := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(img, img.Bounds(), src, b.Min, draw.Src)
+	return writeTiff(w, img.Pix, img.Stride, img.Rect, 4, tiffRGB, dpi)
+}
+
+// writeTiff writes the 8 bit pixels with the provided number of samples per pixel and photometric
+// interpretation. The four samples are either CMYK or RGB with an unassociated alpha.
+func writeTiff(w io.Writer, pix []byte, stride int, rect image.Rectangle, samples int, photometric uint16, dpi int) error {
+	const (
+		tShort    = 3
+		tLong     = 4
+		tRational = 5
+	)
+	type ifdEntry struct {
+		tag, typ uint16
+		count    uint32
+		value    uint32
+	}
+
+	if dpi <= 0 {
+		dpi = 72
+	}
+	width, height := rect.Dx(), rect.Dy()
+	stripSize := uint32(width * height * samples)
+
+	// The multi sample images have either the ink set or the extra (alpha) sample tag,
+	// and their bits per sample don't fit into the value field.
+	numEntries, bitsSize := 13, uint32(0)
+	if samples > 1 {
+		numEntries, bitsSize = 14, uint32(2*samples)
+	}
+	var (
+		ifdOffset   = uint32(8)
+		ifdSize     = uint32(2 + numEntries*12 + 4)
+		bitsOffset  = ifdOffset + ifdSize
+		resOffset   = bitsOffset + bitsSize
+		stripOffset = resOffset + 8
+	)
+	bits := uint32(8)
+	if samples > 1 {
+		bits = bitsOffset
+	}
+
+	entries := []ifdEntry{
+		{256, tLong, 1, uint32(width)},        // ImageWidth
+		{257, tLong, 1, uint32(height)},       // ImageLength
+		{258, tShort, uint32(samples), bits},  // BitsPerSample
+		{259, tShort, 1, 1},                   // Compression: none
+		{262, tShort, 1, uint32(photometric)}, // PhotometricInterpretation
+		{273, tLong, 1, stripOffset},          // StripOffsets
+		{277, tShort, 1, uint32(samples)},     // SamplesPerPixel
+		{278, tLong, 1, uint32(height)},       // RowsPerStrip
+		{279, tLong, 1, stripSize},            // StripByteCounts
+		{282, tRational, 1, resOffset},        // XResolution
+		{283, tRational, 1, resOffset},        // YResolution
+		{284, tShort, 1, 1},                   // PlanarConfiguration: chunky
+		{296, tShort, 1, 2},                   // ResolutionUnit: inch
+	}
+	switch {
+	case photometric == tiffSeparated:
+		entries = append(entries, ifdEntry{332, tShort, 1, 1}) // InkSet: CMYK
+	case samples > 1:
+		entries = append(entries, ifdEntry{338, tShort, 1, 2}) // ExtraSamples: unassociated alpha
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{'I', 'I', 42, 0})
+	binary.Write(buf, binary.LittleEndian, ifdOffset)
+	binary.Write(buf, binary.LittleEndian, uint16(len(entries)))
+
+	for _, e := range entries {
+		binary.Write(buf, binary.LittleEndian, e.tag)
+		binary.Write(buf, binary.LittleEndian, e.typ)
+		binary.Write(buf, binary.LittleEndian, e.count)
+		if e.typ == tShort && e.count == 1 {
+			// Short values are left justified inside the value field.
+			binary.Write(buf, binary.LittleEndian, uint16(e.value))
+			binary.Write(buf, binary.LittleEndian, uint16(0))
+		} else {
+			binary.Write(buf, binary.LittleEndian, e.value)
+		}
+	}
+	// Offset of the next IFD, zero meaning there is none.
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	for i := 0; samples > 1 && i < samples; i++ {
+		binary.Write(buf, binary.LittleEndian, uint16(8))
+	}
+	binary.Write(buf, binary.LittleEndian, [2]uint32{uint32(dpi), 1})
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	for y := 0; y < height; y++ {
+		row := pix[y*stride : y*stride+width*samples]
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
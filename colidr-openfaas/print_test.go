@@ -0,0 +1,93 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// tiffTag returns the value of a short tag of the first IFD of the TIFF file written by writeTiff.
+func tiffTag(t *testing.T, data []byte, tag uint16) (uint16, bool) {
+	t.Helper()
+	ifd := binary.LittleEndian.Uint32(data[4:])
+	n := int(binary.LittleEndian.Uint16(data[ifd:]))
+	for i := 0; i < n; i++ {
+		e := data[int(ifd)+2+i*12:]
+		if binary.LittleEndian.Uint16(e) == tag {
+			return binary.LittleEndian.Uint16(e[8:]), true
+		}
+	}
+	return 0, false
+}
+
+func TestTiffEncoder(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 5, 3))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 10)
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, 5, 3))
+	rgba.Set(1, 1, color.RGBA{200, 100, 50, 255})
+
+	tests := []struct {
+		name        string
+		src         image.Image
+		print       printOptions
+		photometric uint16
+		samples     uint16
+	}{
+		{"gray", gray, printOptions{dpi: 300}, tiffGray, 1},
+		{"rgba", rgba, printOptions{dpi: 300}, tiffRGB, 4},
+		{"cmyk without print", gray, printOptions{dpi: 300, cmyk: true}, tiffGray, 1},
+		{"print without cmyk", gray, printOptions{enabled: true, dpi: 300}, tiffGray, 1},
+		{"print cmyk", gray, printOptions{enabled: true, dpi: 300, cmyk: true}, tiffSeparated, 4},
+	}
+	enc, err := lookupEncoder("tiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := enc.Encode(&buf, EncodeSource{Image: tt.src}, EncodeOptions{Format: "tiff", print: tt.print}); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		data := buf.Bytes()
+		if p, _ := tiffTag(t, data, 262); p != tt.photometric {
+			t.Errorf("%s: photometric interpretation %d, expected %d", tt.name, p, tt.photometric)
+		}
+		if s, _ := tiffTag(t, data, 277); s != tt.samples {
+			t.Errorf("%s: %d samples per pixel, expected %d", tt.name, s, tt.samples)
+		}
+		// The pixels are stored in a single strip at the end of the file.
+		size := 5 * 3 * int(tt.samples)
+		if len(data) < size {
+			t.Errorf("%s: %d bytes, expected at least %d bytes of pixels", tt.name, len(data), size)
+		} else if tt.photometric == tiffGray && !bytes.Equal(data[len(data)-size:], gray.Pix) {
+			t.Errorf("%s: the grayscale pixels aren't stored unaltered", tt.name)
+		}
+	}
+}
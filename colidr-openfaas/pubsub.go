@@ -0,0 +1,199 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// pubSubEndpoint is the address of the Google Cloud Pub/Sub REST API.
+	pubSubEndpoint = "https://pubsub.googleapis.com/v1/"
+	// gceTokenURL is the metadata server address providing the access token of the service account.
+	gceTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// pubSubClient pulls the messages from a Google Cloud Pub/Sub subscription through the REST API.
+type pubSubClient struct {
+	subscription    string
+	deadLetterTopic string
+	http            *http.Client
+
+	mu       sync.Mutex
+	token    string
+	expiry   time.Time
+	attempts map[string]int
+}
+
+// newPubSubClient configures the client from the pubsub_subscription (projects/{project}/subscriptions/{name})
+// and pubsub_dead_letter_topic (projects/{project}/topics/{name}) environment variables.
+func newPubSubClient() *pubSubClient {
+	return &pubSubClient{
+		subscription:    os.Getenv("pubsub_subscription"),
+		deadLetterTopic: os.Getenv("pubsub_dead_letter_topic"),
+		http:            &http.Client{Timeout: time.Minute},
+		attempts:        make(map[string]int),
+	}
+}
+
+// accessToken returns the OAuth2 access token, read from the pubsub-token secret,
+// or requested from the metadata server when running on Google Cloud.
+func (c *pubSubClient) accessToken() (string, error) {
+	if token := readSecret("pubsub-token"); token != "" {
+		return token, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expiry) {
+		return c.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, gceTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to get the access token: %v", err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || res.AccessToken == "" {
+		return "", errors.New("unable to get the access token from the metadata server")
+	}
+	c.token = res.AccessToken
+	// The token is renewed a minute before it expires.
+	c.expiry = time.Now().Add(time.Duration(res.ExpiresIn-60) * time.Second)
+	return c.token, nil
+}
+
+// call invokes the method of the resource, decoding the JSON response into res.
+func (c *pubSubClient) call(resource, method string, req, res interface{}) error {
+	token, err := c.accessToken()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest(http.MethodPost, pubSubEndpoint+resource+":"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.http.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pubsub %s failed with status %v: %s", method, resp.Status, data)
+	}
+	if res == nil {
+		return nil
+	}
+	return json.Unmarshal(data, res)
+}
+
+func (c *pubSubClient) receive(visibility time.Duration) (*queueMessage, error) {
+	var res struct {
+		ReceivedMessages []struct {
+			AckID   string `json:"ackId"`
+			Message struct {
+				Data      string `json:"data"`
+				MessageID string `json:"messageId"`
+			} `json:"message"`
+			DeliveryAttempt int `json:"deliveryAttempt"`
+		} `json:"receivedMessages"`
+	}
+	if err := c.call(c.subscription, "pull", map[string]interface{}{"maxMessages": 1}, &res); err != nil {
+		return nil, err
+	}
+	if len(res.ReceivedMessages) == 0 {
+		return nil, nil
+	}
+	msg := res.ReceivedMessages[0]
+	body, err := base64.StdEncoding.DecodeString(msg.Message.Data)
+	if err != nil {
+		body = []byte(msg.Message.Data)
+	}
+
+	// The delivery attempts are only reported with a dead-letter policy, otherwise they're counted by the worker.
+	attempts := msg.DeliveryAttempt
+	if attempts == 0 {
+		c.mu.Lock()
+		c.attempts[msg.Message.MessageID]++
+		attempts = c.attempts[msg.Message.MessageID]
+		c.mu.Unlock()
+	}
+	m := &queueMessage{id: msg.Message.MessageID, body: body, handle: msg.AckID, attempts: attempts}
+	return m, c.extend(m, visibility)
+}
+
+func (c *pubSubClient) extend(m *queueMessage, visibility time.Duration) error {
+	return c.call(c.subscription, "modifyAckDeadline", map[string]interface{}{
+		"ackIds":             []string{m.handle},
+		"ackDeadlineSeconds": int(visibility.Seconds()),
+	}, nil)
+}
+
+func (c *pubSubClient) ack(m *queueMessage) error {
+	c.mu.Lock()
+	delete(c.attempts, m.id)
+	c.mu.Unlock()
+	return c.call(c.subscription, "acknowledge", map[string]interface{}{"ackIds": []string{m.handle}}, nil)
+}
+
+func (c *pubSubClient) retry(m *queueMessage) error {
+	return c.extend(m, 0)
+}
+
+func (c *pubSubClient) deadLetter(m *queueMessage, reason string) (bool, error) {
+	if c.deadLetterTopic == "" {
+		return false, nil
+	}
+	err := c.call(c.deadLetterTopic, "publish", map[string]interface{}{
+		"messages": []map[string]string{{"data": base64.StdEncoding.EncodeToString(deadLetterBody(m, reason))}},
+	}, nil)
+	return err == nil, err
+}
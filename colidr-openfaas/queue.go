@@ -0,0 +1,210 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultQueueVisibility is the time a received message is hidden from the other workers,
+	// extended periodically while it's processed.
+	defaultQueueVisibility = 60 * time.Second
+	// defaultQueueMaxAttempts is the number of the deliveries after which a failing message is dead-lettered.
+	defaultQueueMaxAttempts = 5
+)
+
+// queueMessage is a message pulled from the queue. The body is the JSON encoded batchItem,
+// i.e. the storage key or the URL of the image together with the parameters and the output key.
+type queueMessage struct {
+	id       string
+	body     []byte
+	handle   string
+	attempts int
+}
+
+// queueClient is a pull based cloud queue.
+type queueClient interface {
+	// receive waits for the next message, returning nil if none arrived until the long poll timeout.
+	receive(visibility time.Duration) (*queueMessage, error)
+	// extend hides the message from the other workers for the provided duration from now.
+	extend(m *queueMessage, visibility time.Duration) error
+	// ack deletes the processed message.
+	ack(m *queueMessage) error
+	// retry makes the message visible again, for a later delivery.
+	retry(m *queueMessage) error
+	// deadLetter forwards the failed message to the dead-letter queue, returning false
+	// if none is configured, in which case the native redrive policy of the queue applies.
+	deadLetter(m *queueMessage, reason string) (bool, error)
+}
+
+// newQueueClient returns the queue client selected through the queue_mode environment variable,
+// sqs or pubsub, or nil if the worker mode is disabled.
+func newQueueClient() queueClient {
+	switch os.Getenv("queue_mode") {
+	case "sqs":
+		return newSQSClient()
+	case "pubsub":
+		return newPubSubClient()
+	}
+	return nil
+}
+
+// startQueueWorkers starts the pull workers, their number being set through the queue_workers
+// environment variable (1 by default).
+func startQueueWorkers() {
+	client := newQueueClient()
+	if client == nil {
+		return
+	}
+	workers, err := strconv.Atoi(os.Getenv("queue_workers"))
+	if err != nil || workers < 1 {
+		workers = 1
+	}
+	visibility := defaultQueueVisibility
+	if d, err := time.ParseDuration(os.Getenv("queue_visibility")); err == nil && d >= 10*time.Second {
+		visibility = d
+	}
+	maxAttempts, err := strconv.Atoi(os.Getenv("queue_max_attempts"))
+	if err != nil || maxAttempts < 1 {
+		maxAttempts = defaultQueueMaxAttempts
+	}
+	for i := 0; i < workers; i++ {
+		go runQueueWorker(client, visibility, maxAttempts)
+	}
+}
+
+// runQueueWorker pulls and processes the messages, forever.
+func runQueueWorker(client queueClient, visibility time.Duration, maxAttempts int) {
+	for {
+		m, err := client.receive(visibility)
+		if err != nil {
+			log.Printf("unable to receive the queue messages: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if m != nil {
+			handleQueueMessage(client, m, visibility, maxAttempts)
+		}
+	}
+}
+
+// handleQueueMessage processes the message, extending its visibility timeout during the long
+// renders. The failing messages are retried until the maximum number of attempts, then they're
+// dead-lettered, like the malformed ones.
+func handleQueueMessage(client queueClient, m *queueMessage, visibility time.Duration, maxAttempts int) {
+	var item batchItem
+	if err := json.Unmarshal(m.body, &item); err != nil {
+		failQueueMessage(client, m, "malformed message: "+err.Error(), true)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(visibility / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := client.extend(m, visibility); err != nil {
+					log.Printf("unable to extend the visibility of the message %s: %v", m.id, err)
+				}
+			}
+		}
+	}()
+	res := processBatchItem(item, os.Getenv("queue_params"))
+	close(done)
+
+	event := completionEvent{
+		JobID:     m.id,
+		Kind:      "queue",
+		Status:    "succeeded",
+		ResultURL: res.URL,
+		Metrics: map[string]float64{
+			"attempts":         float64(m.attempts),
+			"size":             float64(res.Size),
+			"duration_seconds": res.Duration,
+		},
+	}
+	if res.Error != "" {
+		final := m.attempts >= maxAttempts
+		failQueueMessage(client, m, res.Error, final)
+		if final {
+			event.Status, event.Error = "failed", res.Error
+			notifyCompletion(event)
+		}
+		return
+	}
+	if err := client.ack(m); err != nil {
+		log.Printf("unable to acknowledge the message %s: %v", m.id, err)
+		return
+	}
+	log.Printf("processed the message %s: %s stored in %s (%.1fs)", m.id, res.Source, res.URL, res.Duration)
+	notifyCompletion(event)
+}
+
+// failQueueMessage dead-letters the failed message after the last attempt, or releases it for a retry.
+func failQueueMessage(client queueClient, m *queueMessage, reason string, final bool) {
+	log.Printf("unable to process the message %s (attempt %d): %s", m.id, m.attempts, reason)
+	if final {
+		forwarded, err := client.deadLetter(m, reason)
+		if err != nil {
+			log.Printf("unable to dead-letter the message %s: %v", m.id, err)
+		}
+		if forwarded {
+			if err := client.ack(m); err != nil {
+				log.Printf("unable to acknowledge the message %s: %v", m.id, err)
+			}
+			return
+		}
+	}
+	if err := client.retry(m); err != nil {
+		log.Printf("unable to release the message %s: %v", m.id, err)
+	}
+}
+
+// deadLetterBody wraps the failed message with the reason of the failure.
+func deadLetterBody(m *queueMessage, reason string) []byte {
+	body, _ := json.Marshal(struct {
+		ID       string          `json:"id"`
+		Attempts int             `json:"attempts"`
+		Error    string          `json:"error"`
+		Message  json.RawMessage `json:"message"`
+	}{m.id, m.attempts, reason, messageJSON(m.body)})
+	return body
+}
+
+// messageJSON returns the message body as raw JSON, quoting it if it isn't valid JSON.
+func messageJSON(body []byte) json.RawMessage {
+	if json.Valid(body) {
+		return body
+	}
+	quoted, _ := json.Marshal(string(body))
+	return quoted
+}
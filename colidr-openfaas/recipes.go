@@ -0,0 +1,170 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// recipe is a named pipeline: the transforms applied on the source image, the CLD
+// parameters (possibly referencing a preset), the post filters and the output format.
+type recipe struct {
+	Pre    []string          `json:"pre,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+	Post   []string          `json:"post,omitempty"`
+	Format string            `json:"format,omitempty"`
+}
+
+// recipes contains the built-in recipes, extended by the ones defined in the recipes file.
+var recipes = map[string]recipe{
+	"plotter": {
+		Pre:    []string{"fit:2048"},
+		Params: map[string]string{"preset": "fine", "ai": "false"},
+		Post:   []string{"thin:1"},
+		Format: "svg",
+	},
+	"poster": {
+		Pre:    []string{"fit:4096"},
+		Params: map[string]string{"preset": "bold"},
+		Post:   []string{"thicken:1", "blur:3"},
+		Format: "png",
+	},
+}
+
+// loadRecipes returns the built-in recipes together with the ones defined in the JSON file
+// configured through the recipes_file environment variable, which can override the built-in ones.
+func loadRecipes() (map[string]recipe, error) {
+	file := os.Getenv("recipes_file")
+	if file == "" {
+		return recipes, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the recipes: %v", err)
+	}
+	var defined map[string]recipe
+	if err := json.Unmarshal(data, &defined); err != nil {
+		return nil, fmt.Errorf("unable to parse the recipes: %v", err)
+	}
+
+	all := make(map[string]recipe, len(recipes)+len(defined))
+	for name, r := range recipes {
+		all[name] = r
+	}
+	for name, r := range defined {
+		all[name] = r
+	}
+	return all, nil
+}
+
+// values returns the recipe expressed as request parameters.
+func (r recipe) values() url.Values {
+	values := url.Values{}
+	for k, v := range r.Params {
+		values.Set(k, v)
+	}
+	if len(r.Pre) > 0 {
+		values.Set("t", strings.Join(r.Pre, ";"))
+	}
+	if len(r.Post) > 0 {
+		values.Set("post", strings.Join(r.Post, ";"))
+	}
+	if r.Format != "" {
+		values.Set("format", r.Format)
+	}
+	return values
+}
+
+// applyRecipe returns the parameters of the recipe, overridden by the explicitly provided ones.
+// The recipe is either referenced by name, or submitted as JSON in the recipe_json parameter.
+func applyRecipe(values url.Values) (url.Values, error) {
+	var r recipe
+	switch {
+	case values.Get("recipe_json") != "":
+		if err := json.Unmarshal([]byte(values.Get("recipe_json")), &r); err != nil {
+			return nil, fmt.Errorf("unable to parse the recipe: %v", err)
+		}
+	case values.Get("recipe") != "":
+		all, err := loadRecipes()
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if r, ok = all[values.Get("recipe")]; !ok {
+			return nil, fmt.Errorf("unknown recipe %q", values.Get("recipe"))
+		}
+	default:
+		return values, nil
+	}
+
+	merged := r.values()
+	for k, v := range values {
+		if k != "recipe" && k != "recipe_json" {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
+
+// exportRecipe returns the effective recipe of the request, with every parameter resolved
+// (including the seed), so the same look can be reproduced by submitting it with another image.
+func exportRecipe(rp *requestParams) recipe {
+	r := recipe{Params: make(map[string]string), Format: rp.format}
+	if spec := formatTransforms(rp.opts.transforms); spec != "" {
+		r.Pre = strings.Split(spec, ";")
+	}
+	if spec := formatPostFilters(rp.opts.postFilters); spec != "" {
+		r.Post = strings.Split(spec, ";")
+	}
+
+	for k, v := range rp.describe() {
+		switch k {
+		case "t", "post", "format", "tau_auto":
+			continue
+		}
+		switch v := v.(type) {
+		case []float32:
+			vals := make([]string, len(v))
+			for i, f := range v {
+				vals[i] = fmt.Sprint(f)
+			}
+			r.Params[k] = strings.Join(vals, ",")
+		case []string:
+			r.Params[k] = strings.Join(v, ",")
+		default:
+			r.Params[k] = fmt.Sprint(v)
+		}
+	}
+	if rp.opts.autoTau {
+		r.Params["tau"] = "auto"
+	}
+	if rp.opts.tauPercentile == 0 {
+		delete(r.Params, "tau_pct")
+	}
+	return r
+}
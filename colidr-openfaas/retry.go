@@ -0,0 +1,58 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+// defaultMinCoverage is the ratio of line pixels below which the result is considered empty.
+const defaultMinCoverage = 0.001
+
+// relaxedParams describes the parameters used for regenerating an empty result.
+type relaxedParams struct {
+	Tau      float32 `json:"tau"`
+	Rho      float64 `json:"rho"`
+	Coverage float64 `json:"coverage"`
+}
+
+// lineCoverage returns the ratio of the line (dark) pixels of the generated image.
+func lineCoverage(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var lines int
+	for _, v := range data {
+		if v < 128 {
+			lines++
+		}
+	}
+	return float64(lines) / float64(len(data))
+}
+
+// relaxParams returns the options with tau and rho moved halfway towards 1,
+// which makes the thresholding keep the weaker edges too. The tau resolved from
+// a percentile or by Otsu's method is relaxed as an absolute value.
+func relaxParams(o options) options {
+	o.tauPercentile = 0
+	o.autoTau = false
+	o.tau += (1 - o.tau) / 2
+	o.rho += (1 - o.rho) / 2
+	return o
+}
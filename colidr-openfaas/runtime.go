@@ -0,0 +1,133 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// defaultRuntimeModelFile is where the runtime model is persisted between the invocations,
+// since in classic watchdog mode a new process is forked for every request.
+const defaultRuntimeModelFile = "/tmp/colidr-runtime-model.json"
+
+// runtimeModel is a simple linear regression, fitted on the observed requests, which maps
+// the static cost estimate of a request to the actual processing time on the current deployment.
+type runtimeModel struct {
+	N   float64 `json:"n"`
+	SX  float64 `json:"sx"`
+	SY  float64 `json:"sy"`
+	SXX float64 `json:"sxx"`
+	SXY float64 `json:"sxy"`
+}
+
+// runtimeModelFile returns the model location, configurable through the runtime_model_file environment variable.
+func runtimeModelFile() string {
+	if val, exists := os.LookupEnv("runtime_model_file"); exists && val != "" {
+		return val
+	}
+	return defaultRuntimeModelFile
+}
+
+// loadRuntimeModel reads the persisted model, returning an empty one if it doesn't exist yet.
+func loadRuntimeModel(file string) *runtimeModel {
+	m := &runtimeModel{}
+	if data, err := ioutil.ReadFile(file); err == nil {
+		if err := json.Unmarshal(data, m); err != nil {
+			return &runtimeModel{}
+		}
+	}
+	return m
+}
+
+// save persists the model, replacing the previous file atomically.
+func (m *runtimeModel) save(file string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, data)
+}
+
+// writeFileAtomic writes the data into a temporary file, then renames it over the destination,
+// so the concurrent readers never see a partially written file.
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// observe updates the model with the static estimate and the measured duration of a request.
+func (m *runtimeModel) observe(estimate, seconds float64) {
+	m.N++
+	m.SX += estimate
+	m.SY += seconds
+	m.SXX += estimate * estimate
+	m.SXY += estimate * seconds
+}
+
+// predict returns the expected processing time of a request based on its static estimate.
+// Until enough observations are collected the static estimate is returned unchanged.
+func (m *runtimeModel) predict(estimate float64) float64 {
+	if m.N < 2 {
+		return estimate
+	}
+	den := m.N*m.SXX - m.SX*m.SX
+	if den == 0 {
+		return estimate * m.SY / m.SX
+	}
+	slope := (m.N*m.SXY - m.SX*m.SY) / den
+	intercept := (m.SY - slope*m.SX) / m.N
+
+	if res := slope*estimate + intercept; res > 0 {
+		return res
+	}
+	return estimate
+}
+
+// estimateRuntime returns the static processing time estimate of the image in seconds.
+func (o options) estimateRuntime(pixels int) float64 {
+	return o.workUnits(pixels)*secondsPerUnit + o.tasks(pixels)*secondsPerTask
+}
+
+// recordRuntime updates the persisted runtime model with the measured processing time.
+func recordRuntime(o options, pixels int, seconds float64) error {
+	file := runtimeModelFile()
+	m := loadRuntimeModel(file)
+	m.observe(o.estimateRuntime(pixels), seconds)
+
+	return m.save(file)
+}
@@ -0,0 +1,65 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"crypto/subtle"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// secretsDir is the location where OpenFaaS mounts the function secrets.
+const secretsDir = "/var/openfaas/secrets"
+
+// readSecret returns the value of a secret, read either from the environment variable with the
+// same name (dashes replaced by underscores) or from the OpenFaaS secret file. It returns
+// an empty string if the secret is not configured.
+func readSecret(name string) string {
+	if val, exists := os.LookupEnv(strings.Replace(name, "-", "_", -1)); exists && val != "" {
+		return val
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(secretsDir, name)); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return ""
+}
+
+// authorizeAdmin reports whether the request carries the admin token as a bearer token, set through
+// the admin_token environment variable or the admin-token secret, otherwise it writes the error
+// response. The admin endpoints are disabled without the token, so they respond with not found.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := readSecret("admin-token")
+	if token == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		http.Error(w, "missing or invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
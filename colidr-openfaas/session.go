@@ -0,0 +1,523 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// defaultSessionTTL is the time after which the idle sessions are evicted.
+	defaultSessionTTL = 15 * time.Minute
+	// defaultSessionHistory is the number of renders kept in the session history.
+	defaultSessionHistory = 10
+	// defaultMaxSessions is the default maximum number of the active sessions.
+	defaultMaxSessions = 32
+)
+
+// errSessionClosed is returned when the session is removed while a request is waiting for it.
+var errSessionClosed = errors.New("the session is closed")
+
+// session holds the decoded source image together with its computed edge tangent flow,
+// so the same image can be re-rendered many times with different parameters cheaply.
+type session struct {
+	mu         sync.Mutex
+	image      gocv.Mat
+	etf        *Etf
+	etfKernel  int
+	etfIter    int
+	etfLinear  bool
+	source     gocv.Mat
+	lastAccess time.Time
+	history    []historyEntry
+	nextIndex  int
+	maxHistory int
+	sourceHash string
+	// closed is set when the resources are released, so the requests which got the session
+	// before its removal don't use them.
+	closed bool
+}
+
+// historyEntry is a previous render of the session, kept for undo and comparison.
+type historyEntry struct {
+	Index   int                 `json:"index"`
+	Params  map[string][]string `json:"params"`
+	Created time.Time           `json:"created"`
+	Size    int                 `json:"size"`
+	result  []byte
+	format  string
+}
+
+// sessionStore keeps track of the active sessions, evicting the idle ones.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	ttl      time.Duration
+	history  int
+	max      int
+}
+
+// sessionInfo is returned when a new session is created.
+type sessionInfo struct {
+	ID     string `json:"id"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// newSessionStore creates the session store and starts the eviction of the idle sessions.
+// The time to live can be configured through the session_ttl environment variable,
+// while the number of renders kept in the history through the session_history one and the maximum
+// number of the active sessions through the max_sessions one.
+func newSessionStore() *sessionStore {
+	ttl := defaultSessionTTL
+	if d, err := time.ParseDuration(os.Getenv("session_ttl")); err == nil && d > 0 {
+		ttl = d
+	}
+	history := defaultSessionHistory
+	if n, err := strconv.Atoi(os.Getenv("session_history")); err == nil && n >= 0 {
+		history = n
+	}
+	s := &sessionStore{sessions: make(map[string]*session), ttl: ttl, history: history, max: envInt("max_sessions", defaultMaxSessions)}
+
+	go func() {
+		for range time.Tick(ttl / 2) {
+			s.evict()
+		}
+	}()
+	return s
+}
+
+// create decodes the image, computes its edge tangent flow and registers the new session.
+func (s *sessionStore) create(data []byte, rp *requestParams) (*sessionInfo, error) {
+	if s.full() {
+		return nil, errTooManySessions
+	}
+	var err error
+	sourceHash := fmt.Sprintf("%x", sha256.Sum256(data))
+	if isTruncatedJPEG(data) {
+		if !rp.salvage {
+			return nil, &truncatedInputError{size: len(data)}
+		}
+		if data, err = salvageJPEG(data); err != nil {
+			return nil, err
+		}
+	}
+	if rp.useICC {
+		if data, err = applyICC(data, rp.linear); err != nil {
+			return nil, fmt.Errorf("unable to apply the embedded ICC profile: %v", err)
+		}
+	}
+
+	// The source is kept in memory for recomputing the edge tangent flow with different parameters.
+	source, err := decodeMat(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rp.opts.transforms) > 0 {
+		transformed, err := applyTransforms(source, rp.opts.transforms)
+		closeMat(&source)
+		if err != nil {
+			return nil, err
+		}
+		source = transformed
+	}
+	rp.opts = rp.opts.resolveSizes(source.Cols(), source.Rows())
+	img := newMat()
+	gocv.CvtColor(source, img, gocv.ColorBGRToGray)
+
+	if err := checkBlank(img, rp.opts.blankThreshold); err != nil {
+		closeMat(&img)
+		closeMat(&source)
+		return nil, err
+	}
+	etf, err := newRefinedEtf(source, rp.opts)
+	if err != nil {
+		closeMat(&img)
+		closeMat(&source)
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		closeMat(&img)
+		closeMat(&source)
+		etf.Close()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	// The concurrent uploads might have filled the store in the meantime.
+	if len(s.sessions) >= s.max {
+		s.mu.Unlock()
+		closeMat(&img)
+		closeMat(&source)
+		etf.Close()
+		return nil, errTooManySessions
+	}
+	s.sessions[id] = &session{
+		image:      img,
+		etf:        etf,
+		etfKernel:  rp.opts.etfKernel,
+		etfIter:    rp.opts.etfIteration,
+		etfLinear:  rp.opts.linearRGB,
+		source:     source,
+		lastAccess: time.Now(),
+		maxHistory: s.history,
+		sourceHash: sourceHash,
+	}
+	s.mu.Unlock()
+
+	return &sessionInfo{ID: id, Width: img.Cols(), Height: img.Rows()}, nil
+}
+
+// checkSessionParams rejects the parameters the sessions can't apply: the symmetry is enforced
+// on the decoded source before computing the edge tangent flow, while the alpha mask is taken
+// from the uploaded image, neither of them being kept by the session.
+func checkSessionParams(rp *requestParams) error {
+	if rp.opts.symmetry != "" {
+		return errors.New("the symmetry parameter is not supported by the sessions")
+	}
+	if rp.opts.alphaMask {
+		return errors.New("the alpha_mask parameter is not supported by the sessions")
+	}
+	return nil
+}
+
+// errTooManySessions is returned when the maximum number of the active sessions is reached.
+var errTooManySessions = errors.New("too many active sessions")
+
+// full reports whether the maximum number of the active sessions is reached.
+func (s *sessionStore) full() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions) >= s.max
+}
+
+// get returns the session with the provided identifier, refreshing its last access time.
+func (s *sessionStore) get(id string) (*session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if ok {
+		sess.mu.Lock()
+		sess.lastAccess = time.Now()
+		sess.mu.Unlock()
+	}
+	return sess, ok
+}
+
+// remove deletes the session, releasing its resources.
+func (s *sessionStore) remove(id string) bool {
+	s.mu.Lock()
+	sess, ok := s.sessions[id]
+	delete(s.sessions, id)
+	s.mu.Unlock()
+
+	if ok {
+		sess.close()
+	}
+	return ok
+}
+
+// evict removes the sessions which were not accessed for longer than the time to live.
+func (s *sessionStore) evict() {
+	s.mu.Lock()
+	var expired []*session
+	for id, sess := range s.sessions {
+		sess.mu.Lock()
+		if time.Since(sess.lastAccess) > s.ttl {
+			expired = append(expired, sess)
+			delete(s.sessions, id)
+		}
+		sess.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	for _, sess := range expired {
+		sess.close()
+	}
+}
+
+// render re-renders the session image with the provided parameters. The edge tangent flow
+// is reused, unless the ETF related parameters are changed, in which case it's recomputed.
+func (sess *session) render(params url.Values, rp *requestParams) ([]byte, error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return nil, errSessionClosed
+	}
+
+	start := time.Now()
+	rp.sourceHash = sess.sourceHash
+	rp.opts = rp.opts.resolveSizes(sess.source.Cols(), sess.source.Rows())
+	if rp.opts.etfKernel != sess.etfKernel || rp.opts.etfIteration != sess.etfIter ||
+		rp.opts.linearRGB != sess.etfLinear {
+		etf, err := newRefinedEtf(sess.source, rp.opts)
+		if err != nil {
+			return nil, err
+		}
+		sess.etf.Close()
+		sess.etf = etf
+		sess.etfKernel, sess.etfIter = rp.opts.etfKernel, rp.opts.etfIteration
+		sess.etfLinear = rp.opts.linearRGB
+	}
+
+	// The generation alters the source image, so it has to work on a copy.
+	img := cloneMat(sess.image)
+	cld, err := newCLDWithEtf(img, sess.etf, rp.opts)
+	if err != nil {
+		closeMat(&img)
+		return nil, err
+	}
+	defer cld.Close()
+
+	res, err := render(cld, rp, "image", start)
+	if err != nil {
+		return nil, err
+	}
+	sess.record(params, res, rp.format)
+
+	return res, nil
+}
+
+// record appends the render to the history, dropping the oldest entries.
+func (sess *session) record(params url.Values, res []byte, format string) {
+	if sess.maxHistory == 0 {
+		return
+	}
+	sess.nextIndex++
+	sess.history = append(sess.history, historyEntry{
+		Index:   sess.nextIndex,
+		Params:  params,
+		Created: time.Now(),
+		Size:    len(res),
+		result:  res,
+		format:  format,
+	})
+	if len(sess.history) > sess.maxHistory {
+		sess.history = sess.history[len(sess.history)-sess.maxHistory:]
+	}
+}
+
+// entries returns a copy of the session history.
+func (sess *session) entries() []historyEntry {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	return append([]historyEntry(nil), sess.history...)
+}
+
+// entry returns the history entry with the provided index.
+func (sess *session) entry(index string) (historyEntry, bool) {
+	n, err := strconv.Atoi(index)
+	if err != nil {
+		return historyEntry{}, false
+	}
+	for _, e := range sess.entries() {
+		if e.Index == n {
+			return e, true
+		}
+	}
+	return historyEntry{}, false
+}
+
+// historyDiff describes the differences between two renders of the session.
+type historyDiff struct {
+	From          int                  `json:"from"`
+	To            int                  `json:"to"`
+	Params        map[string][2]string `json:"params"`
+	ChangedPixels float64              `json:"changed_pixels"`
+}
+
+// diffEntries compares the parameters and the rendered images of two history entries.
+// The changed pixels are expressed as the ratio of the pixels differing between the two renders.
+func diffEntries(a, b historyEntry) historyDiff {
+	diff := historyDiff{From: a.Index, To: b.Index, Params: make(map[string][2]string)}
+
+	pa, pb := url.Values(a.Params), url.Values(b.Params)
+	for k := range pa {
+		if pa.Get(k) != pb.Get(k) {
+			diff.Params[k] = [2]string{pa.Get(k), pb.Get(k)}
+		}
+	}
+	for k := range pb {
+		if _, ok := pa[k]; !ok {
+			diff.Params[k] = [2]string{"", pb.Get(k)}
+		}
+	}
+
+	ia, _, errA := image.Decode(bytes.NewReader(a.result))
+	ib, _, errB := image.Decode(bytes.NewReader(b.result))
+	if errA != nil || errB != nil || ia.Bounds() != ib.Bounds() {
+		diff.ChangedPixels = -1
+		return diff
+	}
+
+	var changed int
+	bounds := ia.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ga := color.GrayModel.Convert(ia.At(x, y)).(color.Gray).Y
+			gb := color.GrayModel.Convert(ib.At(x, y)).(color.Gray).Y
+			// Ignore the small differences caused by the lossy compression.
+			if absInt(int(ga)-int(gb)) > 32 {
+				changed++
+			}
+		}
+	}
+	diff.ChangedPixels = float64(changed) / float64(bounds.Dx()*bounds.Dy())
+
+	return diff
+}
+
+// close releases the resources of the session. It waits for the render in progress,
+// while the later renders fail.
+func (sess *session) close() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.closed = true
+	closeMat(&sess.image)
+	closeMat(&sess.source)
+	sess.etf.Close()
+}
+
+// ServeHTTP routes the session requests:
+//
+//	POST   /sessions              uploads the image and returns the session identifier
+//	POST   /sessions/{id}/render  renders the image with the parameters from the query string
+//	DELETE /sessions/{id}         removes the session
+//	GET    /sessions/{id}/history the history of the renders
+func (s *sessionStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/"), "/")
+
+	rp, err := parseParams(r.URL.Query())
+	if err == nil {
+		err = checkSessionParams(rp)
+	}
+	if err != nil {
+		w.Header().Set("X-Error-Code", "invalid_parameters")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case parts[0] == "" && r.Method == http.MethodPost:
+		data, err := readLimited(r.Body, maxUploadSize())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		info, err := s.create(data, rp)
+		if err == errTooManySessions {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if !s.remove(parts[0]) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "render" && r.Method == http.MethodPost:
+		sess, ok := s.get(parts[0])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		res, err := sess.render(r.URL.Query(), rp)
+		if err == errSessionClosed {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", detectContentType(res, rp.format))
+		w.Write(res)
+	case len(parts) >= 2 && parts[1] == "history" && r.Method == http.MethodGet:
+		sess, ok := s.get(parts[0])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		sess.serveHistory(w, r, parts[2:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveHistory routes the session history requests:
+//
+//	GET /sessions/{id}/history             lists the previous renders with their parameters
+//	GET /sessions/{id}/history/{n}         returns the result of the render
+//	GET /sessions/{id}/history/{n}/diff/{m} compares two renders
+func (sess *session) serveHistory(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch len(parts) {
+	case 0:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sess.entries())
+	case 1:
+		e, ok := sess.entry(parts[0])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", detectContentType(e.result, e.format))
+		w.Write(e.result)
+	case 3:
+		a, okA := sess.entry(parts[0])
+		b, okB := sess.entry(parts[2])
+		if parts[1] != "diff" || !okA || !okB {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(diffEntries(a, b))
+	default:
+		http.NotFound(w, r)
+	}
+}
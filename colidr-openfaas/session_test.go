@@ -0,0 +1,47 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSessionUnsupportedParams(t *testing.T) {
+	s := &sessionStore{sessions: make(map[string]*session), max: 1}
+	img := testImage(t)
+	for _, query := range []string{"symmetry=v", "alpha_mask=true"} {
+		for _, path := range []string{"/sessions", "/sessions/id/render"} {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path+"?"+query, bytes.NewReader(img)))
+			if w.Code != http.StatusBadRequest || w.Header().Get("X-Error-Code") != "invalid_parameters" {
+				t.Errorf("%s?%s: status %d (%s), expected the parameter to be rejected", path, query, w.Code, w.Header().Get("X-Error-Code"))
+			}
+		}
+	}
+	if len(s.sessions) != 0 {
+		t.Error("the session is created with the unsupported parameters")
+	}
+}
@@ -0,0 +1,192 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// defaultImageProperty is the order line item property holding the customer image URL.
+const defaultImageProperty = "image_url"
+
+// shopifyOrder is the subset of the Shopify order webhook payload used by the integration.
+type shopifyOrder struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	LineItems []struct {
+		ID         int64 `json:"id"`
+		Properties []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"properties"`
+	} `json:"line_items"`
+}
+
+// fulfillmentRequest is sent to the fulfillment API for each rendered line item.
+type fulfillmentRequest struct {
+	OrderID    int64  `json:"order_id"`
+	OrderName  string `json:"order_name"`
+	LineItemID int64  `json:"line_item_id"`
+	ResultURL  string `json:"result_url"`
+}
+
+// shopifyCDN is the host of the files uploaded to the Shopify stores.
+const shopifyCDN = "cdn.shopify.com"
+
+// verifyShopifyRequest authenticates the webhook with the Shopify webhook secret. The requests are
+// refused when the secret is not configured, since forged orders would be rendered and fulfilled otherwise.
+func verifyShopifyRequest(ctx *RequestContext) error {
+	secret := readSecret("shopify-webhook-secret")
+	if secret == "" {
+		return errors.New("the shopify webhook secret is not configured")
+	}
+	if !verifyShopifySignature(ctx.Body, secret, ctx.Header.Get("X-Shopify-Hmac-Sha256")) {
+		return errors.New("invalid shopify signature")
+	}
+	return nil
+}
+
+// handleShopify receives the order webhooks, renders the customer images found in the line item properties
+// with the configured preset at print resolution, uploads them to the storage and calls back the fulfillment API.
+func handleShopify(ctx *RequestContext) string {
+	var order shopifyOrder
+	if err := json.Unmarshal(ctx.Body, &order); err != nil {
+		return fmt.Sprintf("unable to decode the order: %v", err)
+	}
+
+	property := defaultImageProperty
+	if val, exists := os.LookupEnv("pod_image_property"); exists && val != "" {
+		property = val
+	}
+	params := url.Values{"print": {"true"}}
+	if preset := os.Getenv("pod_preset"); preset != "" {
+		params.Set("preset", preset)
+	}
+
+	for _, item := range order.LineItems {
+		for _, prop := range item.Properties {
+			if prop.Name != property || prop.Value == "" {
+				continue
+			}
+			if !isShopImageURL(prop.Value) {
+				return fmt.Sprintf("refusing to download the image of line item %d from %q", item.ID, prop.Value)
+			}
+			data, err := downloadImage(prop.Value, nil)
+			if err != nil {
+				return fmt.Sprintf("unable to download the image of line item %d: %v", item.ID, err)
+			}
+			res, err := process(data, params, "image")
+			if err != nil {
+				return fmt.Sprintf("unable to render the image of line item %d: %v", item.ID, err)
+			}
+
+			key := fmt.Sprintf("orders/%d/%d.jpg", order.ID, item.ID)
+			link, err := uploadResult(key, res, "image/jpeg")
+			if err != nil {
+				return fmt.Sprintf("unable to upload the image of line item %d: %v", item.ID, err)
+			}
+
+			err = notifyFulfillment(fulfillmentRequest{
+				OrderID:    order.ID,
+				OrderName:  order.Name,
+				LineItemID: item.ID,
+				ResultURL:  link,
+			})
+			if err != nil {
+				return fmt.Sprintf("unable to call the fulfillment API for line item %d: %v", item.ID, err)
+			}
+		}
+	}
+	return "ok"
+}
+
+// isShopImageURL reports whether the customer image is served over https by the Shopify CDN or by one
+// of the hosts listed in the pod_image_hosts environment variable (separated by commas), like the storage
+// of a customer upload app.
+func isShopImageURL(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return false
+	}
+	if u.Host == shopifyCDN {
+		return true
+	}
+	for _, host := range strings.Split(os.Getenv("pod_image_hosts"), ",") {
+		if host = strings.TrimSpace(host); host != "" && u.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyShopifySignature checks the base64 encoded HMAC-SHA256 signature of the webhook body.
+func verifyShopifySignature(body []byte, secret, signature string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// notifyFulfillment posts the rendered line item to the fulfillment API configured
+// through the fulfillment_url environment variable, authenticated with the fulfillment-token secret.
+func notifyFulfillment(fr fulfillmentRequest) error {
+	endpoint := os.Getenv("fulfillment_url")
+	if endpoint == "" {
+		return nil
+	}
+	body, err := json.Marshal(fr)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := readSecret("fulfillment-token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := storageClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
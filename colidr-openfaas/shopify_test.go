@@ -0,0 +1,84 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestVerifyShopifyRequest(t *testing.T) {
+	body := []byte(`{"id":1,"line_items":[]}`)
+	sign := func(secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	request := func(signature string) *RequestContext {
+		header := http.Header{}
+		header.Set("X-Shopify-Hmac-Sha256", signature)
+		return &RequestContext{Body: body, Header: header}
+	}
+
+	os.Unsetenv("shopify_webhook_secret")
+	if err := verifyShopifyRequest(request(sign(""))); err == nil {
+		t.Error("the webhook is accepted without the secret")
+	}
+
+	os.Setenv("shopify_webhook_secret", "secret")
+	defer os.Unsetenv("shopify_webhook_secret")
+	if err := verifyShopifyRequest(request(sign("secret"))); err != nil {
+		t.Errorf("the signed webhook is refused: %v", err)
+	}
+	for _, signature := range []string{"", sign("other")} {
+		if err := verifyShopifyRequest(request(signature)); err == nil {
+			t.Errorf("%q: the webhook is accepted", signature)
+		}
+	}
+}
+
+func TestIsShopImageURL(t *testing.T) {
+	os.Setenv("pod_image_hosts", "uploads.example.com, files.example.org")
+	defer os.Unsetenv("pod_image_hosts")
+
+	tests := map[string]bool{
+		"https://cdn.shopify.com/s/files/1/0001/files/photo.jpg": true,
+		"https://uploads.example.com/photo.jpg":                  true,
+		"https://files.example.org/photo.jpg":                    true,
+		"http://cdn.shopify.com/s/files/photo.jpg":               false,
+		"https://cdn.shopify.com.example.net/photo.jpg":          false,
+		"https://user@cdn.shopify.com/photo.jpg":                 false,
+		"https://169.254.169.254/latest/meta-data":               false,
+		"file:///etc/passwd":                                     false,
+		"https://example.com/photo.jpg":                          false,
+	}
+	for link, want := range tests {
+		if got := isShopImageURL(link); got != want {
+			t.Errorf("%s: %v, expected %v", link, got, want)
+		}
+	}
+}
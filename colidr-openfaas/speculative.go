@@ -0,0 +1,128 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// renderDeadline returns the latency budget of the client, provided in milliseconds
+// through the X-Deadline-Ms header.
+func renderDeadline(ctx *RequestContext) (time.Duration, bool) {
+	ms, err := strconv.Atoi(ctx.Header.Get("X-Deadline-Ms"))
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// draftParams returns the parameters of the draft render, which skips the refinement
+// iterations of the edge tangent flow and the fDoG iterations beyond the first one.
+func draftParams(rp *requestParams) *requestParams {
+	draft := *rp
+	if draft.opts.etfIteration > 1 {
+		draft.opts.etfIteration = 1
+	}
+	draft.opts.fDogIteration = 0
+	return &draft
+}
+
+// renderResult is the outcome of a render of the race.
+type renderResult struct {
+	data []byte
+	err  error
+}
+
+// raceRender races a draft render against the full render, returning the full one if it's done
+// by the deadline, otherwise the draft one, or whichever succeeds first when neither is ready
+// at the deadline. It also returns the quality of the render returned, full or draft. The render
+// which lost the race is left to complete in the background, its result being discarded.
+//
+// The second render is admitted as an extra request, holding its slot until both renders are done,
+// so the races don't double the load past the admission limit. Without a free slot only the full
+// render runs.
+func raceRender(data []byte, rp *requestParams, output string, deadline time.Duration) ([]byte, string, error) {
+	if !admitExtra() {
+		res, err := pipeline.Process(data, rp, output)
+		return res, "full", err
+	}
+	var done int32
+	finish := func() {
+		if atomic.AddInt32(&done, 1) == 2 {
+			releaseExtra()
+		}
+	}
+
+	fullCh, draftCh := make(chan renderResult, 1), make(chan renderResult, 1)
+	draft := draftParams(rp)
+	go func() {
+		defer finish()
+		res, err := pipeline.Process(data, rp, output)
+		fullCh <- renderResult{res, err}
+	}()
+	go func() {
+		defer finish()
+		res, err := pipeline.Process(data, draft, output)
+		draftCh <- renderResult{res, err}
+	}()
+
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+
+	var (
+		drafted *renderResult
+		expired bool
+		lastErr error
+	)
+	for pending := 2; pending > 0; {
+		select {
+		case r := <-fullCh:
+			pending, fullCh = pending-1, nil
+			if r.err == nil {
+				return r.data, "full", nil
+			}
+			lastErr = r.err
+		case r := <-draftCh:
+			pending, draftCh = pending-1, nil
+			if r.err != nil {
+				lastErr = r.err
+				continue
+			}
+			if expired {
+				return r.data, "draft", nil
+			}
+			drafted = &r
+		case <-timer.C:
+			expired = true
+			if drafted != nil {
+				return drafted.data, "draft", nil
+			}
+		}
+	}
+	if drafted != nil {
+		return drafted.data, "draft", nil
+	}
+	return nil, "", lastErr
+}
@@ -0,0 +1,77 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"gocv.io/x/gocv"
+)
+
+// responseMemory is the memory used by the DoG response matrices held in RAM, across the requests.
+var responseMemory int64
+
+// spillDir returns the scratch directory where the DoG responses are spilled, set through
+// the spill_dir environment variable. The spilling is disabled without it.
+func spillDir() string {
+	return os.Getenv("spill_dir")
+}
+
+// spillBudget returns the memory budget of the DoG responses held in RAM, set in megabytes
+// through the spill_budget environment variable. Zero means every response is spilled.
+func spillBudget() int64 {
+	mb, err := strconv.ParseInt(os.Getenv("spill_budget"), 10, 64)
+	if err != nil || mb < 0 {
+		return 0
+	}
+	return mb << 20
+}
+
+// newResponseMat allocates a floating point matrix for the DoG responses. When the memory budget
+// would be exceeded, the matrix is backed by a memory mapped file in the scratch directory,
+// keeping the huge renders possible at the cost of I/O.
+func newResponseMat(rows, cols int) matrix {
+	size := int64(rows) * int64(cols) * 4
+	if dir := spillDir(); dir != "" && atomic.LoadInt64(&responseMemory)+size > spillBudget() {
+		if m, err := newMappedMat(dir, rows, cols); err == nil {
+			return m
+		}
+	}
+	atomic.AddInt64(&responseMemory, size)
+	m := newMatWithSize(rows, cols, gocv.MatTypeCV32F)
+	return &m
+}
+
+// closeMatrix releases the matrix allocated by newResponseMat.
+func closeMatrix(m matrix) {
+	switch m := m.(type) {
+	case *gocv.Mat:
+		atomic.AddInt64(&responseMemory, -int64(m.Rows())*int64(m.Cols())*4)
+		closeMat(m)
+	case io.Closer:
+		m.Close()
+	}
+}
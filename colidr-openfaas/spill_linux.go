@@ -0,0 +1,70 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"gocv.io/x/gocv"
+)
+
+// mappedMat is a floating point matrix backed by a memory mapped file.
+type mappedMat struct {
+	*denseMat
+	raw []byte
+}
+
+// newMappedMat maps a temporary file of the matrix size into memory. The file is removed
+// right away, the mapping remaining valid until the matrix is closed.
+func newMappedMat(dir string, rows, cols int) (*mappedMat, error) {
+	f, err := ioutil.TempFile(dir, "colidr-*.mat")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defer os.Remove(f.Name())
+
+	n := rows * cols
+	if err := f.Truncate(int64(n) * 4); err != nil {
+		return nil, err
+	}
+	raw, err := syscall.Mmap(int(f.Fd()), 0, n*4, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	data := (*[1 << 30]float32)(unsafe.Pointer(&raw[0]))[:n:n]
+
+	return &mappedMat{
+		denseMat: &denseMat{rows: rows, cols: cols, channels: 1, typ: gocv.MatTypeCV32F, data: data},
+		raw:      raw,
+	}, nil
+}
+
+// Close unmaps the matrix.
+func (m *mappedMat) Close() error {
+	m.data = nil
+	return syscall.Munmap(m.raw)
+}
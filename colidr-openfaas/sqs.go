@@ -0,0 +1,218 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqsClient pulls the messages from an Amazon SQS queue, through the JSON protocol of the API
+// signed with AWS Signature Version 4, without depending on the AWS SDK.
+type sqsClient struct {
+	queueURL      string
+	deadLetterURL string
+	region        string
+	endpoint      string
+	http          *http.Client
+}
+
+// newSQSClient configures the client from the sqs_queue_url, sqs_dead_letter_url and sqs_region
+// environment variables. The region is derived from the queue URL by default.
+func newSQSClient() *sqsClient {
+	c := &sqsClient{
+		queueURL:      os.Getenv("sqs_queue_url"),
+		deadLetterURL: os.Getenv("sqs_dead_letter_url"),
+		region:        os.Getenv("sqs_region"),
+		http:          &http.Client{Timeout: time.Minute},
+	}
+	u, err := url.Parse(c.queueURL)
+	if err == nil {
+		c.endpoint = u.Scheme + "://" + u.Host + "/"
+		// The queue URLs look like https://sqs.us-east-1.amazonaws.com/123456789012/name.
+		if parts := strings.Split(u.Host, "."); c.region == "" && len(parts) > 2 && parts[0] == "sqs" {
+			c.region = parts[1]
+		}
+	}
+	return c
+}
+
+// awsCredentials returns the access key, the secret key and the optional session token, read from
+// the standard AWS environment variables or from the aws-access-key-id, aws-secret-access-key
+// and aws-session-token secrets.
+func awsCredentials() (string, string, string) {
+	get := func(env, secret string) string {
+		if v := os.Getenv(env); v != "" {
+			return v
+		}
+		return readSecret(secret)
+	}
+	return get("AWS_ACCESS_KEY_ID", "aws-access-key-id"), get("AWS_SECRET_ACCESS_KEY", "aws-secret-access-key"),
+		get("AWS_SESSION_TOKEN", "aws-session-token")
+}
+
+// call invokes the SQS action, decoding the JSON response into res.
+func (c *sqsClient) call(action string, req, res interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest(http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	r.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+	signAWSRequest(r, body, c.region, "sqs", time.Now().UTC())
+
+	resp, err := c.http.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sqs %s failed with status %v: %s", action, resp.Status, data)
+	}
+	if res == nil {
+		return nil
+	}
+	return json.Unmarshal(data, res)
+}
+
+// signAWSRequest signs the request with AWS Signature Version 4.
+func signAWSRequest(r *http.Request, body []byte, region, service string, now time.Time) {
+	accessKey, secretKey, token := awsCredentials()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	r.Header.Set("X-Amz-Date", amzDate)
+	if token != "" {
+		r.Header.Set("X-Amz-Security-Token", token)
+	}
+	// The host, the content type and the x-amz headers are signed, sorted by name.
+	names := []string{"host"}
+	for name := range r.Header {
+		if name = strings.ToLower(name); name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var headers bytes.Buffer
+	for _, name := range names {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.URL.Host
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+	signed := strings.Join(names, ";")
+	payloadHash := sha256.Sum256(body)
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{r.Method, path, r.URL.RawQuery, headers.String(), signed, hex.EncodeToString(payloadHash[:])}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(data))
+		return mac.Sum(nil)
+	}
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signed, signature))
+}
+
+func (c *sqsClient) receive(visibility time.Duration) (*queueMessage, error) {
+	var res struct {
+		Messages []struct {
+			MessageID     string            `json:"MessageId"`
+			ReceiptHandle string            `json:"ReceiptHandle"`
+			Body          string            `json:"Body"`
+			Attributes    map[string]string `json:"Attributes"`
+		} `json:"Messages"`
+	}
+	err := c.call("ReceiveMessage", map[string]interface{}{
+		"QueueUrl":            c.queueURL,
+		"MaxNumberOfMessages": 1,
+		"WaitTimeSeconds":     20,
+		"VisibilityTimeout":   int(visibility.Seconds()),
+		"AttributeNames":      []string{"ApproximateReceiveCount"},
+	}, &res)
+	if err != nil || len(res.Messages) == 0 {
+		return nil, err
+	}
+	msg := res.Messages[0]
+	attempts, _ := strconv.Atoi(msg.Attributes["ApproximateReceiveCount"])
+	return &queueMessage{id: msg.MessageID, body: []byte(msg.Body), handle: msg.ReceiptHandle, attempts: attempts}, nil
+}
+
+func (c *sqsClient) extend(m *queueMessage, visibility time.Duration) error {
+	return c.call("ChangeMessageVisibility", map[string]interface{}{
+		"QueueUrl":          c.queueURL,
+		"ReceiptHandle":     m.handle,
+		"VisibilityTimeout": int(visibility.Seconds()),
+	}, nil)
+}
+
+func (c *sqsClient) ack(m *queueMessage) error {
+	return c.call("DeleteMessage", map[string]interface{}{"QueueUrl": c.queueURL, "ReceiptHandle": m.handle}, nil)
+}
+
+func (c *sqsClient) retry(m *queueMessage) error {
+	return c.extend(m, 0)
+}
+
+func (c *sqsClient) deadLetter(m *queueMessage, reason string) (bool, error) {
+	if c.deadLetterURL == "" {
+		return false, nil
+	}
+	err := c.call("SendMessage", map[string]interface{}{
+		"QueueUrl":    c.deadLetterURL,
+		"MessageBody": string(deadLetterBody(m, reason)),
+	}, nil)
+	return err == nil, err
+}
@@ -0,0 +1,176 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultStageTimeout is the timeout of the stages configured without one.
+const defaultStageTimeout = time.Minute
+
+// stage is a sibling function invoked through the gateway before or after the CLD stage.
+type stage struct {
+	name    string
+	query   string
+	timeout time.Duration
+}
+
+// parseStages parses the comma separated list of the stages, each in the name[?query][@timeout]
+// form, e.g. "upscale?scale=2@30s,colorize".
+func parseStages(spec string) ([]stage, error) {
+	var stages []stage
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		s := stage{timeout: defaultStageTimeout}
+		if i := strings.LastIndex(item, "@"); i >= 0 {
+			d, err := time.ParseDuration(item[i+1:])
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid timeout of the stage %q", item)
+			}
+			s.timeout, item = d, item[:i]
+		}
+		if i := strings.Index(item, "?"); i >= 0 {
+			s.query, item = item[i+1:], item[:i]
+		}
+		if item == "" || strings.ContainsAny(item, "/ ") {
+			return nil, fmt.Errorf("invalid stage name %q", item)
+		}
+		s.name = item
+		stages = append(stages, s)
+	}
+	return stages, nil
+}
+
+// stageError is the failure of a sibling function, propagated to the client as a gateway error.
+type stageError struct {
+	stage   string
+	status  int
+	timeout bool
+	msg     string
+}
+
+func (e *stageError) Error() string {
+	if e.status != 0 {
+		return fmt.Sprintf("stage %s returned %d: %s", e.stage, e.status, e.msg)
+	}
+	return fmt.Sprintf("stage %s failed: %s", e.stage, e.msg)
+}
+
+// httpStatus returns the status of the response, 504 on timeouts and 502 otherwise.
+func (e *stageError) httpStatus() int {
+	if e.timeout {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// invoke posts the data to the sibling function and returns its response body.
+func (s stage) invoke(data []byte) ([]byte, error) {
+	url := fmt.Sprintf("%s/function/%s", tileGateway(), s.name)
+	if s.query != "" {
+		url += "?" + s.query
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, &stageError{stage: s.name, msg: err.Error()}
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(data))
+
+	client := &http.Client{Timeout: s.timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		ne, ok := err.(net.Error)
+		return nil, &stageError{stage: s.name, timeout: ok && ne.Timeout(), msg: err.Error()}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, &stageError{stage: s.name, status: res.StatusCode, msg: strings.TrimSpace(string(msg))}
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		ne, ok := err.(net.Error)
+		return nil, &stageError{stage: s.name, timeout: ok && ne.Timeout(), msg: err.Error()}
+	}
+	return body, nil
+}
+
+// runStages passes the data through the stages in order.
+func runStages(stages []stage, data []byte) ([]byte, error) {
+	var err error
+	for _, s := range stages {
+		if data, err = s.invoke(data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// stagedProcessor composes the processor with the sibling functions configured through the
+// pre_stages and post_stages environment variables. The pre stages receive the uploaded image
+// and must return an image, while the post stages receive the encoded drawing of the image output.
+type stagedProcessor struct {
+	next processor
+}
+
+// Process runs the pre stages, the wrapped processor, then the post stages.
+func (p stagedProcessor) Process(data []byte, rp *requestParams, output string) ([]byte, error) {
+	if rp.exportRecipe || rp.dryRun {
+		return p.next.Process(data, rp, output)
+	}
+
+	pre, err := parseStages(os.Getenv("pre_stages"))
+	if err != nil {
+		return nil, err
+	}
+	post, err := parseStages(os.Getenv("post_stages"))
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err = runStages(pre, data); err != nil {
+		return nil, err
+	}
+	if len(pre) > 0 && inputFormat(data) == "" {
+		return nil, &stageError{stage: pre[len(pre)-1].name, msg: "the response is not a supported image"}
+	}
+
+	res, err := p.next.Process(data, rp, output)
+	if err != nil || output != "image" || rp.analyze {
+		return res, err
+	}
+	return runStages(post, res)
+}
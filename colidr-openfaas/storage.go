@@ -0,0 +1,117 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// storageClient is the HTTP client used for uploading the results to the storage.
+var storageClient = &http.Client{Timeout: 5 * time.Minute}
+
+// uploadResult stores the data under the provided key and returns its URL. The storage is configured
+// through the storage_url environment variable, an URL template like https://bucket.example.com/{key}
+// accepting PUT requests (e.g. S3 compatible storages), with the optional Authorization header value
+// read from the storage-auth secret. If the objects are exposed through a different address, it can be
+// configured in the same way through the storage_public_url environment variable.
+func uploadResult(key string, data []byte, contentType string) (string, error) {
+	target := os.Getenv("storage_url")
+	if target == "" {
+		return "", errors.New("the storage_url is not configured")
+	}
+	link := objectURL(target, key)
+
+	req, err := http.NewRequest(http.MethodPut, link, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if auth := readSecret("storage-auth"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := storageClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("unexpected storage response status %v", resp.Status)
+	}
+
+	if public := os.Getenv("storage_public_url"); public != "" {
+		return objectURL(public, key), nil
+	}
+	return link, nil
+}
+
+// objectURL substitutes the key into the URL template. Each path segment of the key is escaped,
+// the dot segments included, so the key can't change the query, the fragment or the directory
+// of the target URL.
+func objectURL(template, key string) string {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		switch seg {
+		case ".", "..":
+			segments[i] = strings.Replace(seg, ".", "%2E", -1)
+		default:
+			segments[i] = url.PathEscape(seg)
+		}
+	}
+	return strings.Replace(template, "{key}", strings.Join(segments, "/"), -1)
+}
+
+// downloadObject reads the object stored under the provided key, from the storage configured
+// for the uploads, with the same authorization.
+func downloadObject(key string) ([]byte, error) {
+	target := os.Getenv("storage_url")
+	if target == "" {
+		return nil, errors.New("the storage_url is not configured")
+	}
+	req, err := http.NewRequest(http.MethodGet, objectURL(target, key), nil)
+	if err != nil {
+		return nil, err
+	}
+	if auth := readSecret("storage-auth"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := storageClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected storage response status %v", resp.Status)
+	}
+	return readLimited(resp.Body, maxUploadSize())
+}
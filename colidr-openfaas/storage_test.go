@@ -0,0 +1,44 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import "testing"
+
+func TestObjectURL(t *testing.T) {
+	const template = "https://bucket.example.com/results/{key}"
+	tests := []struct {
+		key, want string
+	}{
+		{"orders/1001/1.jpg", "https://bucket.example.com/results/orders/1001/1.jpg"},
+		{"a b.jpg", "https://bucket.example.com/results/a%20b.jpg"},
+		{"x.jpg?acl=public", "https://bucket.example.com/results/x.jpg%3Facl=public"},
+		{"x.jpg#frag", "https://bucket.example.com/results/x.jpg%23frag"},
+		{"../../admin", "https://bucket.example.com/results/%2E%2E/%2E%2E/admin"},
+		{"./x.jpg", "https://bucket.example.com/results/%2E/x.jpg"},
+	}
+	for _, tt := range tests {
+		if got := objectURL(template, tt.key); got != tt.want {
+			t.Errorf("%q: %s, expected %s", tt.key, got, tt.want)
+		}
+	}
+}
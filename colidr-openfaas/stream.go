@@ -0,0 +1,75 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// defaultMaxUploadSize is the maximum accepted request size, unless configured otherwise.
+const defaultMaxUploadSize = 32 << 20
+
+// errUploadTooLarge is returned when the request body exceeds the configured size limit.
+var errUploadTooLarge = errors.New("upload size limit exceeded")
+
+// maxUploadSize returns the request size limit configured through the max_upload_bytes environment variable.
+func maxUploadSize() int64 {
+	if val, exists := os.LookupEnv("max_upload_bytes"); exists {
+		if size, err := strconv.ParseInt(val, 10, 64); err == nil && size > 0 {
+			return size
+		}
+	}
+	return defaultMaxUploadSize
+}
+
+// readLimited reads the whole stream, aborting as soon as more than limit bytes are received,
+// instead of buffering the entire request before rejecting it.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errUploadTooLarge
+	}
+	return data, nil
+}
+
+// HandleStream is an alternative entry point to Handle, which reads the request from a stream,
+// like the STDIN in classic watchdog mode, enforcing the upload size limit while reading.
+func HandleStream(r io.Reader) string {
+	limit := maxUploadSize()
+	req, err := readLimited(r, limit)
+	if err != nil {
+		if err == errUploadTooLarge {
+			return fmt.Sprintf("the request exceeds the maximum allowed size of %d bytes", limit)
+		}
+		return fmt.Sprintf("unable to read the request: %v", err)
+	}
+	return Handle(req)
+}
@@ -0,0 +1,113 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import "sort"
+
+// strokeComponent is a connected set of line pixels, corresponding to a traced stroke.
+type strokeComponent struct {
+	pixels []int
+	score  float64
+}
+
+// labelStrokes returns the 8-connected components of the dark pixels of the grayscale image.
+func labelStrokes(data []byte, width, height int) [][]int {
+	visited := make([]bool, len(data))
+	var (
+		components [][]int
+		stack      []int
+	)
+	for start, v := range data {
+		if v >= 128 || visited[start] {
+			continue
+		}
+		var pixels []int
+		visited[start] = true
+		stack = append(stack[:0], start)
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			pixels = append(pixels, i)
+
+			x, y := i%width, i/width
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					nx, ny := x+dx, y+dy
+					if nx < 0 || nx >= width || ny < 0 || ny >= height {
+						continue
+					}
+					if j := ny*width + nx; !visited[j] && data[j] < 128 {
+						visited[j] = true
+						stack = append(stack, j)
+					}
+				}
+			}
+		}
+		components = append(components, pixels)
+	}
+	return components
+}
+
+// pruneStrokes enforces the stroke budget, erasing the least significant strokes of the result
+// until at most maxStrokes are left and the line coverage doesn't exceed the target coverage.
+// The strokes are ranked by their size weighted by their strength, the mean distance of the flow
+// DoG response from tau, so the shortest and faintest strokes are removed first.
+func (c *Cld) pruneStrokes() {
+	if c.maxStrokes <= 0 && c.targetCoverage <= 0 {
+		return
+	}
+	rows, cols := c.result.Rows(), c.result.Cols()
+	data := c.result.ToBytes()
+
+	labels := labelStrokes(data, cols, rows)
+	strokes := make([]strokeComponent, len(labels))
+	for i, pixels := range labels {
+		var strength float64
+		for _, p := range pixels {
+			strength += float64(c.tau - c.fDog.GetFloatAt(p/cols, p%cols))
+		}
+		strokes[i] = strokeComponent{pixels: pixels, score: strength}
+	}
+	sort.SliceStable(strokes, func(i, j int) bool { return strokes[i].score > strokes[j].score })
+
+	keep := len(strokes)
+	if c.maxStrokes > 0 && keep > c.maxStrokes {
+		keep = c.maxStrokes
+	}
+	if c.targetCoverage > 0 {
+		budget := int(c.targetCoverage * float64(rows*cols))
+		var covered int
+		for i := 0; i < keep; i++ {
+			if covered += len(strokes[i].pixels); covered > budget {
+				keep = i
+				break
+			}
+		}
+	}
+
+	for _, s := range strokes[keep:] {
+		for _, p := range s.pixels {
+			c.result.SetUCharAt(p/cols, p%cols, 255)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"sort"
+
+	"gocv.io/x/gocv"
+)
+
+// stroke is a traced line outline.
+type stroke struct {
+	points []image.Point
+}
+
+// traceStrokes extracts the outlines of the lines from a binary mask, where the lines are black.
+func traceStrokes(mask gocv.Mat) []stroke {
+	inv := newMat()
+	defer closeMat(&inv)
+
+	gocv.BitwiseNot(mask, inv)
+	contours := gocv.FindContours(inv, gocv.RetrievalExternal, gocv.ChainApproxSimple)
+
+	strokes := make([]stroke, 0, len(contours))
+	for _, c := range contours {
+		if len(c) < 2 {
+			continue
+		}
+		strokes = append(strokes, stroke{points: c})
+	}
+	return strokes
+}
+
+// length returns the approximate length of the stroke, which is half of its outline perimeter.
+func (s stroke) length() float64 {
+	var perimeter float64
+	for i := range s.points {
+		p, q := s.points[i], s.points[(i+1)%len(s.points)]
+		perimeter += math.Hypot(float64(q.X-p.X), float64(q.Y-p.Y))
+	}
+	return perimeter / 2
+}
+
+// orientation returns the angle in degrees, in the [0, 180) range, of the stroke principal axis.
+func (s stroke) orientation() float64 {
+	var mx, my float64
+	for _, p := range s.points {
+		mx += float64(p.X)
+		my += float64(p.Y)
+	}
+	n := float64(len(s.points))
+	mx, my = mx/n, my/n
+
+	var sxx, syy, sxy float64
+	for _, p := range s.points {
+		dx, dy := float64(p.X)-mx, float64(p.Y)-my
+		sxx += dx * dx
+		syy += dy * dy
+		sxy += dx * dy
+	}
+	angle := 0.5 * math.Atan2(2*sxy, sxx-syy) * 180 / math.Pi
+	if angle < 0 {
+		angle += 180
+	}
+	return angle
+}
+
+// bucket returns the name of the group the stroke belongs to.
+func (s stroke) bucket(groupBy string) string {
+	switch groupBy {
+	case "length":
+		switch l := s.length(); {
+		case l < 20:
+			return "short"
+		case l < 100:
+			return "medium"
+		}
+		return "long"
+	case "orientation":
+		// The image Y axis points downward, so the angles are measured clockwise.
+		switch a := s.orientation(); {
+		case a < 22.5 || a >= 157.5:
+			return "horizontal"
+		case a < 67.5:
+			return "diagonal-down"
+		case a < 112.5:
+			return "vertical"
+		}
+		return "diagonal-up"
+	}
+	return ""
+}
+
+// tone returns the mean intensity of the grayscale image sampled along the stroke outline.
+func (s stroke) tone(gray []byte, cols int) float64 {
+	var sum float64
+	var n int
+	for i := range s.points {
+		p, q := s.points[i], s.points[(i+1)%len(s.points)]
+		steps := int(math.Max(math.Abs(float64(q.X-p.X)), math.Abs(float64(q.Y-p.Y))))
+		if steps == 0 {
+			steps = 1
+		}
+		for t := 0; t < steps; t++ {
+			x := p.X + (q.X-p.X)*t/steps
+			y := p.Y + (q.Y-p.Y)*t/steps
+			if idx := y*cols + x; idx >= 0 && idx < len(gray) {
+				sum += float64(gray[idx])
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return 255
+	}
+	return sum / float64(n)
+}
+
+// sortStrokes orders the strokes by the tone of the source image underneath, the darkest first
+// with the dark order and the lightest first with the light order, so a partially completed plot
+// already resembles the image.
+func sortStrokes(strokes []stroke, order string, gray []byte, cols int) error {
+	var desc bool
+	switch order {
+	case "":
+		return nil
+	case "dark":
+	case "light":
+		desc = true
+	default:
+		return fmt.Errorf("invalid stroke order %q: must be dark or light", order)
+	}
+	tones := make(map[int]float64, len(strokes))
+	idx := make([]int, len(strokes))
+	for i, s := range strokes {
+		idx[i] = i
+		tones[i] = s.tone(gray, cols)
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		if desc {
+			return tones[idx[i]] > tones[idx[j]]
+		}
+		return tones[idx[i]] < tones[idx[j]]
+	})
+	sorted := make([]stroke, len(strokes))
+	for i, k := range idx {
+		sorted[i] = strokes[k]
+	}
+	copy(strokes, sorted)
+	return nil
+}
+
+// path returns the SVG path data of the stroke outline.
+func (s stroke) path() string {
+	d := fmt.Sprintf("M%d %d", s.points[0].X, s.points[0].Y)
+	for _, p := range s.points[1:] {
+		d += fmt.Sprintf("L%d %d", p.X, p.Y)
+	}
+	return d + "Z"
+}
+
+// encodeSVG traces the generated lines and writes them as SVG. Each line layer (or pen layer) is emitted
+// as a separate named group, and the strokes inside the layers can be further grouped by length or
+// orientation, then ordered by the underlying tone. It should be called after GenerateCld.
+func (c *Cld) encodeSVG(w io.Writer, opts EncodeOptions) error {
+	layers, err := c.plotLayers(opts)
+	if err != nil {
+		return err
+	}
+
+	rows, cols := c.result.Rows(), c.result.Cols()
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n", cols, rows, cols, rows)
+	fmt.Fprintf(w, `<rect id="background" width="%d" height="%d" fill="#ffffff"/>`+"\n", cols, rows)
+
+	for i, l := range layers {
+		fmt.Fprintf(w, `<g id="layer-%d" inkscape:groupmode="layer" inkscape:label="%s" fill="#%02x%02x%02x">`+"\n",
+			i+1, l.label, l.color.R, l.color.G, l.color.B)
+
+		groups := make(map[string][]stroke)
+		var names []string
+		for _, s := range l.strokes {
+			name := s.bucket(opts.GroupBy)
+			if _, ok := groups[name]; !ok {
+				names = append(names, name)
+			}
+			groups[name] = append(groups[name], s)
+		}
+
+		for _, name := range names {
+			if name != "" {
+				fmt.Fprintf(w, `<g id="layer-%d-%s-%s">`+"\n", i+1, opts.GroupBy, name)
+			}
+			for _, s := range groups[name] {
+				fmt.Fprintf(w, `<path d="%s"/>`+"\n", s.path())
+			}
+			if name != "" {
+				fmt.Fprintln(w, "</g>")
+			}
+		}
+		fmt.Fprintln(w, "</g>")
+	}
+	_, err = fmt.Fprintln(w, "</svg>")
+	return err
+}
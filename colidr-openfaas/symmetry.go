@@ -0,0 +1,197 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+// maxSymmetryError is the mean absolute difference (in gray levels) between the image and its
+// mirrored copy, above which no symmetry is detected in auto mode.
+const maxSymmetryError = 24.0
+
+// symmetry holds the mirror axes, as the sum of the mirrored coordinates (x' = v - x and
+// y' = h - y), so the axes can fall between two pixels. A negative value disables the axis.
+type symmetry struct {
+	v, h int
+}
+
+// noSymmetry disables the mirroring.
+var noSymmetry = symmetry{v: -1, h: -1}
+
+// validateSymmetry checks the symmetry mode: v (vertical axis), h (horizontal axis), vh (both) or auto.
+func validateSymmetry(mode string, axis float64) error {
+	switch mode {
+	case "", "v", "h", "vh", "auto":
+	default:
+		return fmt.Errorf("invalid symmetry %q: must be v, h, vh or auto", mode)
+	}
+	if axis < 0 || axis > 1 {
+		return fmt.Errorf("invalid symmetry_axis %v: must be between 0 and 1", axis)
+	}
+	return nil
+}
+
+// resolveSymmetry returns the mirror axes of the grayscale image. The axis position is either
+// provided relative to the image size, or detected as the one the image is the most similar
+// to its mirrored copy around. In auto mode the better of the two axes is used, if any.
+func resolveSymmetry(mode string, axis float64, gray []byte, width, height int) symmetry {
+	sym := noSymmetry
+	locate := func(vertical bool) (int, float64) {
+		size := width
+		if !vertical {
+			size = height
+		}
+		if axis > 0 {
+			s := int(math.Round(2*axis*float64(size))) - 1
+			return s, mirrorError(gray, width, height, s, vertical)
+		}
+		return detectAxis(gray, width, height, vertical)
+	}
+
+	switch mode {
+	case "v":
+		sym.v, _ = locate(true)
+	case "h":
+		sym.h, _ = locate(false)
+	case "vh":
+		sym.v, _ = locate(true)
+		sym.h, _ = locate(false)
+	case "auto":
+		v, errV := locate(true)
+		h, errH := locate(false)
+		switch {
+		case errV <= errH && errV < maxSymmetryError:
+			sym.v = v
+		case errH < errV && errH < maxSymmetryError:
+			sym.h = h
+		}
+	}
+	return sym
+}
+
+// detectAxis searches the axis in the central part of the image, where the image matches
+// its mirrored copy the best, returning the axis with its mean absolute error.
+func detectAxis(gray []byte, width, height int, vertical bool) (int, float64) {
+	size := width
+	if !vertical {
+		size = height
+	}
+	best, bestErr := size-1, math.Inf(1)
+	for s := int(0.6 * float64(size)); s <= int(1.4*float64(size)); s++ {
+		if e := mirrorError(gray, width, height, s, vertical); e < bestErr {
+			best, bestErr = s, e
+		}
+	}
+	return best, bestErr
+}
+
+// mirrorError returns the mean absolute difference of the image and its mirrored copy
+// around the axis, over the overlapping region. The pixels are subsampled for speed.
+func mirrorError(gray []byte, width, height, s int, vertical bool) float64 {
+	var (
+		sum float64
+		n   int
+	)
+	for y := 0; y < height; y += 2 {
+		for x := 0; x < width; x += 2 {
+			mx, my := x, y
+			if vertical {
+				mx = s - x
+			} else {
+				my = s - y
+			}
+			if mx < 0 || mx >= width || my < 0 || my >= height {
+				continue
+			}
+			sum += math.Abs(float64(gray[y*width+x]) - float64(gray[my*width+mx]))
+			n++
+		}
+	}
+	if n == 0 {
+		return math.Inf(1)
+	}
+	return sum / float64(n)
+}
+
+// mirror makes the interleaved pixel data symmetric around the axes. The mirrored pixel
+// pairs are either averaged, or the pixels of the left (top) side are copied over the other side.
+func (sym symmetry) mirror(data []byte, width, height, channels int, average bool) {
+	apply := func(i, j int) {
+		for c := 0; c < channels; c++ {
+			if average {
+				v := (int(data[i+c]) + int(data[j+c]) + 1) / 2
+				data[i+c], data[j+c] = byte(v), byte(v)
+			} else {
+				data[j+c] = data[i+c]
+			}
+		}
+	}
+	if sym.v >= 0 {
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if mx := sym.v - x; mx > x && mx < width {
+					apply((y*width+x)*channels, (y*width+mx)*channels)
+				}
+			}
+		}
+	}
+	if sym.h >= 0 {
+		for y := 0; y < height; y++ {
+			if my := sym.h - y; my > y && my < height {
+				for x := 0; x < width; x++ {
+					apply((y*width+x)*channels, (my*width+x)*channels)
+				}
+			}
+		}
+	}
+}
+
+// mirrorMat returns the symmetric copy of the 8 bit matrix.
+func (sym symmetry) mirrorMat(src gocv.Mat, average bool) (gocv.Mat, error) {
+	data := src.ToBytes()
+	sym.mirror(data, src.Cols(), src.Rows(), src.Channels(), average)
+	return newMatFromBytes(src.Rows(), src.Cols(), src.Type(), data)
+}
+
+// symmetrize enforces the symmetry of the generated lines, resolving the axes
+// from the source image on the first call.
+func (c *Cld) symmetrize() {
+	if c.symmetry == "" {
+		return
+	}
+	if c.sym == nil {
+		sym := resolveSymmetry(c.symmetry, c.symmetryAxis, c.image.ToBytes(), c.image.Cols(), c.image.Rows())
+		c.sym = &sym
+	}
+	if *c.sym == noSymmetry {
+		return
+	}
+	if res, err := c.sym.mirrorMat(c.result, false); err == nil {
+		closeMat(&c.result)
+		c.result = res
+	}
+}
@@ -0,0 +1,169 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package synth generates synthetic grayscale images with known analytic edge structures,
+// like circles, gratings and checkerboards, optionally corrupted by noise at a controlled
+// signal-to-noise ratio. They are meant as inputs for validating and benchmarking the
+// line drawing, since the expected edge locations can be computed exactly.
+package synth
+
+import (
+	"image"
+	"math"
+	"math/rand"
+)
+
+// Pattern is a synthetic image with analytically known edges.
+type Pattern interface {
+	// Render rasterizes the pattern into an image of the provided size.
+	Render(width, height int) *image.Gray
+	// EdgeDistance returns the distance of the point from the nearest edge of the pattern.
+	EdgeDistance(x, y float64) float64
+}
+
+// Circle is a filled disk on a uniform background.
+type Circle struct {
+	CX, CY, Radius float64
+	// Fg and Bg are the intensities of the disk and the background.
+	Fg, Bg uint8
+}
+
+// Render draws the disk, the pixels crossed by the edge being antialiased by supersampling.
+func (c Circle) Render(width, height int) *image.Gray {
+	return render(width, height, func(x, y float64) float64 {
+		if math.Hypot(x-c.CX, y-c.CY) <= c.Radius {
+			return float64(c.Fg)
+		}
+		return float64(c.Bg)
+	})
+}
+
+// EdgeDistance returns the distance of the point from the circle outline.
+func (c Circle) EdgeDistance(x, y float64) float64 {
+	return math.Abs(math.Hypot(x-c.CX, y-c.CY) - c.Radius)
+}
+
+// Grating is a square wave grating with alternating dark and light stripes.
+type Grating struct {
+	// Period is the width of a dark and a light stripe together, in pixels.
+	Period float64
+	// Angle is the orientation of the stripes in radians, 0 meaning vertical stripes.
+	Angle  float64
+	Fg, Bg uint8
+}
+
+// phase returns the position of the point across the stripes, in periods.
+func (g Grating) phase(x, y float64) float64 {
+	return (x*math.Cos(g.Angle) + y*math.Sin(g.Angle)) / g.Period
+}
+
+// Render draws the grating.
+func (g Grating) Render(width, height int) *image.Gray {
+	return render(width, height, func(x, y float64) float64 {
+		if p := g.phase(x, y); p-math.Floor(p) < 0.5 {
+			return float64(g.Fg)
+		}
+		return float64(g.Bg)
+	})
+}
+
+// EdgeDistance returns the distance of the point from the nearest stripe boundary.
+func (g Grating) EdgeDistance(x, y float64) float64 {
+	p := 2 * g.phase(x, y)
+	return math.Abs(p-math.Floor(p+0.5)) * g.Period / 2
+}
+
+// Checkerboard is a board of alternating square cells.
+type Checkerboard struct {
+	// Size is the side of the cells, in pixels.
+	Size   float64
+	Fg, Bg uint8
+}
+
+// Render draws the checkerboard.
+func (cb Checkerboard) Render(width, height int) *image.Gray {
+	return render(width, height, func(x, y float64) float64 {
+		if (int(math.Floor(x/cb.Size))+int(math.Floor(y/cb.Size)))%2 == 0 {
+			return float64(cb.Fg)
+		}
+		return float64(cb.Bg)
+	})
+}
+
+// EdgeDistance returns the distance of the point from the nearest cell boundary.
+func (cb Checkerboard) EdgeDistance(x, y float64) float64 {
+	dx := math.Abs(x/cb.Size-math.Floor(x/cb.Size+0.5)) * cb.Size
+	dy := math.Abs(y/cb.Size-math.Floor(y/cb.Size+0.5)) * cb.Size
+	return math.Min(dx, dy)
+}
+
+// supersampling is the number of samples per pixel side used for antialiasing the edges.
+const supersampling = 4
+
+// render rasterizes the intensity function, averaging the samples taken inside every pixel.
+func render(width, height int, f func(x, y float64) float64) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var sum float64
+			for sy := 0; sy < supersampling; sy++ {
+				for sx := 0; sx < supersampling; sx++ {
+					sum += f(float64(x)+(float64(sx)+0.5)/supersampling, float64(y)+(float64(sy)+0.5)/supersampling)
+				}
+			}
+			img.Pix[y*img.Stride+x] = uint8(math.Round(sum / (supersampling * supersampling)))
+		}
+	}
+	return img
+}
+
+// AddNoise returns a copy of the image corrupted by additive white Gaussian noise, with the
+// signal-to-noise ratio given in decibels, relative to the variance of the image. The noise
+// is generated from the seed, so the results are reproducible.
+func AddNoise(img *image.Gray, snr float64, seed int64) *image.Gray {
+	b := img.Bounds()
+	dst := image.NewGray(b)
+
+	var mean, variance float64
+	n := float64(b.Dx() * b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			mean += float64(img.GrayAt(x, y).Y) / n
+		}
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			d := float64(img.GrayAt(x, y).Y) - mean
+			variance += d * d / n
+		}
+	}
+	sigma := math.Sqrt(variance / math.Pow(10, snr/10))
+
+	rnd := rand.New(rand.NewSource(seed))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			v := float64(img.GrayAt(x, y).Y) + rnd.NormFloat64()*sigma
+			dst.Pix[dst.PixOffset(x, y)] = uint8(math.Max(0, math.Min(255, math.Round(v))))
+		}
+	}
+	return dst
+}
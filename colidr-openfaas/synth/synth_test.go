@@ -0,0 +1,114 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package synth
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestRenderFollowsEdgeDistance(t *testing.T) {
+	const size = 64
+	patterns := map[string]Pattern{
+		"circle":       Circle{CX: 30.3, CY: 33.1, Radius: 17.4, Fg: 32, Bg: 224},
+		"grating":      Grating{Period: 10, Angle: 0.7, Fg: 32, Bg: 224},
+		"checkerboard": Checkerboard{Size: 7.5, Fg: 32, Bg: 224},
+	}
+	for name, p := range patterns {
+		img := p.Render(size, size)
+		if b := img.Bounds(); b.Dx() != size || b.Dy() != size {
+			t.Fatalf("%s: rendered %v", name, b)
+		}
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				v := img.GrayAt(x, y).Y
+				// The pixels away from the edges are uniform, the antialiased ones lie in between.
+				if p.EdgeDistance(float64(x)+0.5, float64(y)+0.5) > 1 {
+					if v != 32 && v != 224 {
+						t.Fatalf("%s: pixel %d,%d away from the edges is %d", name, x, y, v)
+					}
+				} else if v < 32 || v > 224 {
+					t.Fatalf("%s: edge pixel %d,%d is %d", name, x, y, v)
+				}
+			}
+		}
+	}
+}
+
+func TestEdgeDistance(t *testing.T) {
+	c := Circle{CX: 10, CY: 10, Radius: 5}
+	for _, tt := range []struct{ x, y, want float64 }{{15, 10, 0}, {10, 10, 5}, {10, 18, 3}} {
+		if d := c.EdgeDistance(tt.x, tt.y); math.Abs(d-tt.want) > 1e-9 {
+			t.Errorf("circle edge distance at %v,%v: %v, expected %v", tt.x, tt.y, d, tt.want)
+		}
+	}
+	g := Grating{Period: 10}
+	for _, tt := range []struct{ x, want float64 }{{0, 0}, {5, 0}, {2.5, 2.5}, {7, 2}} {
+		if d := g.EdgeDistance(tt.x, 3); math.Abs(d-tt.want) > 1e-9 {
+			t.Errorf("grating edge distance at %v: %v, expected %v", tt.x, d, tt.want)
+		}
+	}
+	cb := Checkerboard{Size: 8}
+	for _, tt := range []struct{ x, y, want float64 }{{8, 3, 0}, {4, 4, 4}, {10, 5, 2}} {
+		if d := cb.EdgeDistance(tt.x, tt.y); math.Abs(d-tt.want) > 1e-9 {
+			t.Errorf("checkerboard edge distance at %v,%v: %v, expected %v", tt.x, tt.y, d, tt.want)
+		}
+	}
+}
+
+// snr returns the signal-to-noise ratio of the noisy image in decibels.
+func snr(clean, noisy *image.Gray) float64 {
+	var mean, signal, noise float64
+	n := float64(len(clean.Pix))
+	for _, v := range clean.Pix {
+		mean += float64(v) / n
+	}
+	for i, v := range clean.Pix {
+		d := float64(v) - mean
+		signal += d * d
+		e := float64(noisy.Pix[i]) - float64(v)
+		noise += e * e
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+func TestAddNoise(t *testing.T) {
+	clean := Checkerboard{Size: 16, Fg: 64, Bg: 192}.Render(256, 256)
+	for _, want := range []float64{5, 10, 20} {
+		noisy := AddNoise(clean, want, 1)
+		if got := snr(clean, noisy); math.Abs(got-want) > 0.5 {
+			t.Errorf("SNR %.2f dB, expected %v dB", got, want)
+		}
+	}
+
+	a, b := AddNoise(clean, 10, 7), AddNoise(clean, 10, 7)
+	for i := range a.Pix {
+		if a.Pix[i] != b.Pix[i] {
+			t.Fatal("the noise of the same seed differs")
+		}
+	}
+	if c := AddNoise(clean, 10, 8); string(c.Pix) == string(a.Pix) {
+		t.Error("the noise of different seeds is the same")
+	}
+}
@@ -0,0 +1,286 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// telegramAPI is the Telegram Bot API endpoint.
+const telegramAPI = "https://api.telegram.org"
+
+// defaultTelegramStateDir is where the per chat parameters are persisted between the invocations.
+const defaultTelegramStateDir = "/tmp/colidr-telegram"
+
+// telegramUpdate is the subset of the Telegram update object used by the bot.
+type telegramUpdate struct {
+	Message *struct {
+		MessageID int64 `json:"message_id"`
+		Chat      struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text    string `json:"text"`
+		Caption string `json:"caption"`
+		Photo   []struct {
+			FileID string `json:"file_id"`
+			Width  int    `json:"width"`
+			Height int    `json:"height"`
+		} `json:"photo"`
+		Document *struct {
+			FileID   string `json:"file_id"`
+			MimeType string `json:"mime_type"`
+		} `json:"document"`
+	} `json:"message"`
+}
+
+// telegramBot handles the updates received through the Telegram webhook.
+type telegramBot struct {
+	token    string
+	stateDir string
+}
+
+// verifyTelegramRequest checks the secret token the webhook was registered with. The updates are
+// refused when the secret is not configured, since anyone could post as Telegram otherwise.
+func verifyTelegramRequest(ctx *RequestContext) error {
+	secret := readSecret("telegram-webhook-secret")
+	if secret == "" {
+		return errors.New("the telegram webhook secret is not configured")
+	}
+	token := ctx.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(token)) != 1 {
+		return errors.New("invalid telegram secret token")
+	}
+	return nil
+}
+
+// handleTelegram processes the photos sent to the bot, using the parameters configured
+// for the chat through the inline commands (like /tau 0.9) or provided in the photo caption.
+func handleTelegram(ctx *RequestContext) string {
+	var update telegramUpdate
+	if err := json.Unmarshal(ctx.Body, &update); err != nil {
+		return fmt.Sprintf("unable to decode the telegram update: %v", err)
+	}
+	if update.Message == nil {
+		return "ok"
+	}
+
+	bot := &telegramBot{token: readSecret("telegram-bot-token"), stateDir: defaultTelegramStateDir}
+	if val, exists := os.LookupEnv("telegram_state_dir"); exists && val != "" {
+		bot.stateDir = val
+	}
+
+	msg := update.Message
+	chatID := msg.Chat.ID
+
+	var fileID string
+	switch {
+	case len(msg.Photo) > 0:
+		// The photo sizes are sorted ascending, the last one being the original.
+		fileID = msg.Photo[len(msg.Photo)-1].FileID
+	case msg.Document != nil && isSupportedImage(msg.Document.MimeType):
+		fileID = msg.Document.FileID
+	default:
+		if reply := bot.command(chatID, msg.Text); reply != "" {
+			if err := bot.sendMessage(chatID, reply); err != nil {
+				return fmt.Sprintf("unable to send the telegram message: %v", err)
+			}
+		}
+		return "ok"
+	}
+
+	params := bot.loadParams(chatID)
+	if err := applyCommands(params, msg.Caption); err != nil {
+		bot.sendMessage(chatID, err.Error())
+		return "ok"
+	}
+
+	data, err := bot.downloadFile(fileID)
+	if err != nil {
+		return fmt.Sprintf("unable to download the telegram photo: %v", err)
+	}
+	res, err := process(data, params, "image")
+	if err != nil {
+		bot.sendMessage(chatID, err.Error())
+		return "ok"
+	}
+
+	fields := map[string]string{
+		"chat_id":             strconv.FormatInt(chatID, 10),
+		"reply_to_message_id": strconv.FormatInt(msg.MessageID, 10),
+	}
+	if err := postMultipart(bot.endpoint("sendPhoto"), nil, fields, "photo", "cld.jpg", res); err != nil {
+		return fmt.Sprintf("unable to send the telegram photo: %v", err)
+	}
+	return "ok"
+}
+
+// command executes the inline commands, returning the reply sent back to the chat.
+func (bot *telegramBot) command(chatID int64, text string) string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") {
+		return ""
+	}
+	// Commands in group chats can be suffixed with the bot name, like /tau@bot.
+	name := strings.Split(strings.Fields(text)[0], "@")[0]
+
+	switch name {
+	case "/start", "/help":
+		return "Send me a photo and I will reply with its coherent line drawing.\n" +
+			"Tune the parameters with commands like /tau 0.99 or /sr 2.9, " +
+			"list them with /params and restore the defaults with /reset. " +
+			"The commands can be provided in the photo caption as well."
+	case "/reset":
+		if err := bot.saveParams(chatID, url.Values{}); err != nil {
+			return err.Error()
+		}
+		return "The parameters have been reset to the defaults."
+	case "/params":
+		params := bot.loadParams(chatID)
+		if len(params) == 0 {
+			return "Using the default parameters."
+		}
+		keys := make([]string, 0, len(params))
+		for k := range params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		lines := make([]string, len(keys))
+		for i, k := range keys {
+			lines[i] = fmt.Sprintf("%s = %s", k, params.Get(k))
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	params := bot.loadParams(chatID)
+	if err := applyCommands(params, text); err != nil {
+		return err.Error()
+	}
+	if err := bot.saveParams(chatID, params); err != nil {
+		return err.Error()
+	}
+	return "Parameters updated."
+}
+
+// applyCommands parses the "/name value" pairs into the parameters,
+// validating them against the parameters accepted by the function.
+func applyCommands(params url.Values, text string) error {
+	fields := strings.Fields(text)
+	for i := 0; i < len(fields); i++ {
+		if !strings.HasPrefix(fields[i], "/") {
+			continue
+		}
+		name := strings.TrimPrefix(strings.Split(fields[i], "@")[0], "/")
+		if i+1 >= len(fields) {
+			return fmt.Errorf("missing value for /%s", name)
+		}
+		i++
+		params.Set(name, fields[i])
+	}
+	if _, err := parseParams(params); err != nil {
+		return err
+	}
+	return nil
+}
+
+// loadParams returns the parameters stored for the chat.
+func (bot *telegramBot) loadParams(chatID int64) url.Values {
+	data, err := ioutil.ReadFile(bot.stateFile(chatID))
+	if err != nil {
+		return url.Values{}
+	}
+	params, err := url.ParseQuery(string(data))
+	if err != nil {
+		return url.Values{}
+	}
+	return params
+}
+
+// saveParams persists the chat parameters.
+func (bot *telegramBot) saveParams(chatID int64, params url.Values) error {
+	if err := os.MkdirAll(bot.stateDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(bot.stateFile(chatID), []byte(params.Encode()), 0600)
+}
+
+func (bot *telegramBot) stateFile(chatID int64) string {
+	return filepath.Join(bot.stateDir, fmt.Sprintf("%d", chatID))
+}
+
+func (bot *telegramBot) endpoint(method string) string {
+	return fmt.Sprintf("%s/bot%s/%s", telegramAPI, bot.token, method)
+}
+
+// downloadFile resolves the file path of the uploaded photo and downloads it.
+func (bot *telegramBot) downloadFile(fileID string) ([]byte, error) {
+	resp, err := chatClient.Get(bot.endpoint("getFile") + "?file_id=" + url.QueryEscape(fileID))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		OK     bool `json:"ok"`
+		Result struct {
+			FilePath string `json:"file_path"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if !res.OK {
+		return nil, fmt.Errorf("unable to resolve the file %s", fileID)
+	}
+	return downloadImage(fmt.Sprintf("%s/file/bot%s/%s", telegramAPI, bot.token, res.Result.FilePath), nil)
+}
+
+// sendMessage sends a text message to the chat.
+func (bot *telegramBot) sendMessage(chatID int64, text string) error {
+	body, err := json.Marshal(map[string]interface{}{"chat_id": chatID, "text": text})
+	if err != nil {
+		return err
+	}
+	resp, err := chatClient.Post(bot.endpoint("sendMessage"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
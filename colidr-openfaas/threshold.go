@@ -0,0 +1,121 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"math"
+	"sort"
+)
+
+// threshold returns the tau used for thresholding the flow DoG response. When tau is expressed
+// as a percentile, it is resolved from the distribution of the response, which keeps the amount
+// of lines stable across images with different contrast. With tau=auto it is picked by Otsu's
+// method instead. The resolved value is stored back
+// into the options, so the later passes (and the retries) use it as absolute value.
+func (c *Cld) threshold(src matrix) float32 {
+	if c.norm != nil {
+		// The bands of the low memory mode use the thresholds of the whole image.
+		if t, ok := c.norm.threshold(); ok {
+			c.tau = t
+		}
+		return c.tau
+	}
+	if c.tauPercentile > 0 {
+		// The lines are the pixels with the lowest response, so tau_pct=85 keeps the 15% strongest edges.
+		c.tau = responsePercentile(c.arena, src, 100-c.tauPercentile)
+	} else if c.autoTau {
+		c.tau = otsuThreshold(src)
+	}
+	return c.tau
+}
+
+// responsePercentile returns the value below which the requested percentage of the matrix values fall.
+// The values are sorted in a buffer of the arena.
+func responsePercentile(a *arena, src matrix, pct float64) float32 {
+	rows, cols := src.Rows(), src.Cols()
+	values := a.float32s(rows * cols)[:0]
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			values = append(values, src.GetFloatAt(y, x))
+		}
+	}
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	idx := int(math.Ceil(pct / 100 * float64(len(values))))
+	if idx >= len(values) {
+		idx = len(values) - 1
+	}
+	return values[idx]
+}
+
+// otsuBins is the number of histogram bins used by Otsu's method.
+const otsuBins = 256
+
+// otsuThreshold returns the threshold maximizing the between-class variance of the values
+// of the matrix, which are expected in the [0, 1] range, like the normalized flow DoG response.
+func otsuThreshold(src matrix) float32 {
+	var hist [otsuBins]float64
+	rows, cols := src.Rows(), src.Cols()
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			v := float64(src.GetFloatAt(y, x))
+			if math.IsNaN(v) {
+				continue
+			}
+			v = math.Max(0, math.Min(1, v))
+			hist[int(v*(otsuBins-1)+0.5)]++
+		}
+	}
+	return otsuLevel(&hist)
+}
+
+// otsuLevel returns the Otsu threshold of the histogram of the values in the [0, 1] range.
+func otsuLevel(hist *[otsuBins]float64) float32 {
+	var total, sum float64
+	for i, n := range hist {
+		total += n
+		sum += float64(i) * n
+	}
+
+	var (
+		bgCount, bgSum float64
+		best, maxVar   float64
+	)
+	for i, n := range hist {
+		bgCount += n
+		bgSum += float64(i) * n
+		fgCount := total - bgCount
+		if bgCount == 0 || fgCount == 0 {
+			continue
+		}
+		meanBg, meanFg := bgSum/bgCount, (sum-bgSum)/fgCount
+		if v := bgCount * fgCount * (meanBg - meanFg) * (meanBg - meanFg); v > maxVar {
+			maxVar, best = v, float64(i)
+		}
+	}
+	// The pixels below tau become lines, so the threshold is placed at the upper edge of the lower class bin.
+	return float32((best + 0.5) / (otsuBins - 1))
+}
@@ -0,0 +1,320 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// minTileSize is the minimum tile edge of the distributed rendering.
+const minTileSize = 128
+
+// tileClient invokes the tile renderings through the OpenFaaS gateway.
+var tileClient = &http.Client{Timeout: 5 * time.Minute}
+
+// tileBlendLevels is the number of the weight levels of the cross-fade between the neighbouring tiles.
+const tileBlendLevels = 16
+
+// tileAttempts is the number of the attempts of a tile rendering, retrying on the transient failures.
+const tileAttempts = 3
+
+// defaultTileSize returns the tile edge of the coordinator mode, set through the tile_size
+// environment variable. Zero renders the images locally.
+func defaultTileSize() int {
+	if v, err := strconv.Atoi(os.Getenv("tile_size")); err == nil && v > 0 {
+		return v
+	}
+	return 0
+}
+
+// tileGateway returns the base URL of the sub-invocations, set through the gateway_url environment variable.
+func tileGateway() string {
+	if url := os.Getenv("gateway_url"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return "http://gateway.openfaas:8080"
+}
+
+// tileFunction returns the name of the function rendering the tiles, set through tile_function.
+func tileFunction() string {
+	if name := os.Getenv("tile_function"); name != "" {
+		return name
+	}
+	return "colidr"
+}
+
+// tileConcurrency returns the number of the tiles rendered at a time, set through tile_concurrency.
+func tileConcurrency() int {
+	if v, err := strconv.Atoi(os.Getenv("tile_concurrency")); err == nil && v > 0 {
+		return v
+	}
+	return 4
+}
+
+// tiled reports whether the request is rendered in distributed tiles. The features working on
+// the whole image, the traced outputs and the animations are rendered by a single replica.
+func (rp *requestParams) tiled(output string) bool {
+	if rp.tileSize == 0 || (output != "image" && output != "json_image") {
+		return false
+	}
+	switch rp.encoderFormat() {
+	case "svg", "gcode", "dst", "ascii", "apng":
+		return false
+	}
+	return !rp.wholeImage() && rp.opts.symmetry == ""
+}
+
+// tileParams returns the query parameters of the tile sub-invocations. The tiles are transformed
+// already and rendered as lossless PNG, while the print, the color management and the content
+// credentials are applied once on the stitched image.
+func tileParams(rp *requestParams) string {
+	values := exportRecipe(rp).values()
+	values.Del("t")
+	values.Set("format", "png")
+	values.Set("output", "image")
+	values.Set("tile_size", "0")
+	values.Set("band_rows", "0")
+	values.Set("blank_threshold", "0")
+	for _, name := range []string{"icc", "embed_icc", "print", "c2pa", "iptc", "retry"} {
+		values.Set(name, "false")
+	}
+	return values.Encode()
+}
+
+// renderTiles renders the source image in square tiles of the tile_size edge, fanned out as
+// sub-invocations of the tile function through the gateway, then stitches the returned tiles.
+// Each tile is extended by the margin of the banded processing. Since every tile is normalized
+// and thresholded on its own, the neighbouring tiles are cross-faded over the half of the margin
+// around their shared borders, so no seams show. The images fitting in a single tile are rendered locally.
+func renderTiles(data []byte, rp *requestParams, output string) ([]byte, error) {
+	src, err := decodeMat(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize CLD: %v", err)
+	}
+	defer closeMat(&src)
+	if len(rp.opts.transforms) > 0 {
+		transformed, err := applyTransforms(src, rp.opts.transforms)
+		if err != nil {
+			return nil, err
+		}
+		closeMat(&src)
+		src = transformed
+	}
+	// The sizes relative to the image are resolved for the whole image, not for the tiles.
+	rp.opts = rp.opts.resolveSizes(src.Cols(), src.Rows())
+
+	opts := rp.opts
+	opts.transforms = nil
+	size := rp.tileSize
+	rows, cols := src.Rows(), src.Cols()
+	if rows <= size && cols <= size {
+		cld, err := NewCLDFromMat(src, opts)
+		if err != nil {
+			return nil, err
+		}
+		defer cld.Close()
+		return render(cld, rp, output, time.Now())
+	}
+
+	gray := newMat()
+	defer closeMat(&gray)
+	if src.Channels() == 1 {
+		src.CopyTo(gray)
+	} else {
+		gocv.CvtColor(src, gray, gocv.ColorBGRToGray)
+	}
+	if err := checkBlank(gray, opts.blankThreshold); err != nil {
+		return nil, err
+	}
+
+	var (
+		tiles  []image.Rectangle
+		margin = bandMargin(opts)
+		bounds = image.Rect(0, 0, cols, rows)
+		params = tileParams(rp)
+		blend  = maxInt(1, minInt(margin, size)/2)
+		// acc accumulates the weighted tiles, the weights of every pixel summing up to tileBlendLevels².
+		acc = make([]uint16, rows*cols)
+	)
+	for y := 0; y < rows; y += size {
+		for x := 0; x < cols; x += size {
+			tiles = append(tiles, image.Rect(x, y, x+size, y+size).Intersect(bounds))
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, tileConcurrency())
+	)
+	for _, tile := range tiles {
+		outer := tile.Inset(-margin).Intersect(bounds)
+		region := trackMat(src.Region(outer))
+		encoded, err := gocv.IMEncode(".png", region)
+		closeMat(&region)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode the tile %v: %v", tile, err)
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(tile, outer image.Rectangle, encoded []byte) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			img, err := renderTile(encoded, params, outer.Size())
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("cannot render the tile %v: %v", tile, err)
+				}
+				return
+			}
+			// The tile covers its inner part, fading in and out over the borders shared with the neighbouring tiles.
+			offset := outer.Min
+			for y := outer.Min.Y; y < outer.Max.Y; y++ {
+				wy := blendWeight(y, tile.Min.Y, tile.Max.Y, rows, blend)
+				if wy == 0 {
+					continue
+				}
+				for x := outer.Min.X; x < outer.Max.X; x++ {
+					if wx := blendWeight(x, tile.Min.X, tile.Max.X, cols, blend); wx > 0 {
+						pix := img.Pix[(y-offset.Y)*img.Stride+x-offset.X]
+						acc[y*cols+x] += uint16(wx * wy * int(pix))
+					}
+				}
+			}
+		}(tile, outer, encoded)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	result := image.NewGray(bounds)
+	for i, v := range acc {
+		result.Pix[i] = uint8((int(v) + tileBlendLevels*tileBlendLevels/2) / (tileBlendLevels * tileBlendLevels))
+	}
+
+	return encodeOutput(EncodeSource{Image: result}, rp, output)
+}
+
+// blendWeight returns the weight of the tile spanning [lo, hi) of the [0, n) axis at p. The weight
+// ramps over the blend pixels on both sides of the borders shared with the neighbouring tiles,
+// so the weights of the neighbouring tiles sum up to tileBlendLevels.
+func blendWeight(p, lo, hi, n, blend int) int {
+	ramp := func(border int) int {
+		t := (float64(p-border+blend) + 0.5) / float64(2*blend)
+		return int(math.Max(0, math.Min(1, t))*tileBlendLevels + 0.5)
+	}
+	w := tileBlendLevels
+	if lo > 0 {
+		w = minInt(w, ramp(lo))
+	}
+	if hi < n {
+		w = minInt(w, tileBlendLevels-ramp(hi))
+	}
+	return w
+}
+
+// renderTile sends the encoded tile to the tile function and decodes the returned drawing,
+// retrying on the network errors and on the 429 and 5xx responses.
+func renderTile(tile []byte, params string, size image.Point) (*image.Gray, error) {
+	url := fmt.Sprintf("%s/function/%s?%s", tileGateway(), tileFunction(), params)
+
+	var err error
+	for attempt := 0; attempt < tileAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var (
+			body  []byte
+			retry bool
+		)
+		if body, retry, err = postTile(url, tile); err != nil {
+			if retry {
+				continue
+			}
+			return nil, err
+		}
+
+		img, err := png.Decode(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode the rendered tile: %v", err)
+		}
+		if img.Bounds().Size() != size {
+			return nil, fmt.Errorf("rendered tile size %v does not match %v", img.Bounds().Size(), size)
+		}
+		gray := image.NewGray(image.Rectangle{Max: size})
+		for y := 0; y < size.Y; y++ {
+			for x := 0; x < size.X; x++ {
+				gray.Set(x, y, img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y+y))
+			}
+		}
+		return gray, nil
+	}
+	return nil, err
+}
+
+// postTile posts the tile to the tile function, reporting whether the failure is worth a retry.
+func postTile(url string, tile []byte) ([]byte, bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(tile))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "image/png")
+	if key := readSecret("api-key"); key != "" {
+		req.Header.Set("X-Api-Key", key)
+	}
+
+	res, err := tileClient.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		retry := res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+		return nil, retry, fmt.Errorf("tile function returned %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	return body, err != nil, err
+}
@@ -0,0 +1,229 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+// transform is a geometric operation applied on the source image before processing.
+type transform struct {
+	op   string
+	args []string
+}
+
+// parseTransforms parses the transform list, like "crop:10,10,800,600;rot:90;fit:1024".
+// The supported operations are:
+//
+//	crop:x,y,w,h   crops the region, clamped to the image bounds
+//	rot:deg        rotates clockwise by a multiple of 90 degrees
+//	flip:h|v       mirrors the image horizontally or vertically
+//	fit:n          scales down the image to fit into a n×n box, keeping the aspect ratio
+//	resize:w,h     resizes the image, a zero dimension keeping the aspect ratio
+func parseTransforms(spec string) ([]transform, error) {
+	var transforms []transform
+	for _, step := range strings.Split(spec, ";") {
+		step = strings.TrimSpace(step)
+		if step == "" {
+			continue
+		}
+		parts := strings.SplitN(step, ":", 2)
+		t := transform{op: strings.ToLower(parts[0])}
+		if len(parts) == 2 {
+			t.args = strings.Split(parts[1], ",")
+		}
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("invalid transform %q: %v", step, err)
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, nil
+}
+
+// formatTransforms returns the transform list in the format accepted by parseTransforms.
+func formatTransforms(transforms []transform) string {
+	steps := make([]string, len(transforms))
+	for i, t := range transforms {
+		steps[i] = t.op
+		if len(t.args) > 0 {
+			steps[i] += ":" + strings.Join(t.args, ",")
+		}
+	}
+	return strings.Join(steps, ";")
+}
+
+// ints returns the arguments of the transform as integers.
+func (t transform) ints() ([]int, error) {
+	vals := make([]int, len(t.args))
+	for i, a := range t.args {
+		v, err := strconv.Atoi(strings.TrimSpace(a))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", a)
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// validate checks the operation and the number and range of its arguments.
+func (t transform) validate() error {
+	if t.op == "flip" {
+		if len(t.args) != 1 || (t.args[0] != "h" && t.args[0] != "v") {
+			return fmt.Errorf("flip expects h or v")
+		}
+		return nil
+	}
+	vals, err := t.ints()
+	if err != nil {
+		return err
+	}
+	switch t.op {
+	case "crop":
+		if len(vals) != 4 || vals[0] < 0 || vals[1] < 0 || vals[2] <= 0 || vals[3] <= 0 {
+			return fmt.Errorf("crop expects x,y,width,height")
+		}
+	case "rot":
+		if len(vals) != 1 || vals[0]%90 != 0 {
+			return fmt.Errorf("rot expects a multiple of 90 degrees")
+		}
+	case "fit":
+		if len(vals) != 1 || vals[0] <= 0 {
+			return fmt.Errorf("fit expects a positive size")
+		}
+	case "resize":
+		if len(vals) != 2 || vals[0] < 0 || vals[1] < 0 || vals[0]+vals[1] == 0 {
+			return fmt.Errorf("resize expects width,height")
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", t.op)
+	}
+	return nil
+}
+
+// applyTransforms applies the transforms in order and returns the resulting matrix,
+// which has to be closed by the caller. The source matrix is left unchanged.
+func applyTransforms(src gocv.Mat, transforms []transform) (gocv.Mat, error) {
+	dst := cloneMat(src)
+	for _, t := range transforms {
+		res, err := t.apply(dst)
+		closeMat(&dst)
+		if err != nil {
+			return gocv.Mat{}, err
+		}
+		dst = res
+	}
+	return dst, nil
+}
+
+// apply returns the transformed copy of the matrix.
+func (t transform) apply(src gocv.Mat) (gocv.Mat, error) {
+	if t.op == "flip" {
+		return remapMat(src, src.Cols(), src.Rows(), func(x, y int) (int, int) {
+			if t.args[0] == "h" {
+				return src.Cols() - 1 - x, y
+			}
+			return x, src.Rows() - 1 - y
+		})
+	}
+	vals, _ := t.ints()
+	rows, cols := src.Rows(), src.Cols()
+
+	switch t.op {
+	case "crop":
+		rect := image.Rect(vals[0], vals[1], vals[0]+vals[2], vals[1]+vals[3]).Intersect(image.Rect(0, 0, cols, rows))
+		if rect.Empty() {
+			return gocv.Mat{}, newError(ErrInvalidInput, "the crop region is outside of the %dx%d image", cols, rows)
+		}
+		region := trackMat(src.Region(rect))
+		defer closeMat(&region)
+		return cloneMat(region), nil
+	case "rot":
+		switch (vals[0]%360 + 360) % 360 {
+		case 90:
+			return remapMat(src, rows, cols, func(x, y int) (int, int) { return y, rows - 1 - x })
+		case 180:
+			return remapMat(src, cols, rows, func(x, y int) (int, int) { return cols - 1 - x, rows - 1 - y })
+		case 270:
+			return remapMat(src, rows, cols, func(x, y int) (int, int) { return cols - 1 - y, x })
+		}
+		return cloneMat(src), nil
+	case "fit":
+		if cols <= vals[0] && rows <= vals[0] {
+			return cloneMat(src), nil
+		}
+		scale := float64(vals[0]) / float64(cols)
+		if rows > cols {
+			scale = float64(vals[0]) / float64(rows)
+		}
+		return resizeMat(src, int(float64(cols)*scale+0.5), int(float64(rows)*scale+0.5)), nil
+	case "resize":
+		width, height := vals[0], vals[1]
+		if width == 0 {
+			width = int(float64(cols)*float64(height)/float64(rows) + 0.5)
+		}
+		if height == 0 {
+			height = int(float64(rows)*float64(width)/float64(cols) + 0.5)
+		}
+		return resizeMat(src, width, height), nil
+	}
+	return gocv.Mat{}, fmt.Errorf("unknown operation %q", t.op)
+}
+
+// resizeMat returns the resized copy of the matrix, using area interpolation for the downscaling.
+func resizeMat(src gocv.Mat, width, height int) gocv.Mat {
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	interp := gocv.InterpolationFlags(gocv.InterpolationLinear)
+	if width < src.Cols() {
+		interp = gocv.InterpolationArea
+	}
+	dst := newMat()
+	gocv.Resize(src, &dst, image.Point{width, height}, 0, 0, interp)
+	return dst
+}
+
+// remapMat builds a matrix of the provided size, taking every pixel from the source position
+// returned by the mapping. It implements the lossless rotations and flips, which the OpenCV
+// bindings don't provide.
+func remapMat(src gocv.Mat, width, height int, from func(x, y int) (int, int)) (gocv.Mat, error) {
+	ch := src.Channels()
+	data := src.ToBytes()
+	out := make([]byte, len(data))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sx, sy := from(x, y)
+			si := (sy*src.Cols() + sx) * ch
+			copy(out[(y*width+x)*ch:(y*width+x+1)*ch], data[si:si+ch])
+		}
+	}
+	return newMatFromBytes(height, width, src.Type(), out)
+}
@@ -0,0 +1,105 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+
+	"gocv.io/x/gocv"
+)
+
+// truncatedInputError is returned for the JPEG images which end before the end of image marker.
+type truncatedInputError struct {
+	size int
+}
+
+func (e *truncatedInputError) Error() string {
+	return fmt.Sprintf("truncated input: the JPEG data ends after %d bytes without the end of image marker", e.size)
+}
+
+// isTruncatedJPEG reports whether the data is a JPEG image missing its end of image marker.
+// The trailing padding bytes, added by some encoders after the marker, are ignored.
+func isTruncatedJPEG(data []byte) bool {
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return false
+	}
+	end := bytes.TrimRight(data, "\x00")
+	return !bytes.HasSuffix(end, []byte{0xFF, 0xD9})
+}
+
+// salvageJPEG performs a best-effort decode of the truncated JPEG image and returns the
+// successfully decoded region PNG encoded. The decoder fills the missing blocks with
+// uniform gray, so the uniform rows at the bottom of the image are trimmed.
+func salvageJPEG(data []byte) ([]byte, error) {
+	tmpfile, err := ioutil.TempFile("/tmp", "truncated")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	// Terminate the stream, so the decoder reaches the end of image.
+	patched := append(append([]byte(nil), data...), 0xFF, 0xD9)
+	if _, err := tmpfile.Write(patched); err != nil {
+		tmpfile.Close()
+		return nil, fmt.Errorf("unable to write the temporary file: %v", err)
+	}
+	tmpfile.Close()
+
+	img := imRead(tmpfile.Name(), gocv.IMReadColor)
+	if img.Empty() {
+		closeMat(&img)
+		return nil, &truncatedInputError{size: len(data)}
+	}
+	defer closeMat(&img)
+
+	rows, cols := img.Rows(), img.Cols()
+	pixels := img.ToBytes()
+	rowSize := len(pixels) / rows
+
+	valid := rows
+	for valid > 0 && isUniform(pixels[(valid-1)*rowSize:valid*rowSize]) {
+		valid--
+	}
+	if valid == 0 {
+		return nil, &truncatedInputError{size: len(data)}
+	}
+
+	region := trackMat(img.Region(image.Rect(0, 0, cols, valid)))
+	defer closeMat(&region)
+
+	return gocv.IMEncode(".png", region)
+}
+
+// isUniform reports whether all the bytes of the row have the same value.
+func isUniform(row []byte) bool {
+	for _, v := range row {
+		if v != row[0] {
+			return false
+		}
+	}
+	return true
+}
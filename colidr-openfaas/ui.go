@@ -0,0 +1,261 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// NewHTTPHandler returns the handler used by the HTTP mode templates. It serves the interactive
+// web UI on GET requests, while the images posted to it are processed using the query parameters.
+// The /preview endpoints provide an MJPEG stream for tuning the parameters in near realtime,
+// while the /sessions endpoints make possible to re-render the same image without uploading it again.
+// The request metrics are exposed on the /metrics endpoint in the Prometheus text format, while
+// the /prewarm endpoint pins the edge tangent flows of the images of a manifest and the /batch
+// endpoint runs the batch of a job manifest. The /capabilities endpoint reports the OpenCV runtime,
+// while the /benchmark endpoint reports the performance of the node.
+func NewHTTPHandler() http.Handler {
+	hub := newPreviewHub()
+	sessions := newSessionStore()
+	go warmed.loadWarmManifest()
+	go scheduleBatch()
+	startQueueWorkers()
+	logCapabilities()
+
+	upload := chain(handleUpload, defaultMiddlewares()...)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.Handle("/preview", chainHTTP(hub))
+	mux.Handle("/preview/", chainHTTP(hub))
+	mux.Handle("/sessions", chainHTTP(sessions))
+	mux.Handle("/sessions/", chainHTTP(sessions))
+	mux.HandleFunc("/recipe", serveRecipe)
+	mux.Handle("/prewarm", chainHTTP(warmed))
+	mux.HandleFunc("/batch", serveBatch)
+	mux.HandleFunc("/capabilities", serveCapabilities)
+	mux.HandleFunc("/benchmark", serveBenchmark)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, uiPage)
+		case http.MethodPost, http.MethodOptions:
+			req, err := requestFromHTTP(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			writeResponse(w, upload(req))
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+// serveRecipe returns the effective recipe of the parameters provided in the query string,
+// so it can be shared and submitted with other images.
+func serveRecipe(w http.ResponseWriter, r *http.Request) {
+	rp, err := parseParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(exportRecipe(rp))
+}
+
+// handleUpload processes the image posted to the HTTP handler using the query parameters.
+func handleUpload(ctx *RequestContext) *response {
+	if ctx.Method != http.MethodPost {
+		return errorResponse(http.StatusMethodNotAllowed, "%s", http.StatusText(http.StatusMethodNotAllowed))
+	}
+	data, err := requestImage(ctx)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "%s", err)
+	}
+
+	negotiateOutput(ctx)
+	rp, err := ctx.resolve()
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "invalid parameters: %v", err).withCode("invalid_parameters")
+	}
+	res, err := pipeline.Process(data, rp, "image")
+	if err != nil {
+		return errorFor(err)
+	}
+
+	resp := newResponse(http.StatusOK, res)
+	resp.header.Set("Content-Type", detectContentType(res, rp.encoderFormat()))
+	return resp
+}
+
+// negotiateOutput sets the output format negotiated through the Accept header when no format
+// is given, unless a recipe is used, which defines its own output format.
+func negotiateOutput(ctx *RequestContext) {
+	if ctx.Params.Get("format") != "" || ctx.Params.Get("recipe") != "" ||
+		ctx.Params.Get("recipe_json") != "" || ctx.Header.Get("X-Recipe") != "" {
+		return
+	}
+	if format := negotiateFormat(ctx.Header.Get("Accept")); format != "" && format != "raw" {
+		ctx.Params.Set("format", format)
+	}
+}
+
+// detectContentType returns the content type of the generated output.
+func detectContentType(res []byte, format string) string {
+	if enc, ok := encoders[format]; ok {
+		return enc.MIMEType()
+	}
+	return http.DetectContentType(res)
+}
+
+// uiPage is the single page web UI, for demoing the function without external tooling.
+// The draft preview is rendered from a downscaled copy of the image to keep it responsive.
+const uiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coherent Line Drawing</title>
+<style>
+body { font-family: sans-serif; margin: 20px; display: flex; gap: 20px; }
+#controls { width: 280px; }
+#controls label { display: block; margin-top: 10px; font-size: 13px; }
+#controls input[type=range] { width: 100%; }
+#preview img { max-width: 100%; border: 1px solid #ccc; }
+#status { color: #888; font-size: 13px; margin-top: 10px; }
+</style>
+</head>
+<body>
+<div id="controls">
+	<input type="file" id="file" accept="image/jpeg,image/png">
+	<label>Preset
+		<select id="preset">
+			<option value="default">Default</option>
+			<option value="fine">Fine lines</option>
+			<option value="bold">Bold strokes</option>
+			<option value="sketchy">Sketchy</option>
+		</select>
+	</label>
+	<div id="sliders"></div>
+	<label><input type="checkbox" id="ai" checked> Anti aliasing</label>
+	<p><button id="render">Render full resolution</button></p>
+	<div id="status"></div>
+</div>
+<div id="preview"><img id="result"></div>
+<script>
+var params = {
+	tau: {min: 0.9, max: 1, step: 0.001, value: 0.98},
+	rho: {min: 0.9, max: 1, step: 0.001, value: 0.98},
+	sr: {min: 1, max: 5, step: 0.1, value: 2.6},
+	sm: {min: 1, max: 6, step: 0.1, value: 3},
+	sc: {min: 0.5, max: 3, step: 0.1, value: 1},
+	k: {min: 1, max: 7, step: 1, value: 2},
+	ei: {min: 0, max: 5, step: 1, value: 2},
+	di: {min: 0, max: 5, step: 1, value: 1},
+	bl: {min: 1, max: 9, step: 2, value: 3}
+};
+var presets = {
+	default: {tau: 0.98, rho: 0.98, sr: 2.6, sm: 3, sc: 1, k: 2, ei: 2, di: 1, bl: 3},
+	fine: {tau: 0.99, rho: 0.997, sr: 1.6, sm: 2, sc: 0.8, k: 2, ei: 1, di: 0, bl: 1},
+	bold: {tau: 0.95, rho: 0.98, sr: 3.5, sm: 4.5, sc: 1.6, k: 3, ei: 3, di: 2, bl: 5},
+	sketchy: {tau: 0.97, rho: 0.99, sr: 2.9, sm: 3.5, sc: 1, k: 2, ei: 2, di: 1, bl: 3}
+};
+var source = null, draft = null, timer = null;
+
+Object.keys(params).forEach(function(name) {
+	var p = params[name];
+	var label = document.createElement("label");
+	label.innerHTML = name + ": <span id='" + name + "-val'>" + p.value + "</span>" +
+		"<input type='range' id='" + name + "' min='" + p.min + "' max='" + p.max + "' step='" + p.step + "' value='" + p.value + "'>";
+	document.getElementById("sliders").appendChild(label);
+	document.getElementById(name).addEventListener("input", function(e) {
+		document.getElementById(name + "-val").textContent = e.target.value;
+		schedule();
+	});
+});
+
+function query() {
+	var q = Object.keys(params).map(function(name) {
+		return name + "=" + document.getElementById(name).value;
+	});
+	q.push("ai=" + document.getElementById("ai").checked);
+	return q.join("&");
+}
+
+function render(blob, status) {
+	if (!blob) return;
+	document.getElementById("status").textContent = status;
+	fetch("?" + query(), {method: "POST", body: blob}).then(function(res) {
+		if (!res.ok) return res.text().then(function(t) { throw new Error(t); });
+		return res.blob();
+	}).then(function(res) {
+		document.getElementById("result").src = URL.createObjectURL(res);
+		document.getElementById("status").textContent = "";
+	}).catch(function(err) {
+		document.getElementById("status").textContent = err.message;
+	});
+}
+
+function schedule() {
+	clearTimeout(timer);
+	timer = setTimeout(function() { render(draft, "Rendering draft..."); }, 300);
+}
+
+document.getElementById("file").addEventListener("change", function(e) {
+	source = e.target.files[0];
+	if (!source) return;
+	var img = new Image();
+	img.onload = function() {
+		var scale = Math.min(1, 320 / Math.max(img.width, img.height));
+		var canvas = document.createElement("canvas");
+		canvas.width = Math.round(img.width * scale);
+		canvas.height = Math.round(img.height * scale);
+		canvas.getContext("2d").drawImage(img, 0, 0, canvas.width, canvas.height);
+		canvas.toBlob(function(b) { draft = b; schedule(); }, "image/png");
+	};
+	img.src = URL.createObjectURL(source);
+});
+
+document.getElementById("preset").addEventListener("change", function(e) {
+	var preset = presets[e.target.value];
+	Object.keys(preset).forEach(function(name) {
+		document.getElementById(name).value = preset[name];
+		document.getElementById(name + "-val").textContent = preset[name];
+	});
+	schedule();
+});
+
+document.getElementById("ai").addEventListener("change", schedule);
+document.getElementById("render").addEventListener("click", function() {
+	render(source, "Rendering full resolution...");
+});
+</script>
+</body>
+</html>
+`
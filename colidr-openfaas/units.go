@@ -0,0 +1,123 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	// maxRelativeSize is the largest relative kernel size, in percent of the image diagonal.
+	maxRelativeSize = 10.0
+	// defaultReferenceSize is the long edge of the image the normalized parameters are tuned for.
+	defaultReferenceSize = 1024
+)
+
+// referenceSize returns the reference size of the normalized parameters, set through
+// the reference_size environment variable.
+func referenceSize() int {
+	return envInt("reference_size", defaultReferenceSize)
+}
+
+// relativeSizes holds the kernel sizes requested relative to the image, in percent of the
+// image diagonal, so the same parameters produce consistent results across the resolutions.
+// The zero values keep the sizes in pixels.
+type relativeSizes struct {
+	etfKernel float64
+	sigmaM    float64
+	sigmaC    float64
+}
+
+// any reports whether any of the sizes is relative to the image.
+func (r relativeSizes) any() bool {
+	return r.etfKernel > 0 || r.sigmaM > 0 || r.sigmaC > 0
+}
+
+// resolveSizes returns the options with the spatial parameters resolved for the image of
+// the provided dimensions. The normalized parameters are rescaled by the ratio of the image
+// long edge to the reference size, then the relative kernel sizes are converted to pixels.
+func (o options) resolveSizes(cols, rows int) options {
+	if o.normalize && o.referenceSize > 0 {
+		scale := float64(maxInt(cols, rows)) / float64(o.referenceSize)
+		o.etfKernel = int(math.Min(maxEtfKernel, math.Max(1, math.Round(float64(o.etfKernel)*scale))))
+		o.sigmaM *= scale
+		o.sigmaC *= scale
+		o.blurSize = scaleOdd(o.blurSize, scale)
+		if o.combineBlur > 0 {
+			o.combineBlur = scaleOdd(o.combineBlur, scale)
+		}
+		if o.maxSteps > 0 {
+			o.maxSteps = int(math.Min(maxFlowSteps, math.Max(1, math.Round(float64(o.maxSteps)*scale))))
+		}
+		o.normalize = false
+	}
+	if !o.relSizes.any() {
+		return o
+	}
+	diag := math.Hypot(float64(cols), float64(rows)) / 100
+	if o.relSizes.etfKernel > 0 {
+		o.etfKernel = int(math.Min(maxEtfKernel, math.Max(1, math.Round(o.relSizes.etfKernel*diag))))
+	}
+	if o.relSizes.sigmaM > 0 {
+		o.sigmaM = o.relSizes.sigmaM * diag
+	}
+	if o.relSizes.sigmaC > 0 {
+		o.sigmaC = o.relSizes.sigmaC * diag
+	}
+	o.relSizes = relativeSizes{}
+	return o
+}
+
+// scaleOdd scales the blur size, rounding it to the nearest odd size.
+func scaleOdd(size int, scale float64) int {
+	return maxInt(1, 2*int(math.Round((float64(size)*scale-1)/2))+1)
+}
+
+// relative parses the parameter value given in percent of the image diagonal, like k=1.5%,
+// reporting whether the value is relative. The values in pixels are left to the caller.
+func (p *paramParser) relative(name string, dst *float64) bool {
+	s := strings.TrimSpace(p.value(name))
+	if !strings.HasSuffix(s, "%") {
+		return false
+	}
+	v, err := parseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err == nil && !(v > 0 && v <= maxRelativeSize) {
+		err = fmt.Errorf("%q must be between 0 and %v%% of the image diagonal", s, maxRelativeSize)
+	}
+	if err != nil {
+		p.fail(name, err)
+		return true
+	}
+	*dst = v
+	return true
+}
+
+// formatRelative formats the resolved size, or its relative value if it's relative to the image.
+func formatRelative(size interface{}, rel float64) interface{} {
+	if rel > 0 {
+		return fmt.Sprintf("%v%%", rel)
+	}
+	return size
+}
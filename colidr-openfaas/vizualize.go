@@ -25,6 +25,8 @@ package function
 import (
 	"image"
 	"math"
+	"math/rand"
+	"time"
 
 	"gocv.io/x/gocv"
 )
@@ -33,12 +35,20 @@ import (
 type PostProcessing struct {
 	Etf
 	blurSize int
+	rnd      *rand.Rand
 }
 
 // NewPostProcessing is a constructor method which initialize a PostProcessing struct.
 func NewPostProcessing(blurSize int) *PostProcessing {
+	return NewPostProcessingWithSeed(blurSize, time.Now().UnixNano())
+}
+
+// NewPostProcessingWithSeed initializes a PostProcessing struct, using the seed
+// for all the random elements, which makes the results reproducible.
+func NewPostProcessingWithSeed(blurSize int, seed int64) *PostProcessing {
 	return &PostProcessing{
 		blurSize: blurSize,
+		rnd:      rand.New(rand.NewSource(seed)),
 	}
 }
 
@@ -49,8 +59,13 @@ func (pp *PostProcessing) VizEtf(flowField, dst *gocv.Mat) {
 		sigma = 2.0 * it * it
 	)
 
-	noise := gocv.NewMatWithSize(flowField.Rows()/2, flowField.Cols()/2, gocv.MatTypeCV32F+gocv.MatChannels3)
-	gocv.Randu(&noise, 0.0, 1.0)
+	noise := newMatWithSize(flowField.Rows()/2, flowField.Cols()/2, gocv.MatTypeCV32F+gocv.MatChannels3)
+	defer closeMat(&noise)
+	for i := 0; i < noise.Rows(); i++ {
+		for j := 0; j < noise.Cols(); j++ {
+			noise.SetVecfAt(i, j, gocv.Vecf{pp.rnd.Float32(), pp.rnd.Float32(), pp.rnd.Float32()})
+		}
+	}
 	gocv.Resize(noise, &noise, image.Point{flowField.Cols(), flowField.Rows()}, 0, 0, gocv.InterpolationNearestNeighbor)
 
 	rows := noise.Rows()
@@ -130,6 +145,118 @@ func (pp *PostProcessing) AntiAlias(src, dst gocv.Mat) {
 	gocv.GaussianBlur(dst, &dst, image.Point{pp.blurSize, pp.blurSize}, 0.0, 0.0, gocv.BorderConstant)
 }
 
+// Jitter perturbs the strokes with a low frequency noise displacement field, mimicking a hand drawn wobble.
+// The amplitude is expressed in pixels, while the frequency in noise cycles per pixel.
+func (pp *PostProcessing) Jitter(src gocv.Mat, amplitude, frequency float64) (gocv.Mat, error) {
+	rows, cols := src.Rows(), src.Cols()
+	data := src.ToBytes()
+	out := make([]byte, len(data))
+
+	noiseX := newValueNoise(cols, rows, frequency, pp.rnd)
+	noiseY := newValueNoise(cols, rows, frequency, pp.rnd)
+
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			dx := int(round(float64(x) + amplitude*noiseX.at(float64(x), float64(y))))
+			dy := int(round(float64(y) + amplitude*noiseY.at(float64(x), float64(y))))
+
+			dx = int(math.Max(0, math.Min(float64(cols-1), float64(dx))))
+			dy = int(math.Max(0, math.Min(float64(rows-1), float64(dy))))
+
+			out[y*cols+x] = data[dy*cols+dx]
+		}
+	}
+	return newMatFromBytes(rows, cols, gocv.MatTypeCV8UC1, out)
+}
+
+// jitterStrokes perturbs the traced strokes of the vector output with a low frequency noise displacement
+// field, like Jitter does with the raster lines. The outlines are resampled along their segments first,
+// so the long straight segments wobble as well.
+func (pp *PostProcessing) jitterStrokes(layers []penLayer, width, height int, amplitude, frequency float64) {
+	noiseX := newValueNoise(width, height, frequency, pp.rnd)
+	noiseY := newValueNoise(width, height, frequency, pp.rnd)
+	// A few samples per noise cycle are enough to follow the displacement field smoothly.
+	step := math.Max(2, 0.25/noiseX.frequency)
+
+	displace := func(x, y float64) image.Point {
+		dx := x + amplitude*noiseX.at(x, y)
+		dy := y + amplitude*noiseY.at(x, y)
+		return image.Point{
+			X: int(round(math.Max(0, math.Min(float64(width-1), dx)))),
+			Y: int(round(math.Max(0, math.Min(float64(height-1), dy)))),
+		}
+	}
+
+	for i := range layers {
+		for j, s := range layers[i].strokes {
+			points := make([]image.Point, 0, len(s.points))
+			for k, p := range s.points {
+				q := s.points[(k+1)%len(s.points)]
+				n := maxInt(1, int(math.Ceil(math.Hypot(float64(q.X-p.X), float64(q.Y-p.Y))/step)))
+				for m := 0; m < n; m++ {
+					t := float64(m) / float64(n)
+					pt := displace(float64(p.X)+float64(q.X-p.X)*t, float64(p.Y)+float64(q.Y-p.Y)*t)
+					if len(points) == 0 || points[len(points)-1] != pt {
+						points = append(points, pt)
+					}
+				}
+			}
+			if len(points) >= 2 {
+				layers[i].strokes[j].points = points
+			}
+		}
+	}
+}
+
+// maxNoiseLattice is the maximum number of the noise lattice points. The frequency of the noise
+// covering the large images is lowered to fit, bounding the memory used by the lattice.
+const maxNoiseLattice = 1 << 20
+
+// valueNoise is a smoothly interpolated lattice of random values in the [-1, 1] range.
+type valueNoise struct {
+	lattice   [][]float64
+	frequency float64
+}
+
+// newValueNoise generates the noise lattice covering an area of the provided size.
+func newValueNoise(width, height int, frequency float64, rnd *rand.Rand) *valueNoise {
+	if frequency <= 0 {
+		frequency = 0.02
+	}
+	if cells := float64(width) * float64(height) * frequency * frequency; cells > maxNoiseLattice {
+		frequency *= math.Sqrt(maxNoiseLattice / cells)
+	}
+	cx := int(float64(width)*frequency) + 2
+	cy := int(float64(height)*frequency) + 2
+
+	lattice := make([][]float64, cy)
+	for i := range lattice {
+		lattice[i] = make([]float64, cx)
+		for j := range lattice[i] {
+			lattice[i][j] = rnd.Float64()*2 - 1
+		}
+	}
+	return &valueNoise{lattice, frequency}
+}
+
+// at returns the noise value at the provided coordinates, which are clamped to the covered area.
+func (n *valueNoise) at(x, y float64) float64 {
+	fx, fy := math.Max(0, x*n.frequency), math.Max(0, y*n.frequency)
+	x0 := minInt(int(fx), len(n.lattice[0])-2)
+	y0 := minInt(int(fy), len(n.lattice)-2)
+	tx, ty := smoothstep(math.Min(1, fx-float64(x0))), smoothstep(math.Min(1, fy-float64(y0)))
+
+	top := n.lattice[y0][x0]*(1-tx) + n.lattice[y0][x0+1]*tx
+	bottom := n.lattice[y0+1][x0]*(1-tx) + n.lattice[y0+1][x0+1]*tx
+
+	return top*(1-ty) + bottom*ty
+}
+
+// smoothstep eases the interpolation between the noise lattice points.
+func smoothstep(t float64) float64 {
+	return t * t * (3 - 2*t)
+}
+
 func abs(val float32) float32 {
 	if val < 0.0 {
 		return -val
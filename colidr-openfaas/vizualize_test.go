@@ -0,0 +1,95 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestValueNoiseBounds(t *testing.T) {
+	for _, size := range [][2]int{{1, 1}, {7, 3}, {640, 480}, {20000, 20000}} {
+		n := newValueNoise(size[0], size[1], maxJitterFreq, rand.New(rand.NewSource(1)))
+		if cells := len(n.lattice) * len(n.lattice[0]); cells > 2*maxNoiseLattice {
+			t.Errorf("%dx%d: %d lattice points, expected at most about %d", size[0], size[1], cells, maxNoiseLattice)
+		}
+		// The noise stays in range on the borders and beyond them.
+		w, h := float64(size[0]), float64(size[1])
+		for _, p := range [][2]float64{{0, 0}, {w - 1, h - 1}, {w, h}, {-1, -1}, {w / 2, h / 3}} {
+			if v := n.at(p[0], p[1]); v < -1 || v > 1 || math.IsNaN(v) {
+				t.Errorf("%dx%d: noise %v at %v, expected to be in the [-1, 1] range", size[0], size[1], v, p)
+			}
+		}
+	}
+}
+
+func TestJitterStrokes(t *testing.T) {
+	const width, height, amplitude = 64, 48, 3.0
+	outline := []image.Point{{10, 10}, {50, 10}, {50, 30}, {10, 30}}
+	jitter := func(seed int64) []image.Point {
+		layers := []penLayer{{strokes: []stroke{{points: append([]image.Point(nil), outline...)}}}}
+		NewPostProcessingWithSeed(3, seed).jitterStrokes(layers, width, height, amplitude, 0.1)
+		return layers[0].strokes[0].points
+	}
+
+	points := jitter(1)
+	// The long straight segments are resampled, so they wobble instead of just being shifted.
+	if len(points) <= len(outline) {
+		t.Fatalf("%d points, expected the outline of %d points to be resampled", len(points), len(outline))
+	}
+	for _, p := range points {
+		if p.X < 0 || p.Y < 0 || p.X >= width || p.Y >= height {
+			t.Fatalf("point %v outside of the %dx%d image", p, width, height)
+		}
+		if d := rectDistance(p, 10, 10, 50, 30); d > amplitude*math.Sqrt2+1 {
+			t.Fatalf("point %v is %.2f pixels from the outline, expected at most the amplitude", p, d)
+		}
+	}
+	if !reflect.DeepEqual(points, jitter(1)) {
+		t.Error("the jitter isn't reproducible with the same seed")
+	}
+	if reflect.DeepEqual(points, jitter(2)) {
+		t.Error("the jitter doesn't change with the seed")
+	}
+}
+
+// rectDistance returns the distance of the point from the outline of the rectangle.
+func rectDistance(p image.Point, x0, y0, x1, y1 int) float64 {
+	x, y := float64(p.X), float64(p.Y)
+	dx := math.Min(math.Abs(x-float64(x0)), math.Abs(x-float64(x1)))
+	dy := math.Min(math.Abs(y-float64(y0)), math.Abs(y-float64(y1)))
+	inX := x >= float64(x0) && x <= float64(x1)
+	inY := y >= float64(y0) && y <= float64(y1)
+	switch {
+	case inX && inY:
+		return math.Min(dx, dy)
+	case inX:
+		return dy
+	case inY:
+		return dx
+	}
+	return math.Hypot(dx, dy)
+}
@@ -0,0 +1,290 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"gocv.io/x/gocv"
+)
+
+// warmManifestEntry is an image of the pre-warm manifest, either downloaded from the URL or read
+// from the file, with the query parameters the edge tangent flow is computed with.
+type warmManifestEntry struct {
+	URL    string `json:"url,omitempty"`
+	File   string `json:"file,omitempty"`
+	Params string `json:"params,omitempty"`
+}
+
+// warmEntry is a pinned image, together with its edge tangent flow.
+type warmEntry struct {
+	image gocv.Mat
+	etf   *Etf
+}
+
+// warmInfo describes a pinned image.
+type warmInfo struct {
+	Key    string `json:"key"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// warmStore pins the edge tangent flows of the popular images, e.g. of a product catalog, which are
+// computed at deploy time, so the renders of these images skip the most expensive stage. The entries
+// are keyed by the hash of the source image and the parameters affecting the edge tangent flow.
+type warmStore struct {
+	mu      sync.RWMutex
+	entries map[string]*warmEntry
+}
+
+var warmed = &warmStore{entries: make(map[string]*warmEntry)}
+
+// defaultMaxWarm is the default maximum number of the pinned edge tangent flows.
+const defaultMaxWarm = 64
+
+// maxWarm returns the maximum number of the pinned edge tangent flows, which are kept in memory
+// for the lifetime of the function, configured through the prewarm_max_entries environment variable.
+func maxWarm() int {
+	return envInt("prewarm_max_entries", defaultMaxWarm)
+}
+
+// warmKey returns the key of the pinned edge tangent flow of the source image hash.
+func warmKey(sourceHash string, rp *requestParams) string {
+	o := rp.opts
+	return fmt.Sprintf("%s:k=%d:ei=%d:srgb_linear=%t:icc=%t:linear=%t", sourceHash, o.etfKernel, o.etfIteration, o.linearRGB, rp.useICC, rp.linear)
+}
+
+// warmable reports whether the render can use a pinned edge tangent flow. The transforms,
+// the symmetry and the low memory mode alter the flow field, so they're computed from scratch,
+// as are the color styles and the alpha masks, since the pinned flows don't keep the source colors
+// and transparency. The kernel sizes
+// relative to the image and the normalized ones are not known before decoding it, so they
+// can't be keyed either.
+func warmable(rp *requestParams) bool {
+	return len(rp.opts.transforms) == 0 && rp.opts.symmetry == "" && rp.opts.bandRows == 0 &&
+		!rp.opts.keepColor && !rp.opts.alphaMask && !rp.opts.relSizes.any() && !rp.opts.normalize
+}
+
+// lookup returns the CLD created from the pinned edge tangent flow of the source image, if any.
+// The returned CLD shares the flow, so it isn't released on Close.
+func (s *warmStore) lookup(rp *requestParams) (*Cld, bool, error) {
+	if !warmable(rp) {
+		return nil, false, nil
+	}
+	s.mu.RLock()
+	entry, ok := s.entries[warmKey(rp.sourceHash, rp)]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+	cld, err := newCLDWithEtf(cloneMat(entry.image), entry.etf, rp.opts)
+	return cld, true, err
+}
+
+// warm computes and pins the edge tangent flow of the image, with the provided parameters.
+// The images already pinned are not computed again.
+func (s *warmStore) warm(data []byte, rp *requestParams) (*warmInfo, error) {
+	if !warmable(rp) {
+		return nil, errors.New("the transforms, the symmetry and the low memory mode can't be pre-warmed")
+	}
+	key := warmKey(fmt.Sprintf("%x", sha256.Sum256(data)), rp)
+	s.mu.RLock()
+	entry, ok := s.entries[key]
+	s.mu.RUnlock()
+	if ok {
+		return &warmInfo{Key: key, Width: entry.image.Cols(), Height: entry.image.Rows()}, nil
+	}
+	if s.count() >= maxWarm() {
+		return nil, fmt.Errorf("the maximum of %d pinned images is reached", maxWarm())
+	}
+
+	var err error
+	if isTruncatedJPEG(data) {
+		if !rp.salvage {
+			return nil, &truncatedInputError{size: len(data)}
+		}
+		if data, err = salvageJPEG(data); err != nil {
+			return nil, err
+		}
+	}
+	if rp.useICC {
+		if data, err = applyICC(data, rp.linear); err != nil {
+			return nil, fmt.Errorf("unable to apply the embedded ICC profile: %v", err)
+		}
+	}
+	source, err := decodeMat(data)
+	if err != nil {
+		return nil, err
+	}
+	defer closeMat(&source)
+
+	img := newMat()
+	gocv.CvtColor(source, img, gocv.ColorBGRToGray)
+	etf, err := newRefinedEtf(source, rp.opts)
+	if err != nil {
+		closeMat(&img)
+		return nil, err
+	}
+
+	// The concurrent warms might have filled the store in the meantime.
+	s.mu.Lock()
+	if _, ok := s.entries[key]; ok || len(s.entries) >= maxWarm() {
+		s.mu.Unlock()
+		closeMat(&img)
+		etf.Close()
+		if ok {
+			return &warmInfo{Key: key, Width: source.Cols(), Height: source.Rows()}, nil
+		}
+		return nil, fmt.Errorf("the maximum of %d pinned images is reached", maxWarm())
+	}
+	s.entries[key] = &warmEntry{image: img, etf: etf}
+	s.mu.Unlock()
+
+	return &warmInfo{Key: key, Width: img.Cols(), Height: img.Rows()}, nil
+}
+
+// count returns the number of the pinned images.
+func (s *warmStore) count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.entries)
+}
+
+// warmManifest pins the images of the manifest, returning the pinned ones and the errors of the others.
+// The local files are only read from the trusted manifests, i.e. the one provided at deploy time.
+func (s *warmStore) warmManifest(manifest []warmManifestEntry, allowFiles bool) ([]*warmInfo, []string) {
+	var (
+		infos []*warmInfo
+		errs  []string
+	)
+	for _, e := range manifest {
+		info, err := s.warmManifestEntry(e, allowFiles)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s%s: %v", e.URL, e.File, err))
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, errs
+}
+
+func (s *warmStore) warmManifestEntry(e warmManifestEntry, allowFiles bool) (*warmInfo, error) {
+	values, err := url.ParseQuery(e.Params)
+	if err != nil {
+		return nil, err
+	}
+	rp, err := parseParams(values)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	switch {
+	case e.URL != "":
+		data, err = fetchImage(e.URL, fetchHeaders(newRequestContext(http.MethodGet, nil, make(http.Header), nil, "")))
+	case e.File != "" && !allowFiles:
+		err = errors.New("the files can only be pre-warmed from the deploy time manifest")
+	case e.File != "":
+		data, err = ioutil.ReadFile(e.File)
+	default:
+		err = errors.New("either the url or the file of the image is required")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.warm(data, rp)
+}
+
+// loadWarmManifest pins the images of the manifest file set through the prewarm_manifest
+// environment variable, when the function is deployed.
+func (s *warmStore) loadWarmManifest() {
+	file := os.Getenv("prewarm_manifest")
+	if file == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Printf("unable to read the pre-warm manifest: %v", err)
+		return
+	}
+	var manifest []warmManifestEntry
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		log.Printf("unable to parse the pre-warm manifest: %v", err)
+		return
+	}
+	infos, errs := s.warmManifest(manifest, true)
+	for _, e := range errs {
+		log.Printf("unable to pre-warm %s", e)
+	}
+	log.Printf("pre-warmed %d images", len(infos))
+}
+
+// ServeHTTP lists the pinned images on GET requests, while the manifest posted to it is pre-warmed.
+// Both require the admin token, and the posted manifests can only list image URLs.
+func (s *warmStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var res struct {
+		Pinned []*warmInfo `json:"pinned"`
+		Errors []string    `json:"errors,omitempty"`
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !authorizeAdmin(w, r) {
+			return
+		}
+		s.mu.RLock()
+		for key, e := range s.entries {
+			res.Pinned = append(res.Pinned, &warmInfo{Key: key, Width: e.image.Cols(), Height: e.image.Rows()})
+		}
+		s.mu.RUnlock()
+	case http.MethodPost:
+		if !authorizeAdmin(w, r) {
+			return
+		}
+		body, err := readLimited(r.Body, maxUploadSize())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		var manifest []warmManifestEntry
+		if err := json.Unmarshal(body, &manifest); err != nil {
+			http.Error(w, fmt.Sprintf("invalid manifest: %v", err), http.StatusBadRequest)
+			return
+		}
+		res.Pinned, res.Errors = s.warmManifest(manifest, false)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
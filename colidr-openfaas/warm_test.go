@@ -0,0 +1,76 @@
+// MIT License
+//
+// Copyright (c) 2019 Endre Simo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package function
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestWarmKeyLinearRGB(t *testing.T) {
+	gamma, err := parseParams(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	linear, err := parseParams(url.Values{"srgb_linear": {"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The flows computed on the linear light values can't be shared with the gamma encoded ones.
+	if warmKey("hash", gamma) == warmKey("hash", linear) {
+		t.Errorf("the linear and the gamma encoded flows share the key %s", warmKey("hash", gamma))
+	}
+}
+
+func TestWarmStoreRequiresAdmin(t *testing.T) {
+	s := &warmStore{entries: make(map[string]*warmEntry)}
+	get := func(auth string) int {
+		r := httptest.NewRequest(http.MethodGet, "/prewarm", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", "Bearer "+auth)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Without an admin token the pinned images are not exposed.
+	if code := get(""); code != http.StatusNotFound {
+		t.Errorf("status %d without admin token, expected %d", code, http.StatusNotFound)
+	}
+
+	os.Setenv("admin_token", "secret")
+	defer os.Unsetenv("admin_token")
+	if code := get(""); code != http.StatusUnauthorized {
+		t.Errorf("status %d without authorization, expected %d", code, http.StatusUnauthorized)
+	}
+	if code := get("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("status %d with an invalid token, expected %d", code, http.StatusUnauthorized)
+	}
+	if code := get("secret"); code != http.StatusOK {
+		t.Errorf("status %d with the admin token, expected %d", code, http.StatusOK)
+	}
+}